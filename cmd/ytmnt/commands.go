@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/yinyajiang/yt-mnt/pkg/ies"
+	"github.com/yinyajiang/yt-mnt/service/monitor"
+)
+
+func (a *app) downloadOption(dir string) monitor.AssetDownloadOption {
+	opt := a.cfg.DownloadOption()
+	if dir != "" {
+		opt.Dir = dir
+	}
+	return opt
+}
+
+func cmdSubscribe(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("subscribe")
+	user := fs.Bool("user", false, "subscribe the uploader of the url")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("url is required")
+	}
+	e, err := a.m.OpenExplorerContext(ctx, fs.Arg(0), false)
+	if err != nil {
+		return err
+	}
+	if *user {
+		e.Select(monitor.IndexUser)
+	} else {
+		e.Select(monitor.IndexRoot)
+	}
+	bundles, err := a.m.SubscribeSelected(e)
+	if err != nil && len(bundles) == 0 {
+		return err
+	}
+	for _, b := range bundles {
+		fmt.Printf("%d\t%s\t%s\n", b.ID, b.Title, b.URL)
+	}
+	return err
+}
+
+func cmdUnsubscribe(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("unsubscribe")
+	deleteEmpty := fs.Bool("delete-empty", false, "delete the bundle if it has no assets")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	ids, err := parseIDs(fs.Args())
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		deleted, err := a.m.Unsubscribe(id, *deleteEmpty)
+		if err != nil {
+			return err
+		}
+		if deleted {
+			fmt.Printf("%d deleted\n", id)
+		} else {
+			fmt.Printf("%d unsubscribed\n", id)
+		}
+	}
+	return nil
+}
+
+func cmdFeeds(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("feeds")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	feeds, err := a.m.ListTypeBundles(false, true, monitor.BundleTypeFeed)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tIE\tTITLE\tASSETS\tFINISHED\tLAST UPDATE\tURL")
+	for _, f := range feeds {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\t%s\t%s\n", f.ID, f.IE, ellipsis(f.Title, 40),
+			f.AssetCount, f.AssetFinishedCount, formatTime(f.LastUpdate), f.URL)
+	}
+	return w.Flush()
+}
+
+func cmdUpdate(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("update")
+	all := fs.Bool("all", false, "update all feeds")
+	dir := fs.String("dir", "", "download dir of new assets")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	ids, err := parseIDs(fs.Args())
+	if err != nil {
+		return err
+	}
+	if *all {
+		feeds, err := a.m.ListTypeBundles(false, false, monitor.BundleTypeFeed)
+		if err != nil {
+			return err
+		}
+		for _, f := range feeds {
+			ids = append(ids, f.ID)
+		}
+	}
+	if len(ids) == 0 {
+		fs.Usage()
+		return errors.New("feed id or -all is required")
+	}
+	var errs []error
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		result := a.m.UpdateFeedWithResultContext(ctx, id, a.downloadOption(*dir))
+		if result.Err != nil {
+			fmt.Fprintf(os.Stderr, "%d: %s\n", id, result.Err)
+			errs = append(errs, result.Err)
+			continue
+		}
+		fmt.Printf("%d: %d new\n", id, len(result.NewAssets))
+		for _, asset := range result.NewAssets {
+			fmt.Printf("  %d\t%s\n", asset.ID, asset.Title)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d feeds failed", len(errs), len(ids))
+	}
+	return nil
+}
+
+// selectIndexes 解析 -select，对应Explorer.Select的索引
+func selectIndexes(s string) ([]int, error) {
+	indexes := make([]int, 0)
+	for _, part := range strings.Split(s, ",") {
+		switch part = strings.TrimSpace(part); part {
+		case "":
+		case "all":
+			indexes = append(indexes, monitor.IndexAllPage)
+		case "page":
+			indexes = append(indexes, monitor.IndexCurrentPage)
+		case "explored":
+			indexes = append(indexes, monitor.IndexExplored)
+		case "root":
+			indexes = append(indexes, monitor.IndexRoot)
+		case "user":
+			indexes = append(indexes, monitor.IndexUser)
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid selection: %s", part)
+			}
+			indexes = append(indexes, n)
+		}
+	}
+	return indexes, nil
+}
+
+func cmdExplore(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("explore")
+	pages := fs.Int("pages", 1, "number of pages to load")
+	all := fs.Bool("all", false, "load all pages")
+	plain := fs.Bool("plain", false, "expand carousels")
+	selection := fs.String("select", "", "items to select, comma separated indexes or all, page, explored, root, user")
+	subscribe := fs.Bool("subscribe", false, "subscribe the selection")
+	add := fs.Bool("add", false, "add the selection as assets")
+	dir := fs.String("dir", "", "download dir of added assets")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("url is required")
+	}
+	if *subscribe && *add {
+		return errors.New("-subscribe and -add are exclusive")
+	}
+	e, err := a.m.OpenExplorerContext(ctx, fs.Arg(0), *plain)
+	if err != nil {
+		return err
+	}
+	root := e.Root()
+	fmt.Printf("%s (%s)\n", root.Title, root.URL)
+
+	if !*subscribe || *selection != "" {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		index := 0
+		for page := 0; (*all || page < *pages) && !e.IsEnd(); page++ {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			var entries []*ies.MediaEntry
+			if *all {
+				entries, err = e.ExploreNextAllContext(ctx)
+			} else {
+				entries, err = e.ExploreNextContext(ctx)
+			}
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", index, mediaTypeName(entry.MediaType), formatTime(entry.UploadDate), ellipsis(entry.Title, 60))
+				index++
+			}
+		}
+		w.Flush()
+		if !e.IsEnd() {
+			fmt.Println("... more")
+		}
+	}
+
+	if !*subscribe && !*add {
+		return nil
+	}
+	indexes, err := selectIndexes(*selection)
+	if err != nil {
+		return err
+	}
+	if len(indexes) == 0 {
+		indexes = []int{monitor.IndexRoot}
+	}
+	e.Select(indexes...)
+	var bundles []*monitor.Bundle
+	if *subscribe {
+		bundles, err = a.m.SubscribeSelected(e)
+	} else {
+		bundles, err = a.m.AssetbasedSelected(e, nil, a.downloadOption(*dir))
+	}
+	if err != nil && len(bundles) == 0 {
+		return err
+	}
+	for _, b := range bundles {
+		fmt.Printf("%d\t%s\t%d assets\n", b.ID, b.Title, b.AssetCount)
+	}
+	return err
+}
+
+func cmdDownload(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("download")
+	bundle := fs.Bool("bundle", false, "ids are bundle ids, download all unfinished assets")
+	dir := fs.String("dir", "", "download dir for assets without one")
+	force := fs.Bool("force", false, "download again even if finished")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	ids, err := parseIDs(fs.Args())
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		fs.Usage()
+		return errors.New("id is required")
+	}
+	if *bundle {
+		assetIDs := make([]uint, 0)
+		for _, id := range ids {
+			assets, err := a.m.QueryAssets(monitor.AssetQuery{
+				BundleID: id,
+				Order:    monitor.AssetOrderUploadDateAsc,
+			})
+			if err != nil {
+				return err
+			}
+			for _, asset := range assets {
+				if *force || asset.Status != monitor.AssetStatusFinished {
+					assetIDs = append(assetIDs, asset.ID)
+				}
+			}
+		}
+		ids = assetIDs
+	}
+	if *dir == "" {
+		*dir = a.cfg.Download.Dir
+	}
+
+	failed := 0
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		bar := newProgressBar(os.Stderr)
+		asset, err := a.m.DownloadAsset(ctx, id, *dir, func(asset *monitor.Asset) {
+			bar.title = fmt.Sprintf("%d %s", asset.ID, asset.Title)
+		}, bar.update, *force)
+		bar.done(err)
+		if err != nil {
+			failed++
+			continue
+		}
+		fmt.Println(asset.FilePath())
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d downloads failed", failed, len(ids))
+	}
+	return nil
+}
+
+func cmdAssets(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("assets")
+	bundle := fs.Uint("bundle", 0, "bundle id")
+	status := fs.String("status", "", "comma separated status: new, downloading, finished, canceled, fail")
+	keyword := fs.String("keyword", "", "title, uploader or channel contains")
+	order := fs.String("order", "", "newest, oldest, upload, upload-asc")
+	offset := fs.Int("offset", 0, "skip n assets")
+	limit := fs.Int("limit", 50, "max assets, 0 for all")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	q := monitor.AssetQuery{
+		BundleID: uint(*bundle),
+		Keyword:  *keyword,
+		Offset:   *offset,
+		Limit:    *limit,
+	}
+	for _, s := range strings.Split(*status, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		st, ok := statusByName[s]
+		if !ok {
+			return fmt.Errorf("invalid status: %s", s)
+		}
+		q.Status = append(q.Status, st)
+	}
+	switch *order {
+	case "", "newest":
+		q.Order = monitor.AssetOrderNewest
+	case "oldest":
+		q.Order = monitor.AssetOrderOldest
+	case "upload":
+		q.Order = monitor.AssetOrderUploadDateDesc
+	case "upload-asc":
+		q.Order = monitor.AssetOrderUploadDateAsc
+	default:
+		return fmt.Errorf("invalid order: %s", *order)
+	}
+	total, err := a.m.CountAssets(q)
+	if err != nil {
+		return err
+	}
+	assets, err := a.m.QueryAssets(q)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tBUNDLE\tSTATUS\tUPLOADED\tTITLE")
+	for _, asset := range assets {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\n", asset.ID, asset.BundleID, statusName(asset.Status), formatTime(asset.UploadDate), ellipsis(asset.Title, 60))
+	}
+	w.Flush()
+	if int64(q.Offset+len(assets)) < total {
+		fmt.Printf("%d-%d of %d\n", q.Offset+1, q.Offset+len(assets), total)
+	}
+	return nil
+}
+
+func cmdRename(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("rename")
+	bundle := fs.Bool("bundle", false, "rename a bundle instead of an asset")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return errors.New("id and title are required")
+	}
+	ids, err := parseIDs(fs.Args()[:1])
+	if err != nil {
+		return err
+	}
+	title := strings.Join(fs.Args()[1:], " ")
+	if *bundle {
+		return a.m.ChangeBundleTitle(ids[0], title)
+	}
+	return a.m.ChangeAssetTitle(ids[0], title)
+}
+
+func cmdRm(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("rm")
+	bundle := fs.Bool("bundle", false, "ids are bundle ids")
+	keepFiles := fs.Bool("keep-files", false, "keep finished files on disk")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	ids, err := parseIDs(fs.Args())
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		fs.Usage()
+		return errors.New("id is required")
+	}
+	for _, id := range ids {
+		if *bundle {
+			a.m.DeleteBundle(id, *keepFiles)
+			continue
+		}
+		if _, err := a.m.GetAsset(id); err != nil {
+			return fmt.Errorf("asset %d: %w", id, err)
+		}
+		a.m.DeleteAsset(id, *keepFiles)
+	}
+	return nil
+}
+
+func parseIDs(args []string) ([]uint, error) {
+	ids := make([]uint, 0, len(args))
+	for _, arg := range args {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("invalid id: %s", arg)
+		}
+		ids = append(ids, uint(id))
+	}
+	return ids, nil
+}
+
+var statusByName = map[string]int{
+	"new":         monitor.AssetStatusNew,
+	"downloading": monitor.AssetStatusDownloading,
+	"finished":    monitor.AssetStatusFinished,
+	"canceled":    monitor.AssetStatusCanceled,
+	"fail":        monitor.AssetStatusFail,
+}
+
+func statusName(status int) string {
+	for name, st := range statusByName {
+		if st == status {
+			return name
+		}
+	}
+	return strconv.Itoa(status)
+}
+
+func mediaTypeName(mediaType int) string {
+	switch mediaType {
+	case ies.MediaTypeVideo:
+		return "video"
+	case ies.MediaTypeAudio:
+		return "audio"
+	case ies.MediaTypeImage:
+		return "image"
+	case ies.MediaTypeCarousel:
+		return "carousel"
+	case ies.MediaTypePlaylist:
+		return "playlist"
+	case ies.MediaTypePlaylistGroup:
+		return "playlist group"
+	case ies.MediaTypeUser:
+		return "user"
+	}
+	return strconv.Itoa(mediaType)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+func ellipsis(s string, max int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	r := []rune(s)
+	if len(r) <= max {
+		return s
+	}
+	return string(r[:max-1]) + "…"
+}
@@ -0,0 +1,150 @@
+// ytmnt 命令行管理订阅和下载
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+
+	"github.com/yinyajiang/yt-mnt/service/config"
+	"github.com/yinyajiang/yt-mnt/service/monitor"
+)
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, app *app, args []string) error
+}
+
+var commands map[string]command
+
+// 在init中赋值，避免命令和newFlagSet之间的初始化循环
+func init() {
+	commands = map[string]command{
+		"subscribe":   {"subscribe [-user] <url>", cmdSubscribe},
+		"unsubscribe": {"unsubscribe [-delete-empty] <bundle-id>...", cmdUnsubscribe},
+		"feeds":       {"feeds", cmdFeeds},
+		"update":      {"update [-all] [feed-id]...", cmdUpdate},
+		"explore":     {"explore [-pages n] [-all] [-plain] [-select 0,1|all|page|explored|root|user] [-subscribe|-add] <url>", cmdExplore},
+		"download":    {"download [-bundle] [-dir d] [-force] <id>...", cmdDownload},
+		"assets":      {"assets [-bundle id] [-status 1,3] [-keyword k] [-order upload] [-offset n] [-limit n]", cmdAssets},
+		"rename":      {"rename [-bundle] <id> <title>", cmdRename},
+		"rm":          {"rm [-bundle] [-keep-files] <id>...", cmdRm},
+	}
+}
+
+type app struct {
+	cfg *config.Config
+	m   *monitor.Monitor
+}
+
+func userConfigDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "ytmnt")
+}
+
+// defaultConfigPath 用户配置目录中的config.json、config.yaml、config.yml或config.toml，都不存在时返回空
+func defaultConfigPath() string {
+	for _, name := range []string{"config.json", "config.yaml", "config.yml", "config.toml"} {
+		path := filepath.Join(userConfigDir(), name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+/*
+loadConfig 读取配置，格式和环境变量见config包，如 YTMNT_DB_PATH、YTMNT_TOKENS_YOUTUBE
+path为空时使用YTMNT_CONFIG或用户配置目录中的配置文件，都没有时只使用环境变量
+*/
+func loadConfig(path string) (*config.Config, error) {
+	if path == "" {
+		path = os.Getenv(config.EnvPrefix + "CONFIG")
+	}
+	if path == "" {
+		path = defaultConfigPath()
+	}
+	defaults := config.Default()
+	defaults.DB.Path = filepath.Join(userConfigDir(), "ytmnt.db")
+	return config.Load(path, defaults)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: ytmnt [-config file] [-db file] [-v] <command> [args]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+}
+
+func main() {
+	configPath := flag.String("config", "", "config file, default $YTMNT_CONFIG or the user config dir")
+	dbPath := flag.String("db", "", "database file, overrides the config")
+	verbose := flag.Bool("v", false, "log sql")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fatal(err)
+	}
+	if *dbPath != "" {
+		cfg.DB.Path = *dbPath
+	}
+	if *verbose {
+		cfg.DB.Verbose = true
+	}
+	//命令只执行一次，不启动配置中的后台任务：队列会恢复下载后在退出时被中断，保留策略启动时就会删除文件
+	//需要后台任务的命令自己启动
+	cfg.Scheduler.Enable = false
+	cfg.Queue.Enable = false
+	cfg.Retention.Enable = false
+	m, err := config.NewMonitor(cfg)
+	if err != nil {
+		fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	err = cmd.run(ctx, &app{cfg: cfg, m: m}, flag.Args()[1:])
+	stop()
+	m.Close()
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "ytmnt: %s\n", err)
+	os.Exit(1)
+}
+
+// newFlagSet 子命令的参数，出错时打印用法
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: ytmnt %s\n", commands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
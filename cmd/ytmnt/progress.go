@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const progressBarWidth = 30
+
+// progressBar 在一行内刷新的下载进度
+type progressBar struct {
+	w     io.Writer
+	title string
+	last  time.Time
+	shown bool
+}
+
+func newProgressBar(w io.Writer) *progressBar {
+	return &progressBar{
+		w: w,
+	}
+}
+
+func (p *progressBar) update(total, downloaded, speed, eta int64, percent float64, videoDuration int64) {
+	now := time.Now()
+	if percent < 100 && now.Sub(p.last) < 200*time.Millisecond {
+		return
+	}
+	p.last = now
+	if percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	filled := int(percent / 100 * progressBarWidth)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	line := fmt.Sprintf("[%s] %5.1f%% %s", bar, percent, formatBytes(downloaded))
+	if total > 0 {
+		line += "/" + formatBytes(total)
+	}
+	if speed > 0 {
+		line += " " + formatBytes(speed) + "/s"
+	}
+	if eta > 0 {
+		line += " eta " + (time.Duration(eta) * time.Second).String()
+	}
+	fmt.Fprintf(p.w, "\r\033[K%s %s", ellipsis(p.title, 30), line)
+	p.shown = true
+}
+
+func (p *progressBar) done(err error) {
+	if p.shown {
+		fmt.Fprint(p.w, "\n")
+	}
+	if err != nil {
+		fmt.Fprintf(p.w, "%s: %s\n", p.title, err)
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
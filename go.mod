@@ -3,12 +3,14 @@ module github.com/yinyajiang/yt-mnt
 go 1.20
 
 require (
+	github.com/BurntSushi/toml v1.4.0
 	github.com/duke-git/lancet/v2 v2.3.0
 	github.com/google/uuid v1.6.0
 	github.com/pkg/errors v0.9.1
 	github.com/tidwall/gjson v1.17.1
 	golang.org/x/exp v0.0.0-20221208152030-732eee02a75a
 	google.golang.org/api v0.175.0
+	gopkg.in/yaml.v3 v3.0.1
 	gorm.io/driver/sqlite v1.5.5
 	gorm.io/gorm v1.25.9
 )
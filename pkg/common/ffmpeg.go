@@ -0,0 +1,242 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrFFmpegNotFound = errors.New("ffmpeg not found")
+
+var (
+	ffmpegPath     string
+	ffmpegPathLock sync.RWMutex
+)
+
+// SetFFmpegPath 设置ffmpeg的路径，可执行文件旁边和PATH中都找不到时使用
+func SetFFmpegPath(path string) {
+	ffmpegPathLock.Lock()
+	defer ffmpegPathLock.Unlock()
+	ffmpegPath = path
+}
+
+// FFmpegPath 依次查找可执行文件旁边、PATH、设置的路径
+func FFmpegPath() (string, error) {
+	if local := LocalExecutableFile("ffmpeg"); local != "" && IsExistsFile(local) {
+		return local, nil
+	}
+	if path, err := exec.LookPath(ExecutableFile("ffmpeg")); err == nil {
+		return path, nil
+	}
+	ffmpegPathLock.RLock()
+	configured := ffmpegPath
+	ffmpegPathLock.RUnlock()
+	if configured != "" && IsExistsFile(configured) {
+		return configured, nil
+	}
+	return "", ErrFFmpegNotFound
+}
+
+type FFmpegError struct {
+	Args     []string
+	ExitCode int
+	// stderr的最后部分
+	Stderr string
+	Err    error
+}
+
+func (e *FFmpegError) Error() string {
+	msg := fmt.Sprintf("ffmpeg exited with code %d", e.ExitCode)
+	if line := lastLine(e.Stderr); line != "" {
+		msg += ": " + line
+	}
+	return msg
+}
+
+func (e *FFmpegError) Unwrap() error {
+	return e.Err
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+type FFmpegProgress struct {
+	// 已处理的时长
+	OutTime time.Duration
+	// 输入的总时长，未知时为0
+	Duration time.Duration
+	// 已输出的字节数
+	TotalSize int64
+	// 处理速度，相对于播放速度的倍数
+	Speed   float64
+	Percent float64
+	Done    bool
+}
+
+type FFmpegProgressFunc func(p FFmpegProgress)
+
+var durationRegexp = regexp.MustCompile(`Duration:\s*(\d+):(\d+):(\d+(?:\.\d+)?)`)
+
+func parseFFmpegDuration(line string) time.Duration {
+	matchs := durationRegexp.FindStringSubmatch(line)
+	if len(matchs) != 4 {
+		return 0
+	}
+	h, _ := strconv.ParseInt(matchs[1], 10, 64)
+	m, _ := strconv.ParseInt(matchs[2], 10, 64)
+	s, _ := strconv.ParseFloat(matchs[3], 64)
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s*float64(time.Second))
+}
+
+const maxStderrLines = 64
+
+/*
+RunFFmpeg 运行ffmpeg，通过-progress解析处理进度
+失败时返回*FFmpegError，ctx取消时返回ctx.Err()
+*/
+func RunFFmpeg(ctx context.Context, args []string, progress ...FFmpegProgressFunc) error {
+	bin, err := FFmpegPath()
+	if err != nil {
+		return err
+	}
+	fullArgs := append([]string{"-hide_banner", "-nostdin", "-nostats", "-y", "-progress", "pipe:1"}, args...)
+	cmd := exec.CommandContext(ctx, bin, fullArgs...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return &FFmpegError{Args: args, ExitCode: -1, Err: err}
+	}
+
+	var (
+		lock     sync.Mutex
+		duration time.Duration
+		tail     []string
+		wg       sync.WaitGroup
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		scanner := bufio.NewScanner(stderr)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			lock.Lock()
+			//多个输入时取最长的
+			if d := parseFFmpegDuration(line); d > duration {
+				duration = d
+			}
+			tail = append(tail, line)
+			if len(tail) > maxStderrLines {
+				tail = tail[1:]
+			}
+			lock.Unlock()
+		}
+		io.Copy(io.Discard, stderr)
+	}()
+	go func() {
+		defer wg.Done()
+		scanner := bufio.NewScanner(stdout)
+		var p FFmpegProgress
+		for scanner.Scan() {
+			key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+			if !found {
+				continue
+			}
+			switch key {
+			case "out_time_us", "out_time_ms":
+				//out_time_ms实际也是微秒
+				if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+					p.OutTime = time.Duration(us) * time.Microsecond
+				}
+			case "total_size":
+				p.TotalSize, _ = strconv.ParseInt(value, 10, 64)
+			case "speed":
+				p.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "x"), 64)
+			case "progress":
+				p.Done = value == "end"
+				lock.Lock()
+				p.Duration = duration
+				lock.Unlock()
+				p.Percent = 0
+				if p.Done {
+					p.Percent = 100
+				} else if p.Duration > 0 {
+					p.Percent = min64(float64(p.OutTime)/float64(p.Duration)*100, 100)
+				}
+				for _, fn := range progress {
+					if fn != nil {
+						fn(p)
+					}
+				}
+			}
+		}
+		io.Copy(io.Discard, stdout)
+	}()
+	wg.Wait()
+	err = cmd.Wait()
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	ffErr := &FFmpegError{
+		Args:     args,
+		ExitCode: -1,
+		Stderr:   strings.Join(tail, "\n"),
+		Err:      err,
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		ffErr.ExitCode = exitErr.ExitCode()
+	}
+	return ffErr
+}
+
+var streamRegexp = regexp.MustCompile(`Stream #0:\d+.*?: (Video|Audio|Subtitle|Data|Attachment)`)
+
+// FFmpegStreams 返回输入文件中每个流的类型，如 Video、Audio
+func FFmpegStreams(ctx context.Context, input string) ([]string, error) {
+	//只有输入时ffmpeg会打印流信息后以错误退出
+	err := RunFFmpeg(ctx, []string{"-i", input})
+	var ffErr *FFmpegError
+	if !errors.As(err, &ffErr) {
+		if err == nil {
+			err = errors.New("ffmpeg printed no stream info")
+		}
+		return nil, err
+	}
+	streams := make([]string, 0)
+	for _, line := range strings.Split(ffErr.Stderr, "\n") {
+		if matchs := streamRegexp.FindStringSubmatch(line); len(matchs) == 2 {
+			streams = append(streams, matchs[1])
+		}
+	}
+	if len(streams) == 0 {
+		return nil, ffErr
+	}
+	return streams, nil
+}
+
+func min64(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
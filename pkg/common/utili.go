@@ -2,14 +2,16 @@ package common
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"log"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"runtime"
 	"strings"
+
+	"github.com/yinyajiang/yt-mnt/pkg/mp4"
 )
 
 func URLDotExt(u string) string {
@@ -36,30 +38,74 @@ func IsCtxDone(ctx context.Context) bool {
 	}
 }
 
-func MergeAV(ctx context.Context, v, a, output string) error {
+// MergeContext 返回的context在ctx或other结束时结束，值和截止时间来自ctx
+func MergeContext(ctx, other context.Context) (context.Context, context.CancelFunc) {
+	merged, cancel := context.WithCancel(ctx)
+	if other == nil || other.Done() == nil {
+		return merged, cancel
+	}
+	go func() {
+		select {
+		case <-other.Done():
+			cancel()
+		case <-merged.Done():
+		}
+	}()
+	return merged, cancel
+}
+
+func MergeAV(ctx context.Context, v, a, output string, progress ...FFmpegProgressFunc) error {
+	//优先使用原生封装，失败时(编码不支持、文件结构无法解析等)使用ffmpeg
+	if isMP4Ext(output) {
+		err := mp4.MergeAV(ctx, v, a, output)
+		if err == nil {
+			for _, fn := range progress {
+				if fn != nil {
+					fn(FFmpegProgress{Percent: 100, Done: true})
+				}
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if !errors.Is(err, mp4.ErrUnsupported) {
+			log.Printf("native mp4 merge fail, fallback to ffmpeg: %s", err)
+		}
+	}
 	// ffmpeg -i input.mp4 -i input.mp3 -c copy output.mp4
-	cmd := exec.CommandContext(ctx, LocalExecutableFile("ffmpeg"), "-i", v, "-i", a, "-c", "copy", output)
-	if err := cmd.Run(); err != nil {
-		return err
+	err := RunFFmpeg(ctx, []string{"-i", v, "-i", a, "-map", "0:v?", "-map", "1:a?", "-c", "copy", output}, progress...)
+	if err != nil {
+		os.Remove(output)
 	}
-	return nil
+	return err
 }
 
-func ConvertToExt(ctx context.Context, input, ext string) string {
+func isMP4Ext(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp4", ".m4v", ".m4a", ".mov":
+		return true
+	}
+	return false
+}
+
+// ConvertToExt 转换为ext格式，成功后删除原文件，返回新文件路径
+func ConvertToExt(ctx context.Context, input, ext string, progress ...FFmpegProgressFunc) (string, error) {
 	if strings.ToLower(ext) == "audio" {
 		ext = "mp3"
 	}
 	ext = strings.TrimPrefix(ext, ".")
 
-	before, _, _ := strings.Cut(input, ".")
-	output := filepath.Join(filepath.Dir(input), before+"."+ext)
-	cmd := exec.CommandContext(ctx, LocalExecutableFile("ffmpeg"), "-i", input, output)
-	if err := cmd.Run(); err != nil {
-		fmt.Println(err)
-		return input
+	output := strings.TrimSuffix(input, filepath.Ext(input)) + "." + ext
+	if output == input {
+		return input, nil
+	}
+	if err := RunFFmpeg(ctx, []string{"-i", input, output}, progress...); err != nil {
+		os.Remove(output)
+		return input, err
 	}
 	os.Remove(input)
-	return output
+	return output, nil
 }
 
 func ExecutableFile(name string) string {
@@ -117,3 +117,10 @@ func (d *DBStorage) WhereUpdates(where interface{}, values interface{}) error {
 	defer d._dbWriteOperate.Done()
 	return d.db.Where(where).Updates(values).Error
 }
+
+// ModelUpdates 按model的主键更新，values为map时零值也会更新
+func (d *DBStorage) ModelUpdates(model interface{}, values interface{}) error {
+	d._dbWriteOperate.Add(1)
+	defer d._dbWriteOperate.Done()
+	return d.db.Model(model).Updates(values).Error
+}
@@ -0,0 +1,335 @@
+package direct
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type mpdSegmentTimelineS struct {
+	T *int64 `xml:"t,attr"`
+	D int64  `xml:"d,attr"`
+	R int64  `xml:"r,attr"`
+}
+
+type mpdSegmentTemplate struct {
+	Media           string                `xml:"media,attr"`
+	Initialization  string                `xml:"initialization,attr"`
+	StartNumber     *int64                `xml:"startNumber,attr"`
+	Timescale       int64                 `xml:"timescale,attr"`
+	Duration        int64                 `xml:"duration,attr"`
+	SegmentTimeline []mpdSegmentTimelineS `xml:"SegmentTimeline>S"`
+}
+
+type mpdURL struct {
+	SourceURL string `xml:"sourceURL,attr"`
+	Range     string `xml:"range,attr"`
+}
+
+type mpdSegmentURL struct {
+	Media      string `xml:"media,attr"`
+	MediaRange string `xml:"mediaRange,attr"`
+}
+
+type mpdSegmentList struct {
+	Initialization *mpdURL          `xml:"Initialization"`
+	SegmentURLs    []*mpdSegmentURL `xml:"SegmentURL"`
+}
+
+type mpdRepresentation struct {
+	ID              string              `xml:"id,attr"`
+	Bandwidth       int64               `xml:"bandwidth,attr"`
+	Width           int64               `xml:"width,attr"`
+	Height          int64               `xml:"height,attr"`
+	MimeType        string              `xml:"mimeType,attr"`
+	BaseURL         string              `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+}
+
+type mpdAdaptationSet struct {
+	ContentType     string               `xml:"contentType,attr"`
+	MimeType        string               `xml:"mimeType,attr"`
+	BaseURL         string               `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate  `xml:"SegmentTemplate"`
+	SegmentList     *mpdSegmentList      `xml:"SegmentList"`
+	Representations []*mpdRepresentation `xml:"Representation"`
+}
+
+type mpdPeriod struct {
+	Duration       string              `xml:"duration,attr"`
+	BaseURL        string              `xml:"BaseURL"`
+	AdaptationSets []*mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdManifest struct {
+	Type                      string       `xml:"type,attr"`
+	MediaPresentationDuration string       `xml:"mediaPresentationDuration,attr"`
+	BaseURL                   string       `xml:"BaseURL"`
+	Periods                   []*mpdPeriod `xml:"Period"`
+}
+
+type dashRepresentation struct {
+	rep      *mpdRepresentation
+	set      *mpdAdaptationSet
+	base     *url.URL
+	duration float64
+}
+
+var isoDurationRegexp = regexp.MustCompile(`^P(?:(\d+(?:\.\d+)?)D)?(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseISODuration PT1H2M3.5S，返回秒数
+func parseISODuration(s string) float64 {
+	matchs := isoDurationRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if len(matchs) != 5 {
+		return 0
+	}
+	var seconds float64
+	for i, unit := range []float64{24 * 3600, 3600, 60, 1} {
+		if matchs[i+1] == "" {
+			continue
+		}
+		n, _ := strconv.ParseFloat(matchs[i+1], 64)
+		seconds += n * unit
+	}
+	return seconds
+}
+
+var templateIdentifierRegexp = regexp.MustCompile(`\$(RepresentationID|Number|Bandwidth|Time)(%0\d+d)?\$`)
+
+func expandTemplate(tmpl string, rep *mpdRepresentation, number, t int64) string {
+	s := templateIdentifierRegexp.ReplaceAllStringFunc(tmpl, func(match string) string {
+		groups := templateIdentifierRegexp.FindStringSubmatch(match)
+		format := "%d"
+		if groups[2] != "" {
+			format = groups[2]
+		}
+		switch groups[1] {
+		case "RepresentationID":
+			return rep.ID
+		case "Number":
+			return fmt.Sprintf(format, number)
+		case "Bandwidth":
+			return fmt.Sprintf(format, rep.Bandwidth)
+		case "Time":
+			return fmt.Sprintf(format, t)
+		}
+		return match
+	})
+	return strings.ReplaceAll(s, "$$", "$")
+}
+
+func parseRange(s string) *byteRange {
+	first, last, found := strings.Cut(s, "-")
+	if !found {
+		return nil
+	}
+	start, err1 := strconv.ParseInt(first, 10, 64)
+	end, err2 := strconv.ParseInt(last, 10, 64)
+	if err1 != nil || err2 != nil || end < start {
+		return nil
+	}
+	return &byteRange{
+		Offset: start,
+		Length: end - start + 1,
+	}
+}
+
+func joinBase(base *url.URL, ref string) *url.URL {
+	if ref == "" {
+		return base
+	}
+	u, err := base.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return base
+	}
+	return u
+}
+
+func (d *dashRepresentation) contentType() string {
+	for _, s := range []string{d.set.ContentType, d.set.MimeType, d.rep.MimeType} {
+		if strings.HasPrefix(s, "video") {
+			return "video"
+		}
+		if strings.HasPrefix(s, "audio") {
+			return "audio"
+		}
+	}
+	if d.rep.Height > 0 {
+		return "video"
+	}
+	return ""
+}
+
+func (d *dashRepresentation) playlist() (*mediaPlaylist, error) {
+	pl := &mediaPlaylist{
+		Ext: ".mp4",
+	}
+	if strings.Contains(d.rep.MimeType+d.set.MimeType, "webm") {
+		pl.Ext = ".webm"
+	}
+	tmpl := d.rep.SegmentTemplate
+	if tmpl == nil {
+		tmpl = d.set.SegmentTemplate
+	}
+	list := d.rep.SegmentList
+	if list == nil {
+		list = d.set.SegmentList
+	}
+
+	switch {
+	case tmpl != nil:
+		timescale := tmpl.Timescale
+		if timescale <= 0 {
+			timescale = 1
+		}
+		number := int64(1)
+		if tmpl.StartNumber != nil {
+			number = *tmpl.StartNumber
+		}
+		if tmpl.Initialization != "" {
+			pl.Init = &mediaSegment{
+				URL: resolveURL(d.base, expandTemplate(tmpl.Initialization, d.rep, 0, 0)),
+			}
+		}
+		if len(tmpl.SegmentTimeline) > 0 {
+			var t int64
+			for _, s := range tmpl.SegmentTimeline {
+				if s.T != nil {
+					t = *s.T
+				}
+				for i := int64(0); i <= s.R; i++ {
+					pl.Segments = append(pl.Segments, &mediaSegment{
+						URL: resolveURL(d.base, expandTemplate(tmpl.Media, d.rep, number, t)),
+					})
+					t += s.D
+					number++
+				}
+			}
+		} else if tmpl.Duration > 0 {
+			if d.duration <= 0 {
+				return nil, errors.New("dash manifest without duration")
+			}
+			count := int64(math.Ceil(d.duration * float64(timescale) / float64(tmpl.Duration)))
+			for i := int64(0); i < count; i++ {
+				pl.Segments = append(pl.Segments, &mediaSegment{
+					URL: resolveURL(d.base, expandTemplate(tmpl.Media, d.rep, number+i, i*tmpl.Duration)),
+				})
+			}
+		}
+	case list != nil:
+		if list.Initialization != nil {
+			pl.Init = &mediaSegment{
+				URL:       d.base.String(),
+				ByteRange: parseRange(list.Initialization.Range),
+			}
+			if list.Initialization.SourceURL != "" {
+				pl.Init.URL = resolveURL(d.base, list.Initialization.SourceURL)
+			}
+		}
+		for _, segURL := range list.SegmentURLs {
+			seg := &mediaSegment{
+				URL:       d.base.String(),
+				ByteRange: parseRange(segURL.MediaRange),
+			}
+			if segURL.Media != "" {
+				seg.URL = resolveURL(d.base, segURL.Media)
+			}
+			pl.Segments = append(pl.Segments, seg)
+		}
+	default:
+		//SegmentBase或者只有BaseURL，整个文件作为一个分段
+		pl.Segments = append(pl.Segments, &mediaSegment{
+			URL: d.base.String(),
+		})
+	}
+	if len(pl.Segments) == 0 {
+		return nil, errors.New("no segment found in dash representation")
+	}
+	return pl, nil
+}
+
+func appendPlaylist(dst, src *mediaPlaylist) *mediaPlaylist {
+	if dst == nil {
+		return src
+	}
+	dst.Segments = append(dst.Segments, src.Segments...)
+	return dst
+}
+
+func resolveDASH(manifestURL string, body []byte, height int64) (*manifestTracks, error) {
+	var mpd mpdManifest
+	if err := xml.Unmarshal(body, &mpd); err != nil {
+		return nil, err
+	}
+	if mpd.Type == "dynamic" {
+		return nil, errors.New("live dash manifest is not supported")
+	}
+	base, err := url.Parse(manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	base = joinBase(base, mpd.BaseURL)
+	totalDuration := parseISODuration(mpd.MediaPresentationDuration)
+
+	tracks := &manifestTracks{}
+	for _, period := range mpd.Periods {
+		periodBase := joinBase(base, period.BaseURL)
+		duration := parseISODuration(period.Duration)
+		if duration <= 0 {
+			duration = totalDuration
+		}
+
+		var videos, audios []*dashRepresentation
+		for _, set := range period.AdaptationSets {
+			setBase := joinBase(periodBase, set.BaseURL)
+			for _, rep := range set.Representations {
+				r := &dashRepresentation{
+					rep:      rep,
+					set:      set,
+					base:     joinBase(setBase, rep.BaseURL),
+					duration: duration,
+				}
+				switch r.contentType() {
+				case "video":
+					videos = append(videos, r)
+				case "audio":
+					audios = append(audios, r)
+				}
+			}
+		}
+		if len(videos) == 0 && len(audios) == 0 {
+			continue
+		}
+
+		heightOf := func(r *dashRepresentation) int64 { return r.rep.Height }
+		bandwidthOf := func(r *dashRepresentation) int64 { return r.rep.Bandwidth }
+		if len(videos) != 0 {
+			pl, err := pickVariantByHeight(videos, height, heightOf, bandwidthOf).playlist()
+			if err != nil {
+				return nil, err
+			}
+			tracks.Video = appendPlaylist(tracks.Video, pl)
+		}
+		if len(audios) != 0 {
+			pl, err := pickVariantByHeight(audios, 0, heightOf, bandwidthOf).playlist()
+			if err != nil {
+				return nil, err
+			}
+			tracks.Audio = appendPlaylist(tracks.Audio, pl)
+		}
+	}
+	if tracks.Video == nil {
+		//只有音频
+		tracks.Video, tracks.Audio = tracks.Audio, nil
+	}
+	if tracks.Video == nil {
+		return nil, errors.New("no representation found in dash manifest")
+	}
+	return tracks, nil
+}
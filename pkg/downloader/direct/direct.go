@@ -3,13 +3,17 @@ package direct
 import (
 	"context"
 	"errors"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/duke-git/lancet/v2/fileutil"
 	"github.com/yinyajiang/yt-mnt/pkg/common"
 	"github.com/yinyajiang/yt-mnt/pkg/downloader"
+	"github.com/yinyajiang/yt-mnt/pkg/ies"
 	instagram "github.com/yinyajiang/yt-mnt/pkg/ies/instagram"
 )
 
@@ -18,30 +22,51 @@ func Name() string {
 }
 
 func init() {
-	downloader.Regist(&DirectDownloader{})
+	downloader.Regist(New(Options{}))
+}
+
+type Options struct {
+	//分段下载的连接数，<=0 使用默认值，1 表示单连接下载
+	Segments int
+	//每个分段的最小字节数，<=0 使用默认值
+	MinSegmentSize int64
 }
 
 type DirectDownloader struct {
+	segments       int
+	minSegmentSize int64
+}
+
+func New(opt Options) *DirectDownloader {
+	if opt.Segments <= 0 {
+		opt.Segments = 4
+	}
+	if opt.MinSegmentSize <= 0 {
+		opt.MinSegmentSize = 2 * 1024 * 1024
+	}
+	return &DirectDownloader{
+		segments:       opt.Segments,
+		minSegmentSize: opt.MinSegmentSize,
+	}
 }
 
 func (m *DirectDownloader) Delete(opt downloader.DeleteOptions, deleteFile bool) {
 	if !deleteFile {
 		return
 	}
-	if !opt.HasAudioFormat {
-		if common.IsExistsFile(opt.FilePath()) {
-			os.Remove(opt.FilePath())
-		}
-		return
+	removeDownloadFiles(opt.FilePath())
+	data := loadDirectData(opt.DownloaderData)
+	if data.Thumbnail != "" {
+		removeDownloadFiles(filepath.Join(opt.DownloadFileDir, data.Thumbnail))
 	}
-	vPath := opt.FilePath() + ".video"
-	if common.IsExistsFile(vPath) {
-		os.Remove(opt.FilePath())
+	for _, name := range data.Subtitles {
+		removeDownloadFiles(filepath.Join(opt.DownloadFileDir, name))
 	}
-	aPath := opt.FilePath() + ".audio"
-	if common.IsExistsFile(aPath) {
-		os.Remove(opt.FilePath())
+	if !opt.HasAudioFormat {
+		return
 	}
+	removeDownloadFiles(opt.FilePath() + ".video")
+	removeDownloadFiles(opt.FilePath() + ".audio")
 }
 
 func (m *DirectDownloader) ChangeFileTitle(opt downloader.DownloadOptions, title string) error {
@@ -51,19 +76,56 @@ func (m *DirectDownloader) ChangeFileTitle(opt downloader.DownloadOptions, title
 	if title == "" {
 		return errors.New("title is empty")
 	}
-	vPath := opt.FilePath() + ".video"
-	aPath := opt.FilePath() + ".audio"
-	if _, err := os.Stat(vPath); err == nil {
-		os.Remove(vPath)
+	//未完成的文件跟随标题改名，保留断点续传的进度
+	oldPath := opt.FilePath()
+	oldStem := *opt.DownloadFileStem
+	opt.SetStem(title)
+	newPath := opt.FilePath()
+	if oldPath == newPath {
+		return nil
 	}
-	if _, err := os.Stat(aPath); err == nil {
-		os.Remove(aPath)
+	for _, suffix := range []string{".video", ".audio", ""} {
+		renameDownloadFiles(oldPath+suffix, newPath+suffix)
+	}
+	//缩略图和字幕跟随改名
+	if opt.DownloaderData != nil {
+		data := loadDirectData(*opt.DownloaderData)
+		if data.Thumbnail != "" {
+			thumbnail := *opt.DownloadFileStem + filepath.Ext(data.Thumbnail)
+			renameDownloadFiles(filepath.Join(opt.DownloadFileDir, data.Thumbnail), filepath.Join(opt.DownloadFileDir, thumbnail))
+			data.Thumbnail = thumbnail
+		}
+		for i, name := range data.Subtitles {
+			if !strings.HasPrefix(name, oldStem+".") {
+				continue
+			}
+			newName := *opt.DownloadFileStem + strings.TrimPrefix(name, oldStem)
+			renameDownloadFiles(filepath.Join(opt.DownloadFileDir, name), filepath.Join(opt.DownloadFileDir, newName))
+			data.Subtitles[i] = newName
+		}
+		*opt.DownloaderData = data.String()
 	}
-	opt.SetStem(title)
 	return nil
 }
 
 func (d *DirectDownloader) Download(ctx context.Context, opt downloader.DownloadOptions, sink downloader.ProgressSink) (ok bool, err error) {
+	ok, err = d.download(ctx, opt, sink)
+	if err == nil && opt.IsDownloadThumbnail {
+		//缩略图失败不影响媒体文件
+		if e := downloadThumbnail(ctx, opt); e != nil {
+			log.Printf("download thumbnail fail: %s", e)
+		}
+	}
+	if err == nil && opt.Subtitle != "" {
+		//字幕同样不影响媒体文件
+		if e := downloadSubtitles(ctx, opt); e != nil {
+			log.Printf("download subtitles fail: %s", e)
+		}
+	}
+	return ok, err
+}
+
+func (d *DirectDownloader) download(ctx context.Context, opt downloader.DownloadOptions, sink downloader.ProgressSink) (ok bool, err error) {
 	if opt.MainDownloadFormat.URL == "" {
 		return false, errors.New("no formats available for direct download")
 	}
@@ -81,9 +143,22 @@ func (d *DirectDownloader) Download(ctx context.Context, opt downloader.Download
 	}
 
 	ok = true
+	//合并和转换也计入进度，下载阶段不直接到100%
+	needMerge := opt.AudioDownloadFormat.URL != ""
+	downloadEnd, mergeEnd := postProgressRange(needMerge, convertAudioExt != "")
+
+	//HLS/DASH清单
+	if opt.MainDownloadFormat.ManifestProtocol() != ies.FormatProtocolHTTP {
+		err = d.downloadManifest(ctx, opt, sink, downloadEnd, mergeEnd)
+		if err == nil && convertAudioExt != "" {
+			err = convertAudio(ctx, opt, convertAudioExt, sink, mergeEnd)
+		}
+		return ok, err
+	}
+
 	//只下载一个
-	if opt.AudioDownloadFormat.URL == "" {
-		err = downloadFile(ctx, opt.MainDownloadFormat.URL, opt.FilePath(), 0, sink)
+	if !needMerge {
+		err = d.downloadFileSegmented(ctx, opt.MainDownloadFormat.URL, opt.FilePath(), 0, 0, downloader.ScaleSink(sink, 0, downloadEnd))
 		return ok, err
 	}
 
@@ -93,30 +168,187 @@ func (d *DirectDownloader) Download(ctx context.Context, opt downloader.Download
 	if common.IsCtxDone(ctx) {
 		return ok, ctx.Err()
 	}
+	downloadSink := downloader.ScaleSink(sink, 0, downloadEnd)
 	vPath := opt.FilePath() + ".video"
 	aPath := opt.FilePath() + ".audio"
-	err = downloadFile(ctx, opt.MainDownloadFormat.URL, vPath, avTotal, sink)
-	if err != nil {
-		return ok, err
+	//上次已经下载完成的部分不再下载
+	if !common.IsExistsFile(vPath) {
+		err = d.downloadFileSegmented(ctx, opt.MainDownloadFormat.URL, vPath, avTotal, 0, downloadSink)
+		if err != nil {
+			return ok, err
+		}
 	}
-	err = downloadFile(ctx, opt.AudioDownloadFormat.URL, aPath, avTotal, sink)
-	if err != nil {
-		return ok, err
+	vSize, _ := fileutil.FileSize(vPath)
+	if !common.IsExistsFile(aPath) {
+		err = d.downloadFileSegmented(ctx, opt.AudioDownloadFormat.URL, aPath, avTotal, vSize, downloadSink)
+		if err != nil {
+			return ok, err
+		}
 	}
-	err = common.MergeAV(ctx, vPath, aPath, opt.FilePath())
-	if err == nil {
-		os.Remove(vPath)
-		os.Remove(aPath)
+	if err = mergeAV(ctx, vPath, aPath, opt.FilePath(), sink, downloadEnd, mergeEnd); err != nil {
+		return ok, err
 	}
 
 	//conver audio
 	if convertAudioExt != "" {
-		convertPath := common.ConvertToExt(ctx, opt.FilePath(), convertAudioExt)
-		opt.SetExt(filepath.Ext(convertPath))
+		err = convertAudio(ctx, opt, convertAudioExt, sink, mergeEnd)
 	}
 	return ok, err
 }
 
+// postProgressRange 返回下载阶段和合并阶段结束时的进度，剩余部分属于转换
+func postProgressRange(merge, convert bool) (downloadEnd, mergeEnd float64) {
+	downloadEnd = 100
+	if convert {
+		downloadEnd -= 15
+	}
+	if merge {
+		downloadEnd -= 5
+	}
+	mergeEnd = downloadEnd
+	if merge {
+		mergeEnd += 5
+	}
+	return
+}
+
+func fileSize(paths ...string) int64 {
+	var total int64
+	for _, path := range paths {
+		size, _ := fileutil.FileSize(path)
+		total += size
+	}
+	return total
+}
+
+func mergeAV(ctx context.Context, vPath, aPath, output string, sink downloader.ProgressSink, from, to float64) error {
+	err := common.MergeAV(ctx, vPath, aPath, output, downloader.FFmpegSink(sink, fileSize(vPath, aPath), from, to))
+	if err != nil {
+		if common.IsCtxDone(ctx) {
+			return ctx.Err()
+		}
+		return downloader.NewDownloadError(downloader.ErrKindMerge, err)
+	}
+	os.Remove(vPath)
+	os.Remove(aPath)
+	return nil
+}
+
+func convertAudio(ctx context.Context, opt downloader.DownloadOptions, ext string, sink downloader.ProgressSink, from float64) error {
+	convertPath, err := common.ConvertToExt(ctx, opt.FilePath(), ext, downloader.FFmpegSink(sink, fileSize(opt.FilePath()), from, 100))
+	if err != nil {
+		if common.IsCtxDone(ctx) {
+			return ctx.Err()
+		}
+		return downloader.NewDownloadError(downloader.ErrKindConvert, err)
+	}
+	opt.SetExt(filepath.Ext(convertPath))
+	return nil
+}
+
+func manifestHeight(opt downloader.DownloadOptions) int64 {
+	if opt.MainDownloadFormat.Height > 0 {
+		return opt.MainDownloadFormat.Height
+	}
+	if opt.Quality == nil {
+		return 0
+	}
+	switch strings.ToLower(*opt.Quality) {
+	case "", "best":
+		return 0
+	case "worst":
+		return 1
+	}
+	info, _ := common.ParseResolutionInfo(*opt.Quality)
+	return info.ResolutionNum
+}
+
+func (d *DirectDownloader) downloadManifest(ctx context.Context, opt downloader.DownloadOptions, sink downloader.ProgressSink, downloadEnd, mergeEnd float64) (err error) {
+	tracks, err := resolveManifest(ctx, opt.MainDownloadFormat, manifestHeight(opt))
+	if err != nil {
+		return err
+	}
+	httpAudio := false
+	if tracks.Audio == nil && opt.AudioDownloadFormat.URL != "" {
+		if opt.AudioDownloadFormat.ManifestProtocol() != ies.FormatProtocolHTTP {
+			//音频是单独的清单
+			audioTracks, err := resolveManifest(ctx, opt.AudioDownloadFormat, 0)
+			if err != nil {
+				return err
+			}
+			tracks.Audio = audioTracks.Video
+		} else {
+			//音频是普通的http文件
+			httpAudio = true
+		}
+	}
+	opt.SetExt(tracks.Video.Ext)
+
+	progress := &manifestProgress{
+		totalSegments: int64(len(tracks.Video.Segments)),
+	}
+	if tracks.Audio != nil {
+		progress.totalSegments += int64(len(tracks.Audio.Segments))
+	} else if httpAudio {
+		//整个音频文件按一个分段计算
+		progress.totalSegments++
+	} else {
+		//清单中没有单独的音频，不需要合并
+		downloadEnd = mergeEnd
+	}
+	downloadSink := downloader.ScaleSink(sink, 0, downloadEnd)
+	stopReport := progress.report(ctx, downloadSink)
+	if tracks.Audio == nil && !httpAudio {
+		err = fetchPlaylistToFile(ctx, tracks.Video, opt.FilePath(), d.segments, opt.RetryPolicy, progress)
+		stopReport()
+		if err != nil {
+			return err
+		}
+	} else {
+		vPath := opt.FilePath() + ".video"
+		aPath := opt.FilePath() + ".audio"
+		err = fetchPlaylistToFile(ctx, tracks.Video, vPath, d.segments, opt.RetryPolicy, progress)
+		if err == nil && httpAudio {
+			err = d.downloadHTTPAudio(ctx, opt.AudioDownloadFormat.URL, aPath, progress)
+		} else if err == nil {
+			err = fetchPlaylistToFile(ctx, tracks.Audio, aPath, d.segments, opt.RetryPolicy, progress)
+		}
+		stopReport()
+		if err != nil {
+			return err
+		}
+		if downloadSink != nil {
+			downloadSink(progress.current(), progress.current(), 0, 0, 100, 0)
+		}
+		if err = mergeAV(ctx, vPath, aPath, opt.FilePath(), sink, downloadEnd, mergeEnd); err != nil {
+			return err
+		}
+	}
+	if sink != nil {
+		sink(progress.current(), progress.current(), 0, 0, mergeEnd, 0)
+	}
+	return nil
+}
+
+// downloadHTTPAudio 下载清单视频对应的http音频文件，进度计入清单的进度
+func (d *DirectDownloader) downloadHTTPAudio(ctx context.Context, url, path string, progress *manifestProgress) error {
+	var last int64
+	err := d.downloadFileSegmented(ctx, url, path, 0, 0, func(_, downloaded, _, _ int64, _ float64, _ int64) {
+		progress.add(int(downloaded - last))
+		last = downloaded
+	})
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&progress.doneSegments, 1)
+	return nil
+}
+
+// HandleSubtitles 字幕文件记录在DownloaderData中，删除和改名时一起处理
+func (d *DirectDownloader) HandleSubtitles() bool {
+	return true
+}
+
 func (d *DirectDownloader) SupportedIE() []string {
 	return []string{
 		instagram.Name(),
@@ -0,0 +1,283 @@
+package direct
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type hlsVariant struct {
+	URL        string
+	Bandwidth  int64
+	Width      int64
+	Height     int64
+	AudioGroup string
+}
+
+type hlsRendition struct {
+	Type    string
+	GroupID string
+	URL     string
+	Default bool
+}
+
+type hlsMaster struct {
+	Variants   []*hlsVariant
+	Renditions []*hlsRendition
+}
+
+// parseAttributeList 解析 BANDWIDTH=1280000,RESOLUTION=1280x720,CODECS="avc1.4d401f,mp4a.40.2"
+func parseAttributeList(s string) map[string]string {
+	attrs := make(map[string]string)
+	for len(s) > 0 {
+		key, rest, found := strings.Cut(s, "=")
+		if !found {
+			break
+		}
+		key = strings.TrimSpace(key)
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end == -1 {
+				value, s = rest[1:], ""
+			} else {
+				value, s = rest[1:end+1], rest[end+2:]
+			}
+			s = strings.TrimPrefix(s, ",")
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+		}
+		attrs[key] = value
+	}
+	return attrs
+}
+
+func parseHLSByteRange(s string, lastEnd int64) *byteRange {
+	length, offset, hasOffset := strings.Cut(s, "@")
+	n, err := strconv.ParseInt(length, 10, 64)
+	if err != nil {
+		return nil
+	}
+	br := &byteRange{
+		Offset: lastEnd,
+		Length: n,
+	}
+	if hasOffset {
+		br.Offset, _ = strconv.ParseInt(offset, 10, 64)
+	}
+	return br
+}
+
+func isHLSMaster(body []byte) bool {
+	return bytes.Contains(body, []byte("#EXT-X-STREAM-INF"))
+}
+
+func parseHLSMaster(base *url.URL, body []byte) (*hlsMaster, error) {
+	master := &hlsMaster{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	var pending *hlsVariant
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			attrs := parseAttributeList(strings.TrimPrefix(line, "#EXT-X-STREAM-INF:"))
+			pending = &hlsVariant{
+				AudioGroup: attrs["AUDIO"],
+			}
+			pending.Bandwidth, _ = strconv.ParseInt(attrs["BANDWIDTH"], 10, 64)
+			if w, h, found := strings.Cut(attrs["RESOLUTION"], "x"); found {
+				pending.Width, _ = strconv.ParseInt(w, 10, 64)
+				pending.Height, _ = strconv.ParseInt(h, 10, 64)
+			}
+		case strings.HasPrefix(line, "#EXT-X-MEDIA:"):
+			attrs := parseAttributeList(strings.TrimPrefix(line, "#EXT-X-MEDIA:"))
+			rendition := &hlsRendition{
+				Type:    attrs["TYPE"],
+				GroupID: attrs["GROUP-ID"],
+				Default: attrs["DEFAULT"] == "YES",
+			}
+			if uri := attrs["URI"]; uri != "" {
+				rendition.URL = resolveURL(base, uri)
+			}
+			master.Renditions = append(master.Renditions, rendition)
+		case strings.HasPrefix(line, "#"):
+			continue
+		default:
+			if pending != nil {
+				pending.URL = resolveURL(base, line)
+				master.Variants = append(master.Variants, pending)
+				pending = nil
+			}
+		}
+	}
+	if len(master.Variants) == 0 {
+		return nil, errors.New("no variant found in hls master playlist")
+	}
+	return master, scanner.Err()
+}
+
+func parseHLSMedia(base *url.URL, body []byte) (*mediaPlaylist, error) {
+	pl := &mediaPlaylist{
+		Ext: ".ts",
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	var (
+		sequence   int64
+		key        *segmentKey
+		pendingBR  *byteRange
+		lastEnd    int64
+		hasSegment bool
+	)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			sequence, _ = strconv.ParseInt(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"), 10, 64)
+		case strings.HasPrefix(line, "#EXT-X-KEY:"):
+			attrs := parseAttributeList(strings.TrimPrefix(line, "#EXT-X-KEY:"))
+			key = &segmentKey{
+				Method: attrs["METHOD"],
+			}
+			if key.Method == "NONE" {
+				key = nil
+				continue
+			}
+			if uri := attrs["URI"]; uri != "" {
+				key.URI = resolveURL(base, uri)
+			}
+			if iv := attrs["IV"]; iv != "" {
+				iv = strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X")
+				key.IV, _ = hex.DecodeString(iv)
+			}
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			attrs := parseAttributeList(strings.TrimPrefix(line, "#EXT-X-MAP:"))
+			pl.Init = &mediaSegment{
+				URL: resolveURL(base, attrs["URI"]),
+				Key: key,
+			}
+			if br := attrs["BYTERANGE"]; br != "" {
+				pl.Init.ByteRange = parseHLSByteRange(br, 0)
+			}
+			pl.Ext = ".mp4"
+		case strings.HasPrefix(line, "#EXT-X-BYTERANGE:"):
+			pendingBR = parseHLSByteRange(strings.TrimPrefix(line, "#EXT-X-BYTERANGE:"), lastEnd)
+		case strings.HasPrefix(line, "#EXTINF:"):
+			hasSegment = true
+		case strings.HasPrefix(line, "#"):
+			continue
+		default:
+			if !hasSegment {
+				continue
+			}
+			seg := &mediaSegment{
+				URL:       resolveURL(base, line),
+				ByteRange: pendingBR,
+				Key:       key,
+				Sequence:  sequence,
+			}
+			if pendingBR != nil {
+				lastEnd = pendingBR.Offset + pendingBR.Length
+			}
+			pl.Segments = append(pl.Segments, seg)
+			sequence++
+			pendingBR = nil
+			hasSegment = false
+		}
+	}
+	if len(pl.Segments) == 0 {
+		return nil, errors.New("no segment found in hls media playlist")
+	}
+	return pl, scanner.Err()
+}
+
+// pickVariantByHeight 选择不超过目标分辨率的最高画质，都超过时选最低的，height<=0时选最高的
+func pickVariantByHeight[T any](items []T, height int64, heightOf func(T) int64, bandwidthOf func(T) int64) (picked T) {
+	var (
+		best   = -1
+		lowest = -1
+		better = func(a, b T) bool {
+			if heightOf(a) != heightOf(b) {
+				return heightOf(a) > heightOf(b)
+			}
+			return bandwidthOf(a) > bandwidthOf(b)
+		}
+	)
+	for i, item := range items {
+		if lowest == -1 || better(items[lowest], item) {
+			lowest = i
+		}
+		if height > 0 && heightOf(item) > height {
+			continue
+		}
+		if best == -1 || better(item, items[best]) {
+			best = i
+		}
+	}
+	if best == -1 {
+		best = lowest
+	}
+	if best == -1 {
+		return
+	}
+	return items[best]
+}
+
+func resolveHLS(ctx context.Context, manifestURL string, body []byte, height int64) (*manifestTracks, error) {
+	base, _ := url.Parse(manifestURL)
+	if !isHLSMaster(body) {
+		pl, err := parseHLSMedia(base, body)
+		if err != nil {
+			return nil, err
+		}
+		return &manifestTracks{Video: pl}, nil
+	}
+
+	master, err := parseHLSMaster(base, body)
+	if err != nil {
+		return nil, err
+	}
+	variant := pickVariantByHeight(master.Variants, height,
+		func(v *hlsVariant) int64 { return v.Height },
+		func(v *hlsVariant) int64 { return v.Bandwidth })
+
+	loadMedia := func(u string) (*mediaPlaylist, error) {
+		body, err := fetchBody(ctx, u, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		base, _ := url.Parse(u)
+		return parseHLSMedia(base, body)
+	}
+
+	tracks := &manifestTracks{}
+	if tracks.Video, err = loadMedia(variant.URL); err != nil {
+		return nil, err
+	}
+	if variant.AudioGroup == "" {
+		return tracks, nil
+	}
+	var audio *hlsRendition
+	for _, rendition := range master.Renditions {
+		if rendition.Type != "AUDIO" || rendition.GroupID != variant.AudioGroup || rendition.URL == "" {
+			continue
+		}
+		if audio == nil || rendition.Default {
+			audio = rendition
+		}
+	}
+	if audio != nil {
+		if tracks.Audio, err = loadMedia(audio.URL); err != nil {
+			return nil, err
+		}
+	}
+	return tracks, nil
+}
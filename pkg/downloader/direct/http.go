@@ -2,53 +2,91 @@ package direct
 
 import (
 	"context"
-	"crypto/tls"
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/yinyajiang/yt-mnt/pkg/downloader"
 )
 
-var _defclient = &http.Client{
-	Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	},
+// resumeStage 记录.downing文件对应的远端文件信息，用于断点续传时判断远端文件是否变化
+type resumeStage struct {
+	ETag         string
+	LastModified string
+	Total        int64
+
+	//分段下载时每个分段的进度
+	Segments []*segmentStage `json:",omitempty"`
 }
 
-func client() *http.Client {
-	if downloader.Proxy() == "" {
-		return _defclient
+func (s *resumeStage) ifRange() string {
+	if s.ETag != "" && !strings.HasPrefix(s.ETag, "W/") {
+		return s.ETag
 	}
-	proxyUrl, err := url.Parse(downloader.Proxy())
-	if err != nil {
-		return _defclient
+	return s.LastModified
+}
+
+func (s *resumeStage) isChanged(etag, lastModified string) bool {
+	if s.ETag != "" && etag != "" {
+		return etag != s.ETag
 	}
-	return &http.Client{
-		Transport: &http.Transport{
-			Proxy:           http.ProxyURL(proxyUrl),
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
+	if s.LastModified != "" && lastModified != "" {
+		return lastModified != s.LastModified
 	}
+	return false
 }
 
-func urlSize(ctx context.Context, url string) int64 {
-	req, err := http.NewRequest("GET", url, nil)
+func readResumeStage(path string) (stage resumeStage, ok bool) {
+	by, err := os.ReadFile(path)
 	if err != nil {
-		return 0
+		return
 	}
-	req = req.WithContext(ctx)
+	if json.Unmarshal(by, &stage) != nil {
+		return
+	}
+	return stage, true
+}
 
-	resp, err := client().Do(req)
+func writeResumeStage(path string, stage resumeStage) error {
+	by, err := json.Marshal(stage)
 	if err != nil {
-		return 0
+		return err
 	}
-	defer resp.Body.Close()
+	return os.WriteFile(path, by, 0644)
+}
+
+func downingPaths(path string) (downingPath, stagePath string) {
+	downingPath = path + ".downing"
+	stagePath = downingPath + ".stage"
+	return
+}
+
+func removeDownloadFiles(path string) {
+	downingPath, stagePath := downingPaths(path)
+	for _, p := range []string{path, downingPath, stagePath} {
+		if _, err := os.Stat(p); err == nil {
+			os.Remove(p)
+		}
+	}
+}
 
+func renameDownloadFiles(oldPath, newPath string) {
+	oldDowningPath, oldStagePath := downingPaths(oldPath)
+	newDowningPath, newStagePath := downingPaths(newPath)
+	for i, p := range []string{oldPath, oldDowningPath, oldStagePath} {
+		if _, err := os.Stat(p); err == nil {
+			os.Rename(p, []string{newPath, newDowningPath, newStagePath}[i])
+		}
+	}
+}
+
+func contentLength(resp *http.Response) int64 {
 	var total int64
 	if len(resp.Header.Values("Content-Length")) > 0 {
 		total, _ = strconv.ParseInt(resp.Header.Values("Content-Length")[0], 10, 64)
@@ -56,31 +94,68 @@ func urlSize(ctx context.Context, url string) int64 {
 	return total
 }
 
-func downloadW(ctx context.Context, url string, w io.Writer, total int64, sink downloader.ProgressSink) (err error) {
+// bytes 100-199/1000
+func parseContentRange(s string) (start, end, total int64, ok bool) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "bytes ") {
+		return
+	}
+	s = strings.TrimPrefix(s, "bytes ")
+	rng, size, found := strings.Cut(s, "/")
+	if !found {
+		return
+	}
+	first, last, found := strings.Cut(rng, "-")
+	if !found {
+		return
+	}
+	var err error
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+		return
+	}
+	if end, err = strconv.ParseInt(last, 10, 64); err != nil {
+		return
+	}
+	if size != "*" {
+		total, _ = strconv.ParseInt(size, 10, 64)
+	}
+	return start, end, total, true
+}
+
+func urlSize(ctx context.Context, url string) int64 {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return
+		return 0
 	}
 	req = req.WithContext(ctx)
 
-	resp, err := client().Do(req)
+	resp, err := downloader.HTTPClient().Do(req)
 	if err != nil {
-		return
+		return 0
 	}
 	defer resp.Body.Close()
+	return contentLength(resp)
+}
 
-	if total <= 0 {
-		if len(resp.Header.Values("Content-Length")) > 0 {
-			total, _ = strconv.ParseInt(resp.Header.Values("Content-Length")[0], 10, 64)
+func requestRange(ctx context.Context, url string, offset int64, ifRange string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
 		}
 	}
+	return downloader.HTTPClient().Do(req)
+}
 
-	defer resp.Body.Close()
-
+func downloadW(ctx context.Context, r io.Reader, w io.Writer, downloaded, total int64, sink downloader.ProgressSink) (err error) {
 	var (
-		downloaded     int64
 		lastTime       = time.Now()
-		lastDownloaded int64
+		lastDownloaded = downloaded
 		buf            = make([]byte, 32*1024) // 32KB buffer
 	)
 
@@ -90,7 +165,7 @@ loop:
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
-			nRead, err := resp.Body.Read(buf)
+			nRead, err := r.Read(buf)
 			if err != nil && err != io.EOF {
 				return err
 			}
@@ -127,22 +202,117 @@ loop:
 		}
 	}
 	if sink != nil {
-		sink(total, downloaded, 0, 0, 100, 0)
+		sink(total, downloaded, 0, 0, donePercent(total, downloaded), 0)
 	}
 	return nil
 }
 
-func downloadFile(ctx context.Context, url, path string, avTotal int64, sink downloader.ProgressSink) (err error) {
+// donePercent 音视频分开下载时，第一个文件完成不代表整体完成
+func donePercent(total, downloaded int64) float64 {
+	if total <= 0 || downloaded >= total {
+		return 100
+	}
+	return float64(downloaded) / float64(total) * 100
+}
+
+/*
+downloadFile 下载url到path，下载中的数据保存在path.downing，远端文件信息保存在path.downing.stage
+再次下载时会使用Range从.downing的末尾继续，远端文件变化或者服务器不支持Range时从头下载
+avTotal和avBase用于音视频分开下载时合并进度，avTotal为音视频的总大小，avBase为之前已经下载完成的大小
+*/
+func downloadFile(ctx context.Context, url, path string, avTotal, avBase int64, sink downloader.ProgressSink) (err error) {
 	os.MkdirAll(filepath.Dir(path), os.ModePerm)
-	downingPath := path + ".downing"
-	f, err := os.Create(downingPath)
+	downingPath, stagePath := downingPaths(path)
+
+	var offset int64
+	stage, ok := readResumeStage(stagePath)
+	if ok && len(stage.Segments) == 0 {
+		if info, e := os.Stat(downingPath); e == nil {
+			offset = info.Size()
+		}
+		if stage.Total > 0 && offset > stage.Total {
+			offset = 0
+		}
+	}
+
+	var resp *http.Response
+	for {
+		if offset == 0 {
+			stage = resumeStage{}
+		}
+		resp, err = requestRange(ctx, url, offset, stage.ifRange())
+		if err != nil {
+			return
+		}
+
+		restart := false
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+			start, _, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+			if !ok || start != offset || stage.isChanged(resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")) || (stage.Total > 0 && total > 0 && total != stage.Total) {
+				restart = true
+			} else if total > 0 {
+				stage.Total = total
+			}
+		case http.StatusRequestedRangeNotSatisfiable:
+			resp.Body.Close()
+			if offset > 0 && offset == stage.Total {
+				os.Remove(stagePath)
+				return os.Rename(downingPath, path)
+			}
+			restart = true
+		case http.StatusOK:
+			//服务器忽略了Range或者远端文件已变化，从头下载
+			offset = 0
+			stage = resumeStage{
+				Total: contentLength(resp),
+			}
+		default:
+			resp.Body.Close()
+			return downloader.NewHTTPStatusError(url, resp.StatusCode, resp.Status)
+		}
+		if !restart {
+			break
+		}
+		resp.Body.Close()
+		if offset == 0 {
+			return fmt.Errorf("download %s failed: unexpected range response", url)
+		}
+		offset = 0
+	}
+	defer resp.Body.Close()
+
+	stage.ETag = resp.Header.Get("ETag")
+	stage.LastModified = resp.Header.Get("Last-Modified")
+
+	var f *os.File
+	if offset > 0 {
+		f, err = os.OpenFile(downingPath, os.O_WRONLY, 0644)
+		if err == nil {
+			if err = f.Truncate(offset); err == nil {
+				_, err = f.Seek(offset, io.SeekStart)
+			}
+			if err != nil {
+				f.Close()
+			}
+		}
+	} else {
+		f, err = os.Create(downingPath)
+	}
 	if err != nil {
 		return
 	}
-	err = downloadW(ctx, url, f, avTotal, sink)
+	writeResumeStage(stagePath, stage)
+
+	total := avTotal
+	if total <= 0 {
+		total = stage.Total
+	}
+	err = downloadW(ctx, resp.Body, f, avBase+offset, total, sink)
 	f.Close()
 	if err == nil {
-		os.Rename(downingPath, path)
+		os.Remove(stagePath)
+		err = os.Rename(downingPath, path)
 	}
 	return err
 }
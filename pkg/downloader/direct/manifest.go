@@ -0,0 +1,366 @@
+package direct
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yinyajiang/yt-mnt/pkg/downloader"
+	"github.com/yinyajiang/yt-mnt/pkg/ies"
+)
+
+type byteRange struct {
+	Offset int64
+	Length int64
+}
+
+type segmentKey struct {
+	Method string
+	URI    string
+	IV     []byte
+}
+
+type mediaSegment struct {
+	URL       string
+	ByteRange *byteRange
+	Key       *segmentKey
+	Sequence  int64
+}
+
+// mediaPlaylist HLS的media playlist或者DASH的一个representation
+type mediaPlaylist struct {
+	Init     *mediaSegment
+	Segments []*mediaSegment
+	// 输出文件的扩展名
+	Ext string
+}
+
+type manifestTracks struct {
+	Video *mediaPlaylist
+	// 音频单独存在时需要合并
+	Audio *mediaPlaylist
+}
+
+func resolveURL(base *url.URL, ref string) string {
+	if base == nil {
+		return ref
+	}
+	u, err := base.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return ref
+	}
+	return u.String()
+}
+
+func fetchBody(ctx context.Context, u string, br *byteRange, counter func(n int)) ([]byte, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if br != nil {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", br.Offset, br.Offset+br.Length-1))
+	}
+	resp, err := downloader.HTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, downloader.NewHTTPStatusError(u, resp.StatusCode, resp.Status)
+	}
+
+	var buf bytes.Buffer
+	chunk := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(chunk)
+		if n > 0 {
+			buf.Write(chunk[:n])
+			if counter != nil {
+				counter(n)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	data := buf.Bytes()
+	//服务器忽略了Range
+	if br != nil && resp.StatusCode == http.StatusOK && int64(len(data)) > br.Offset+br.Length-1 {
+		data = data[br.Offset : br.Offset+br.Length]
+	}
+	return data, nil
+}
+
+func decryptAES128(data, key, iv []byte) ([]byte, error) {
+	if len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("aes-128 segment size is not a multiple of block size")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+	//PKCS7
+	if n := len(out); n > 0 {
+		pad := int(out[n-1])
+		if pad > 0 && pad <= aes.BlockSize && pad <= n {
+			out = out[:n-pad]
+		}
+	}
+	return out, nil
+}
+
+func sequenceIV(seq int64) []byte {
+	iv := make([]byte, 16)
+	binary.BigEndian.PutUint64(iv[8:], uint64(seq))
+	return iv
+}
+
+// manifestProgress 合并多个清单的分段下载进度，清单不提供大小时按已下载分段的平均大小估算总大小
+type manifestProgress struct {
+	downloaded    int64
+	doneSegments  int64
+	totalSegments int64
+}
+
+func (p *manifestProgress) add(n int) {
+	atomic.AddInt64(&p.downloaded, int64(n))
+}
+
+func (p *manifestProgress) current() int64 {
+	return atomic.LoadInt64(&p.downloaded)
+}
+
+func (p *manifestProgress) estimateTotal() int64 {
+	done := atomic.LoadInt64(&p.doneSegments)
+	cur := p.current()
+	if done <= 0 || p.totalSegments <= 0 {
+		return 0
+	}
+	if done >= p.totalSegments {
+		return cur
+	}
+	return cur * p.totalSegments / done
+}
+
+func (p *manifestProgress) report(ctx context.Context, sink downloader.ProgressSink) (stop func()) {
+	if sink == nil {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		lastTime := time.Now()
+		lastDownloaded := p.current()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				cur := p.current()
+				total := p.estimateTotal()
+				speed := float64(cur-lastDownloaded) / now.Sub(lastTime).Seconds()
+				lastTime = now
+				lastDownloaded = cur
+				percent := float64(0)
+				eta := int64(0)
+				if total > 0 {
+					percent = float64(cur) / float64(total) * 100
+					if speed > 0 {
+						eta = int64(float64(total-cur) / speed)
+					}
+				}
+				sink(total, cur, int64(speed), eta, percent, 0)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+type keyCache struct {
+	lock sync.Mutex
+	keys map[string][]byte
+}
+
+func (c *keyCache) get(ctx context.Context, uri string) ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if key, ok := c.keys[uri]; ok {
+		return key, nil
+	}
+	key, err := fetchBody(ctx, uri, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 16 {
+		return nil, fmt.Errorf("invalid aes-128 key length: %d", len(key))
+	}
+	if c.keys == nil {
+		c.keys = make(map[string][]byte)
+	}
+	c.keys[uri] = key
+	return key, nil
+}
+
+func fetchSegment(ctx context.Context, seg *mediaSegment, keys *keyCache, policy downloader.RetryPolicy, progress *manifestProgress) (data []byte, err error) {
+	for attempt := 1; ; attempt++ {
+		var got int
+		data, err = fetchBody(ctx, seg.URL, seg.ByteRange, func(n int) {
+			got += n
+			progress.add(n)
+		})
+		if err == nil {
+			break
+		}
+		//失败的分段会重新下载，已经计入的进度需要去掉
+		progress.add(-got)
+		if ctx.Err() != nil || !downloader.ClassifyError(err).IsRetryable() || attempt >= policy.MaxAttempts {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(policy.Delay(attempt)):
+		}
+	}
+	if seg.Key == nil || seg.Key.Method == "" || seg.Key.Method == "NONE" {
+		return data, nil
+	}
+	if seg.Key.Method != "AES-128" {
+		return nil, fmt.Errorf("unsupported hls encryption method: %s", seg.Key.Method)
+	}
+	key, err := keys.get(ctx, seg.Key.URI)
+	if err != nil {
+		return nil, err
+	}
+	iv := seg.Key.IV
+	if len(iv) == 0 {
+		iv = sequenceIV(seg.Sequence)
+	}
+	return decryptAES128(data, key, iv)
+}
+
+/*
+fetchPlaylist 并发下载分段，按顺序写入w
+同时在途的分段数量限制为concurrency*2，避免占用过多内存
+*/
+func fetchPlaylist(ctx context.Context, pl *mediaPlaylist, w io.Writer, concurrency int, policy downloader.RetryPolicy, progress *manifestProgress) error {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	keys := &keyCache{}
+	if pl.Init != nil {
+		data, err := fetchSegment(ctx, pl.Init, keys, policy, progress)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make([]chan result, len(pl.Segments))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+	window := make(chan struct{}, concurrency*2)
+	workers := make(chan struct{}, concurrency)
+	go func() {
+		for i, seg := range pl.Segments {
+			select {
+			case <-ctx.Done():
+				return
+			case window <- struct{}{}:
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case workers <- struct{}{}:
+			}
+			go func(i int, seg *mediaSegment) {
+				defer func() { <-workers }()
+				data, err := fetchSegment(ctx, seg, keys, policy, progress)
+				results[i] <- result{data, err}
+			}(i, seg)
+		}
+	}()
+
+	for i := range pl.Segments {
+		var r result
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case r = <-results[i]:
+		}
+		<-window
+		if r.err != nil {
+			return r.err
+		}
+		if _, err := w.Write(r.data); err != nil {
+			return err
+		}
+		atomic.AddInt64(&progress.doneSegments, 1)
+	}
+	return nil
+}
+
+func fetchPlaylistToFile(ctx context.Context, pl *mediaPlaylist, path string, concurrency int, policy downloader.RetryPolicy, progress *manifestProgress) error {
+	os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	downingPath, _ := downingPaths(path)
+	f, err := os.Create(downingPath)
+	if err != nil {
+		return err
+	}
+	err = fetchPlaylist(ctx, pl, f, concurrency, policy, progress)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(downingPath, path)
+}
+
+func resolveManifest(ctx context.Context, format ies.Format, height int64) (*manifestTracks, error) {
+	body, err := fetchBody(ctx, format.URL, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch format.ManifestProtocol() {
+	case ies.FormatProtocolHLS:
+		return resolveHLS(ctx, format.URL, body, height)
+	case ies.FormatProtocolDASH:
+		return resolveDASH(format.URL, body, height)
+	}
+	return nil, fmt.Errorf("unsupported manifest protocol: %s", format.Protocol)
+}
@@ -0,0 +1,286 @@
+package direct
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yinyajiang/yt-mnt/pkg/downloader"
+	"github.com/yinyajiang/yt-mnt/pkg/ies"
+)
+
+const rangeFixture = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+var (
+	aesFixtureKey = []byte("0123456789abcdef")
+	aesFixtureIV  = mustHex("000102030405060708090a0b0c0d0e0f")
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func encryptAES128(plain, key, iv []byte) []byte {
+	pad := aes.BlockSize - len(plain)%aes.BlockSize
+	plain = append(append([]byte{}, plain...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	block, _ := aes.NewCipher(key)
+	out := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, plain)
+	return out
+}
+
+/*
+newManifestServer 提供testdata/manifest下的清单
+/seg/、/dash/ 返回 "路径|" 作为分段内容
+/range.bin 支持Range请求
+/aes/ 返回AES-128加密的分段和密钥
+/flaky/ 第一次请求返回503
+*/
+func newManifestServer(t *testing.T) *httptest.Server {
+	var (
+		mu    sync.Mutex
+		flaky = make(map[string]int)
+	)
+	mux := http.NewServeMux()
+	mux.Handle("/fixtures/", http.StripPrefix("/fixtures/", http.FileServer(http.Dir("testdata/manifest"))))
+	segment := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path + "|"))
+	}
+	mux.HandleFunc("/seg/", segment)
+	mux.HandleFunc("/dash/", segment)
+	mux.HandleFunc("/range.bin", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "range.bin", time.Time{}, strings.NewReader(rangeFixture))
+	})
+	mux.HandleFunc("/aes/key.bin", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(aesFixtureKey)
+	})
+	mux.HandleFunc("/aes/", func(w http.ResponseWriter, r *http.Request) {
+		var iv []byte
+		switch r.URL.Path {
+		case "/aes/seg-5.ts":
+			iv = sequenceIV(5)
+		case "/aes/seg-6.ts":
+			iv = sequenceIV(6)
+		case "/aes/seg-7.ts":
+			iv = aesFixtureIV
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(encryptAES128([]byte(r.URL.Path+"|"), aesFixtureKey, iv))
+	})
+	mux.HandleFunc("/flaky/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		flaky[r.URL.Path]++
+		n := flaky[r.URL.Path]
+		mu.Unlock()
+		if n == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(r.URL.Path + "|"))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func resolveFixture(t *testing.T, srv *httptest.Server, name string, height int64) *manifestTracks {
+	t.Helper()
+	tracks, err := resolveManifest(context.Background(), ies.Format{URL: srv.URL + "/fixtures/" + name}, height)
+	if err != nil {
+		t.Fatalf("resolve %s: %s", name, err)
+	}
+	return tracks
+}
+
+func fetchFixture(t *testing.T, pl *mediaPlaylist, policy downloader.RetryPolicy) (string, *manifestProgress) {
+	t.Helper()
+	var buf bytes.Buffer
+	progress := &manifestProgress{
+		totalSegments: int64(len(pl.Segments)),
+	}
+	if err := fetchPlaylist(context.Background(), pl, &buf, 2, policy, progress); err != nil {
+		t.Fatalf("fetch playlist: %s", err)
+	}
+	return buf.String(), progress
+}
+
+func TestHLSMasterPicksVariantAndDefaultAudio(t *testing.T) {
+	srv := newManifestServer(t)
+	cases := []struct {
+		height int64
+		video  string
+	}{
+		{0, "/seg/v1080-0.ts|/seg/v1080-1.ts|"},
+		{720, "/seg/v720-0.ts|/seg/v720-1.ts|"},
+		{500, "/seg/v360-0.ts|/seg/v360-1.ts|"},
+		//都超过目标分辨率时选最低的
+		{144, "/seg/v360-0.ts|/seg/v360-1.ts|"},
+	}
+	for _, c := range cases {
+		tracks := resolveFixture(t, srv, "master.m3u8", c.height)
+		if tracks.Audio == nil {
+			t.Fatalf("height %d: audio rendition not resolved", c.height)
+		}
+		video, _ := fetchFixture(t, tracks.Video, downloader.RetryPolicy{})
+		if video != c.video {
+			t.Errorf("height %d: video = %q, want %q", c.height, video, c.video)
+		}
+		audio, _ := fetchFixture(t, tracks.Audio, downloader.RetryPolicy{})
+		if want := "/seg/amain-0.aac|/seg/amain-1.aac|"; audio != want {
+			t.Errorf("height %d: audio = %q, want %q", c.height, audio, want)
+		}
+	}
+}
+
+func TestHLSMediaPlaylist(t *testing.T) {
+	srv := newManifestServer(t)
+	tracks := resolveFixture(t, srv, "media.m3u8", 0)
+	if tracks.Audio != nil {
+		t.Fatal("media playlist should not have a separate audio track")
+	}
+	if tracks.Video.Ext != ".ts" {
+		t.Errorf("ext = %q, want .ts", tracks.Video.Ext)
+	}
+	for i, seg := range tracks.Video.Segments {
+		if want := int64(10 + i); seg.Sequence != want {
+			t.Errorf("segment %d sequence = %d, want %d", i, seg.Sequence, want)
+		}
+	}
+	got, progress := fetchFixture(t, tracks.Video, downloader.RetryPolicy{})
+	want := "/seg/m-10.ts|/seg/m-11.ts|/seg/m-12.ts|"
+	if got != want {
+		t.Errorf("content = %q, want %q", got, want)
+	}
+	if progress.current() != int64(len(want)) || progress.estimateTotal() != int64(len(want)) {
+		t.Errorf("progress = %d/%d, want %d", progress.current(), progress.estimateTotal(), len(want))
+	}
+}
+
+func TestHLSAES128(t *testing.T) {
+	srv := newManifestServer(t)
+	tracks := resolveFixture(t, srv, "aes.m3u8", 0)
+	got, _ := fetchFixture(t, tracks.Video, downloader.RetryPolicy{})
+	want := "/aes/seg-5.ts|/aes/seg-6.ts|/aes/seg-7.ts|/seg/clear-8.ts|"
+	if got != want {
+		t.Errorf("content = %q, want %q", got, want)
+	}
+}
+
+func TestHLSByteRange(t *testing.T) {
+	srv := newManifestServer(t)
+	tracks := resolveFixture(t, srv, "byterange.m3u8", 0)
+	if tracks.Video.Ext != ".mp4" {
+		t.Errorf("ext = %q, want .mp4", tracks.Video.Ext)
+	}
+	got, _ := fetchFixture(t, tracks.Video, downloader.RetryPolicy{})
+	//init 4@0，6@4，5接着上一个分段，3@20
+	if want := "0123" + "456789" + "abcde" + "klm"; got != want {
+		t.Errorf("content = %q, want %q", got, want)
+	}
+}
+
+func TestDASHSegmentTemplate(t *testing.T) {
+	srv := newManifestServer(t)
+	tracks := resolveFixture(t, srv, "template.mpd", 0)
+	if tracks.Audio == nil {
+		t.Fatal("audio adaptation set not resolved")
+	}
+	video, _ := fetchFixture(t, tracks.Video, downloader.RetryPolicy{})
+	//9秒，每段4秒，共3段
+	if want := "/dash/v720/init.mp4|/dash/v720/seg-001.m4s|/dash/v720/seg-002.m4s|/dash/v720/seg-003.m4s|"; video != want {
+		t.Errorf("video = %q, want %q", video, want)
+	}
+	audio, _ := fetchFixture(t, tracks.Audio, downloader.RetryPolicy{})
+	if want := "/dash/a128/init.mp4|/dash/a128/seg-1.m4s|/dash/a128/seg-2.m4s|/dash/a128/seg-3.m4s|"; audio != want {
+		t.Errorf("audio = %q, want %q", audio, want)
+	}
+
+	tracks = resolveFixture(t, srv, "template.mpd", 480)
+	video, _ = fetchFixture(t, tracks.Video, downloader.RetryPolicy{})
+	if !strings.HasPrefix(video, "/dash/v480/init.mp4|") {
+		t.Errorf("height 480: video = %q", video)
+	}
+}
+
+func TestDASHSegmentTimeline(t *testing.T) {
+	srv := newManifestServer(t)
+	tracks := resolveFixture(t, srv, "timeline.mpd", 0)
+	if tracks.Audio != nil {
+		t.Fatal("timeline fixture has no audio")
+	}
+	if tracks.Video.Ext != ".webm" {
+		t.Errorf("ext = %q, want .webm", tracks.Video.Ext)
+	}
+	got, _ := fetchFixture(t, tracks.Video, downloader.RetryPolicy{})
+	if want := "/dash/v1/init.webm|/dash/v1/t-0.webm|/dash/v1/t-4000.webm|/dash/v1/t-8000.webm|"; got != want {
+		t.Errorf("content = %q, want %q", got, want)
+	}
+}
+
+func TestDASHSegmentList(t *testing.T) {
+	srv := newManifestServer(t)
+	//只有音频时作为主轨道
+	tracks := resolveFixture(t, srv, "list.mpd", 0)
+	if tracks.Audio != nil {
+		t.Fatal("audio only manifest should be the main track")
+	}
+	got, _ := fetchFixture(t, tracks.Video, downloader.RetryPolicy{})
+	if want := "0123" + "456789" + "abcde"; got != want {
+		t.Errorf("content = %q, want %q", got, want)
+	}
+}
+
+func TestFetchPlaylistRetriesWithPolicy(t *testing.T) {
+	srv := newManifestServer(t)
+	pl := &mediaPlaylist{
+		Segments: []*mediaSegment{
+			{URL: srv.URL + "/flaky/0.ts"},
+			{URL: srv.URL + "/flaky/1.ts"},
+		},
+	}
+	var buf bytes.Buffer
+	err := fetchPlaylist(context.Background(), pl, &buf, 1, downloader.RetryPolicy{MaxAttempts: 1}, &manifestProgress{})
+	if err == nil {
+		t.Fatal("expected failure without retries")
+	}
+
+	pl.Segments[0].URL = srv.URL + "/flaky/2.ts"
+	pl.Segments[1].URL = srv.URL + "/flaky/3.ts"
+	policy := downloader.RetryPolicy{MaxAttempts: 2, InitialDelay: time.Millisecond}
+	got, _ := fetchFixture(t, pl, policy)
+	if want := "/flaky/2.ts|/flaky/3.ts|"; got != want {
+		t.Errorf("content = %q, want %q", got, want)
+	}
+}
+
+func TestManifestHTTPAudioProgress(t *testing.T) {
+	srv := newManifestServer(t)
+	path := filepath.Join(t.TempDir(), "a.audio")
+	progress := &manifestProgress{totalSegments: 1}
+	if err := New(Options{Segments: 1}).downloadHTTPAudio(context.Background(), srv.URL+"/range.bin", path, progress); err != nil {
+		t.Fatalf("download audio: %s", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != rangeFixture {
+		t.Fatalf("audio file = %q, %v", data, err)
+	}
+	if progress.current() != int64(len(rangeFixture)) || progress.estimateTotal() != int64(len(rangeFixture)) {
+		t.Errorf("progress = %d/%d, want %d", progress.current(), progress.estimateTotal(), len(rangeFixture))
+	}
+}
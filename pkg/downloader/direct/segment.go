@@ -0,0 +1,285 @@
+package direct
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yinyajiang/yt-mnt/pkg/common"
+	"github.com/yinyajiang/yt-mnt/pkg/downloader"
+)
+
+type segmentStage struct {
+	Start int64
+	End   int64
+	Done  int64
+}
+
+func (s *segmentStage) size() int64 {
+	return s.End - s.Start + 1
+}
+
+func (s *segmentStage) done() int64 {
+	return atomic.LoadInt64(&s.Done)
+}
+
+func probeRange(ctx context.Context, url string) (stage resumeStage, ok bool) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := downloader.HTTPClient().Do(req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return
+	}
+	_, _, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if !ok || total <= 0 {
+		return stage, false
+	}
+	return resumeStage{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Total:        total,
+	}, true
+}
+
+func splitSegments(total int64, count int) []*segmentStage {
+	segments := make([]*segmentStage, 0, count)
+	size := total / int64(count)
+	for i := 0; i < count; i++ {
+		start := int64(i) * size
+		end := start + size - 1
+		if i == count-1 {
+			end = total - 1
+		}
+		segments = append(segments, &segmentStage{
+			Start: start,
+			End:   end,
+		})
+	}
+	return segments
+}
+
+/*
+downloadFileSegmented 将文件按字节范围拆分成多个分段并行下载到预分配的.downing文件
+服务器不支持Range、文件太小或者已有单连接的下载进度时使用downloadFile
+*/
+func (d *DirectDownloader) downloadFileSegmented(ctx context.Context, url, path string, avTotal, avBase int64, sink downloader.ProgressSink) (err error) {
+	if d.segments <= 1 {
+		return downloadFile(ctx, url, path, avTotal, avBase, sink)
+	}
+	probe, ok := probeRange(ctx, url)
+	if !ok {
+		return downloadFile(ctx, url, path, avTotal, avBase, sink)
+	}
+
+	os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	downingPath, stagePath := downingPaths(path)
+
+	stage, ok := readResumeStage(stagePath)
+	if ok && len(stage.Segments) == 0 && common.IsExistsFile(downingPath) {
+		//已有单连接下载的进度
+		return downloadFile(ctx, url, path, avTotal, avBase, sink)
+	}
+	if !ok || len(stage.Segments) == 0 || stage.Total != probe.Total || stage.isChanged(probe.ETag, probe.LastModified) || !common.IsExistsFile(downingPath) {
+		count := d.segments
+		if d.minSegmentSize > 0 {
+			if n := probe.Total / d.minSegmentSize; n < int64(count) {
+				count = int(n)
+			}
+		}
+		if count <= 1 {
+			return downloadFile(ctx, url, path, avTotal, avBase, sink)
+		}
+		stage = probe
+		stage.Segments = splitSegments(probe.Total, count)
+
+		f, e := os.Create(downingPath)
+		if e != nil {
+			return e
+		}
+		err = f.Truncate(probe.Total)
+		f.Close()
+		if err != nil {
+			return
+		}
+	}
+
+	var stageLock sync.Mutex
+	saveStage := func() {
+		stageLock.Lock()
+		defer stageLock.Unlock()
+		snapshot := stage
+		snapshot.Segments = make([]*segmentStage, 0, len(stage.Segments))
+		for _, seg := range stage.Segments {
+			snapshot.Segments = append(snapshot.Segments, &segmentStage{
+				Start: seg.Start,
+				End:   seg.End,
+				Done:  seg.done(),
+			})
+		}
+		writeResumeStage(stagePath, snapshot)
+	}
+	saveStage()
+
+	var downloaded int64
+	for _, seg := range stage.Segments {
+		downloaded += seg.done()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	total := avTotal
+	if total <= 0 {
+		total = stage.Total
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(stage.Segments))
+	for _, seg := range stage.Segments {
+		if seg.done() >= seg.size() {
+			continue
+		}
+		wg.Add(1)
+		go func(seg *segmentStage) {
+			defer wg.Done()
+			if e := downloadSegment(ctx, url, downingPath, stage.ifRange(), seg, &downloaded); e != nil {
+				errs <- e
+				cancel()
+			}
+		}(seg)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastTime := time.Now()
+	lastDownloaded := atomic.LoadInt64(&downloaded)
+loop:
+	for {
+		select {
+		case <-finished:
+			break loop
+		case now := <-ticker.C:
+			saveStage()
+			if sink == nil {
+				continue
+			}
+			cur := atomic.LoadInt64(&downloaded)
+			speed := float64(cur-lastDownloaded) / now.Sub(lastTime).Seconds()
+			lastTime = now
+			lastDownloaded = cur
+			percent := float64(0)
+			eta := int64(0)
+			if total > 0 {
+				percent = float64(avBase+cur) / float64(total) * 100
+				if speed > 0 {
+					eta = int64(float64(total-avBase-cur) / speed)
+				}
+			}
+			sink(total, avBase+cur, int64(speed), eta, percent, 0)
+		}
+	}
+	saveStage()
+
+	close(errs)
+	for e := range errs {
+		if err == nil || err == context.Canceled {
+			err = e
+		}
+	}
+	if err == nil && common.IsCtxDone(ctx) {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+
+	if sink != nil {
+		sink(total, avBase+stage.Total, 0, 0, donePercent(total, avBase+stage.Total), 0)
+	}
+	os.Remove(stagePath)
+	return os.Rename(downingPath, path)
+}
+
+func downloadSegment(ctx context.Context, url, downingPath, ifRange string, seg *segmentStage, downloaded *int64) error {
+	offset := seg.Start + seg.done()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, seg.End))
+	if ifRange != "" {
+		req.Header.Set("If-Range", ifRange)
+	}
+	resp, err := downloader.HTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return downloader.NewHTTPStatusError(url, resp.StatusCode, resp.Status)
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("download segment %d-%d failed: %s", offset, seg.End, resp.Status)
+	}
+	if start, _, _, ok := parseContentRange(resp.Header.Get("Content-Range")); !ok || start != offset {
+		return fmt.Errorf("download segment %d-%d failed: unexpected content range", offset, seg.End)
+	}
+
+	f, err := os.OpenFile(downingPath, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := io.NewOffsetWriter(f, offset)
+	buf := make([]byte, 32*1024)
+	left := seg.End - offset + 1
+	for left > 0 {
+		if common.IsCtxDone(ctx) {
+			return ctx.Err()
+		}
+		n, err := resp.Body.Read(buf)
+		if int64(n) > left {
+			n = int(left)
+		}
+		if n > 0 {
+			if _, e := w.Write(buf[:n]); e != nil {
+				return e
+			}
+			left -= int64(n)
+			atomic.AddInt64(&seg.Done, int64(n))
+			atomic.AddInt64(downloaded, int64(n))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if left > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package direct
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/yinyajiang/yt-mnt/pkg/common"
+	"github.com/yinyajiang/yt-mnt/pkg/downloader"
+	"github.com/yinyajiang/yt-mnt/pkg/ies"
+)
+
+// directData 保存在DownloaderData中的附加信息
+type directData struct {
+	// 缩略图文件名，与媒体文件在同一目录
+	Thumbnail string `json:",omitempty"`
+	// 字幕文件名
+	Subtitles []string `json:",omitempty"`
+}
+
+func loadDirectData(s string) directData {
+	var data directData
+	if s != "" {
+		json.Unmarshal([]byte(s), &data)
+	}
+	return data
+}
+
+func (d directData) String() string {
+	if d.Thumbnail == "" && len(d.Subtitles) == 0 {
+		return ""
+	}
+	by, _ := json.Marshal(d)
+	return string(by)
+}
+
+// imageExt 根据内容判断图片的真实类型
+func imageExt(data []byte) string {
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/webp":
+		return ".webp"
+	case "image/gif":
+		return ".gif"
+	case "image/bmp":
+		return ".bmp"
+	}
+	return ""
+}
+
+/*
+downloadThumbnail 下载缩略图到媒体文件旁边，文件名与媒体相同
+优先尝试IE提供的更高分辨率的地址
+*/
+func downloadThumbnail(ctx context.Context, opt downloader.DownloadOptions) error {
+	if opt.Thumbnail == nil || *opt.Thumbnail == "" || opt.DownloaderData == nil {
+		return nil
+	}
+	data := loadDirectData(*opt.DownloaderData)
+	if data.Thumbnail != "" && common.IsExistsFile(filepath.Join(opt.DownloadFileDir, data.Thumbnail)) {
+		return nil
+	}
+
+	var lastErr error
+	for _, u := range ies.ThumbnailCandidates(*opt.Thumbnail, opt.URL) {
+		body, err := fetchBody(ctx, u, nil, nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		ext := imageExt(body)
+		if ext == "" {
+			lastErr = errors.New("thumbnail is not an image: " + u)
+			continue
+		}
+		path := filepath.Join(opt.DownloadFileDir, *opt.DownloadFileStem+ext)
+		//媒体本身就是这张图片
+		if path == opt.FilePath() {
+			return nil
+		}
+		downingPath, _ := downingPaths(path)
+		if err = os.WriteFile(downingPath, body, 0644); err != nil {
+			return err
+		}
+		if err = os.Rename(downingPath, path); err != nil {
+			os.Remove(downingPath)
+			return err
+		}
+		data.Thumbnail = filepath.Base(path)
+		*opt.DownloaderData = data.String()
+		return nil
+	}
+	return lastErr
+}
+
+// downloadSubtitles 下载选中语言的字幕到媒体文件旁边
+func downloadSubtitles(ctx context.Context, opt downloader.DownloadOptions) error {
+	tracks := downloader.SelectSubtitles(opt.Subtitles, opt.Subtitle, opt.IsOriginalSubtitle)
+	if len(tracks) == 0 {
+		if len(opt.Subtitles) != 0 {
+			return errors.New("no subtitle matched: " + opt.Subtitle)
+		}
+		return nil
+	}
+	files, err := downloader.DownloadSubtitles(ctx, tracks, opt.DownloadFileDir, *opt.DownloadFileStem, opt.SubtitleFormat)
+	if opt.DownloaderData != nil && len(files) != 0 {
+		data := loadDirectData(*opt.DownloaderData)
+		recorded := make(map[string]bool, len(data.Subtitles))
+		for _, name := range data.Subtitles {
+			recorded[name] = true
+		}
+		for _, file := range files {
+			if name := filepath.Base(file.Path); !recorded[name] {
+				data.Subtitles = append(data.Subtitles, name)
+			}
+		}
+		*opt.DownloaderData = data.String()
+	}
+	return err
+}
@@ -2,6 +2,7 @@ package downloader
 
 import (
 	"context"
+	"errors"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -42,10 +43,16 @@ type DownloadOptions struct {
 	DownloadPercent     float64
 	DownloadFileDir     string
 
+	//逗号分隔的字幕语言，all表示所有语言，为空不下载字幕
 	Subtitle            string
 	IsDownloadThumbnail bool
-	IsOriginalSubtitle  bool
-	HopeMediaType       string
+	//只下载人工字幕，不使用自动生成的字幕
+	IsOriginalSubtitle bool
+	HopeMediaType      string
+	//可选的字幕轨道
+	Subtitles []*ies.Subtitle
+	//字幕保存的格式，srt/vtt/ttml，为空保留原格式
+	SubtitleFormat string
 
 	//in out params
 	DownloadFileStem *string
@@ -53,6 +60,9 @@ type DownloadOptions struct {
 	DownloaderData   *string
 	Quality          *string
 
+	//下载器的重试策略，由MiddleDownloader填充，分段等内部请求也按它重试
+	RetryPolicy RetryPolicy
+
 	RefillInfo
 }
 
@@ -120,11 +130,15 @@ func (opt *DownloadOptions) SetStem(stem string) {
 	}
 }
 
+// ErrNoDownloader 没有注册支持该IE的下载器
+var ErrNoDownloader = errors.New("no downloader supports the ie")
+
 var _downloaders = make(map[string]Downloader)
 
 func Regist(d Downloader) {
 	_downloaders[d.Name()] = &MiddleDownloader{
-		d: d,
+		d:      d,
+		policy: DefaultRetryPolicy(),
 	}
 }
 
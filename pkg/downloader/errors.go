@@ -0,0 +1,177 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+type ErrorKind string
+
+const (
+	ErrKindUnknown     ErrorKind = "unknown"
+	ErrKindTransient   ErrorKind = "transient"
+	ErrKindExpiredURL  ErrorKind = "expired_url"
+	ErrKindForbidden   ErrorKind = "forbidden"
+	ErrKindNotFound    ErrorKind = "not_found"
+	ErrKindDiskFull    ErrorKind = "disk_full"
+	ErrKindMerge       ErrorKind = "merge_failure"
+	ErrKindConvert     ErrorKind = "convert_failure"
+	ErrKindPostProcess ErrorKind = "postprocess_failure"
+	ErrKindCanceled    ErrorKind = "canceled"
+)
+
+// IsRecoverable 重试或者刷新下载地址后有可能成功
+func (k ErrorKind) IsRecoverable() bool {
+	switch k {
+	case ErrKindTransient, ErrKindExpiredURL, ErrKindDiskFull, ErrKindCanceled:
+		return true
+	}
+	return false
+}
+
+// IsRetryable 可以直接原样重试
+func (k ErrorKind) IsRetryable() bool {
+	return k == ErrKindTransient
+}
+
+type DownloadError struct {
+	Kind       ErrorKind
+	StatusCode int
+	URL        string
+	Err        error
+}
+
+func (e *DownloadError) Error() string {
+	if e.Err == nil {
+		return string(e.Kind)
+	}
+	return fmt.Sprintf("%s: %s", e.Kind, e.Err.Error())
+}
+
+func (e *DownloadError) Unwrap() error {
+	return e.Err
+}
+
+func NewDownloadError(kind ErrorKind, err error) *DownloadError {
+	return &DownloadError{
+		Kind: kind,
+		Err:  err,
+	}
+}
+
+func NewHTTPStatusError(u string, statusCode int, status string) *DownloadError {
+	kind := ErrKindUnknown
+	switch {
+	case statusCode == http.StatusForbidden:
+		kind = ErrKindForbidden
+		if IsURLExpired(u) {
+			kind = ErrKindExpiredURL
+		}
+	case statusCode == http.StatusGone:
+		kind = ErrKindExpiredURL
+	case statusCode == http.StatusNotFound:
+		kind = ErrKindNotFound
+	case statusCode == http.StatusRequestTimeout,
+		statusCode == http.StatusTooManyRequests,
+		statusCode >= 500:
+		kind = ErrKindTransient
+	}
+	return &DownloadError{
+		Kind:       kind,
+		StatusCode: statusCode,
+		URL:        u,
+		Err:        fmt.Errorf("http status %s", status),
+	}
+}
+
+// ClassifyError 对下载错误进行分类，err为nil时返回空
+func ClassifyError(err error) ErrorKind {
+	if err == nil {
+		return ""
+	}
+	var downErr *DownloadError
+	if errors.As(err, &downErr) {
+		return downErr.Kind
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrKindCanceled
+	case errors.Is(err, syscall.ENOSPC):
+		return ErrKindDiskFull
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.EPIPE):
+		return ErrKindTransient
+	}
+	//url.Error本身也实现了net.Error，只按它包装的错误分类，证书、协议等错误不重试
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		if urlErr.Timeout() {
+			return ErrKindTransient
+		}
+		if urlErr.Err == nil {
+			return ErrKindUnknown
+		}
+		return ClassifyError(urlErr.Err)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return ErrKindTransient
+	}
+	return ErrKindUnknown
+}
+
+// AsDownloadError 将任意错误包装成DownloadError
+func AsDownloadError(err error) *DownloadError {
+	if err == nil {
+		return nil
+	}
+	var downErr *DownloadError
+	if errors.As(err, &downErr) {
+		return downErr
+	}
+	return NewDownloadError(ClassifyError(err), err)
+}
+
+// IsURLExpired 根据签名地址中的过期时间参数判断地址是否已经过期
+func IsURLExpired(u string) bool {
+	expire, ok := URLExpireTime(u)
+	return ok && !expire.After(time.Now())
+}
+
+/*
+URLExpireTime 解析签名地址中的过期时间
+instagram cdn: oe=十六进制时间戳
+googlevideo等: expire=十进制时间戳
+*/
+func URLExpireTime(u string) (time.Time, bool) {
+	info, err := url.Parse(u)
+	if err != nil {
+		return time.Time{}, false
+	}
+	query := info.Query()
+	if oe := query.Get("oe"); oe != "" {
+		if ts, err := strconv.ParseInt(oe, 16, 64); err == nil {
+			return time.Unix(ts, 0), true
+		}
+	}
+	for _, key := range []string{"expire", "expires", "Expires"} {
+		if v := query.Get(key); v != "" {
+			if ts, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return time.Unix(ts, 0), true
+			}
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,101 @@
+package downloader
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want ErrorKind
+	}{
+		{"nil", nil, ""},
+		{"download error", NewDownloadError(ErrKindMerge, errors.New("merge")), ErrKindMerge},
+		{"wrapped download error", fmt.Errorf("stage: %w", NewHTTPStatusError("http://a/b", 404, "404 Not Found")), ErrKindNotFound},
+		{"canceled", context.Canceled, ErrKindCanceled},
+		{"deadline", context.DeadlineExceeded, ErrKindTransient},
+		{"disk full", &os.PathError{Op: "write", Path: "/tmp/a", Err: syscall.ENOSPC}, ErrKindDiskFull},
+		{"unexpected eof", io.ErrUnexpectedEOF, ErrKindTransient},
+		{"connection reset", &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, ErrKindTransient},
+		{"connection refused", &url.Error{Op: "Get", URL: "http://a", Err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}, ErrKindTransient},
+		{"url timeout", &url.Error{Op: "Get", URL: "http://a", Err: timeoutError{}}, ErrKindTransient},
+		{"url certificate", &url.Error{Op: "Get", URL: "http://a", Err: x509.UnknownAuthorityError{}}, ErrKindUnknown},
+		{"url without cause", &url.Error{Op: "Get", URL: "http://a"}, ErrKindUnknown},
+		{"net error", timeoutError{}, ErrKindTransient},
+		{"other", errors.New("boom"), ErrKindUnknown},
+	}
+	for _, c := range cases {
+		if got := ClassifyError(c.err); got != c.want {
+			t.Errorf("%s: ClassifyError = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestNewHTTPStatusError(t *testing.T) {
+	expired := fmt.Sprintf("https://cdn.example.com/v.mp4?oe=%X", time.Now().Add(-time.Hour).Unix())
+	valid := fmt.Sprintf("https://cdn.example.com/v.mp4?oe=%X", time.Now().Add(time.Hour).Unix())
+	cases := []struct {
+		url    string
+		status int
+		want   ErrorKind
+	}{
+		{valid, 403, ErrKindForbidden},
+		{expired, 403, ErrKindExpiredURL},
+		{valid, 410, ErrKindExpiredURL},
+		{valid, 404, ErrKindNotFound},
+		{valid, 408, ErrKindTransient},
+		{valid, 429, ErrKindTransient},
+		{valid, 503, ErrKindTransient},
+		{valid, 400, ErrKindUnknown},
+	}
+	for _, c := range cases {
+		if got := NewHTTPStatusError(c.url, c.status, "").Kind; got != c.want {
+			t.Errorf("status %d %s: kind = %q, want %q", c.status, c.url, got, c.want)
+		}
+	}
+}
+
+func TestURLExpireTime(t *testing.T) {
+	cases := []struct {
+		url  string
+		want int64
+		ok   bool
+	}{
+		//instagram cdn，十六进制
+		{"https://scontent.cdninstagram.com/v/t51.jpg?oh=abc&oe=66B3C5F0", 0x66B3C5F0, true},
+		{"https://scontent.cdninstagram.com/v/t51.jpg?oe=66b3c5f0", 0x66B3C5F0, true},
+		//googlevideo，十进制
+		{"https://rr1---sn-a.googlevideo.com/videoplayback?expire=1717171717&ei=x", 1717171717, true},
+		{"https://example.com/a.mp4?expires=1700000000", 1700000000, true},
+		{"https://example.com/a.mp4?Expires=1700000000", 1700000000, true},
+		//十六进制优先
+		{"https://example.com/a.mp4?oe=10&expire=1700000000", 0x10, true},
+		{"https://example.com/a.mp4?oe=zz&expire=1700000000", 1700000000, true},
+		{"https://example.com/a.mp4?expire=soon", 0, false},
+		{"https://example.com/a.mp4", 0, false},
+		{"://bad", 0, false},
+	}
+	for _, c := range cases {
+		got, ok := URLExpireTime(c.url)
+		if ok != c.ok || (ok && got.Unix() != c.want) {
+			t.Errorf("URLExpireTime(%s) = %d, %v, want %d, %v", c.url, got.Unix(), ok, c.want, c.ok)
+		}
+	}
+}
@@ -4,14 +4,48 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yinyajiang/yt-mnt/pkg/common"
 )
 
 type MiddleDownloader struct {
 	d Downloader
+
+	policyMu sync.RWMutex
+	policy   RetryPolicy
+}
+
+func (m *MiddleDownloader) SetRetryPolicy(p RetryPolicy) {
+	m.policyMu.Lock()
+	defer m.policyMu.Unlock()
+	m.policy = p
+}
+
+func (m *MiddleDownloader) RetryPolicy() RetryPolicy {
+	m.policyMu.RLock()
+	defer m.policyMu.RUnlock()
+	return m.policy
 }
 
 func (m *MiddleDownloader) Delete(downloaderData DeleteOptions, deleteFile bool) {
 	m.d.Delete(downloaderData, deleteFile)
+	if deleteFile && !m.HandleSubtitles() {
+		for _, file := range FindSubtitleFiles(downloaderData.FilePath()) {
+			os.Remove(file.Path)
+		}
+	}
+}
+
+// HandleSubtitles 下载器是否自己下载字幕
+func (m *MiddleDownloader) HandleSubtitles() bool {
+	handler, ok := m.d.(SubtitleHandler)
+	return ok && handler.HandleSubtitles()
 }
 
 func (m *MiddleDownloader) ChangeFileTitle(opt DownloadOptions, title string) error {
@@ -21,7 +55,19 @@ func (m *MiddleDownloader) ChangeFileTitle(opt DownloadOptions, title string) er
 	if title == "" {
 		return errors.New("title is empty")
 	}
-	return m.d.ChangeFileTitle(opt, title)
+	if m.HandleSubtitles() || opt.DownloadFileExt == nil {
+		return m.d.ChangeFileTitle(opt, title)
+	}
+	subtitles := FindSubtitleFiles(opt.FilePath())
+	if err := m.d.ChangeFileTitle(opt, title); err != nil {
+		return err
+	}
+	//字幕跟随改名
+	media := opt.FilePath()
+	for _, file := range subtitles {
+		os.Rename(file.Path, SubtitlePath(media, file.Language, strings.TrimPrefix(filepath.Ext(file.Path), ".")))
+	}
+	return nil
 }
 func (m *MiddleDownloader) Download(ctx context.Context, opt DownloadOptions, sink_ ProgressSink) (ok bool, err error) {
 	if opt.DownloadFileExt == nil || opt.DownloadFileStem == nil {
@@ -44,7 +90,50 @@ func (m *MiddleDownloader) Download(ctx context.Context, opt DownloadOptions, si
 			sink_(total, downloaded, speed, eta, percent, videoDuration)
 		}
 	}
-	return m.d.Download(ctx, opt, sink)
+
+	policy := m.RetryPolicy()
+	opt.RetryPolicy = policy
+	for attempt := 1; ; attempt++ {
+		ok, err = m.d.Download(ctx, opt, sink)
+		if err == nil {
+			break
+		}
+		kind := ClassifyError(err)
+		if common.IsCtxDone(ctx) || !kind.IsRetryable() || attempt >= policy.MaxAttempts {
+			break
+		}
+		log.Printf("download %s failed(%d/%d), retry: %s", opt.URL, attempt, policy.MaxAttempts, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(policy.Delay(attempt)):
+		}
+	}
+	if err == nil {
+		if opt.Subtitle != "" && !m.HandleSubtitles() {
+			//字幕失败不影响媒体文件
+			if e := m.downloadSubtitles(ctx, opt); e != nil {
+				log.Printf("download subtitles of %s fail: %s", opt.URL, e)
+			}
+		}
+		return
+	}
+	downErr := AsDownloadError(err)
+	if common.IsCtxDone(ctx) {
+		downErr.Kind = ErrKindCanceled
+	}
+	return ok && downErr.Kind.IsRecoverable(), downErr
+}
+
+func (m *MiddleDownloader) downloadSubtitles(ctx context.Context, opt DownloadOptions) error {
+	tracks := SelectSubtitles(opt.Subtitles, opt.Subtitle, opt.IsOriginalSubtitle)
+	if len(tracks) == 0 {
+		if len(opt.Subtitles) != 0 {
+			return errors.New("no subtitle matched: " + opt.Subtitle)
+		}
+		return nil
+	}
+	_, err := DownloadSubtitles(ctx, tracks, opt.DownloadFileDir, *opt.DownloadFileStem, opt.SubtitleFormat)
+	return err
 }
 
 func (m *MiddleDownloader) Name() string {
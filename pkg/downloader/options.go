@@ -1,5 +1,15 @@
 package downloader
 
+import (
+	"crypto/tls"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
 var _proxy string
 
 func SetProxy(p string) {
@@ -9,3 +19,76 @@ func SetProxy(p string) {
 func Proxy() string {
 	return _proxy
 }
+
+var _defclient = &http.Client{
+	Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	},
+}
+
+// HTTPClient 下载器和处理步骤共用的http客户端，设置了代理时通过代理访问
+func HTTPClient() *http.Client {
+	if Proxy() == "" {
+		return _defclient
+	}
+	proxyUrl, err := url.Parse(Proxy())
+	if err != nil {
+		return _defclient
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyUrl),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+}
+
+type RetryPolicy struct {
+	//包含第一次下载在内的最大尝试次数，<=1 表示不重试
+	MaxAttempts  int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	//0~1，在退避时间上随机增减的比例
+	Jitter float64
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:  3,
+		InitialDelay: time.Second * 2,
+		MaxDelay:     time.Minute,
+		Multiplier:   2,
+		Jitter:       0.2,
+	}
+}
+
+// Delay 第attempt次失败后需要等待的时间，attempt从1开始
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	delay := float64(p.InitialDelay) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		jitter := math.Min(p.Jitter, 1)
+		delay += delay * jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(delay)
+}
+
+// SetRetryPolicy 设置指定下载器的重试策略，名称可能来自配置，没有注册时返回错误
+func SetRetryPolicy(name string, p RetryPolicy) error {
+	d, ok := _downloaders[name].(*MiddleDownloader)
+	if !ok {
+		return fmt.Errorf("downloader %q not found", name)
+	}
+	d.SetRetryPolicy(p)
+	return nil
+}
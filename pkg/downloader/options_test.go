@@ -0,0 +1,52 @@
+package downloader
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	cases := []struct {
+		name    string
+		policy  RetryPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{"first", RetryPolicy{InitialDelay: time.Second, Multiplier: 2}, 1, time.Second},
+		{"attempt below 1", RetryPolicy{InitialDelay: time.Second, Multiplier: 2}, 0, time.Second},
+		{"exponential", RetryPolicy{InitialDelay: time.Second, Multiplier: 2}, 4, 8 * time.Second},
+		{"max delay", RetryPolicy{InitialDelay: time.Second, Multiplier: 2, MaxDelay: 5 * time.Second}, 4, 5 * time.Second},
+		{"multiplier below 1", RetryPolicy{InitialDelay: time.Second, Multiplier: 0.5}, 3, time.Second},
+		{"zero delay", RetryPolicy{Multiplier: 2}, 3, 0},
+	}
+	for _, c := range cases {
+		if got := c.policy.Delay(c.attempt); got != c.want {
+			t.Errorf("%s: Delay(%d) = %s, want %s", c.name, c.attempt, got, c.want)
+		}
+	}
+}
+
+func TestRetryPolicyDelayJitter(t *testing.T) {
+	cases := []struct {
+		jitter   float64
+		min, max time.Duration
+	}{
+		{0.2, 8 * time.Second, 12 * time.Second},
+		//超过1按1计算
+		{3, 0, 20 * time.Second},
+	}
+	for _, c := range cases {
+		p := RetryPolicy{InitialDelay: 10 * time.Second, Multiplier: 2, Jitter: c.jitter}
+		for i := 0; i < 200; i++ {
+			if got := p.Delay(1); got < c.min || got > c.max {
+				t.Fatalf("jitter %v: Delay(1) = %s, want in [%s, %s]", c.jitter, got, c.min, c.max)
+			}
+		}
+	}
+}
+
+func TestSetRetryPolicyUnknownName(t *testing.T) {
+	if err := SetRetryPolicy("no-such-downloader", DefaultRetryPolicy()); err == nil {
+		t.Fatal("expected error for unknown downloader")
+	}
+}
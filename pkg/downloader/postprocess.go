@@ -0,0 +1,169 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yinyajiang/yt-mnt/pkg/common"
+)
+
+// PostProcessInfo 后处理的输入，处理器改变了主文件时会更新FilePath
+type PostProcessInfo struct {
+	FilePath string
+
+	Title       string
+	Uploader    string
+	UploadDate  time.Time
+	Description string
+	SourceURL   string
+	// 缩略图的地址或者本地路径
+	Thumbnail string
+	// 需要嵌入的字幕，为空时查找媒体文件旁边的字幕
+	Subtitles []SubtitleFile
+
+	// checksum的输出，格式为 算法:十六进制值
+	Checksum string
+}
+
+/*
+PostProcessor 下载完成后对文件的处理
+处理器需要先输出到临时文件，成功后才替换主文件，失败时主文件保持不变
+*/
+type PostProcessor interface {
+	Name() string
+	Process(ctx context.Context, info *PostProcessInfo, progress common.FFmpegProgressFunc) error
+}
+
+// PostProcessorFactory arg是处理器描述中冒号后面的参数，如 convert:mkv 中的mkv
+type PostProcessorFactory func(arg string) (PostProcessor, error)
+
+var (
+	postProcessorFactories = make(map[string]PostProcessorFactory)
+	postProcessorLock      sync.RWMutex
+)
+
+func RegistPostProcessor(name string, factory PostProcessorFactory) {
+	postProcessorLock.Lock()
+	defer postProcessorLock.Unlock()
+	postProcessorFactories[strings.ToLower(name)] = factory
+}
+
+// NewPostProcessor 根据描述创建处理器，如 extract_audio:mp3、embed_thumbnail
+func NewPostProcessor(spec string) (PostProcessor, error) {
+	name, arg, _ := strings.Cut(strings.TrimSpace(spec), ":")
+	postProcessorLock.RLock()
+	factory, ok := postProcessorFactories[strings.ToLower(name)]
+	postProcessorLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown post processor: %s", name)
+	}
+	return factory(strings.TrimSpace(arg))
+}
+
+func ParsePostProcessors(specs []string) ([]PostProcessor, error) {
+	processors := make([]PostProcessor, 0, len(specs))
+	for _, spec := range specs {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		p, err := NewPostProcessor(spec)
+		if err != nil {
+			return nil, err
+		}
+		processors = append(processors, p)
+	}
+	return processors, nil
+}
+
+type PostProcessError struct {
+	Stage string
+	Err   error
+}
+
+func (e *PostProcessError) Error() string {
+	return fmt.Sprintf("post process %s: %s", e.Stage, e.Err.Error())
+}
+
+func (e *PostProcessError) Unwrap() error {
+	return e.Err
+}
+
+/*
+RunPostProcessors 依次执行处理器，每个步骤平分[from,to]区间的进度
+stage在每个步骤开始时调用，全部完成后以空字符串调用
+失败时返回ErrKindPostProcess的*DownloadError，ctx取消时返回ctx.Err()
+*/
+func RunPostProcessors(ctx context.Context, processors []PostProcessor, info *PostProcessInfo, sink ProgressSink, from, to float64, stage func(name string)) error {
+	if len(processors) == 0 {
+		return nil
+	}
+	total, _ := fileSize(info.FilePath)
+	step := (to - from) / float64(len(processors))
+	for i, p := range processors {
+		if stage != nil {
+			stage(p.Name())
+		}
+		begin := from + step*float64(i)
+		if sink != nil {
+			sink(total, total, 0, 0, begin, 0)
+		}
+		if err := p.Process(ctx, info, FFmpegSink(sink, total, begin, begin+step)); err != nil {
+			if common.IsCtxDone(ctx) {
+				return ctx.Err()
+			}
+			return NewDownloadError(ErrKindPostProcess, &PostProcessError{Stage: p.Name(), Err: err})
+		}
+		total, _ = fileSize(info.FilePath)
+	}
+	if stage != nil {
+		stage("")
+	}
+	if sink != nil {
+		sink(total, total, 0, 0, to, 0)
+	}
+	return nil
+}
+
+func fileSize(path string) (int64, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+func replaceExt(path, ext string) string {
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ext
+}
+
+// processingPath 处理中的临时文件，保留扩展名让ffmpeg识别输出格式
+func processingPath(path, ext string) string {
+	if ext == "" {
+		ext = filepath.Ext(path)
+	}
+	return replaceExt(path, ".processing"+ext)
+}
+
+/*
+commitOutput 用临时文件替换目标文件
+目标和主文件不同时删除主文件，并更新info.FilePath
+*/
+func commitOutput(info *PostProcessInfo, tmp, output string) error {
+	if err := os.Rename(tmp, output); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if output != info.FilePath {
+		os.Remove(info.FilePath)
+		info.FilePath = output
+	}
+	return nil
+}
@@ -0,0 +1,433 @@
+package downloader
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/yinyajiang/yt-mnt/pkg/common"
+	"github.com/yinyajiang/yt-mnt/pkg/mp4"
+	"github.com/yinyajiang/yt-mnt/pkg/subtitle"
+)
+
+const (
+	PostProcessorExtractAudio   = "extract_audio"
+	PostProcessorConvert        = "convert"
+	PostProcessorEmbedThumbnail = "embed_thumbnail"
+	PostProcessorEmbedSubtitles = "embed_subs"
+	PostProcessorMetadata       = "metadata"
+	PostProcessorChecksum       = "checksum"
+)
+
+func init() {
+	RegistPostProcessor(PostProcessorExtractAudio, func(arg string) (PostProcessor, error) {
+		if arg == "" || strings.EqualFold(arg, "audio") {
+			arg = "mp3"
+		}
+		return &extractAudioProcessor{ext: "." + strings.ToLower(strings.TrimPrefix(arg, "."))}, nil
+	})
+	RegistPostProcessor(PostProcessorConvert, func(arg string) (PostProcessor, error) {
+		if arg == "" {
+			return nil, errors.New("convert needs a target ext, e.g. convert:mkv")
+		}
+		return &convertProcessor{ext: "." + strings.ToLower(strings.TrimPrefix(arg, "."))}, nil
+	})
+	RegistPostProcessor(PostProcessorEmbedThumbnail, func(arg string) (PostProcessor, error) {
+		return &embedThumbnailProcessor{}, nil
+	})
+	RegistPostProcessor(PostProcessorEmbedSubtitles, func(arg string) (PostProcessor, error) {
+		return &embedSubtitlesProcessor{}, nil
+	})
+	RegistPostProcessor(PostProcessorMetadata, func(arg string) (PostProcessor, error) {
+		return &metadataProcessor{}, nil
+	})
+	RegistPostProcessor(PostProcessorChecksum, func(arg string) (PostProcessor, error) {
+		if arg == "" {
+			arg = "sha256"
+		}
+		arg = strings.ToLower(arg)
+		if newHash(arg) == nil {
+			return nil, fmt.Errorf("unsupported checksum algorithm: %s", arg)
+		}
+		return &checksumProcessor{algorithm: arg}, nil
+	})
+}
+
+func isMP4Ext(ext string) bool {
+	switch strings.ToLower(ext) {
+	case ".mp4", ".m4v", ".m4a", ".mov":
+		return true
+	}
+	return false
+}
+
+// extractAudioProcessor 提取音频，成功后删除原文件
+type extractAudioProcessor struct {
+	ext string
+}
+
+func (p *extractAudioProcessor) Name() string {
+	return PostProcessorExtractAudio
+}
+
+func (p *extractAudioProcessor) Process(ctx context.Context, info *PostProcessInfo, progress common.FFmpegProgressFunc) error {
+	output := replaceExt(info.FilePath, p.ext)
+	tmp := processingPath(info.FilePath, p.ext)
+	err := mp4.ErrUnsupported
+	//AAC直接从MP4中取出音轨
+	if p.ext == ".m4a" && isMP4Ext(filepath.Ext(info.FilePath)) {
+		err = mp4.Mux(ctx, tmp, []mp4.Source{{Path: info.FilePath, Handler: mp4.HandlerAudio}})
+	}
+	if errors.Is(err, mp4.ErrUnsupported) {
+		err = common.RunFFmpeg(ctx, []string{"-i", info.FilePath, "-vn", "-sn", "-dn", tmp}, progress)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return commitOutput(info, tmp, output)
+}
+
+// convertProcessor 转换容器，优先不重新编码
+type convertProcessor struct {
+	ext string
+}
+
+func (p *convertProcessor) Name() string {
+	return PostProcessorConvert
+}
+
+func (p *convertProcessor) Process(ctx context.Context, info *PostProcessInfo, progress common.FFmpegProgressFunc) error {
+	if strings.EqualFold(filepath.Ext(info.FilePath), p.ext) {
+		return nil
+	}
+	output := replaceExt(info.FilePath, p.ext)
+	tmp := processingPath(info.FilePath, p.ext)
+	err := mp4.ErrUnsupported
+	if isMP4Ext(p.ext) && isMP4Ext(filepath.Ext(info.FilePath)) {
+		err = mp4.Mux(ctx, tmp, []mp4.Source{{Path: info.FilePath}})
+	}
+	if errors.Is(err, mp4.ErrUnsupported) {
+		err = common.RunFFmpeg(ctx, []string{"-i", info.FilePath, "-map", "0", "-c", "copy", tmp}, progress)
+		//编码与目标容器不兼容时重新编码
+		if err != nil && !common.IsCtxDone(ctx) {
+			err = common.RunFFmpeg(ctx, []string{"-i", info.FilePath, tmp}, progress)
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return commitOutput(info, tmp, output)
+}
+
+type embedThumbnailProcessor struct{}
+
+func (p *embedThumbnailProcessor) Name() string {
+	return PostProcessorEmbedThumbnail
+}
+
+func (p *embedThumbnailProcessor) Process(ctx context.Context, info *PostProcessInfo, progress common.FFmpegProgressFunc) error {
+	if info.Thumbnail == "" {
+		return errors.New("no thumbnail")
+	}
+	thumb, cleanup, err := prepareThumbnail(ctx, info.Thumbnail, filepath.Dir(info.FilePath))
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	ext := strings.ToLower(filepath.Ext(info.FilePath))
+	tmp := processingPath(info.FilePath, "")
+	var args []string
+	switch {
+	case isMP4Ext(ext):
+		//封面是最后一个流，需要知道原文件有几个流
+		streams, err := common.FFmpegStreams(ctx, info.FilePath)
+		if err != nil {
+			return err
+		}
+		index := 0
+		for _, stream := range streams {
+			if stream != "Data" {
+				index++
+			}
+		}
+		args = []string{"-i", info.FilePath, "-i", thumb, "-map", "0", "-dn", "-map", "1", "-c", "copy",
+			fmt.Sprintf("-disposition:%d", index), "attached_pic", tmp}
+	case ext == ".mp3":
+		args = []string{"-i", info.FilePath, "-i", thumb, "-map", "0:a", "-map", "1", "-c", "copy", "-id3v2_version", "3",
+			"-metadata:s:v", "title=Album cover", "-metadata:s:v", "comment=Cover (front)", tmp}
+	case ext == ".mkv" || ext == ".mka":
+		args = []string{"-i", info.FilePath, "-map", "0", "-c", "copy", "-attach", thumb,
+			"-metadata:s:t", "mimetype=image/jpeg", "-metadata:s:t", "filename=cover.jpg", tmp}
+	default:
+		return fmt.Errorf("embedding thumbnail into %s is not supported", ext)
+	}
+	if err = common.RunFFmpeg(ctx, args, progress); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return commitOutput(info, tmp, info.FilePath)
+}
+
+// embedSubtitlesProcessor 把字幕作为软字幕嵌入MP4/MKV，字幕文件保留
+type embedSubtitlesProcessor struct{}
+
+func (p *embedSubtitlesProcessor) Name() string {
+	return PostProcessorEmbedSubtitles
+}
+
+func (p *embedSubtitlesProcessor) Process(ctx context.Context, info *PostProcessInfo, progress common.FFmpegProgressFunc) error {
+	subtitles := info.Subtitles
+	if len(subtitles) == 0 {
+		subtitles = FindSubtitleFiles(info.FilePath)
+	}
+	if len(subtitles) == 0 {
+		return nil
+	}
+	ext := strings.ToLower(filepath.Ext(info.FilePath))
+	var codec string
+	switch {
+	case isMP4Ext(ext) && ext != ".m4a":
+		codec = "mov_text"
+	case ext == ".mkv":
+		codec = "srt"
+	default:
+		return fmt.Errorf("embedding subtitles into %s is not supported", ext)
+	}
+
+	//ffmpeg不能读取TTML，统一转换为SRT
+	srts, cleanup, err := prepareSubtitles(subtitles, filepath.Dir(info.FilePath))
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	//新字幕的序号接在原有字幕后面
+	streams, err := common.FFmpegStreams(ctx, info.FilePath)
+	if err != nil {
+		return err
+	}
+	existing := 0
+	for _, stream := range streams {
+		if stream == "Subtitle" {
+			existing++
+		}
+	}
+
+	args := []string{"-i", info.FilePath}
+	for _, srt := range srts {
+		args = append(args, "-i", srt)
+	}
+	args = append(args, "-map", "0", "-dn")
+	for i := range srts {
+		args = append(args, "-map", fmt.Sprint(i+1))
+	}
+	args = append(args, "-c", "copy", "-c:s", codec)
+	for i, sub := range subtitles {
+		args = append(args, fmt.Sprintf("-metadata:s:s:%d", existing+i), "language="+sub.Language)
+	}
+	tmp := processingPath(info.FilePath, "")
+	args = append(args, tmp)
+	if err = common.RunFFmpeg(ctx, args, progress); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return commitOutput(info, tmp, info.FilePath)
+}
+
+// prepareSubtitles 把字幕转换为SRT临时文件
+func prepareSubtitles(subtitles []SubtitleFile, dir string) (paths []string, cleanup func(), err error) {
+	cleanup = func() {
+		for _, path := range paths {
+			os.Remove(path)
+		}
+	}
+	for _, sub := range subtitles {
+		data, err := os.ReadFile(sub.Path)
+		if err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+		srt, err := subtitle.Convert(data, filepath.Ext(sub.Path), subtitle.FormatSRT)
+		if err != nil {
+			cleanup()
+			return nil, func() {}, fmt.Errorf("%s: %w", filepath.Base(sub.Path), err)
+		}
+		f, err := os.CreateTemp(dir, "subtitle-*.srt")
+		if err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+		paths = append(paths, f.Name())
+		_, err = f.Write(srt)
+		f.Close()
+		if err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+	}
+	return paths, cleanup, nil
+}
+
+/*
+prepareThumbnail 准备可以嵌入的缩略图，本地文件直接使用，否则下载到dir
+不是jpeg/png时转换为jpeg
+*/
+func prepareThumbnail(ctx context.Context, thumbnail, dir string) (path string, cleanup func(), err error) {
+	var temps []string
+	cleanup = func() {
+		for _, temp := range temps {
+			os.Remove(temp)
+		}
+	}
+	path = thumbnail
+	if !common.IsExistsFile(thumbnail) {
+		f, err := os.CreateTemp(dir, "thumbnail-*")
+		if err != nil {
+			return "", cleanup, err
+		}
+		temps = append(temps, f.Name())
+		err = httpGetTo(ctx, thumbnail, f)
+		f.Close()
+		if err != nil {
+			cleanup()
+			return "", func() {}, err
+		}
+		path = f.Name()
+	}
+
+	head := make([]byte, 512)
+	f, err := os.Open(path)
+	if err != nil {
+		cleanup()
+		return "", func() {}, err
+	}
+	n, _ := io.ReadFull(f, head)
+	f.Close()
+	switch http.DetectContentType(head[:n]) {
+	case "image/jpeg", "image/png":
+		return path, cleanup, nil
+	}
+	jpgFile, err := os.CreateTemp(dir, "thumbnail-*.jpg")
+	if err != nil {
+		cleanup()
+		return "", func() {}, err
+	}
+	jpgFile.Close()
+	jpg := jpgFile.Name()
+	temps = append(temps, jpg)
+	if err = common.RunFFmpeg(ctx, []string{"-i", path, jpg}); err != nil {
+		cleanup()
+		return "", func() {}, err
+	}
+	return jpg, cleanup, nil
+}
+
+func httpGetTo(ctx context.Context, u string, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := HTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return NewHTTPStatusError(u, resp.StatusCode, resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// metadataProcessor 写入标题、作者、上传日期、简介和来源地址
+type metadataProcessor struct{}
+
+func (p *metadataProcessor) Name() string {
+	return PostProcessorMetadata
+}
+
+func (p *metadataProcessor) Process(ctx context.Context, info *PostProcessInfo, progress common.FFmpegProgressFunc) error {
+	tags := [][2]string{
+		{"title", info.Title},
+		{"artist", info.Uploader},
+		{"description", info.Description},
+		{"comment", info.SourceURL},
+	}
+	if !info.UploadDate.IsZero() {
+		tags = append(tags, [2]string{"date", info.UploadDate.Format("2006-01-02")})
+	}
+	args := []string{"-i", info.FilePath, "-map", "0", "-c", "copy"}
+	for _, tag := range tags {
+		if tag[1] != "" {
+			args = append(args, "-metadata", tag[0]+"="+tag[1])
+		}
+	}
+	tmp := processingPath(info.FilePath, "")
+	args = append(args, tmp)
+	if err := common.RunFFmpeg(ctx, args, progress); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return commitOutput(info, tmp, info.FilePath)
+}
+
+type checksumProcessor struct {
+	algorithm string
+}
+
+func (p *checksumProcessor) Name() string {
+	return PostProcessorChecksum
+}
+
+func newHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "md5":
+		return md5.New()
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "sha512":
+		return sha512.New()
+	}
+	return nil
+}
+
+func (p *checksumProcessor) Process(ctx context.Context, info *PostProcessInfo, progress common.FFmpegProgressFunc) error {
+	f, err := os.Open(info.FilePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := newHash(p.algorithm)
+	buf := make([]byte, 1024*1024)
+	for {
+		if common.IsCtxDone(ctx) {
+			return ctx.Err()
+		}
+		n, err := f.Read(buf)
+		h.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	info.Checksum = p.algorithm + ":" + hex.EncodeToString(h.Sum(nil))
+	return nil
+}
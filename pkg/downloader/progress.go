@@ -0,0 +1,35 @@
+package downloader
+
+import (
+	"github.com/yinyajiang/yt-mnt/pkg/common"
+)
+
+/*
+ScaleSink 把一个阶段的进度映射到整体进度的[from,to]区间
+下载之后还需要合并、转换时，下载阶段不会直接到100%
+*/
+func ScaleSink(sink ProgressSink, from, to float64) ProgressSink {
+	if sink == nil || (from == 0 && to == 100) {
+		return sink
+	}
+	return func(total, downloaded, speed, eta int64, percent float64, videoDuration int64) {
+		if percent == 0 && total > 0 && downloaded > 0 {
+			percent = float64(downloaded) / float64(total) * 100
+		}
+		sink(total, downloaded, speed, eta, from+percent*(to-from)/100, videoDuration)
+	}
+}
+
+// FFmpegSink 把ffmpeg的处理进度作为整体进度的[from,to]区间上报，total是已下载的大小
+func FFmpegSink(sink ProgressSink, total int64, from, to float64) common.FFmpegProgressFunc {
+	if sink == nil {
+		return nil
+	}
+	return func(p common.FFmpegProgress) {
+		var eta int64
+		if p.Speed > 0 && p.Duration > p.OutTime {
+			eta = int64((p.Duration - p.OutTime).Seconds() / p.Speed)
+		}
+		sink(total, total, 0, eta, from+p.Percent*(to-from)/100, int64(p.Duration.Seconds()))
+	}
+}
@@ -0,0 +1,131 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/yinyajiang/yt-mnt/pkg/ies"
+	"github.com/yinyajiang/yt-mnt/pkg/subtitle"
+)
+
+/*
+SubtitleHandler 下载器可选实现，返回true表示自己下载、删除和改名字幕
+否则由MiddleDownloader在下载成功后按DownloadOptions.Subtitles下载，删除和改名时一起处理
+*/
+type SubtitleHandler interface {
+	HandleSubtitles() bool
+}
+
+// SubtitleFile 下载到媒体文件旁边的字幕，文件名为 媒体名.语言.格式
+type SubtitleFile struct {
+	Language string
+	Path     string
+}
+
+/*
+SelectSubtitles 按语言选取字幕，languages逗号分隔，all表示所有语言
+en可以匹配en-US，同一语言优先人工字幕，originalOnly时不使用自动生成的字幕
+*/
+func SelectSubtitles(tracks []*ies.Subtitle, languages string, originalOnly bool) []*ies.Subtitle {
+	ret := make([]*ies.Subtitle, 0)
+	picked := make(map[string]bool)
+	pick := func(want string, auto bool) {
+		for _, track := range tracks {
+			if track == nil || track.URL == "" || track.IsAutoGenerated != auto || picked[track.Language] {
+				continue
+			}
+			if want == "all" || strings.EqualFold(track.Language, want) ||
+				strings.HasPrefix(strings.ToLower(track.Language), strings.ToLower(want)+"-") {
+				picked[track.Language] = true
+				ret = append(ret, track)
+			}
+		}
+	}
+	for _, want := range strings.Split(languages, ",") {
+		want = strings.TrimSpace(want)
+		if want == "" {
+			continue
+		}
+		before := len(ret)
+		pick(want, false)
+		//all时自动字幕太多，只在没有人工字幕的语言上补充
+		if !originalOnly && (len(ret) == before || want == "all") {
+			pick(want, true)
+		}
+	}
+	return ret
+}
+
+/*
+DownloadSubtitles 下载选中的字幕并转换为format格式，format为空时保留原格式
+单个字幕失败不影响其他字幕，返回成功的文件和最后一个错误
+*/
+func DownloadSubtitles(ctx context.Context, tracks []*ies.Subtitle, dir, stem, format string) ([]SubtitleFile, error) {
+	files := make([]SubtitleFile, 0, len(tracks))
+	var lastErr error
+	for _, track := range tracks {
+		var buf bytes.Buffer
+		if err := httpGetTo(ctx, track.URL, &buf); err != nil {
+			if ctx.Err() != nil {
+				return files, ctx.Err()
+			}
+			lastErr = fmt.Errorf("subtitle %s: %w", track.Language, err)
+			continue
+		}
+		to := subtitle.NormalizeFormat(format)
+		if to == "" {
+			to = subtitle.NormalizeFormat(track.Format)
+		}
+		if to == "" {
+			to = subtitle.DetectFormat(buf.Bytes())
+		}
+		data, err := subtitle.Convert(buf.Bytes(), track.Format, to)
+		if err != nil {
+			lastErr = fmt.Errorf("subtitle %s: %w", track.Language, err)
+			continue
+		}
+		path := SubtitlePath(filepath.Join(dir, stem), track.Language, to)
+		if err = os.WriteFile(path, data, 0644); err != nil {
+			lastErr = err
+			continue
+		}
+		files = append(files, SubtitleFile{Language: track.Language, Path: path})
+	}
+	return files, lastErr
+}
+
+// SubtitlePath 媒体文件对应的字幕路径，media可以带扩展名
+func SubtitlePath(media, language, format string) string {
+	return replaceExt(media, "") + "." + language + "." + format
+}
+
+// FindSubtitleFiles 查找媒体文件旁边已经下载的字幕
+func FindSubtitleFiles(media string) []SubtitleFile {
+	dir := filepath.Dir(media)
+	prefix := filepath.Base(replaceExt(media, "")) + "."
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	files := make([]SubtitleFile, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		ext := filepath.Ext(name)
+		if subtitle.NormalizeFormat(ext) == "" || strings.EqualFold(ext, ".xml") {
+			continue
+		}
+		language := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+		if language == "" || strings.Contains(language, ".") {
+			continue
+		}
+		files = append(files, SubtitleFile{Language: language, Path: filepath.Join(dir, name)})
+	}
+	return files
+}
@@ -0,0 +1,317 @@
+package ies
+
+import (
+	"container/list"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRootCacheCapacity = 64
+	DefaultRootCacheTTL      = 30 * time.Minute
+)
+
+/*
+RootCacheStore 根缓存的持久化存储，key由IE名称和链接组成
+LoadRoot 没有数据时返回nil
+*/
+type RootCacheStore interface {
+	LoadRoot(key string) (data []byte, parsedAt time.Time, err error)
+	SaveRoot(key string, data []byte, parsedAt time.Time) error
+	DeleteRoot(key string) error
+	// DeleteRootsBefore 删除parsedAt之前解析的数据
+	DeleteRootsBefore(parsedAt time.Time) error
+	ClearRoots() error
+}
+
+type RootCacheOption struct {
+	//内存中保存的链接数，<=0 使用默认值64
+	Capacity int
+	//解析结果的有效期，<=0 使用默认值30分钟
+	TTL time.Duration
+	//为空只缓存在内存中
+	Store RootCacheStore
+}
+
+type RootCacheStats struct {
+	//内存中的链接数
+	Entries int
+	//内存中命中
+	Hits int64
+	//内存中没有，从存储中读到
+	StoreHits int64
+	//需要请求API
+	Misses int64
+	//超过容量被移除的链接数
+	Evictions int64
+}
+
+// cachedRoot 缓存的ParseRoot结果，Reserve单独保存为JSON，读取时由IE还原类型
+type cachedRoot struct {
+	RootInfo  *MediaEntry
+	RootToken *RootToken
+	Reserve   json.RawMessage `json:",omitempty"`
+	ParsedAt  time.Time       `json:"-"`
+	key       string
+}
+
+type rootCache struct {
+	lock  sync.Mutex
+	opt   RootCacheOption
+	ll    *list.List
+	items map[string]*list.Element
+	stats RootCacheStats
+}
+
+var _rootCache = newRootCache(RootCacheOption{})
+
+func newRootCache(opt RootCacheOption) *rootCache {
+	if opt.Capacity <= 0 {
+		opt.Capacity = DefaultRootCacheCapacity
+	}
+	if opt.TTL <= 0 {
+		opt.TTL = DefaultRootCacheTTL
+	}
+	return &rootCache{
+		opt:   opt,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// SetRootCache 替换ParseRoot的缓存，清空内存中的缓存和统计，删除存储中过期的数据
+func SetRootCache(opt RootCacheOption) {
+	c := newRootCache(opt)
+	if c.opt.Store != nil {
+		if err := c.opt.Store.DeleteRootsBefore(time.Now().Add(-c.opt.TTL)); err != nil {
+			log.Printf("prune root cache fail: %s", err)
+		}
+	}
+	_rootCache.lock.Lock()
+	defer _rootCache.lock.Unlock()
+	_rootCache.opt = c.opt
+	_rootCache.ll = c.ll
+	_rootCache.items = c.items
+	_rootCache.stats = c.stats
+}
+
+// GetRootCacheStats SetRootCache之后的命中统计
+func GetRootCacheStats() RootCacheStats {
+	_rootCache.lock.Lock()
+	defer _rootCache.lock.Unlock()
+	stats := _rootCache.stats
+	stats.Entries = _rootCache.ll.Len()
+	return stats
+}
+
+// InvalidateRoot 删除所有IE中链接的缓存，下次ParseRoot重新请求
+func InvalidateRoot(link string) {
+	keys, store := _rootCache.removeLink(link)
+	if store == nil {
+		return
+	}
+	for _, key := range keys {
+		if err := store.DeleteRoot(key); err != nil {
+			log.Printf("delete root cache %s fail: %s", key, err)
+		}
+	}
+}
+
+// ClearRootCache 清空内存和存储中的缓存
+func ClearRootCache() {
+	_rootCache.lock.Lock()
+	_rootCache.ll.Init()
+	_rootCache.items = make(map[string]*list.Element)
+	store := _rootCache.opt.Store
+	_rootCache.lock.Unlock()
+	if store != nil {
+		if err := store.ClearRoots(); err != nil {
+			log.Printf("clear root cache fail: %s", err)
+		}
+	}
+}
+
+func rootCacheKey(ie, link string) string {
+	return ie + " " + link
+}
+
+func (c *rootCache) removeLink(link string) ([]string, RootCacheStore) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	keys := make([]string, 0)
+	for _, name := range Names() {
+		key := rootCacheKey(name, link)
+		keys = append(keys, key)
+		if el, ok := c.items[key]; ok {
+			c.ll.Remove(el)
+			delete(c.items, key)
+		}
+	}
+	return keys, c.opt.Store
+}
+
+// get 先查内存再查存储，存储中读到的数据放回内存
+func (c *rootCache) get(ie InfoExtractor, link string) (*MediaEntry, *RootToken, bool) {
+	key := rootCacheKey(ie.Name(), link)
+	c.lock.Lock()
+	if el, ok := c.items[key]; ok {
+		root := el.Value.(*cachedRoot)
+		if time.Since(root.ParsedAt) < c.opt.TTL {
+			c.ll.MoveToFront(el)
+			c.stats.Hits++
+			c.lock.Unlock()
+			return root.copy()
+		}
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+	store, ttl := c.opt.Store, c.opt.TTL
+	c.lock.Unlock()
+
+	if store != nil {
+		if root := loadStoredRoot(store, ie, key, ttl); root != nil {
+			c.lock.Lock()
+			c.stats.StoreHits++
+			c.putLocked(root)
+			c.lock.Unlock()
+			return root.copy()
+		}
+	}
+	c.lock.Lock()
+	c.stats.Misses++
+	c.lock.Unlock()
+	return nil, nil, false
+}
+
+func (c *rootCache) put(ie InfoExtractor, link string, rootInfo *MediaEntry, rootToken *RootToken) {
+	root := &cachedRoot{
+		RootInfo:  rootInfo,
+		RootToken: rootToken,
+		ParsedAt:  time.Now(),
+		key:       rootCacheKey(ie.Name(), link),
+	}
+	root.RootInfo, root.RootToken, _ = root.copy()
+
+	c.lock.Lock()
+	c.putLocked(root)
+	store := c.opt.Store
+	c.lock.Unlock()
+	if store != nil {
+		saveStoredRoot(store, ie, root)
+	}
+}
+
+func (c *rootCache) putLocked(root *cachedRoot) {
+	if el, ok := c.items[root.key]; ok {
+		el.Value = root
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[root.key] = c.ll.PushFront(root)
+	for c.ll.Len() > c.opt.Capacity {
+		last := c.ll.Back()
+		c.ll.Remove(last)
+		delete(c.items, last.Value.(*cachedRoot).key)
+		c.stats.Evictions++
+	}
+}
+
+// copy 调用者会修改返回的结果，如ConvertToUserRoot，缓存中保留原值
+func (r *cachedRoot) copy() (*MediaEntry, *RootToken, bool) {
+	token := *r.RootToken
+	return copyMediaEntry(r.RootInfo), &token, true
+}
+
+// copyMediaEntry 深拷贝，Formats、Subtitles和Entries不和原值共享，Reserve是值类型不需要复制
+func copyMediaEntry(entry *MediaEntry) *MediaEntry {
+	if entry == nil {
+		return nil
+	}
+	ret := *entry
+	if entry.Formats != nil {
+		ret.Formats = make([]*Format, len(entry.Formats))
+		for i, f := range entry.Formats {
+			if f != nil {
+				format := *f
+				ret.Formats[i] = &format
+			}
+		}
+	}
+	if entry.Subtitles != nil {
+		ret.Subtitles = make([]*Subtitle, len(entry.Subtitles))
+		for i, s := range entry.Subtitles {
+			if s != nil {
+				subtitle := *s
+				ret.Subtitles[i] = &subtitle
+			}
+		}
+	}
+	if entry.Entries != nil {
+		ret.Entries = make([]*MediaEntry, len(entry.Entries))
+		for i, e := range entry.Entries {
+			ret.Entries[i] = copyMediaEntry(e)
+		}
+	}
+	return &ret
+}
+
+func loadStoredRoot(store RootCacheStore, ie InfoExtractor, key string, ttl time.Duration) *cachedRoot {
+	data, parsedAt, err := store.LoadRoot(key)
+	if err != nil {
+		log.Printf("load root cache %s fail: %s", key, err)
+		return nil
+	}
+	if data == nil {
+		return nil
+	}
+	if time.Since(parsedAt) >= ttl {
+		if err = store.DeleteRoot(key); err != nil {
+			log.Printf("delete root cache %s fail: %s", key, err)
+		}
+		return nil
+	}
+	var root cachedRoot
+	if err = json.Unmarshal(data, &root); err != nil || root.RootInfo == nil || root.RootToken == nil {
+		return nil
+	}
+	if len(root.Reserve) != 0 {
+		decoder, ok := ie.(ReserveDecoder)
+		if !ok {
+			return nil
+		}
+		if root.RootInfo.Reserve, err = decoder.DecodeReserve(root.Reserve); err != nil {
+			return nil
+		}
+	}
+	root.ParsedAt = parsedAt
+	root.key = key
+	return &root
+}
+
+// saveStoredRoot IE没有实现ReserveDecoder时，带有Reserve的结果不保存
+func saveStoredRoot(store RootCacheStore, ie InfoExtractor, root *cachedRoot) {
+	stored := *root
+	if root.RootInfo.Reserve != nil {
+		if _, ok := ie.(ReserveDecoder); !ok {
+			return
+		}
+		reserve, err := json.Marshal(root.RootInfo.Reserve)
+		if err != nil {
+			return
+		}
+		stored.Reserve = reserve
+		info := *root.RootInfo
+		info.Reserve = nil
+		stored.RootInfo = &info
+	}
+	data, err := json.Marshal(&stored)
+	if err != nil {
+		log.Printf("encode root cache %s fail: %s", root.key, err)
+		return
+	}
+	if err = store.SaveRoot(root.key, data, root.ParsedAt); err != nil {
+		log.Printf("save root cache %s fail: %s", root.key, err)
+	}
+}
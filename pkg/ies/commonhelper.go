@@ -1,6 +1,7 @@
 package ies
 
 import (
+	"context"
 	"log"
 	"math"
 	"time"
@@ -8,15 +9,18 @@ import (
 	"github.com/duke-git/lancet/v2/slice"
 )
 
-type GetSubItemCount = func(parentID string) (int64, error)
-type GetSubItemsOrderWithPage = func(parentID string, nextPage *NextPageToken) ([]*MediaEntry, error)
-type GetSubItemsWithPage = func(parentID string, nextPage *NextPageToken) ([]*MediaEntry, error)
+type GetSubItemCount = func(ctx context.Context, parentID string) (int64, error)
+type GetSubItemsOrderWithPage = func(ctx context.Context, parentID string, nextPage *NextPageToken) ([]*MediaEntry, error)
+type GetSubItemsWithPage = func(ctx context.Context, parentID string, nextPage *NextPageToken) ([]*MediaEntry, error)
 
-// mustHasItem 调试接口，无论是否时间满足都会返回数据
-func HelperGetSubItemsByTime(parentID string, getSubItemsWithPageID GetSubItemsOrderWithPage, afterTime time.Time, mustHasItem ...bool) (retItems []*MediaEntry, err error) {
+/*
+mustHasItem 调试接口，无论是否时间满足都会返回数据
+已经获取到部分数据时，后面的页失败不返回错误，ctx结束除外
+*/
+func HelperGetSubItemsByTime(ctx context.Context, parentID string, getSubItemsWithPageID GetSubItemsOrderWithPage, afterTime time.Time, mustHasItem ...bool) (retItems []*MediaEntry, err error) {
 	retItems = make([]*MediaEntry, 0)
 	if afterTime.IsZero() {
-		retItems, err = HelperGetSubItems(parentID, getSubItemsWithPageID)
+		retItems, err = HelperGetSubItems(ctx, parentID, getSubItemsWithPageID)
 		if err != nil {
 			return
 		}
@@ -27,9 +31,10 @@ func HelperGetSubItemsByTime(parentID string, getSubItemsWithPageID GetSubItemsO
 			if nextPage.IsEnd {
 				break
 			}
-			pageItems, e := getSubItemsWithPageID(parentID, &nextPage)
+			pageItems, e := getSubItemsWithPageID(ctx, parentID, &nextPage)
 			if e != nil {
-				if len(retItems) == 0 {
+				if len(retItems) == 0 || ctx.Err() != nil {
+					retItems = nil
 					err = e
 					return
 				}
@@ -72,7 +77,7 @@ func HelperGetSubItemsByTime(parentID string, getSubItemsWithPageID GetSubItemsO
 	return
 }
 
-func HelperGetSubItems(mediaID string, getSubItemsWithPageID GetSubItemsWithPage, latestCount ...int64) ([]*MediaEntry, error) {
+func HelperGetSubItems(ctx context.Context, mediaID string, getSubItemsWithPageID GetSubItemsWithPage, latestCount ...int64) ([]*MediaEntry, error) {
 	leftCount := int64(0)
 	if len(latestCount) > 0 {
 		leftCount = latestCount[0]
@@ -86,9 +91,9 @@ func HelperGetSubItems(mediaID string, getSubItemsWithPageID GetSubItemsWithPage
 		if leftCount <= 0 || nextPage.IsEnd {
 			break
 		}
-		medias, err := getSubItemsWithPageID(mediaID, &nextPage)
+		medias, err := getSubItemsWithPageID(ctx, mediaID, &nextPage)
 		if err != nil {
-			if len(ret) != 0 {
+			if len(ret) != 0 && ctx.Err() == nil {
 				log.Println(err)
 				break
 			} else {
@@ -101,9 +106,9 @@ func HelperGetSubItems(mediaID string, getSubItemsWithPageID GetSubItemsWithPage
 	return ret, nil
 }
 
-func HelperGetSubItemsByDiffCount(mediaID string, beforeCount int64, beforeSubItems []*MediaEntry, outAllCount *int64, getSubItemCount GetSubItemCount, getSubItemsWithPageID GetSubItemsWithPage) (retItems []*MediaEntry, err error) {
+func HelperGetSubItemsByDiffCount(ctx context.Context, mediaID string, beforeCount int64, beforeSubItems []*MediaEntry, outAllCount *int64, getSubItemCount GetSubItemCount, getSubItemsWithPageID GetSubItemsWithPage) (retItems []*MediaEntry, err error) {
 	retItems = make([]*MediaEntry, 0)
-	allCount, err := getSubItemCount(mediaID)
+	allCount, err := getSubItemCount(ctx, mediaID)
 	if allCount == 0 || err != nil {
 		return
 	}
@@ -118,7 +123,7 @@ func HelperGetSubItemsByDiffCount(mediaID string, beforeCount int64, beforeSubIt
 	if beforeCount <= 0 {
 		latestCount = math.MaxInt64
 	}
-	latestItems, err := HelperGetSubItems(mediaID, getSubItemsWithPageID, latestCount)
+	latestItems, err := HelperGetSubItems(ctx, mediaID, getSubItemsWithPageID, latestCount)
 	if err != nil {
 		return
 	}
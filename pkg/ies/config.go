@@ -1,9 +1,13 @@
 package ies
 
+import "time"
+
 type IETokens map[string]string
 
 type IEConfigs struct {
 	Tokens IETokens
+	//单次API调用的超时，<=0 使用默认值30秒
+	CallTimeout time.Duration
 }
 
 var Cfg IEConfigs
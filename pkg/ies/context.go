@@ -0,0 +1,52 @@
+package ies
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const DefaultCallTimeout = 30 * time.Second
+
+// ErrCallTimeout 单次API调用超过了Cfg.CallTimeout，同时也是context.DeadlineExceeded
+var ErrCallTimeout = errors.New("api call timeout")
+
+func callTimeout() time.Duration {
+	if Cfg.CallTimeout <= 0 {
+		return DefaultCallTimeout
+	}
+	return Cfg.CallTimeout
+}
+
+/*
+Call 以单次调用的超时执行一个API请求
+ctx结束时返回的错误包装了ctx.Err()，只是单次调用超时返回的错误包装了ErrCallTimeout
+*/
+func Call[T any](ctx context.Context, do func(ctx context.Context) (T, error)) (T, error) {
+	if err := ctx.Err(); err != nil {
+		var zero T
+		return zero, err
+	}
+	timeout := callTimeout()
+	callCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ret, err := do(callCtx)
+	if err == nil {
+		return ret, nil
+	}
+	return ret, callError(ctx, callCtx, timeout, err)
+}
+
+func callError(ctx, callCtx context.Context, timeout time.Duration, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		if errors.Is(err, ctxErr) {
+			return err
+		}
+		return fmt.Errorf("%w: %s", ctxErr, err)
+	}
+	if callCtx.Err() != nil {
+		return fmt.Errorf("%w after %s: %w", ErrCallTimeout, timeout, context.DeadlineExceeded)
+	}
+	return err
+}
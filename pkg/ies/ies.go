@@ -1,7 +1,9 @@
 package ies
 
 import (
+	"context"
 	"errors"
+	"sort"
 	"time"
 )
 
@@ -21,24 +23,58 @@ type NextPageToken struct {
 type ParseOptions struct {
 }
 
+/*
+InfoExtractor 访问网络的方法都以ctx开始，ctx结束时尽快返回包装了ctx.Err()的错误
+每次API请求另外受Cfg.CallTimeout限制，见Call
+*/
 type InfoExtractor interface {
-	ParseRoot(link string, options ...ParseOptions) (*MediaEntry, *RootToken, error)
+	ParseRoot(ctx context.Context, link string, options ...ParseOptions) (*MediaEntry, *RootToken, error)
 	ConvertToUserRoot(rootToken *RootToken, rootInfo *MediaEntry) error
-	ExtractPage(rootToken *RootToken, nextPage *NextPageToken) ([]*MediaEntry, error)
-	ExtractAllAfterTime(parentMediaID string, afterTime time.Time, mustHasItem ...bool) ([]*MediaEntry, error)
+	ExtractPage(ctx context.Context, rootToken *RootToken, nextPage *NextPageToken) ([]*MediaEntry, error)
+	ExtractAllAfterTime(ctx context.Context, parentMediaID string, afterTime time.Time, mustHasItem ...bool) ([]*MediaEntry, error)
+	/*
+		ParseMedia 解析单个媒体(帖子/视频)链接，返回带有格式的媒体信息
+		IE无法提供流地址时Formats为空，只能交给不需要格式的下载器(IsNeedFormat()==false)下载
+	*/
+	ParseMedia(ctx context.Context, link string) (*MediaEntry, error)
 	IsMatched(link string) bool
 	Name() string
 	Init() error
 }
 
+// ThumbnailUpgrader IE可选实现，返回比thumbnail分辨率更高的缩略图地址，按优先级从高到低排列
+type ThumbnailUpgrader interface {
+	ThumbnailCandidates(thumbnail string) []string
+}
+
+// SubtitleLister IE可选实现，单独查询媒体的字幕轨道，只在需要下载字幕时调用
+type SubtitleLister interface {
+	ListSubtitles(ctx context.Context, link string) ([]*Subtitle, error)
+}
+
+// DetailFiller IE可选实现，列表接口没有返回的详情(如youtube的时长)需要单独查询，只在需要时调用
+type DetailFiller interface {
+	FillDetails(ctx context.Context, entries []*MediaEntry) error
+}
+
+// ErrSubtitleUnsupported IE没有实现SubtitleLister
+var ErrSubtitleUnsupported = errors.New("ie does not support listing subtitles")
+
+// ErrFormatsUnsupported IE不提供媒体的流地址(如youtube data api)，需要注册不需要格式的下载器
+var ErrFormatsUnsupported = errors.New("ie does not provide media formats")
+
+// ReserveDecoder IE可选实现，把JSON还原为MediaEntry.Reserve的原类型，用于持久化的根缓存
+type ReserveDecoder interface {
+	DecodeReserve(data []byte) (any, error)
+}
+
 var (
 	_ies = make(map[string]InfoExtractor)
 )
 
 func Regist(ie InfoExtractor) {
 	_ies[ie.Name()] = &middleInfoExtractor{
-		ie:    ie,
-		cache: make([]cacheInfo, 0),
+		ie: ie,
 	}
 }
 
@@ -65,6 +101,16 @@ func GetIE(hints ...string) (InfoExtractor, error) {
 	return nil, errors.New("no matched IE")
 }
 
+// Names 已注册的IE名称，按名称排序
+func Names() []string {
+	names := make([]string, 0, len(_ies))
+	for name := range _ies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func InitIE(ieTokens IETokens) error {
 	Cfg.Tokens = ieTokens
 	for _, ie := range _ies {
@@ -74,3 +120,18 @@ func InitIE(ieTokens IETokens) error {
 	}
 	return nil
 }
+
+// ThumbnailCandidates 返回缩略图的候选地址，最后一个是原地址，hints同GetIE
+func ThumbnailCandidates(thumbnail string, hints ...string) []string {
+	candidates := make([]string, 0)
+	if ie, err := GetIE(append(hints, thumbnail)...); err == nil {
+		if upgrader, ok := ie.(ThumbnailUpgrader); ok {
+			for _, c := range upgrader.ThumbnailCandidates(thumbnail) {
+				if c != thumbnail {
+					candidates = append(candidates, c)
+				}
+			}
+		}
+	}
+	return append(candidates, thumbnail)
+}
@@ -1,6 +1,8 @@
 package instagram
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"strings"
 	"time"
@@ -42,7 +44,7 @@ func (i *InstagramIE) IsMatched(link string) bool {
 	return strings.Contains(link, "instagram.com")
 }
 
-func (i *InstagramIE) ParseRoot(link string, _ ...ies.ParseOptions) (*ies.MediaEntry, *ies.RootToken, error) {
+func (i *InstagramIE) ParseRoot(ctx context.Context, link string, _ ...ies.ParseOptions) (*ies.MediaEntry, *ies.RootToken, error) {
 	kind, usr, err := ParseInstagramURL(link)
 	if err != nil {
 		return nil, nil, err
@@ -50,9 +52,11 @@ func (i *InstagramIE) ParseRoot(link string, _ ...ies.ParseOptions) (*ies.MediaE
 	var entry *ies.MediaEntry
 	switch kind {
 	case KindUser:
-		entry, err = i.client.User(usr)
+		entry, err = i.client.User(ctx, usr)
 	case KindStory:
 		err = errors.New("instagram story is not supported")
+	case KindPost:
+		err = errors.New("instagram post is not a root, use ParseMedia instead")
 	}
 	if err != nil {
 		return nil, nil, err
@@ -68,21 +72,32 @@ func (i *InstagramIE) ParseRoot(link string, _ ...ies.ParseOptions) (*ies.MediaE
 	}, nil
 }
 
+func (i *InstagramIE) DecodeReserve(data []byte) (any, error) {
+	var reserve InstagramReserve
+	err := json.Unmarshal(data, &reserve)
+	return reserve, err
+}
+
 func (i *InstagramIE) ConvertToUserRoot(_ *ies.RootToken, _ *ies.MediaEntry) error {
 	return errors.New("instagram generate user is not supported")
 }
 
-func (i *InstagramIE) ExtractPage(rootToken *ies.RootToken, nextPage *ies.NextPageToken) ([]*ies.MediaEntry, error) {
+func (i *InstagramIE) ExtractPage(ctx context.Context, rootToken *ies.RootToken, nextPage *ies.NextPageToken) ([]*ies.MediaEntry, error) {
 	if rootToken.MediaType != ies.MediaTypeUser {
 		return nil, errors.New("only user media type is supported")
 	}
-	return i.client.UserPostWithPageID(rootToken.MediaID, nextPage)
+	return i.client.UserPostWithPageID(ctx, rootToken.MediaID, nextPage)
 }
 
 // mustHasItem 调试接口，无论是否时间满足都会返回数据
-func (i *InstagramIE) ExtractAllAfterTime(paretnMediaID string, afterTime time.Time, mustHasItem ...bool) ([]*ies.MediaEntry, error) {
-	return ies.HelperGetSubItemsByTime(paretnMediaID,
-		func(mediaID string, nextPage *ies.NextPageToken) ([]*ies.MediaEntry, error) {
-			return i.client.UserPostWithPageID(mediaID, nextPage)
-		}, afterTime, mustHasItem...)
+func (i *InstagramIE) ExtractAllAfterTime(ctx context.Context, paretnMediaID string, afterTime time.Time, mustHasItem ...bool) ([]*ies.MediaEntry, error) {
+	return ies.HelperGetSubItemsByTime(ctx, paretnMediaID, i.client.UserPostWithPageID, afterTime, mustHasItem...)
+}
+
+func (i *InstagramIE) ParseMedia(ctx context.Context, link string) (*ies.MediaEntry, error) {
+	code, err := ParseInstagramPostCode(link)
+	if err != nil {
+		return nil, err
+	}
+	return i.client.MediaByCode(ctx, code)
 }
@@ -1,6 +1,7 @@
 package insapi
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -20,30 +21,47 @@ type InstagramApi struct {
 	key string
 }
 
+var _proxy string
+
+// SetProxy 设置之后New的客户端使用的代理
+func SetProxy(proxy string) {
+	_proxy = proxy
+}
+
 func New(key string) *InstagramApi {
+	h := http.Client{}
+	if _proxy != "" {
+		if proxy_, err := url.Parse(_proxy); err == nil {
+			h.Transport = &http.Transport{
+				Proxy: http.ProxyURL(proxy_),
+			}
+		} else {
+			log.Printf("invalid proxy url: %s", _proxy)
+		}
+	}
 	return &InstagramApi{
-		h:   http.Client{},
+		h:   h,
 		key: key,
 	}
 }
 
-func (i *InstagramApi) User(user_name string) (*ies.MediaEntry, error) {
-	return i.user(user_name, "")
+func (i *InstagramApi) User(ctx context.Context, user_name string) (*ies.MediaEntry, error) {
+	return i.user(ctx, user_name, "")
 }
 
-func (i *InstagramApi) UsersStory(user_name string) (*ies.MediaEntry, error) {
-	return i.usersStory(user_name, "")
+func (i *InstagramApi) UsersStory(ctx context.Context, user_name string) (*ies.MediaEntry, error) {
+	return i.usersStory(ctx, user_name, "")
 }
 
-func (i *InstagramApi) usersStory(user_name, or_user_id string) (*ies.MediaEntry, error) {
+func (i *InstagramApi) usersStory(ctx context.Context, user_name, or_user_id string) (*ies.MediaEntry, error) {
 	var js gjson.Result
 	var err error
 	if user_name != "" {
-		js, err = i.get("/v2/user/stories/by/username", map[string]any{
+		js, err = i.get(ctx, "/v2/user/stories/by/username", map[string]any{
 			"username": user_name,
 		})
 	} else {
-		js, err = i.get("/v2/user/stories", map[string]any{
+		js, err = i.get(ctx, "/v2/user/stories", map[string]any{
 			"user_id": or_user_id,
 		})
 	}
@@ -66,15 +84,15 @@ func (i *InstagramApi) usersStory(user_name, or_user_id string) (*ies.MediaEntry
 	return &entry, nil
 }
 
-func (i *InstagramApi) user(user_name, or_user_id string) (*ies.MediaEntry, error) {
+func (i *InstagramApi) user(ctx context.Context, user_name, or_user_id string) (*ies.MediaEntry, error) {
 	var js gjson.Result
 	var err error
 	if user_name != "" {
-		js, err = i.get("/v2/user/by/username/", map[string]any{
+		js, err = i.get(ctx, "/v2/user/by/username/", map[string]any{
 			"username": user_name,
 		})
 	} else {
-		js, err = i.get("/v2/user/by/id/", map[string]any{
+		js, err = i.get(ctx, "/v2/user/by/id/", map[string]any{
 			"id": or_user_id,
 		})
 	}
@@ -95,15 +113,15 @@ func (i *InstagramApi) user(user_name, or_user_id string) (*ies.MediaEntry, erro
 	return &user, nil
 }
 
-func (i *InstagramApi) GetUserPostsCount(user_id string) (int64, error) {
-	usr, err := i.user("", user_id)
+func (i *InstagramApi) GetUserPostsCount(ctx context.Context, user_id string) (int64, error) {
+	usr, err := i.user(ctx, "", user_id)
 	if err != nil {
 		return 0, err
 	}
 	return usr.EntryCount, nil
 }
 
-func (i *InstagramApi) UserPosts(user_id string, latestCount ...int64) ([]*ies.MediaEntry, error) {
+func (i *InstagramApi) UserPosts(ctx context.Context, user_id string, latestCount ...int64) ([]*ies.MediaEntry, error) {
 	leftCount := int64(0)
 	if len(latestCount) > 0 {
 		leftCount = latestCount[0]
@@ -117,9 +135,9 @@ func (i *InstagramApi) UserPosts(user_id string, latestCount ...int64) ([]*ies.M
 		if leftCount <= 0 || nextPage.IsEnd {
 			break
 		}
-		medias, err := i.UserPostWithPageID(user_id, &nextPage)
+		medias, err := i.UserPostWithPageID(ctx, user_id, &nextPage)
 		if err != nil {
-			if len(ret) != 0 {
+			if len(ret) != 0 && ctx.Err() == nil {
 				log.Println(err)
 				break
 			} else {
@@ -132,11 +150,11 @@ func (i *InstagramApi) UserPosts(user_id string, latestCount ...int64) ([]*ies.M
 	return ret, nil
 }
 
-func (i *InstagramApi) UserPostWithPageID(user_id string, nextPage *ies.NextPageToken) ([]*ies.MediaEntry, error) {
+func (i *InstagramApi) UserPostWithPageID(ctx context.Context, user_id string, nextPage *ies.NextPageToken) ([]*ies.MediaEntry, error) {
 	if nextPage == nil {
-		return i.UserPosts(user_id)
+		return i.UserPosts(ctx, user_id)
 	}
-	js, err := i.get("/v2/user/medias/", map[string]any{
+	js, err := i.get(ctx, "/v2/user/medias/", map[string]any{
 		"user_id": user_id,
 		"page_id": nextPage.NextPageID,
 	})
@@ -165,7 +183,28 @@ func (i *InstagramApi) UserPostWithPageID(user_id string, nextPage *ies.NextPage
 	return medias, nil
 }
 
-func (i *InstagramApi) get(api string, params map[string]any) (gjson.Result, error) {
+func (i *InstagramApi) MediaByCode(ctx context.Context, code string) (*ies.MediaEntry, error) {
+	js, err := i.get(ctx, "/v2/media/info/by/code", map[string]any{
+		"code": code,
+	})
+	if err != nil {
+		return nil, err
+	}
+	item := js.Get("items.0")
+	if !item.Exists() {
+		item = js.Get("media_or_ad")
+	}
+	if !item.Exists() && js.Get("pk").Exists() {
+		item = js
+	}
+	if !item.Exists() {
+		return nil, fmt.Errorf("no media found: %s", code)
+	}
+	media := parseMediaInfo(item)
+	return &media, nil
+}
+
+func (i *InstagramApi) get(ctx context.Context, api string, params map[string]any) (gjson.Result, error) {
 	file := ""
 	switch api {
 	case "/v2/user/stories/by/username/", "/v2/user/stories/by/username":
@@ -186,24 +225,28 @@ func (i *InstagramApi) get(api string, params map[string]any) (gjson.Result, err
 	if !strings.HasPrefix(api, "/") {
 		api = "/" + api
 	}
-	req, err := i.newRequest("GET", "https://api.hikerapi.com"+api+"?"+u.Encode(), nil, nil)
-	if err != nil {
-		return gjson.Result{}, err
-	}
-	resp, err := i.h.Do(req)
-	if err != nil {
-		return gjson.Result{}, err
-	}
-	defer resp.Body.Close()
-	by, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return gjson.Result{}, err
-	}
-	return gjson.ParseBytes(by), nil
+	link := "https://api.hikerapi.com" + api + "?" + u.Encode()
+	//读取响应也在单次调用的超时之内
+	return ies.Call(ctx, func(ctx context.Context) (gjson.Result, error) {
+		req, err := i.newRequest(ctx, "GET", link, nil, nil)
+		if err != nil {
+			return gjson.Result{}, err
+		}
+		resp, err := i.h.Do(req)
+		if err != nil {
+			return gjson.Result{}, err
+		}
+		defer resp.Body.Close()
+		by, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return gjson.Result{}, err
+		}
+		return gjson.ParseBytes(by), nil
+	})
 }
 
-func (i *InstagramApi) newRequest(method, url string, headers map[string]string, body io.Reader) (req *http.Request, err error) {
-	req, err = http.NewRequest(method, url, body)
+func (i *InstagramApi) newRequest(ctx context.Context, method, url string, headers map[string]string, body io.Reader) (req *http.Request, err error) {
+	req, err = http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return
 	}
@@ -222,8 +265,16 @@ func parseMediaInfo(item gjson.Result) ies.MediaEntry {
 		MediaID:     item.Get("pk").String(),
 		Title:       item.Get("caption.text").String(),
 		Description: item.Get("caption.text").String(),
-		Thumbnail:   item.Get("thumbnail_url").String(),
-		UploadDate:  time.Unix(item.Get("taken_at").Int(), 0),
+		//candidates按分辨率从高到低排列
+		Thumbnail:  item.Get("image_versions2.candidates.0.url").String(),
+		UploadDate: time.Unix(item.Get("taken_at").Int(), 0),
+	}
+	if user != "" {
+		media.Uploader = user
+	}
+	media.Channel = item.Get("user.pk_id").String()
+	if media.Channel == "" {
+		media.Channel = item.Get("user.pk").String()
 	}
 	if code := item.Get("code").String(); code != "" {
 		media.URL = "https://www.instagram.com/p/" + code
@@ -235,12 +286,14 @@ func parseMediaInfo(item gjson.Result) ies.MediaEntry {
 		media.Description = media.Title
 	}
 	if media.Thumbnail == "" {
-		media.Thumbnail = item.Get("image_versions2.candidates.0.url").String()
+		media.Thumbnail = item.Get("thumbnail_url").String()
 	}
 
 	switch item.Get("product_type").String() {
 	case "story":
 		media.URL = "https://www.instagram.com/stories/" + user + "/" + item.Get("pk").String()
+	case "clips":
+		media.IsShort = true
 	}
 
 	switch item.Get("media_type").Int() {
@@ -273,6 +326,12 @@ func parseMediaInfo(item gjson.Result) ies.MediaEntry {
 			if subentry.Title == "" {
 				subentry.Title = media.Title
 			}
+			if subentry.Uploader == "" {
+				subentry.Uploader = media.Uploader
+			}
+			if subentry.Channel == "" {
+				subentry.Channel = media.Channel
+			}
 			media.Entries = append(media.Entries, &subentry)
 		}
 	}
@@ -3,17 +3,20 @@ package instagram
 import (
 	"errors"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
 var (
 	storyRegexp = regexp.MustCompile(`instagram\.com/stories/([^/]+)/?`)
+	postRegexp  = regexp.MustCompile(`instagram\.com/(?:[^/]+/)?(?:p|reel|reels|tv)/([^/?#]+)/?`)
 	userRegexp  = regexp.MustCompile(`instagram\.com/([^/]+)/?`)
 )
 
 const (
 	KindUser = iota
 	KindStory
+	KindPost
 )
 
 func GenInstagramURL(usr string) (url string, err error) {
@@ -32,6 +35,7 @@ func IsInstragramURL(link string) bool {
 	return strings.Contains(link, "instagram.com")
 }
 
+// KindPost时返回的是帖子的shortcode
 func ParseInstagramURL(link string) (kind int, user string, err error) {
 	matchs := storyRegexp.FindStringSubmatch(link)
 	if len(matchs) == 2 {
@@ -40,12 +44,19 @@ func ParseInstagramURL(link string) (kind int, user string, err error) {
 		return
 	}
 
+	if code, e := ParseInstagramPostCode(link); e == nil {
+		user = code
+		kind = KindPost
+		return
+	}
+
 	matchs = userRegexp.FindStringSubmatch(link)
 	if len(matchs) == 2 {
 		user = matchs[1]
 		kind = KindUser
 	}
-	if user == "p" {
+	switch user {
+	case "p", "reel", "reels", "tv", "stories":
 		user = ""
 	}
 	if user == "" {
@@ -53,3 +64,32 @@ func ParseInstagramURL(link string) (kind int, user string, err error) {
 	}
 	return
 }
+
+// - https://www.instagram.com/p/C6q-Xv1Lx2a/
+// - https://www.instagram.com/reel/C6q-Xv1Lx2a/
+// - https://www.instagram.com/username/p/C6q-Xv1Lx2a/
+func ParseInstagramPostCode(link string) (code string, err error) {
+	matchs := postRegexp.FindStringSubmatch(link)
+	if len(matchs) == 2 {
+		code = matchs[1]
+	}
+	if code == "" {
+		err = errors.New("invalid Instagram post URL")
+	}
+	return
+}
+
+const postCodeAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+// InstagramPostCode 把帖子的pk(或 pk_用户id 形式的媒体id)转换为链接中的shortcode
+func InstagramPostCode(pk string) (code string, err error) {
+	pk, _, _ = strings.Cut(pk, "_")
+	n, err := strconv.ParseUint(pk, 10, 64)
+	if err != nil || n == 0 {
+		return "", errors.New("invalid Instagram media pk")
+	}
+	for ; n > 0; n /= 64 {
+		code = string(postCodeAlphabet[n%64]) + code
+	}
+	return
+}
@@ -1,40 +1,23 @@
 package ies
 
 import (
+	"context"
 	"time"
 )
 
-type cacheInfo struct {
-	timeStamp time.Time
-	rootInfo  *MediaEntry
-	rootToken *RootToken
-	url       string
-}
-
 type middleInfoExtractor struct {
-	ie    InfoExtractor
-	cache []cacheInfo
+	ie InfoExtractor
 }
 
-func (m *middleInfoExtractor) ParseRoot(link string, options ...ParseOptions) (*MediaEntry, *RootToken, error) {
-	if len(m.cache) > 10 {
-		m.cache = make([]cacheInfo, 0)
-	}
-
-	for _, cache := range m.cache {
-		if cache.url == link && time.Since(cache.timeStamp) < time.Minute*30 {
-			return cache.rootInfo, cache.rootToken, nil
-		}
+// ParseRoot 结果缓存在_rootCache中，返回的是副本，调用者可以修改
+func (m *middleInfoExtractor) ParseRoot(ctx context.Context, link string, options ...ParseOptions) (*MediaEntry, *RootToken, error) {
+	if rootInfo, rootToken, ok := _rootCache.get(m.ie, link); ok {
+		return rootInfo, rootToken, nil
 	}
 
-	rootInfo, rootToken, err := m.ie.ParseRoot(link, options...)
-	if err == nil {
-		m.cache = append(m.cache, cacheInfo{
-			timeStamp: time.Now(),
-			rootInfo:  rootInfo,
-			rootToken: rootToken,
-			url:       link,
-		})
+	rootInfo, rootToken, err := m.ie.ParseRoot(ctx, link, options...)
+	if err == nil && rootInfo != nil && rootToken != nil {
+		_rootCache.put(m.ie, link, rootInfo, rootToken)
 	}
 	return rootInfo, rootToken, err
 }
@@ -48,8 +31,8 @@ func (m *middleInfoExtractor) ConvertToUserRoot(rootToken *RootToken, rootInfo *
 	return m.ie.ConvertToUserRoot(rootToken, rootInfo)
 }
 
-func (m *middleInfoExtractor) ExtractPage(root *RootToken, nextPage *NextPageToken) ([]*MediaEntry, error) {
-	entrys, err := m.ie.ExtractPage(root, nextPage)
+func (m *middleInfoExtractor) ExtractPage(ctx context.Context, root *RootToken, nextPage *NextPageToken) ([]*MediaEntry, error) {
+	entrys, err := m.ie.ExtractPage(ctx, root, nextPage)
 	if err == nil {
 		for _, entry := range entrys {
 			sortEntryFormats(entry)
@@ -58,8 +41,8 @@ func (m *middleInfoExtractor) ExtractPage(root *RootToken, nextPage *NextPageTok
 	return entrys, err
 }
 
-func (m *middleInfoExtractor) ExtractAllAfterTime(parentMediaID string, afterTime time.Time, mustHasItem ...bool) ([]*MediaEntry, error) {
-	entrys, err := m.ie.ExtractAllAfterTime(parentMediaID, afterTime, mustHasItem...)
+func (m *middleInfoExtractor) ExtractAllAfterTime(ctx context.Context, parentMediaID string, afterTime time.Time, mustHasItem ...bool) ([]*MediaEntry, error) {
+	entrys, err := m.ie.ExtractAllAfterTime(ctx, parentMediaID, afterTime, mustHasItem...)
 	if err == nil {
 		for _, entry := range entrys {
 			sortEntryFormats(entry)
@@ -68,6 +51,14 @@ func (m *middleInfoExtractor) ExtractAllAfterTime(parentMediaID string, afterTim
 	return entrys, err
 }
 
+func (m *middleInfoExtractor) ParseMedia(ctx context.Context, link string) (*MediaEntry, error) {
+	entry, err := m.ie.ParseMedia(ctx, link)
+	if err == nil {
+		sortEntryFormats(entry)
+	}
+	return entry, err
+}
+
 func (m *middleInfoExtractor) IsMatched(url string) bool {
 	return m.ie.IsMatched(url)
 }
@@ -79,3 +70,33 @@ func (m *middleInfoExtractor) Name() string {
 func (m *middleInfoExtractor) Init() error {
 	return m.ie.Init()
 }
+
+func (m *middleInfoExtractor) ThumbnailCandidates(thumbnail string) []string {
+	if upgrader, ok := m.ie.(ThumbnailUpgrader); ok {
+		return upgrader.ThumbnailCandidates(thumbnail)
+	}
+	return nil
+}
+
+// ListSubtitles IE没有实现SubtitleLister时返回ErrSubtitleUnsupported
+func (m *middleInfoExtractor) ListSubtitles(ctx context.Context, link string) ([]*Subtitle, error) {
+	if lister, ok := m.ie.(SubtitleLister); ok {
+		return lister.ListSubtitles(ctx, link)
+	}
+	return nil, ErrSubtitleUnsupported
+}
+
+// FillDetails IE没有实现DetailFiller时列表中已经有详情，不需要补充
+func (m *middleInfoExtractor) FillDetails(ctx context.Context, entries []*MediaEntry) error {
+	if filler, ok := m.ie.(DetailFiller); ok {
+		return filler.FillDetails(ctx, entries)
+	}
+	return nil
+}
+
+func (m *middleInfoExtractor) AffordUpdate() (bool, time.Time) {
+	if limiter, ok := m.ie.(QuotaLimiter); ok {
+		return limiter.AffordUpdate()
+	}
+	return true, time.Time{}
+}
@@ -3,6 +3,8 @@ package ies
 import (
 	"database/sql/driver"
 	"encoding/json"
+	"net/url"
+	"path"
 	"strings"
 	"time"
 )
@@ -13,11 +15,37 @@ const (
 	FormatTypeAudio
 )
 
+const (
+	FormatProtocolHTTP = ""
+	FormatProtocolHLS  = "m3u8"
+	FormatProtocolDASH = "dash"
+)
+
 type Format struct {
 	Width      int64
 	Height     int64
 	URL        string
 	FormatType int
+	// URL指向的是单个文件还是HLS/DASH清单
+	Protocol string `json:",omitempty"`
+}
+
+// ManifestProtocol 没有指定Protocol时根据URL的扩展名判断
+func (f *Format) ManifestProtocol() string {
+	if f.Protocol != "" {
+		return f.Protocol
+	}
+	info, err := url.Parse(f.URL)
+	if err != nil {
+		return FormatProtocolHTTP
+	}
+	switch strings.ToLower(path.Ext(info.Path)) {
+	case ".m3u8":
+		return FormatProtocolHLS
+	case ".mpd":
+		return FormatProtocolDASH
+	}
+	return FormatProtocolHTTP
 }
 
 const (
@@ -47,6 +75,24 @@ func IsMatchedMediaType(entry *MediaEntry, hopeMediaType string) bool {
 	return true
 }
 
+const (
+	SubtitleFormatSRT  = "srt"
+	SubtitleFormatVTT  = "vtt"
+	SubtitleFormatTTML = "ttml"
+)
+
+// Subtitle 字幕轨道
+type Subtitle struct {
+	// BCP-47语言代码，如 en、zh-Hans
+	Language string
+	Name     string
+	// 是否是自动生成(语音识别)的字幕
+	IsAutoGenerated bool `json:",omitempty"`
+	URL             string
+	// URL返回的字幕格式，srt/vtt/ttml
+	Format string
+}
+
 type MediaEntry struct {
 	MediaType int
 	MediaID   string
@@ -57,13 +103,18 @@ type MediaEntry struct {
 	Thumbnail   string
 	URL         string
 	Duration    int64
-	UploadDate  time.Time
-	Uploader    string
-	Channel     string
-	Email       string
-	Formats     []*Format
-	EntryCount  int64
-	Entries     []*MediaEntry
+	// 短视频，如youtube shorts、instagram reels
+	IsShort    bool
+	UploadDate time.Time
+	// 上传者的名称，instagram是用户名
+	Uploader string
+	// 上传者在IE中的唯一ID，youtube是频道ID，instagram是用户的pk
+	Channel    string
+	Email      string
+	Formats    []*Format
+	Subtitles  []*Subtitle
+	EntryCount int64
+	Entries    []*MediaEntry
 
 	Reserve any
 }
@@ -105,3 +156,23 @@ func (f *FormatList) Scan(value interface{}) error {
 	}
 	return json.Unmarshal(data, f)
 }
+
+type SubtitleList []*Subtitle
+
+func (s SubtitleList) Value() (driver.Value, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(s)
+}
+
+func (s *SubtitleList) Scan(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	data, ok := value.([]byte)
+	if !ok || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, s)
+}
@@ -0,0 +1,27 @@
+package ies
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrQuotaExceeded API的每日配额不足，调用被拒绝或者API返回了配额用尽
+var ErrQuotaExceeded = errors.New("api quota exceeded")
+
+// QuotaLimiter IE可选实现，API有每日配额时，调度器更新feed之前询问配额是否足够
+type QuotaLimiter interface {
+	// AffordUpdate 配额不足时返回false和配额重置的时间
+	AffordUpdate() (bool, time.Time)
+}
+
+// AffordUpdate 是否有足够的配额更新一个feed，IE没有配额限制时总是true，hints同GetIE
+func AffordUpdate(hints ...string) (bool, time.Time) {
+	ie, err := GetIE(hints...)
+	if err != nil {
+		return true, time.Time{}
+	}
+	if limiter, ok := ie.(QuotaLimiter); ok {
+		return limiter.AffordUpdate()
+	}
+	return true, time.Time{}
+}
@@ -15,10 +15,11 @@ const (
 	KindChannel       = "channel"
 	KindPlaylist      = "playlist"
 	KindPlaylistGroup = "playlist_group"
+	KindVideo         = "video"
 )
 
 func IsYoutubeURL(link string) bool {
-	return strings.Contains(link, "youtube.com")
+	return strings.Contains(link, "youtube.com") || strings.Contains(link, "youtu.be")
 }
 
 func GenYoutubeURL(channle, usr, playlist string) (url string, err error) {
@@ -49,6 +50,19 @@ func ParseYoutubeURL(link string) (kind, id string, err error) {
 
 	path := parsed.EscapedPath()
 
+	// https://www.youtube.com/watch?v=rbCbho7aLYw
+	// https://youtu.be/rbCbho7aLYw
+	if (strings.HasPrefix(path, "/watch") && parsed.Query().Get("list") == "") ||
+		strings.Contains(parsed.Host, "youtu.be") ||
+		strings.HasPrefix(path, "/shorts/") {
+		id, err = ParseYoutubeVideoID(parsed.String())
+		if err != nil {
+			return
+		}
+		kind = KindVideo
+		return
+	}
+
 	// https://www.youtube.com/playlist?list=PLCB9F975ECF01953C
 	// https://www.youtube.com/watch?v=rbCbho7aLYw&list=PLMpEfaKcGjpWEgNtdnsvLX6LzQL0UC0EM
 	if strings.HasPrefix(path, "/playlist") || strings.HasPrefix(path, "/watch") {
@@ -98,6 +112,42 @@ func ParseYoutubeURL(link string) (kind, id string, err error) {
 	return
 }
 
+/*
+ParseYoutubeVideoID 解析视频链接中的视频id
+- https://www.youtube.com/watch?v=rbCbho7aLYw
+- https://youtu.be/rbCbho7aLYw
+- https://www.youtube.com/shorts/rbCbho7aLYw
+- https://www.youtube.com/live/rbCbho7aLYw
+- https://www.youtube.com/embed/rbCbho7aLYw
+*/
+func ParseYoutubeVideoID(link string) (id string, err error) {
+	if !strings.HasPrefix(link, "http") {
+		link = "https://" + link
+	}
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return
+	}
+	path := parsed.EscapedPath()
+	switch {
+	case strings.Contains(parsed.Host, "youtu.be"):
+		id = strings.Trim(path, "/")
+	case strings.HasPrefix(path, "/watch"):
+		id = parsed.Query().Get("v")
+	default:
+		for _, prefix := range []string{"/shorts/", "/live/", "/embed/", "/v/"} {
+			if strings.HasPrefix(path, prefix) {
+				id, _, _ = strings.Cut(strings.TrimPrefix(path, prefix), "/")
+				break
+			}
+		}
+	}
+	if id == "" {
+		err = errors.New("invalid youtube video link")
+	}
+	return
+}
+
 var (
 	channelRegexp           = regexp.MustCompile(`href="https://www.youtube.com/channel/([^"]+)"`)
 	externalChannelIdRegexp = regexp.MustCompile(`"externalChannelId":"([^"]+)"`)
@@ -125,3 +175,26 @@ func ParseWebpageChannelID(u string) (string, error) {
 	}
 	return "", errors.New("failed to parse channel id")
 }
+
+var ytimgRegexp = regexp.MustCompile(`^https?://i\d*\.ytimg\.com/vi(?:_webp)?/([^/]+)/([a-z0-9_]+)\.(?:jpg|webp)`)
+
+// 缩略图从高到低的分辨率
+var ytimgSizes = []string{"maxresdefault", "sddefault", "hqdefault", "mqdefault", "default"}
+
+// YoutubeThumbnailCandidates 返回比thumbnail分辨率更高的缩略图地址
+func YoutubeThumbnailCandidates(thumbnail string) []string {
+	matchs := ytimgRegexp.FindStringSubmatch(thumbnail)
+	if len(matchs) != 3 {
+		return nil
+	}
+	id, name := matchs[1], matchs[2]
+	candidates := make([]string, 0)
+	for _, size := range ytimgSizes {
+		if size == name {
+			return candidates
+		}
+		candidates = append(candidates, "https://i.ytimg.com/vi/"+id+"/"+size+".jpg")
+	}
+	//hq720等不在列表中的只尝试最高分辨率
+	return candidates[:1]
+}
@@ -1,8 +1,9 @@
 package youtube
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
-	"strings"
 	"time"
 
 	"github.com/yinyajiang/yt-mnt/pkg/ies"
@@ -40,11 +41,15 @@ func (y *YoutubeIE) Init() error {
 	return err
 }
 
+func (y *YoutubeIE) ThumbnailCandidates(thumbnail string) []string {
+	return YoutubeThumbnailCandidates(thumbnail)
+}
+
 func (y *YoutubeIE) IsMatched(link string) bool {
-	return strings.Contains(link, "youtube.com")
+	return IsYoutubeURL(link)
 }
 
-func (y *YoutubeIE) ParseRoot(link string, _ ...ies.ParseOptions) (*ies.MediaEntry, *ies.RootToken, error) {
+func (y *YoutubeIE) ParseRoot(ctx context.Context, link string, _ ...ies.ParseOptions) (*ies.MediaEntry, *ies.RootToken, error) {
 	linkkind, linkid, err := ParseYoutubeURL(link)
 	if err != nil {
 		return nil, nil, err
@@ -53,27 +58,29 @@ func (y *YoutubeIE) ParseRoot(link string, _ ...ies.ParseOptions) (*ies.MediaEnt
 	var entry *ies.MediaEntry
 	switch linkkind {
 	case KindChannel:
-		entry, err = y.client.Channel(linkid)
+		entry, err = y.client.Channel(ctx, linkid)
 		if err == nil {
 			entry.MediaType = ies.MediaTypeUser
 		}
 	case KindPlaylist:
-		entry, err = y.client.Playlist(linkid)
+		entry, err = y.client.Playlist(ctx, linkid)
 		if err == nil {
 			entry.MediaType = ies.MediaTypePlaylist
 		}
 	case KindPlaylistGroup:
-		entry, err = y.client.Channel(linkid)
+		entry, err = y.client.Channel(ctx, linkid)
 		if err == nil {
 			reserve := YoutubeReserve{
 				VideosCount: entry.EntryCount,
 			}
 			entry.EntryCount = 0
 			entry.MediaType = ies.MediaTypePlaylistGroup
-			entry.EntryCount, _ = y.client.ChannelsPlaylistCount(linkid)
+			entry.EntryCount, _ = y.client.ChannelsPlaylistCount(ctx, linkid)
 			reserve.PlaylistsCount = entry.EntryCount
 			entry.Reserve = reserve
 		}
+	case KindVideo:
+		return nil, nil, errors.New("youtube video is not a root, use ParseMedia instead")
 	default:
 		return nil, nil, errors.New("unsupported url type")
 	}
@@ -87,6 +94,20 @@ func (y *YoutubeIE) ParseRoot(link string, _ ...ies.ParseOptions) (*ies.MediaEnt
 	}, nil
 }
 
+// AffordUpdate 自动更新按低优先级计算，剩余配额留给手动浏览
+func (y *YoutubeIE) AffordUpdate() (bool, time.Time) {
+	if ytbapi.CanAfford(ytbapi.UpdateCost, ytbapi.PriorityLow) {
+		return true, time.Time{}
+	}
+	return false, ytbapi.GetQuotaUsage().ResetAt
+}
+
+func (y *YoutubeIE) DecodeReserve(data []byte) (any, error) {
+	var reserve YoutubeReserve
+	err := json.Unmarshal(data, &reserve)
+	return reserve, err
+}
+
 func (y *YoutubeIE) ConvertToUserRoot(rootToken *ies.RootToken, rootInfo *ies.MediaEntry) error {
 	if rootInfo == nil {
 		return errors.New("invalid root or rootInfo")
@@ -106,19 +127,43 @@ func (y *YoutubeIE) ConvertToUserRoot(rootToken *ies.RootToken, rootInfo *ies.Me
 	return errors.New("unsupported media type for convert to user root")
 }
 
-func (y *YoutubeIE) ExtractPage(root *ies.RootToken, nextPage *ies.NextPageToken) ([]*ies.MediaEntry, error) {
+func (y *YoutubeIE) ExtractPage(ctx context.Context, root *ies.RootToken, nextPage *ies.NextPageToken) ([]*ies.MediaEntry, error) {
 	switch root.MediaType {
 	case ies.MediaTypePlaylistGroup:
-		return y.client.ChannelsPlaylistWithPage(root.LinkID, nextPage)
+		return y.client.ChannelsPlaylistWithPage(ctx, root.LinkID, nextPage)
 	case ies.MediaTypePlaylist, ies.MediaTypeUser:
-		return y.client.PlaylistsVideoWithPage(root.MediaID, nextPage)
+		return y.client.PlaylistsVideoWithPage(ctx, root.MediaID, nextPage)
 	}
 	return nil, errors.New("unsupported media type")
 }
 
-func (y *YoutubeIE) ExtractAllAfterTime(paretnMediaID string, afterTime time.Time, mustHasItem ...bool) ([]*ies.MediaEntry, error) {
-	return ies.HelperGetSubItemsByTime(paretnMediaID,
-		func(mediaID string, nextPage *ies.NextPageToken) ([]*ies.MediaEntry, error) {
-			return y.client.PlaylistsVideoWithPage(mediaID, nextPage)
-		}, afterTime, mustHasItem...)
+func (y *YoutubeIE) ExtractAllAfterTime(ctx context.Context, paretnMediaID string, afterTime time.Time, mustHasItem ...bool) ([]*ies.MediaEntry, error) {
+	return ies.HelperGetSubItemsByTime(ctx, paretnMediaID, y.client.PlaylistsVideoWithPage, afterTime, mustHasItem...)
+}
+
+// FillDetails 列表中的视频没有时长，过滤规则需要时长或者shorts时调用
+func (y *YoutubeIE) FillDetails(ctx context.Context, entries []*ies.MediaEntry) error {
+	return y.client.FillVideoDetails(ctx, entries)
+}
+
+/*
+ParseMedia data api不提供视频流地址，返回的媒体信息中没有格式
+下载youtube需要注册支持youtube且不需要格式(IsNeedFormat()==false)的下载器，direct下载器不能下载
+只注册了direct下载器时，Monitor.AddMediaURL在解析前返回downloader.ErrNoDownloader
+*/
+func (y *YoutubeIE) ParseMedia(ctx context.Context, link string) (*ies.MediaEntry, error) {
+	id, err := ParseYoutubeVideoID(link)
+	if err != nil {
+		return nil, err
+	}
+	return y.client.Video(ctx, id)
+}
+
+// ListSubtitles captions.list每次消耗50配额，只在需要下载字幕时调用，接近保留配额时返回ies.ErrQuotaExceeded
+func (y *YoutubeIE) ListSubtitles(ctx context.Context, link string) ([]*ies.Subtitle, error) {
+	id, err := ParseYoutubeVideoID(link)
+	if err != nil {
+		return nil, err
+	}
+	return y.client.Captions(ctx, id)
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/yinyajiang/yt-mnt/pkg/ies"
 
@@ -54,11 +55,13 @@ func New(apiKey string) (*Client, error) {
 	return c, nil
 }
 
-func (c *Client) Channel(chnnelID string) (*ies.MediaEntry, error) {
+func (c *Client) Channel(ctx context.Context, chnnelID string) (*ies.MediaEntry, error) {
 	var channelPart = []string{"snippet", "contentDetails", "statistics"}
 	call := c.service.Channels.List(channelPart)
 	call = call.Id(chnnelID)
-	response, err := call.Do()
+	response, err := doCall(ctx, CallChannels, PriorityNormal, func(ctx context.Context) (*youtube.ChannelListResponse, error) {
+		return call.Context(ctx).Do()
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -87,10 +90,86 @@ func (c *Client) Channel(chnnelID string) (*ies.MediaEntry, error) {
 	return ret, nil
 }
 
-func (c *Client) PlaylistsVideoCount(playlistID string) (int64, error) {
+func (c *Client) Video(ctx context.Context, videoID string) (*ies.MediaEntry, error) {
+	var videoPart = []string{"snippet", "contentDetails"}
+	call := c.service.Videos.List(videoPart)
+	call = call.Id(videoID)
+	response, err := doCall(ctx, CallVideos, PriorityNormal, func(ctx context.Context) (*youtube.VideoListResponse, error) {
+		return call.Context(ctx).Do()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Items) == 0 {
+		return nil, errors.New("no video found")
+	}
+	item := response.Items[0]
+	ret := &ies.MediaEntry{
+		URL:       "https://www.youtube.com/watch?v=" + videoID,
+		MediaID:   videoID,
+		MediaType: ies.MediaTypeVideo,
+	}
+	if item.Snippet != nil {
+		ret.Title = item.Snippet.Title
+		ret.Description = item.Snippet.Description
+		ret.Uploader = item.Snippet.ChannelTitle
+		ret.Channel = item.Snippet.ChannelId
+		ret.UploadDate, _ = parseDate(item.Snippet.PublishedAt)
+		if item.Snippet.Thumbnails != nil && item.Snippet.Thumbnails.Default != nil {
+			ret.Thumbnail = item.Snippet.Thumbnails.Default.Url
+		}
+	}
+	if item.ContentDetails != nil {
+		ret.Duration = parseDuration(item.ContentDetails.Duration)
+		ret.IsShort = isShortDuration(ret.Duration)
+	}
+	return ret, nil
+}
+
+/*
+FillVideoDetails 列表接口不返回时长，批量查询视频补充时长，每50个视频消耗1配额
+data api没有shorts标记，按时长判断
+*/
+func (c *Client) FillVideoDetails(ctx context.Context, videos []*ies.MediaEntry) error {
+	byID := make(map[string]*ies.MediaEntry, len(videos))
+	ids := make([]string, 0, len(videos))
+	for _, video := range videos {
+		if video.MediaID != "" && video.Duration == 0 {
+			byID[video.MediaID] = video
+			ids = append(ids, video.MediaID)
+		}
+	}
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > 50 {
+			n = 50
+		}
+		call := c.service.Videos.List([]string{"contentDetails"}).Id(ids[:n]...).MaxResults(int64(n))
+		response, err := doCall(ctx, CallVideos, PriorityLow, func(ctx context.Context) (*youtube.VideoListResponse, error) {
+			return call.Context(ctx).Do()
+		})
+		if err != nil {
+			return err
+		}
+		for _, item := range response.Items {
+			video, ok := byID[item.Id]
+			if !ok || item.ContentDetails == nil {
+				continue
+			}
+			video.Duration = parseDuration(item.ContentDetails.Duration)
+			video.IsShort = isShortDuration(video.Duration)
+		}
+		ids = ids[n:]
+	}
+	return nil
+}
+
+func (c *Client) PlaylistsVideoCount(ctx context.Context, playlistID string) (int64, error) {
 	call := c.service.Playlists.List([]string{"contentDetails"})
 	call = call.Id(playlistID)
-	response, err := call.Do()
+	response, err := doCall(ctx, CallPlaylists, PriorityLow, func(ctx context.Context) (*youtube.PlaylistListResponse, error) {
+		return call.Context(ctx).Do()
+	})
 	if err != nil {
 		return 0, err
 	}
@@ -100,11 +179,13 @@ func (c *Client) PlaylistsVideoCount(playlistID string) (int64, error) {
 	return response.Items[0].ContentDetails.ItemCount, nil
 }
 
-func (c *Client) Playlist(playlistID string) (*ies.MediaEntry, error) {
+func (c *Client) Playlist(ctx context.Context, playlistID string) (*ies.MediaEntry, error) {
 	var playlistPart = []string{"snippet", "contentDetails"}
 	call := c.service.Playlists.List(playlistPart)
 	call = call.Id(playlistID)
-	response, err := call.Do()
+	response, err := doCall(ctx, CallPlaylists, PriorityNormal, func(ctx context.Context) (*youtube.PlaylistListResponse, error) {
+		return call.Context(ctx).Do()
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -130,16 +211,13 @@ func (c *Client) Playlist(playlistID string) (*ies.MediaEntry, error) {
 	return ret, nil
 }
 
-func (c *Client) PlaylistsVideo(playlistID string, latestCount ...int64) ([]*ies.MediaEntry, error) {
-	return ies.HelperGetSubItems(playlistID,
-		func(playlistQueryID string, nextPage *ies.NextPageToken) ([]*ies.MediaEntry, error) {
-			return c.PlaylistsVideoWithPage(playlistQueryID, nextPage)
-		}, latestCount...)
+func (c *Client) PlaylistsVideo(ctx context.Context, playlistID string, latestCount ...int64) ([]*ies.MediaEntry, error) {
+	return ies.HelperGetSubItems(ctx, playlistID, c.PlaylistsVideoWithPage, latestCount...)
 }
 
-func (c *Client) PlaylistsVideoWithPage(playlistID string, nextPage *ies.NextPageToken) ([]*ies.MediaEntry, error) {
+func (c *Client) PlaylistsVideoWithPage(ctx context.Context, playlistID string, nextPage *ies.NextPageToken) ([]*ies.MediaEntry, error) {
 	if nextPage == nil {
-		return c.PlaylistsVideo(playlistID, -1)
+		return c.PlaylistsVideo(ctx, playlistID, -1)
 	}
 	if nextPage.IsEnd {
 		return nil, nil
@@ -154,7 +232,9 @@ func (c *Client) PlaylistsVideoWithPage(playlistID string, nextPage *ies.NextPag
 	if nextPage.NextPageID != "" {
 		call = call.PageToken(nextPage.NextPageID)
 	}
-	response, err := call.Do()
+	response, err := doCall(ctx, CallPlaylistItems, PriorityNormal, func(ctx context.Context) (*youtube.PlaylistItemListResponse, error) {
+		return call.Context(ctx).Do()
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -188,17 +268,16 @@ func (c *Client) PlaylistsVideoWithPage(playlistID string, nextPage *ies.NextPag
 	return ret, nil
 }
 
-func (c *Client) ChannelsPlaylist(chnnelID string) ([]*ies.MediaEntry, error) {
-	return ies.HelperGetSubItems(chnnelID,
-		func(chnnelID string, nextPage *ies.NextPageToken) ([]*ies.MediaEntry, error) {
-			return c.ChannelsPlaylistWithPage(chnnelID, nextPage)
-		})
+func (c *Client) ChannelsPlaylist(ctx context.Context, chnnelID string) ([]*ies.MediaEntry, error) {
+	return ies.HelperGetSubItems(ctx, chnnelID, c.ChannelsPlaylistWithPage)
 }
 
-func (c *Client) ChannelsPlaylistCount(chnnelID string) (int64, error) {
+func (c *Client) ChannelsPlaylistCount(ctx context.Context, chnnelID string) (int64, error) {
 	var channelsPlaylistPart = []string{"id", "snippet", "contentDetails"}
 	call := c.service.Playlists.List(channelsPlaylistPart).ChannelId(chnnelID).MaxResults(1)
-	response, err := call.Do()
+	response, err := doCall(ctx, CallPlaylists, PriorityLow, func(ctx context.Context) (*youtube.PlaylistListResponse, error) {
+		return call.Context(ctx).Do()
+	})
 	if err != nil {
 		return 0, err
 	}
@@ -209,9 +288,9 @@ func (c *Client) ChannelsPlaylistCount(chnnelID string) (int64, error) {
 	return count, nil
 }
 
-func (c *Client) ChannelsPlaylistWithPage(chnnelID string, nextPage *ies.NextPageToken) ([]*ies.MediaEntry, error) {
+func (c *Client) ChannelsPlaylistWithPage(ctx context.Context, chnnelID string, nextPage *ies.NextPageToken) ([]*ies.MediaEntry, error) {
 	if nextPage == nil {
-		return c.ChannelsPlaylist(chnnelID)
+		return c.ChannelsPlaylist(ctx, chnnelID)
 	}
 	if nextPage.IsEnd {
 		return nil, nil
@@ -225,7 +304,9 @@ func (c *Client) ChannelsPlaylistWithPage(chnnelID string, nextPage *ies.NextPag
 	if nextPage.NextPageID != "" {
 		call = call.PageToken(nextPage.NextPageID)
 	}
-	response, err := call.Do()
+	response, err := doCall(ctx, CallPlaylists, PriorityNormal, func(ctx context.Context) (*youtube.PlaylistListResponse, error) {
+		return call.Context(ctx).Do()
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -256,3 +337,42 @@ func (c *Client) ChannelsPlaylistWithPage(chnnelID string, nextPage *ies.NextPag
 	}
 	return ret, nil
 }
+
+/*
+Captions 返回视频的字幕轨道，包括自动生成的字幕(IsAutoGenerated)
+data api的下载接口需要OAuth，这里返回公开的timedtext地址，自动生成的字幕带上kind=asr
+每次消耗50配额，按低优先级调用，不占用保留给手动操作的配额
+*/
+func (c *Client) Captions(ctx context.Context, videoID string) ([]*ies.Subtitle, error) {
+	call := c.service.Captions.List([]string{"snippet"}, videoID)
+	response, err := doCall(ctx, CallCaptions, PriorityLow, func(ctx context.Context) (*youtube.CaptionListResponse, error) {
+		return call.Context(ctx).Do()
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*ies.Subtitle, 0, len(response.Items))
+	for _, item := range response.Items {
+		if item.Snippet == nil || item.Snippet.Language == "" || item.Snippet.Status == "failed" {
+			continue
+		}
+		asr := strings.EqualFold(item.Snippet.TrackKind, "asr")
+		query := url.Values{}
+		query.Set("v", videoID)
+		query.Set("lang", item.Snippet.Language)
+		query.Set("fmt", ies.SubtitleFormatVTT)
+		if asr {
+			query.Set("kind", "asr")
+		} else if item.Snippet.Name != "" {
+			query.Set("name", item.Snippet.Name)
+		}
+		ret = append(ret, &ies.Subtitle{
+			Language:        item.Snippet.Language,
+			Name:            item.Snippet.Name,
+			IsAutoGenerated: asr,
+			URL:             "https://www.youtube.com/api/timedtext?" + query.Encode(),
+			Format:          ies.SubtitleFormatVTT,
+		})
+	}
+	return ret, nil
+}
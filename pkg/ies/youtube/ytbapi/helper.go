@@ -1,6 +1,8 @@
 package ytbapi
 
 import (
+	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/pkg/errors"
@@ -13,3 +15,33 @@ func parseDate(s string) (time.Time, error) {
 	}
 	return date, nil
 }
+
+var durationRegexp = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// parseDuration 解析ISO 8601格式的时长，如PT1H2M3S，返回秒数
+func parseDuration(s string) int64 {
+	matchs := durationRegexp.FindStringSubmatch(s)
+	if len(matchs) != 5 {
+		return 0
+	}
+	var seconds int64
+	for i, unit := range []int64{24 * 3600, 3600, 60, 1} {
+		if matchs[i+1] == "" {
+			continue
+		}
+		n, _ := strconv.ParseInt(matchs[i+1], 10, 64)
+		seconds += n * unit
+	}
+	return seconds
+}
+
+// shorts最长3分钟
+const shortsMaxDuration = 180
+
+/*
+isShortDuration data api没有shorts标记，只能按时长推测：不超过3分钟的视频都当作shorts，
+普通的短视频也会被判断为shorts；时长未知(0)时返回false
+*/
+func isShortDuration(seconds int64) bool {
+	return seconds > 0 && seconds <= shortsMaxDuration
+}
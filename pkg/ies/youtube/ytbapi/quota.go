@@ -0,0 +1,263 @@
+package ytbapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/yinyajiang/yt-mnt/pkg/ies"
+	"google.golang.org/api/googleapi"
+)
+
+// 调用的名称，与配额文档中的方法名一致
+const (
+	CallChannels      = "channels.list"
+	CallPlaylists     = "playlists.list"
+	CallPlaylistItems = "playlistItems.list"
+	CallVideos        = "videos.list"
+	CallCaptions      = "captions.list"
+)
+
+// 每次调用消耗的单位，见 https://developers.google.com/youtube/v3/determine_quota_cost
+var callCosts = map[string]int64{
+	CallChannels:      1,
+	CallPlaylists:     1,
+	CallPlaylistItems: 1,
+	CallVideos:        1,
+	CallCaptions:      50,
+}
+
+const (
+	DefaultDailyQuota = 10000
+	//更新一页feed至少需要的单位，playlistItems.list和过滤规则需要时长时补充时长的videos.list
+	UpdateCost = 2
+)
+
+type Priority int
+
+const (
+	PriorityNormal Priority = iota
+	//可以省略或者推迟的调用，如播放列表组的数量、补充视频时长、自动更新feed
+	PriorityLow
+)
+
+// QuotaStore 按日期持久化已使用的配额，重启后继续计算
+type QuotaStore interface {
+	LoadQuotaUsage(day string) (map[string]int64, error)
+	AddQuotaUsage(day, call string, units int64) error
+}
+
+type QuotaOption struct {
+	//每日配额，<=0 使用默认值10000
+	DailyLimit int64
+	//剩余配额低于该值时拒绝低优先级的调用，留给浏览等手动操作，0 使用每日配额的10%，<0 不保留
+	LowReserve int64
+	//为空只在内存中计算，重启后从0开始
+	Store QuotaStore
+}
+
+type QuotaUsage struct {
+	//太平洋时间的日期，如 2006-01-02，配额在太平洋时间0点重置
+	Day       string
+	Limit     int64
+	Used      int64
+	Remaining int64
+	//按调用名称统计的单位
+	ByCall map[string]int64
+	//因配额不足拒绝的调用次数
+	Refused int64
+	//API返回了配额用尽，当天不再调用
+	Exhausted bool
+	ResetAt   time.Time
+}
+
+type quota struct {
+	lock      sync.Mutex
+	opt       QuotaOption
+	day       string
+	used      map[string]int64
+	total     int64
+	refused   int64
+	exhausted bool
+}
+
+var _quota = newQuota(QuotaOption{})
+
+var _pacific = func() *time.Location {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		//没有时区数据时按太平洋标准时间，夏令时期间重置时间早一个小时
+		return time.FixedZone("PST", -8*3600)
+	}
+	return loc
+}()
+
+func quotaDay(t time.Time) string {
+	return t.In(_pacific).Format("2006-01-02")
+}
+
+func quotaResetAt(t time.Time) time.Time {
+	t = t.In(_pacific)
+	return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, _pacific)
+}
+
+func newQuota(opt QuotaOption) *quota {
+	if opt.DailyLimit <= 0 {
+		opt.DailyLimit = DefaultDailyQuota
+	}
+	if opt.LowReserve == 0 {
+		opt.LowReserve = opt.DailyLimit / 10
+	}
+	if opt.LowReserve < 0 {
+		opt.LowReserve = 0
+	}
+	return &quota{
+		opt:  opt,
+		day:  quotaDay(time.Now()),
+		used: make(map[string]int64),
+	}
+}
+
+// SetQuotaOption 替换配额设置，有Store时读取当天已使用的配额
+func SetQuotaOption(opt QuotaOption) {
+	q := newQuota(opt)
+	if q.opt.Store != nil {
+		used, err := q.opt.Store.LoadQuotaUsage(q.day)
+		if err != nil {
+			log.Printf("load youtube quota usage fail: %s", err)
+		}
+		for call, units := range used {
+			q.used[call] = units
+			q.total += units
+		}
+	}
+	_quota.lock.Lock()
+	defer _quota.lock.Unlock()
+	_quota.opt = q.opt
+	_quota.day = q.day
+	_quota.used = q.used
+	_quota.total = q.total
+	_quota.refused = 0
+	_quota.exhausted = false
+}
+
+func GetQuotaUsage() QuotaUsage {
+	_quota.lock.Lock()
+	defer _quota.lock.Unlock()
+	now := time.Now()
+	_quota.rollover(now)
+	usage := QuotaUsage{
+		Day:       _quota.day,
+		Limit:     _quota.opt.DailyLimit,
+		Used:      _quota.total,
+		Remaining: _quota.remaining(),
+		ByCall:    make(map[string]int64, len(_quota.used)),
+		Refused:   _quota.refused,
+		Exhausted: _quota.exhausted,
+		ResetAt:   quotaResetAt(now),
+	}
+	for call, units := range _quota.used {
+		usage.ByCall[call] = units
+	}
+	return usage
+}
+
+// CanAfford 剩余配额是否足够units个单位的调用，不消耗配额
+func CanAfford(units int64, priority Priority) bool {
+	_quota.lock.Lock()
+	defer _quota.lock.Unlock()
+	_quota.rollover(time.Now())
+	return _quota.affordable(units, priority)
+}
+
+// rollover 太平洋时间过了0点后重新计算
+func (q *quota) rollover(now time.Time) {
+	if day := quotaDay(now); day != q.day {
+		q.day = day
+		q.used = make(map[string]int64)
+		q.total = 0
+		q.refused = 0
+		q.exhausted = false
+	}
+}
+
+func (q *quota) remaining() int64 {
+	if q.exhausted || q.total >= q.opt.DailyLimit {
+		return 0
+	}
+	return q.opt.DailyLimit - q.total
+}
+
+func (q *quota) affordable(units int64, priority Priority) bool {
+	remaining := q.remaining()
+	if priority == PriorityLow {
+		remaining -= q.opt.LowReserve
+	}
+	return remaining >= units
+}
+
+// spend 调用之前扣除配额，失败的请求同样消耗配额
+func (q *quota) spend(call string, priority Priority) error {
+	cost := callCosts[call]
+	q.lock.Lock()
+	q.rollover(time.Now())
+	if !q.affordable(cost, priority) {
+		q.refused++
+		remaining := q.remaining()
+		q.lock.Unlock()
+		return fmt.Errorf("%w: %s needs %d units, %d remaining", ies.ErrQuotaExceeded, call, cost, remaining)
+	}
+	q.used[call] += cost
+	q.total += cost
+	day, store := q.day, q.opt.Store
+	q.lock.Unlock()
+
+	if store != nil {
+		if err := store.AddQuotaUsage(day, call, cost); err != nil {
+			log.Printf("save youtube quota usage fail: %s", err)
+		}
+	}
+	return nil
+}
+
+func (q *quota) markExhausted() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.rollover(time.Now())
+	q.exhausted = true
+}
+
+// isQuotaError API返回的配额用尽错误，可能是同一个key的其他使用者消耗了配额
+func isQuotaError(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != 403 {
+		return false
+	}
+	for _, item := range apiErr.Errors {
+		switch item.Reason {
+		case "quotaExceeded", "dailyLimitExceeded":
+			return true
+		}
+	}
+	return false
+}
+
+// doCall 扣除配额后以ies.Call执行，配额不足时不发出请求
+func doCall[T any](ctx context.Context, call string, priority Priority, do func(ctx context.Context) (T, error)) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+	if err := _quota.spend(call, priority); err != nil {
+		return zero, err
+	}
+	ret, err := ies.Call(ctx, do)
+	if err != nil && isQuotaError(err) {
+		_quota.markExhausted()
+		err = fmt.Errorf("%w: %w", ies.ErrQuotaExceeded, err)
+	}
+	return ret, err
+}
@@ -0,0 +1,276 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var containerBoxes = map[string]bool{
+	"moov": true,
+	"trak": true,
+	"mdia": true,
+	"minf": true,
+	"stbl": true,
+	"edts": true,
+	"mvex": true,
+	"moof": true,
+	"traf": true,
+}
+
+type box struct {
+	typ string
+	// box头在文件中的偏移
+	start    int64
+	payload  []byte
+	children []*box
+}
+
+func (b *box) child(typ string) *box {
+	for _, c := range b.children {
+		if c.typ == typ {
+			return c
+		}
+	}
+	return nil
+}
+
+func (b *box) childrenOf(typ string) []*box {
+	ret := make([]*box, 0)
+	for _, c := range b.children {
+		if c.typ == typ {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// path 按路径查找子box，如 mdia/minf/stbl
+func (b *box) path(types ...string) *box {
+	cur := b
+	for _, typ := range types {
+		if cur = cur.child(typ); cur == nil {
+			return nil
+		}
+	}
+	return cur
+}
+
+// raw 返回包括box头在内的完整数据
+func (b *box) raw() []byte {
+	return makeBox(b.typ, b.payload)
+}
+
+func readBoxHeader(r io.ReaderAt, off, end int64) (typ string, size, hdrLen int64, err error) {
+	hdr := make([]byte, 16)
+	if _, err = r.ReadAt(hdr[:8], off); err != nil {
+		return
+	}
+	size = int64(binary.BigEndian.Uint32(hdr[0:4]))
+	typ = string(hdr[4:8])
+	hdrLen = 8
+	switch size {
+	case 0:
+		size = end - off
+	case 1:
+		if _, err = r.ReadAt(hdr[8:16], off+8); err != nil {
+			return
+		}
+		size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+		hdrLen = 16
+	}
+	if size < hdrLen || off+size > end {
+		err = fmt.Errorf("mp4: invalid box size: %s", typ)
+	}
+	return
+}
+
+func parseChildren(data []byte, base int64) ([]*box, error) {
+	boxes := make([]*box, 0)
+	for off := int64(0); off+8 <= int64(len(data)); {
+		size := int64(binary.BigEndian.Uint32(data[off : off+4]))
+		typ := string(data[off+4 : off+8])
+		hdrLen := int64(8)
+		switch size {
+		case 0:
+			size = int64(len(data)) - off
+		case 1:
+			if off+16 > int64(len(data)) {
+				return nil, errors.New("mp4: truncated box header")
+			}
+			size = int64(binary.BigEndian.Uint64(data[off+8 : off+16]))
+			hdrLen = 16
+		}
+		if size < hdrLen || off+size > int64(len(data)) {
+			return nil, fmt.Errorf("mp4: invalid box size: %s", typ)
+		}
+		b := &box{
+			typ:     typ,
+			start:   base + off,
+			payload: data[off+hdrLen : off+size],
+		}
+		if containerBoxes[typ] {
+			children, err := parseChildren(b.payload, base+off+hdrLen)
+			if err != nil {
+				return nil, err
+			}
+			b.children = children
+		}
+		boxes = append(boxes, b)
+		off += size
+	}
+	return boxes, nil
+}
+
+// readTopBoxes 读取文件的顶层box，moov和moof会完整读入并解析，mdat等只记录位置
+func readTopBoxes(r io.ReaderAt, fileSize int64) ([]*box, error) {
+	boxes := make([]*box, 0)
+	for off := int64(0); off+8 <= fileSize; {
+		typ, size, hdrLen, err := readBoxHeader(r, off, fileSize)
+		if err != nil {
+			return nil, err
+		}
+		b := &box{
+			typ:   typ,
+			start: off,
+		}
+		if typ == "moov" || typ == "moof" || typ == "ftyp" {
+			b.payload = make([]byte, size-hdrLen)
+			if _, err = r.ReadAt(b.payload, off+hdrLen); err != nil {
+				return nil, err
+			}
+			if containerBoxes[typ] {
+				if b.children, err = parseChildren(b.payload, off+hdrLen); err != nil {
+					return nil, err
+				}
+			}
+		}
+		boxes = append(boxes, b)
+		off += size
+	}
+	return boxes, nil
+}
+
+type reader struct {
+	data []byte
+	off  int
+	err  error
+}
+
+func newReader(data []byte) *reader {
+	return &reader{data: data}
+}
+
+func (r *reader) need(n int) bool {
+	if r.err != nil {
+		return false
+	}
+	if r.off+n > len(r.data) {
+		r.err = errors.New("mp4: truncated box")
+		return false
+	}
+	return true
+}
+
+func (r *reader) u8() uint8 {
+	if !r.need(1) {
+		return 0
+	}
+	v := r.data[r.off]
+	r.off++
+	return v
+}
+
+func (r *reader) u16() uint16 {
+	if !r.need(2) {
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.data[r.off:])
+	r.off += 2
+	return v
+}
+
+func (r *reader) u24() uint32 {
+	if !r.need(3) {
+		return 0
+	}
+	v := uint32(r.data[r.off])<<16 | uint32(r.data[r.off+1])<<8 | uint32(r.data[r.off+2])
+	r.off += 3
+	return v
+}
+
+func (r *reader) u32() uint32 {
+	if !r.need(4) {
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.data[r.off:])
+	r.off += 4
+	return v
+}
+
+func (r *reader) u64() uint64 {
+	if !r.need(8) {
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.data[r.off:])
+	r.off += 8
+	return v
+}
+
+func (r *reader) skip(n int) {
+	if r.need(n) {
+		r.off += n
+	}
+}
+
+// fullHeader 读取full box的version和flags
+func (r *reader) fullHeader() (version uint8, flags uint32) {
+	return r.u8(), r.u24()
+}
+
+type writer struct {
+	buf []byte
+}
+
+func (w *writer) u8(v uint8) *writer {
+	w.buf = append(w.buf, v)
+	return w
+}
+
+func (w *writer) u16(v uint16) *writer {
+	w.buf = binary.BigEndian.AppendUint16(w.buf, v)
+	return w
+}
+
+func (w *writer) u32(v uint32) *writer {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, v)
+	return w
+}
+
+func (w *writer) u64(v uint64) *writer {
+	w.buf = binary.BigEndian.AppendUint64(w.buf, v)
+	return w
+}
+
+func (w *writer) bytes(v []byte) *writer {
+	w.buf = append(w.buf, v...)
+	return w
+}
+
+func (w *writer) fullHeader(version uint8, flags uint32) *writer {
+	return w.u32(uint32(version)<<24 | flags&0xFFFFFF)
+}
+
+func makeBox(typ string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+	w := &writer{buf: make([]byte, 0, size)}
+	w.u32(uint32(size)).bytes([]byte(typ))
+	for _, p := range payloads {
+		w.bytes(p)
+	}
+	return w.buf
+}
@@ -0,0 +1,544 @@
+package mp4
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// ErrUnsupported 输入不是MP4或者编码不支持，调用者可以退回使用ffmpeg
+var ErrUnsupported = errors.New("mp4: unsupported input")
+
+const movieTimescale = 1000
+
+type Options struct {
+	// 输出分片MP4，默认输出moov前置的普通MP4
+	Fragmented bool
+	// 分片时长，<=0 使用默认值2s
+	FragmentDuration time.Duration
+}
+
+type Source struct {
+	Path string
+	// 选取的track类型，HandlerVideo/HandlerAudio，为空选取所有track
+	Handler string
+}
+
+// MergeAV 合并只有视频的MP4和只有音频的MP4，不重新编码
+func MergeAV(ctx context.Context, video, audio, output string, opt ...Options) error {
+	return Mux(ctx, output, []Source{
+		{Path: video, Handler: HandlerVideo},
+		{Path: audio, Handler: HandlerAudio},
+	}, opt...)
+}
+
+// Mux 从多个源文件中选取track封装到一个MP4
+func Mux(ctx context.Context, output string, sources []Source, opt ...Options) error {
+	var o Options
+	if len(opt) != 0 {
+		o = opt[0]
+	}
+	if o.FragmentDuration <= 0 {
+		o.FragmentDuration = 2 * time.Second
+	}
+
+	tracks := make([]*track, 0)
+	for _, source := range sources {
+		f, err := os.Open(source.Path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		all, err := readTracks(f, stat.Size())
+		if err != nil {
+			if errors.Is(err, ErrUnsupported) {
+				return fmt.Errorf("%w: %s", ErrUnsupported, source.Path)
+			}
+			return fmt.Errorf("%w: %s: %v", ErrUnsupported, source.Path, err)
+		}
+		found := false
+		for _, t := range all {
+			if source.Handler != "" && t.handler != source.Handler {
+				continue
+			}
+			if !supportedCodecs[t.codec] {
+				return fmt.Errorf("%w: codec %q in %s", ErrUnsupported, t.codec, source.Path)
+			}
+			if len(t.samples) == 0 {
+				return fmt.Errorf("mp4: track %d of %s has no samples", t.id, source.Path)
+			}
+			tracks = append(tracks, t)
+			found = true
+			if source.Handler != "" {
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: no %s track in %s", ErrUnsupported, source.Handler, source.Path)
+		}
+	}
+	if len(tracks) == 0 {
+		return fmt.Errorf("%w: no track", ErrUnsupported)
+	}
+
+	tmpPath := output + ".muxing"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(f, 1024*1024)
+	m := &muxer{
+		ctx:    ctx,
+		w:      w,
+		tracks: tracks,
+	}
+	if o.Fragmented {
+		err = m.writeFragmented(o.FragmentDuration.Seconds())
+	} else {
+		err = m.writeProgressive()
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, output)
+}
+
+type chunk struct {
+	track int
+	first int
+	count int
+	// 开始时间，秒
+	start      float64
+	decodeTime uint64
+	size       int64
+}
+
+type muxer struct {
+	ctx    context.Context
+	w      io.Writer
+	tracks []*track
+}
+
+/*
+planChunks 把每个track的样本按时长切成块，再按开始时间交错排列
+alignSync为true时视频块从关键帧开始，用于分片输出
+*/
+func (m *muxer) planChunks(maxDuration float64, alignSync bool) []*chunk {
+	chunks := make([]*chunk, 0)
+	for ti, t := range m.tracks {
+		var (
+			cur        *chunk
+			decodeTime uint64
+			curDur     uint64
+		)
+		limit := uint64(maxDuration * float64(t.timescale))
+		for i, s := range t.samples {
+			split := cur == nil || curDur >= limit
+			if split && cur != nil && alignSync && t.handler == HandlerVideo && !s.sync {
+				split = false
+			}
+			if split {
+				cur = &chunk{
+					track:      ti,
+					first:      i,
+					start:      float64(decodeTime) / float64(t.timescale),
+					decodeTime: decodeTime,
+				}
+				chunks = append(chunks, cur)
+				curDur = 0
+			}
+			cur.count++
+			cur.size += int64(s.size)
+			curDur += uint64(s.duration)
+			decodeTime += uint64(s.duration)
+		}
+	}
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].start < chunks[j].start
+	})
+	return chunks
+}
+
+func (m *muxer) copySamples(c *chunk) error {
+	if err := m.ctx.Err(); err != nil {
+		return err
+	}
+	t := m.tracks[c.track]
+	samples := t.samples[c.first : c.first+c.count]
+	//源文件中连续的样本一次复制
+	for i := 0; i < len(samples); {
+		start := samples[i].offset
+		end := start + int64(samples[i].size)
+		j := i + 1
+		for ; j < len(samples) && samples[j].offset == end; j++ {
+			end += int64(samples[j].size)
+		}
+		if _, err := io.Copy(m.w, io.NewSectionReader(t.src, start, end-start)); err != nil {
+			return err
+		}
+		i = j
+	}
+	return nil
+}
+
+func (m *muxer) movieDuration(t *track) uint64 {
+	return t.duration() * movieTimescale / uint64(t.timescale)
+}
+
+func (m *muxer) maxMovieDuration() uint64 {
+	var d uint64
+	for _, t := range m.tracks {
+		if td := m.movieDuration(t); td > d {
+			d = td
+		}
+	}
+	return d
+}
+
+func ftyp(fragmented bool) []byte {
+	w := &writer{}
+	if fragmented {
+		w.bytes([]byte("iso6")).u32(0)
+		w.bytes([]byte("iso6iso5avc1mp41"))
+	} else {
+		w.bytes([]byte("isom")).u32(0x200)
+		w.bytes([]byte("isomiso2avc1mp41"))
+	}
+	return makeBox("ftyp", w.buf)
+}
+
+func mvhd(duration uint64, nextTrackID uint32) []byte {
+	w := &writer{}
+	if duration > math.MaxUint32 {
+		w.fullHeader(1, 0).u64(0).u64(0).u32(movieTimescale).u64(duration)
+	} else {
+		w.fullHeader(0, 0).u32(0).u32(0).u32(movieTimescale).u32(uint32(duration))
+	}
+	w.u32(0x00010000).u16(0x0100).u16(0).u32(0).u32(0)
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		w.u32(v)
+	}
+	for i := 0; i < 6; i++ {
+		w.u32(0)
+	}
+	w.u32(nextTrackID)
+	return makeBox("mvhd", w.buf)
+}
+
+/*
+patchTimes 修改tkhd/mdhd的时长，时长超过32位时升级为version 1
+mid 是修改时间之后、时长之前的字节数，tkhd为8，mdhd为4
+*/
+func patchTimes(payload []byte, mid int, duration uint64) []byte {
+	p := append([]byte{}, payload...)
+	if len(p) < 12+mid+4 {
+		return p
+	}
+	if p[0] == 0 && duration > math.MaxUint32 {
+		r := newReader(p)
+		r.fullHeader()
+		ctime, mtime := r.u32(), r.u32()
+		w := &writer{}
+		w.u8(1).bytes(p[1:4]).u64(uint64(ctime)).u64(uint64(mtime))
+		w.bytes(p[12 : 12+mid]).u64(0).bytes(p[12+mid+4:])
+		p = w.buf
+	}
+	if p[0] == 1 {
+		if len(p) >= 20+mid+8 {
+			binary.BigEndian.PutUint64(p[20+mid:], duration)
+		}
+	} else {
+		binary.BigEndian.PutUint32(p[12+mid:], uint32(duration))
+	}
+	return p
+}
+
+func (m *muxer) tkhd(t *track, id uint32, duration uint64) []byte {
+	p := patchTimes(t.tkhd.payload, 8, duration)
+	//enabled|in_movie
+	p[1], p[2], p[3] = 0, 0, 3
+	if p[0] == 1 {
+		binary.BigEndian.PutUint32(p[20:], id)
+	} else {
+		binary.BigEndian.PutUint32(p[12:], id)
+	}
+	return makeBox("tkhd", p)
+}
+
+func (m *muxer) edts(t *track) []byte {
+	if len(t.edits) == 0 {
+		return nil
+	}
+	w := &writer{}
+	w.fullHeader(1, 0).u32(uint32(len(t.edits)))
+	for _, e := range t.edits {
+		segmentDuration := e.segmentDuration * movieTimescale / uint64(t.movieTimescale)
+		//分片文件的edit list时长常为0
+		if segmentDuration == 0 && len(t.edits) == 1 {
+			segmentDuration = m.movieDuration(t)
+		}
+		w.u64(segmentDuration).u64(uint64(e.mediaTime)).u16(uint16(e.rateInteger)).u16(uint16(e.rateFraction))
+	}
+	return makeBox("edts", makeBox("elst", w.buf))
+}
+
+func (m *muxer) minfHeader(t *track) []byte {
+	if t.mhd != nil {
+		return t.mhd.raw()
+	}
+	w := &writer{}
+	if t.handler == HandlerVideo {
+		w.fullHeader(0, 1).u64(0)
+		return makeBox("vmhd", w.buf)
+	}
+	w.fullHeader(0, 0).u32(0)
+	return makeBox("smhd", w.buf)
+}
+
+func (m *muxer) dinf(t *track) []byte {
+	if t.dinf != nil {
+		return t.dinf.raw()
+	}
+	url := (&writer{}).fullHeader(0, 1).buf
+	dref := (&writer{}).fullHeader(0, 0).u32(1).bytes(makeBox("url ", url)).buf
+	return makeBox("dinf", makeBox("dref", dref))
+}
+
+func (m *muxer) trak(t *track, id uint32, stbl []byte, duration, mediaDuration uint64) []byte {
+	minf := makeBox("minf", m.minfHeader(t), m.dinf(t), stbl)
+	mdia := makeBox("mdia", makeBox("mdhd", patchTimes(t.mdhd.payload, 4, mediaDuration)), t.hdlr.raw(), minf)
+	return makeBox("trak", m.tkhd(t, id, duration), m.edts(t), mdia)
+}
+
+// stbl 生成普通MP4的样本表，chunkOffsets是该track每个块在输出文件中的偏移
+func (m *muxer) stbl(t *track, chunks []*chunk, chunkOffsets []int64) []byte {
+	samples := t.samples
+
+	// stts
+	stts := &writer{}
+	var sttsEntries [][2]uint32
+	for _, s := range samples {
+		if n := len(sttsEntries); n > 0 && sttsEntries[n-1][1] == s.duration {
+			sttsEntries[n-1][0]++
+		} else {
+			sttsEntries = append(sttsEntries, [2]uint32{1, s.duration})
+		}
+	}
+	stts.fullHeader(0, 0).u32(uint32(len(sttsEntries)))
+	for _, e := range sttsEntries {
+		stts.u32(e[0]).u32(e[1])
+	}
+	boxes := [][]byte{t.stsd.raw(), makeBox("stts", stts.buf)}
+
+	// ctts
+	hasCTO, negativeCTO := false, false
+	for _, s := range samples {
+		hasCTO = hasCTO || s.cto != 0
+		negativeCTO = negativeCTO || s.cto < 0
+	}
+	if hasCTO {
+		var cttsEntries [][2]uint32
+		for _, s := range samples {
+			if n := len(cttsEntries); n > 0 && int32(cttsEntries[n-1][1]) == s.cto {
+				cttsEntries[n-1][0]++
+			} else {
+				cttsEntries = append(cttsEntries, [2]uint32{1, uint32(s.cto)})
+			}
+		}
+		ctts := &writer{}
+		version := uint8(0)
+		if negativeCTO {
+			version = 1
+		}
+		ctts.fullHeader(version, 0).u32(uint32(len(cttsEntries)))
+		for _, e := range cttsEntries {
+			ctts.u32(e[0]).u32(e[1])
+		}
+		boxes = append(boxes, makeBox("ctts", ctts.buf))
+	}
+
+	// stss
+	syncs := make([]uint32, 0)
+	for i, s := range samples {
+		if s.sync {
+			syncs = append(syncs, uint32(i+1))
+		}
+	}
+	if len(syncs) != len(samples) {
+		stss := &writer{}
+		stss.fullHeader(0, 0).u32(uint32(len(syncs)))
+		for _, n := range syncs {
+			stss.u32(n)
+		}
+		boxes = append(boxes, makeBox("stss", stss.buf))
+	}
+
+	// stsc
+	stsc := &writer{}
+	var stscEntries [][2]uint32
+	for i, c := range chunks {
+		if n := len(stscEntries); n > 0 && stscEntries[n-1][1] == uint32(c.count) {
+			continue
+		}
+		stscEntries = append(stscEntries, [2]uint32{uint32(i + 1), uint32(c.count)})
+	}
+	stsc.fullHeader(0, 0).u32(uint32(len(stscEntries)))
+	for _, e := range stscEntries {
+		stsc.u32(e[0]).u32(e[1]).u32(1)
+	}
+	boxes = append(boxes, makeBox("stsc", stsc.buf))
+
+	// stsz
+	stsz := &writer{}
+	fixedSize := samples[0].size
+	for _, s := range samples {
+		if s.size != fixedSize {
+			fixedSize = 0
+			break
+		}
+	}
+	stsz.fullHeader(0, 0).u32(fixedSize).u32(uint32(len(samples)))
+	if fixedSize == 0 {
+		for _, s := range samples {
+			stsz.u32(s.size)
+		}
+	}
+	boxes = append(boxes, makeBox("stsz", stsz.buf))
+
+	// co64，长度固定，方便先计算moov大小
+	co64 := &writer{}
+	co64.fullHeader(0, 0).u32(uint32(len(chunkOffsets)))
+	for _, off := range chunkOffsets {
+		co64.u64(uint64(off))
+	}
+	boxes = append(boxes, makeBox("co64", co64.buf))
+
+	return makeBox("stbl", boxes...)
+}
+
+func (m *muxer) progressiveMoov(chunks []*chunk, dataStart int64) []byte {
+	trackChunks := make([][]*chunk, len(m.tracks))
+	trackOffsets := make([][]int64, len(m.tracks))
+	offset := dataStart
+	for _, c := range chunks {
+		trackChunks[c.track] = append(trackChunks[c.track], c)
+		trackOffsets[c.track] = append(trackOffsets[c.track], offset)
+		offset += c.size
+	}
+	boxes := [][]byte{mvhd(m.maxMovieDuration(), uint32(len(m.tracks)+1))}
+	for i, t := range m.tracks {
+		stbl := m.stbl(t, trackChunks[i], trackOffsets[i])
+		boxes = append(boxes, m.trak(t, uint32(i+1), stbl, m.movieDuration(t), t.duration()))
+	}
+	return makeBox("moov", boxes...)
+}
+
+// writeProgressive 输出moov在前的普通MP4
+func (m *muxer) writeProgressive() error {
+	chunks := m.planChunks(1, false)
+	var dataSize int64
+	for _, c := range chunks {
+		dataSize += c.size
+	}
+	ftypBox := ftyp(false)
+	//moov的大小与偏移的值无关，先生成一次得到大小
+	moovSize := int64(len(m.progressiveMoov(chunks, 0)))
+	const mdatHeaderSize = 16
+	dataStart := int64(len(ftypBox)) + moovSize + mdatHeaderSize
+	moov := m.progressiveMoov(chunks, dataStart)
+
+	mdatHeader := (&writer{}).u32(1).bytes([]byte("mdat")).u64(uint64(dataSize + mdatHeaderSize)).buf
+	for _, b := range [][]byte{ftypBox, moov, mdatHeader} {
+		if _, err := m.w.Write(b); err != nil {
+			return err
+		}
+	}
+	for _, c := range chunks {
+		if err := m.copySamples(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *muxer) fragmentedMoov() []byte {
+	boxes := [][]byte{mvhd(0, uint32(len(m.tracks)+1))}
+	emptyStbl := func(t *track) []byte {
+		empty := (&writer{}).fullHeader(0, 0).u32(0).buf
+		stsz := (&writer{}).fullHeader(0, 0).u32(0).u32(0).buf
+		return makeBox("stbl", t.stsd.raw(), makeBox("stts", empty), makeBox("stsc", empty), makeBox("stsz", stsz), makeBox("stco", empty))
+	}
+	mvex := [][]byte{makeBox("mehd", (&writer{}).fullHeader(1, 0).u64(m.maxMovieDuration()).buf)}
+	for i, t := range m.tracks {
+		id := uint32(i + 1)
+		boxes = append(boxes, m.trak(t, id, emptyStbl(t), 0, 0))
+		trex := (&writer{}).fullHeader(0, 0).u32(id).u32(1).u32(0).u32(0).u32(0).buf
+		mvex = append(mvex, makeBox("trex", trex))
+	}
+	boxes = append(boxes, makeBox("mvex", mvex...))
+	return makeBox("moov", boxes...)
+}
+
+func (m *muxer) moof(c *chunk, sequence uint32) []byte {
+	t := m.tracks[c.track]
+	build := func(dataOffset int32) []byte {
+		mfhd := (&writer{}).fullHeader(0, 0).u32(sequence).buf
+		tfhd := (&writer{}).fullHeader(0, tfhdDefaultBaseIsMoof).u32(uint32(c.track + 1)).buf
+		tfdt := (&writer{}).fullHeader(1, 0).u64(c.decodeTime).buf
+		trun := &writer{}
+		trun.fullHeader(1, trunDataOffset|trunSampleDuration|trunSampleSize|trunSampleFlags|trunSampleCTO)
+		trun.u32(uint32(c.count)).u32(uint32(dataOffset))
+		for _, s := range t.samples[c.first : c.first+c.count] {
+			flags := uint32(0x02000000)
+			if !s.sync {
+				flags = 0x01000000 | sampleFlagNonSync
+			}
+			trun.u32(s.duration).u32(s.size).u32(flags).u32(uint32(s.cto))
+		}
+		traf := makeBox("traf", makeBox("tfhd", tfhd), makeBox("tfdt", tfdt), makeBox("trun", trun.buf))
+		return makeBox("moof", makeBox("mfhd", mfhd), traf)
+	}
+	//data offset 从moof开头算起，指向mdat的数据
+	moof := build(0)
+	return build(int32(len(moof) + 8))
+}
+
+// writeFragmented 输出分片MP4，每个分片只包含一个track
+func (m *muxer) writeFragmented(fragmentDuration float64) error {
+	for _, b := range [][]byte{ftyp(true), m.fragmentedMoov()} {
+		if _, err := m.w.Write(b); err != nil {
+			return err
+		}
+	}
+	for i, c := range m.planChunks(fragmentDuration, true) {
+		if _, err := m.w.Write(m.moof(c, uint32(i+1))); err != nil {
+			return err
+		}
+		mdatHeader := (&writer{}).u32(uint32(c.size + 8)).bytes([]byte("mdat")).buf
+		if _, err := m.w.Write(mdatHeader); err != nil {
+			return err
+		}
+		if err := m.copySamples(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
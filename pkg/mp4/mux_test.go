@@ -0,0 +1,229 @@
+package mp4
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type fixtureTrack struct {
+	handler   string
+	codec     string
+	timescale uint32
+	samples   [][]byte
+	durations []uint32
+	// 为空表示全部是关键帧
+	syncs []bool
+}
+
+func (f *fixtureTrack) duration() uint64 {
+	var d uint64
+	for _, n := range f.durations {
+		d += uint64(n)
+	}
+	return d
+}
+
+func newFixtureTrack(handler, codec string, timescale uint32, count int, duration uint32, gop int) *fixtureTrack {
+	f := &fixtureTrack{
+		handler:   handler,
+		codec:     codec,
+		timescale: timescale,
+	}
+	for i := 0; i < count; i++ {
+		//大小不同的样本，内容可以区分来源
+		f.samples = append(f.samples, bytes.Repeat([]byte(fmt.Sprintf("%s%03d", handler, i)), 1+i%3))
+		f.durations = append(f.durations, duration)
+		if gop > 0 {
+			f.syncs = append(f.syncs, i%gop == 0)
+		}
+	}
+	return f
+}
+
+// writeFixture 写入只有一个track的普通MP4，mdat在moov之前
+func writeFixture(t *testing.T, path string, f *fixtureTrack) {
+	t.Helper()
+	ftypBox := ftyp(false)
+	var data []byte
+	for _, s := range f.samples {
+		data = append(data, s...)
+	}
+	mdat := makeBox("mdat", data)
+	dataStart := uint32(len(ftypBox) + 8)
+
+	tkhd := (&writer{}).fullHeader(0, 3).u32(0).u32(0).u32(1).u32(0).u32(0)
+	tkhd.bytes(make([]byte, 60))
+	mdhd := (&writer{}).fullHeader(0, 0).u32(0).u32(0).u32(f.timescale).u32(uint32(f.duration())).u16(0x55c4).u16(0)
+	hdlr := (&writer{}).fullHeader(0, 0).u32(0).bytes([]byte(f.handler)).bytes(make([]byte, 13))
+	stsd := (&writer{}).fullHeader(0, 0).u32(1).bytes(makeBox(f.codec, make([]byte, 16)))
+	stts := (&writer{}).fullHeader(0, 0).u32(uint32(len(f.durations)))
+	for _, d := range f.durations {
+		stts.u32(1).u32(d)
+	}
+	stsc := (&writer{}).fullHeader(0, 0).u32(1).u32(1).u32(uint32(len(f.samples))).u32(1)
+	stsz := (&writer{}).fullHeader(0, 0).u32(0).u32(uint32(len(f.samples)))
+	for _, s := range f.samples {
+		stsz.u32(uint32(len(s)))
+	}
+	stco := (&writer{}).fullHeader(0, 0).u32(1).u32(dataStart)
+	stblBoxes := [][]byte{makeBox("stsd", stsd.buf), makeBox("stts", stts.buf), makeBox("stsc", stsc.buf), makeBox("stsz", stsz.buf), makeBox("stco", stco.buf)}
+	if len(f.syncs) != 0 {
+		stss := &writer{}
+		var syncs []uint32
+		for i, sync := range f.syncs {
+			if sync {
+				syncs = append(syncs, uint32(i+1))
+			}
+		}
+		stss.fullHeader(0, 0).u32(uint32(len(syncs)))
+		for _, n := range syncs {
+			stss.u32(n)
+		}
+		stblBoxes = append(stblBoxes, makeBox("stss", stss.buf))
+	}
+	minf := makeBox("minf", makeBox("stbl", stblBoxes...))
+	mdia := makeBox("mdia", makeBox("mdhd", mdhd.buf), makeBox("hdlr", hdlr.buf), minf)
+	trak := makeBox("trak", makeBox("tkhd", tkhd.buf), mdia)
+	moov := makeBox("moov", mvhd(f.duration()*movieTimescale/uint64(f.timescale), 2), trak)
+
+	var file []byte
+	for _, b := range [][]byte{ftypBox, mdat, moov} {
+		file = append(file, b...)
+	}
+	if err := os.WriteFile(path, file, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func openTracks(t *testing.T, path string) ([]*track, *os.File) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks, err := readTracks(f, stat.Size())
+	if err != nil {
+		t.Fatalf("parse %s: %s", path, err)
+	}
+	return tracks, f
+}
+
+// mdhdDuration 读取mdhd中的媒体时长
+func mdhdDuration(mdhd *box) uint64 {
+	r := newReader(mdhd.payload)
+	version, _ := r.fullHeader()
+	if version == 1 {
+		r.skip(20)
+		return r.u64()
+	}
+	r.skip(12)
+	return uint64(r.u32())
+}
+
+func checkMuxedTrack(t *testing.T, got *track, want *fixtureTrack, fragmented bool) {
+	t.Helper()
+	if got.handler != want.handler || got.codec != want.codec || got.timescale != want.timescale {
+		t.Fatalf("track = %s/%s/%d, want %s/%s/%d", got.handler, got.codec, got.timescale, want.handler, want.codec, want.timescale)
+	}
+	if len(got.samples) != len(want.samples) {
+		t.Fatalf("%s sample count = %d, want %d", want.handler, len(got.samples), len(want.samples))
+	}
+	if got.duration() != want.duration() {
+		t.Errorf("%s duration = %d, want %d", want.handler, got.duration(), want.duration())
+	}
+	//分片输出的moov中时长为0
+	if !fragmented {
+		if d := mdhdDuration(got.mdhd); d != want.duration() {
+			t.Errorf("%s mdhd duration = %d, want %d", want.handler, d, want.duration())
+		}
+	}
+	for i, s := range got.samples {
+		data := make([]byte, s.size)
+		if _, err := got.src.ReadAt(data, s.offset); err != nil {
+			t.Fatalf("%s sample %d: %s", want.handler, i, err)
+		}
+		if !bytes.Equal(data, want.samples[i]) {
+			t.Fatalf("%s sample %d = %q, want %q", want.handler, i, data, want.samples[i])
+		}
+		if s.duration != want.durations[i] {
+			t.Errorf("%s sample %d duration = %d, want %d", want.handler, i, s.duration, want.durations[i])
+		}
+		wantSync := len(want.syncs) == 0 || want.syncs[i]
+		if s.sync != wantSync {
+			t.Errorf("%s sample %d sync = %v, want %v", want.handler, i, s.sync, wantSync)
+		}
+	}
+}
+
+func TestMergeAVRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	//视频 30fps 5秒，每15帧一个关键帧；音频 44.1kHz 每帧1024
+	video := newFixtureTrack(HandlerVideo, "avc1", 15360, 150, 512, 15)
+	audio := newFixtureTrack(HandlerAudio, "mp4a", 44100, 216, 1024, 0)
+	vPath := filepath.Join(dir, "v.mp4")
+	aPath := filepath.Join(dir, "a.m4a")
+	writeFixture(t, vPath, video)
+	writeFixture(t, aPath, audio)
+
+	for _, fragmented := range []bool{false, true} {
+		output := filepath.Join(dir, fmt.Sprintf("out-%v.mp4", fragmented))
+		if err := MergeAV(context.Background(), vPath, aPath, output, Options{Fragmented: fragmented}); err != nil {
+			t.Fatalf("fragmented=%v: merge: %s", fragmented, err)
+		}
+		tracks, f := openTracks(t, output)
+		if len(tracks) != 2 {
+			t.Fatalf("fragmented=%v: track count = %d, want 2", fragmented, len(tracks))
+		}
+		checkMuxedTrack(t, tracks[0], video, fragmented)
+		checkMuxedTrack(t, tracks[1], audio, fragmented)
+
+		boxes, err := readTopBoxes(f, func() int64 { s, _ := f.Stat(); return s.Size() }())
+		if err != nil {
+			t.Fatal(err)
+		}
+		moov := boxes[1]
+		if moov.typ != "moov" {
+			t.Fatalf("fragmented=%v: second box = %s, want moov", fragmented, moov.typ)
+		}
+		//mvhd时长是较长的track换算到movie timescale
+		if !fragmented {
+			want := video.duration() * movieTimescale / uint64(video.timescale)
+			if d := audio.duration() * movieTimescale / uint64(audio.timescale); d > want {
+				want = d
+			}
+			if d := mdhdDuration(moov.child("mvhd")); d != want {
+				t.Errorf("mvhd duration = %d, want %d", d, want)
+			}
+			for i, trak := range moov.childrenOf("trak") {
+				if id := parseTkhdID(trak.child("tkhd")); id != uint32(i+1) {
+					t.Errorf("track %d id = %d", i, id)
+				}
+			}
+		}
+	}
+}
+
+func TestMuxUnsupportedCodec(t *testing.T) {
+	dir := t.TempDir()
+	vPath := filepath.Join(dir, "v.mp4")
+	aPath := filepath.Join(dir, "a.m4a")
+	writeFixture(t, vPath, newFixtureTrack(HandlerVideo, "vp09", 1000, 3, 40, 0))
+	writeFixture(t, aPath, newFixtureTrack(HandlerAudio, "mp4a", 1000, 3, 40, 0))
+	err := MergeAV(context.Background(), vPath, aPath, filepath.Join(dir, "out.mp4"))
+	if !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("err = %v, want ErrUnsupported", err)
+	}
+	if _, e := os.Stat(filepath.Join(dir, "out.mp4.muxing")); !os.IsNotExist(e) {
+		t.Errorf("temporary output not removed")
+	}
+}
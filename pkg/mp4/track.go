@@ -0,0 +1,469 @@
+package mp4
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+	HandlerVideo = "vide"
+	HandlerAudio = "soun"
+)
+
+// 原生封装支持的编码，其他编码返回ErrUnsupported
+var supportedCodecs = map[string]bool{
+	"avc1": true,
+	"avc3": true,
+	"mp4a": true,
+}
+
+type sample struct {
+	// 在源文件中的偏移
+	offset   int64
+	size     uint32
+	duration uint32
+	cto      int32
+	sync     bool
+}
+
+type editEntry struct {
+	// 源文件movie timescale下的时长
+	segmentDuration uint64
+	mediaTime       int64
+	rateInteger     int16
+	rateFraction    int16
+}
+
+type track struct {
+	src       io.ReaderAt
+	id        uint32
+	handler   string
+	codec     string
+	timescale uint32
+	// 源文件的movie timescale，用于换算edit list
+	movieTimescale uint32
+
+	tkhd  *box
+	mdhd  *box
+	hdlr  *box
+	mhd   *box // vmhd/smhd/nmhd
+	dinf  *box
+	stsd  *box
+	edits []editEntry
+
+	samples []*sample
+}
+
+func (t *track) duration() uint64 {
+	var d uint64
+	for _, s := range t.samples {
+		d += uint64(s.duration)
+	}
+	return d
+}
+
+type trexDefaults struct {
+	sampleDuration uint32
+	sampleSize     uint32
+	sampleFlags    uint32
+}
+
+func parseHandler(hdlr *box) string {
+	r := newReader(hdlr.payload)
+	r.fullHeader()
+	r.skip(4)
+	if !r.need(4) {
+		return ""
+	}
+	return string(r.data[r.off : r.off+4])
+}
+
+func parseCodec(stsd *box) string {
+	r := newReader(stsd.payload)
+	r.fullHeader()
+	if r.u32() == 0 {
+		return ""
+	}
+	r.skip(4)
+	if !r.need(4) {
+		return ""
+	}
+	return string(r.data[r.off : r.off+4])
+}
+
+func parseTkhdID(tkhd *box) uint32 {
+	r := newReader(tkhd.payload)
+	version, _ := r.fullHeader()
+	if version == 1 {
+		r.skip(16)
+	} else {
+		r.skip(8)
+	}
+	return r.u32()
+}
+
+func parseMdhdTimescale(mdhd *box) uint32 {
+	r := newReader(mdhd.payload)
+	version, _ := r.fullHeader()
+	if version == 1 {
+		r.skip(16)
+	} else {
+		r.skip(8)
+	}
+	return r.u32()
+}
+
+func parseMvhdTimescale(mvhd *box) uint32 {
+	return parseMdhdTimescale(mvhd)
+}
+
+func parseElst(elst *box) []editEntry {
+	r := newReader(elst.payload)
+	version, _ := r.fullHeader()
+	count := r.u32()
+	entries := make([]editEntry, 0, count)
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		var e editEntry
+		if version == 1 {
+			e.segmentDuration = r.u64()
+			e.mediaTime = int64(r.u64())
+		} else {
+			e.segmentDuration = uint64(r.u32())
+			e.mediaTime = int64(int32(r.u32()))
+		}
+		e.rateInteger = int16(r.u16())
+		e.rateFraction = int16(r.u16())
+		entries = append(entries, e)
+	}
+	if r.err != nil {
+		return nil
+	}
+	return entries
+}
+
+func newTrack(src io.ReaderAt, trak *box, movieTimescale uint32) (*track, error) {
+	t := &track{
+		src:            src,
+		movieTimescale: movieTimescale,
+		tkhd:           trak.child("tkhd"),
+		mdhd:           trak.path("mdia", "mdhd"),
+		hdlr:           trak.path("mdia", "hdlr"),
+		dinf:           trak.path("mdia", "minf", "dinf"),
+		stsd:           trak.path("mdia", "minf", "stbl", "stsd"),
+	}
+	if t.tkhd == nil || t.mdhd == nil || t.hdlr == nil || t.stsd == nil {
+		return nil, fmt.Errorf("mp4: incomplete trak")
+	}
+	minf := trak.path("mdia", "minf")
+	for _, typ := range []string{"vmhd", "smhd", "nmhd"} {
+		if t.mhd = minf.child(typ); t.mhd != nil {
+			break
+		}
+	}
+	if elst := trak.path("edts", "elst"); elst != nil {
+		t.edits = parseElst(elst)
+	}
+	t.id = parseTkhdID(t.tkhd)
+	t.handler = parseHandler(t.hdlr)
+	t.codec = parseCodec(t.stsd)
+	t.timescale = parseMdhdTimescale(t.mdhd)
+	if t.timescale == 0 {
+		return nil, fmt.Errorf("mp4: invalid timescale of track %d", t.id)
+	}
+	return t, nil
+}
+
+// parseSampleTable 解析非分片文件的stbl
+func (t *track) parseSampleTable(stbl *box) error {
+	stsz := stbl.child("stsz")
+	stts := stbl.child("stts")
+	stsc := stbl.child("stsc")
+	if stsz == nil || stts == nil || stsc == nil {
+		return fmt.Errorf("mp4: incomplete sample table")
+	}
+
+	// stsz
+	r := newReader(stsz.payload)
+	r.fullHeader()
+	fixedSize := r.u32()
+	count := r.u32()
+	if r.err != nil {
+		return r.err
+	}
+	samples := make([]*sample, count)
+	for i := range samples {
+		samples[i] = &sample{size: fixedSize, sync: true}
+		if fixedSize == 0 {
+			samples[i].size = r.u32()
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	// 分片文件的moov中没有样本
+	if count == 0 {
+		return nil
+	}
+
+	// stts
+	r = newReader(stts.payload)
+	r.fullHeader()
+	n := 0
+	for entries := r.u32(); entries > 0 && r.err == nil; entries-- {
+		sampleCount, delta := r.u32(), r.u32()
+		for ; sampleCount > 0 && n < len(samples); sampleCount-- {
+			samples[n].duration = delta
+			n++
+		}
+	}
+
+	// ctts
+	if ctts := stbl.child("ctts"); ctts != nil {
+		r = newReader(ctts.payload)
+		r.fullHeader()
+		n = 0
+		for entries := r.u32(); entries > 0 && r.err == nil; entries-- {
+			sampleCount, offset := r.u32(), int32(r.u32())
+			for ; sampleCount > 0 && n < len(samples); sampleCount-- {
+				samples[n].cto = offset
+				n++
+			}
+		}
+	}
+
+	// stss，不存在时全部是关键帧
+	if stss := stbl.child("stss"); stss != nil {
+		for _, s := range samples {
+			s.sync = false
+		}
+		r = newReader(stss.payload)
+		r.fullHeader()
+		for entries := r.u32(); entries > 0 && r.err == nil; entries-- {
+			if i := r.u32(); i >= 1 && int(i) <= len(samples) {
+				samples[i-1].sync = true
+			}
+		}
+	}
+
+	// stco/co64
+	var chunkOffsets []int64
+	if stco := stbl.child("stco"); stco != nil {
+		r = newReader(stco.payload)
+		r.fullHeader()
+		for entries := r.u32(); entries > 0 && r.err == nil; entries-- {
+			chunkOffsets = append(chunkOffsets, int64(r.u32()))
+		}
+	} else if co64 := stbl.child("co64"); co64 != nil {
+		r = newReader(co64.payload)
+		r.fullHeader()
+		for entries := r.u32(); entries > 0 && r.err == nil; entries-- {
+			chunkOffsets = append(chunkOffsets, int64(r.u64()))
+		}
+	} else {
+		return fmt.Errorf("mp4: missing chunk offsets")
+	}
+
+	// stsc
+	type stscEntry struct {
+		firstChunk      uint32
+		samplesPerChunk uint32
+	}
+	var stscEntries []stscEntry
+	r = newReader(stsc.payload)
+	r.fullHeader()
+	for entries := r.u32(); entries > 0 && r.err == nil; entries-- {
+		e := stscEntry{firstChunk: r.u32(), samplesPerChunk: r.u32()}
+		r.u32()
+		stscEntries = append(stscEntries, e)
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	n = 0
+	for i, e := range stscEntries {
+		lastChunk := uint32(len(chunkOffsets))
+		if i+1 < len(stscEntries) {
+			lastChunk = stscEntries[i+1].firstChunk - 1
+		}
+		for chunk := e.firstChunk; chunk <= lastChunk && chunk >= 1 && int(chunk) <= len(chunkOffsets); chunk++ {
+			offset := chunkOffsets[chunk-1]
+			for j := uint32(0); j < e.samplesPerChunk && n < len(samples); j++ {
+				samples[n].offset = offset
+				offset += int64(samples[n].size)
+				n++
+			}
+		}
+	}
+	if n != len(samples) {
+		return fmt.Errorf("mp4: sample table of track %d is inconsistent", t.id)
+	}
+	t.samples = samples
+	return nil
+}
+
+const (
+	tfhdBaseDataOffset        = 0x000001
+	tfhdSampleDescIndex       = 0x000002
+	tfhdDefaultSampleDuration = 0x000008
+	tfhdDefaultSampleSize     = 0x000010
+	tfhdDefaultSampleFlags    = 0x000020
+	tfhdDefaultBaseIsMoof     = 0x020000
+
+	trunDataOffset       = 0x000001
+	trunFirstSampleFlags = 0x000004
+	trunSampleDuration   = 0x000100
+	trunSampleSize       = 0x000200
+	trunSampleFlags      = 0x000400
+	trunSampleCTO        = 0x000800
+
+	sampleFlagNonSync = 0x00010000
+)
+
+// parseFragment 解析一个moof中属于该track的样本
+func (t *track) parseFragment(moof *box, trex trexDefaults) error {
+	for _, traf := range moof.childrenOf("traf") {
+		tfhd := traf.child("tfhd")
+		if tfhd == nil {
+			continue
+		}
+		r := newReader(tfhd.payload)
+		_, flags := r.fullHeader()
+		if r.u32() != t.id {
+			continue
+		}
+		// 没有指定base-data-offset时以moof的开头为基准
+		baseOffset := moof.start
+		defaults := trex
+		if flags&tfhdBaseDataOffset != 0 {
+			baseOffset = int64(r.u64())
+		}
+		if flags&tfhdSampleDescIndex != 0 {
+			r.u32()
+		}
+		if flags&tfhdDefaultSampleDuration != 0 {
+			defaults.sampleDuration = r.u32()
+		}
+		if flags&tfhdDefaultSampleSize != 0 {
+			defaults.sampleSize = r.u32()
+		}
+		if flags&tfhdDefaultSampleFlags != 0 {
+			defaults.sampleFlags = r.u32()
+		}
+		if r.err != nil {
+			return r.err
+		}
+
+		offset := baseOffset
+		for _, trun := range traf.childrenOf("trun") {
+			r := newReader(trun.payload)
+			_, flags := r.fullHeader()
+			count := r.u32()
+			if flags&trunDataOffset != 0 {
+				offset = baseOffset + int64(int32(r.u32()))
+			}
+			firstFlags, hasFirstFlags := uint32(0), false
+			if flags&trunFirstSampleFlags != 0 {
+				firstFlags, hasFirstFlags = r.u32(), true
+			}
+			for i := uint32(0); i < count && r.err == nil; i++ {
+				s := &sample{
+					offset:   offset,
+					duration: defaults.sampleDuration,
+					size:     defaults.sampleSize,
+				}
+				sampleFlags := defaults.sampleFlags
+				if flags&trunSampleDuration != 0 {
+					s.duration = r.u32()
+				}
+				if flags&trunSampleSize != 0 {
+					s.size = r.u32()
+				}
+				if flags&trunSampleFlags != 0 {
+					sampleFlags = r.u32()
+				}
+				if i == 0 && hasFirstFlags {
+					sampleFlags = firstFlags
+				}
+				if flags&trunSampleCTO != 0 {
+					s.cto = int32(r.u32())
+				}
+				s.sync = sampleFlags&sampleFlagNonSync == 0
+				offset += int64(s.size)
+				t.samples = append(t.samples, s)
+			}
+			if r.err != nil {
+				return r.err
+			}
+		}
+	}
+	return nil
+}
+
+func parseTrex(trex *box) (id uint32, defaults trexDefaults) {
+	r := newReader(trex.payload)
+	r.fullHeader()
+	id = r.u32()
+	r.u32()
+	defaults.sampleDuration = r.u32()
+	defaults.sampleSize = r.u32()
+	defaults.sampleFlags = r.u32()
+	return
+}
+
+// readTracks 读取文件中的所有track，支持普通和分片MP4
+func readTracks(src io.ReaderAt, fileSize int64) ([]*track, error) {
+	boxes, err := readTopBoxes(src, fileSize)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		moov  *box
+		moofs []*box
+	)
+	for _, b := range boxes {
+		switch b.typ {
+		case "moov":
+			moov = b
+		case "moof":
+			moofs = append(moofs, b)
+		}
+	}
+	if moov == nil {
+		return nil, ErrUnsupported
+	}
+	movieTimescale := uint32(1000)
+	if mvhd := moov.child("mvhd"); mvhd != nil {
+		if ts := parseMvhdTimescale(mvhd); ts != 0 {
+			movieTimescale = ts
+		}
+	}
+
+	trexs := make(map[uint32]trexDefaults)
+	if mvex := moov.child("mvex"); mvex != nil {
+		for _, trex := range mvex.childrenOf("trex") {
+			id, defaults := parseTrex(trex)
+			trexs[id] = defaults
+		}
+	}
+
+	tracks := make([]*track, 0)
+	for _, trak := range moov.childrenOf("trak") {
+		t, err := newTrack(src, trak, movieTimescale)
+		if err != nil {
+			return nil, err
+		}
+		if stbl := trak.path("mdia", "minf", "stbl"); stbl != nil {
+			if err = t.parseSampleTable(stbl); err != nil {
+				return nil, err
+			}
+		}
+		for _, moof := range moofs {
+			if err = t.parseFragment(moof, trexs[t.id]); err != nil {
+				return nil, err
+			}
+		}
+		tracks = append(tracks, t)
+	}
+	return tracks, nil
+}
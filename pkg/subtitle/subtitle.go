@@ -0,0 +1,225 @@
+package subtitle
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	FormatSRT  = "srt"
+	FormatVTT  = "vtt"
+	FormatTTML = "ttml"
+)
+
+var ErrUnknownFormat = errors.New("subtitle: unknown format")
+
+// Cue 一条字幕，Text是去掉样式后的纯文本，多行用\n分隔
+type Cue struct {
+	Start time.Duration
+	End   time.Duration
+	Text  string
+}
+
+// NormalizeFormat 统一格式名，接受扩展名(带不带点都可以)和常见别名
+func NormalizeFormat(format string) string {
+	switch strings.ToLower(strings.TrimPrefix(format, ".")) {
+	case "srt", "subrip":
+		return FormatSRT
+	case "vtt", "webvtt":
+		return FormatVTT
+	case "ttml", "dfxp", "xml", "ttml2":
+		return FormatTTML
+	}
+	return ""
+}
+
+// DetectFormat 根据内容判断格式，无法判断时返回空
+func DetectFormat(data []byte) string {
+	data = bytes.TrimSpace(trimBOM(data))
+	switch {
+	case bytes.HasPrefix(data, []byte("WEBVTT")):
+		return FormatVTT
+	case bytes.HasPrefix(data, []byte("<")):
+		return FormatTTML
+	case bytes.Contains(data, []byte("-->")):
+		return FormatSRT
+	}
+	return ""
+}
+
+// Parse 解析字幕，format为空时根据内容判断
+func Parse(data []byte, format string) ([]Cue, error) {
+	if format == "" {
+		format = DetectFormat(data)
+	}
+	data = trimBOM(data)
+	switch NormalizeFormat(format) {
+	case FormatSRT:
+		return parseBlocks(data, false)
+	case FormatVTT:
+		return parseBlocks(data, true)
+	case FormatTTML:
+		return parseTTML(data)
+	}
+	return nil, ErrUnknownFormat
+}
+
+func Format(cues []Cue, format string) ([]byte, error) {
+	switch NormalizeFormat(format) {
+	case FormatSRT:
+		return formatSRT(cues), nil
+	case FormatVTT:
+		return formatVTT(cues), nil
+	case FormatTTML:
+		return formatTTML(cues), nil
+	}
+	return nil, ErrUnknownFormat
+}
+
+// Convert 在SRT、VTT、TTML之间转换，from为空时根据内容判断
+func Convert(data []byte, from, to string) ([]byte, error) {
+	if from != "" && NormalizeFormat(from) == NormalizeFormat(to) {
+		return data, nil
+	}
+	cues, err := Parse(data, from)
+	if err != nil {
+		return nil, err
+	}
+	return Format(cues, to)
+}
+
+func trimBOM(data []byte) []byte {
+	return bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+}
+
+var tagRegexp = regexp.MustCompile(`<[^>]*>`)
+
+// cleanText 去掉标签和转义，合并多余的空行
+func cleanText(s string) string {
+	return trimLines(html.UnescapeString(tagRegexp.ReplaceAllString(s, "")))
+}
+
+func trimLines(s string) string {
+	lines := strings.Split(s, "\n")
+	ret := lines[:0]
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" {
+			ret = append(ret, line)
+		}
+	}
+	return strings.Join(ret, "\n")
+}
+
+// parseTimestamp 解析 hh:mm:ss,mmm 或 mm:ss.mmm
+func parseTimestamp(s string) (time.Duration, error) {
+	s = strings.Replace(strings.TrimSpace(s), ",", ".", 1)
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("subtitle: invalid timestamp: %s", s)
+	}
+	var h, m int
+	var sec float64
+	var err error
+	if len(parts) == 3 {
+		_, err = fmt.Sscanf(parts[0]+" "+parts[1]+" "+parts[2], "%d %d %g", &h, &m, &sec)
+	} else {
+		_, err = fmt.Sscanf(parts[0]+" "+parts[1], "%d %g", &m, &sec)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("subtitle: invalid timestamp: %s", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec*float64(time.Second)+0.5), nil
+}
+
+func formatTimestamp(d time.Duration, sep string) string {
+	if d < 0 {
+		d = 0
+	}
+	d = d.Round(time.Millisecond)
+	h := d / time.Hour
+	m := d % time.Hour / time.Minute
+	s := d % time.Minute / time.Second
+	ms := d % time.Second / time.Millisecond
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", h, m, s, sep, ms)
+}
+
+/*
+parseBlocks 解析以空行分隔的SRT/VTT
+VTT跳过头部、NOTE、STYLE、REGION块和时间后面的设置
+*/
+func parseBlocks(data []byte, isVTT bool) ([]Cue, error) {
+	text := strings.ReplaceAll(strings.ReplaceAll(string(data), "\r\n", "\n"), "\r", "\n")
+	cues := make([]Cue, 0)
+	for _, block := range strings.Split(text, "\n\n") {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		timing := -1
+		for i, line := range lines {
+			if strings.Contains(line, "-->") {
+				timing = i
+				break
+			}
+		}
+		if timing == -1 {
+			continue
+		}
+		if isVTT && timing > 0 {
+			switch strings.SplitN(lines[0], " ", 2)[0] {
+			case "NOTE", "STYLE", "REGION":
+				continue
+			}
+		}
+		start, end, found := strings.Cut(lines[timing], "-->")
+		if !found {
+			continue
+		}
+		//VTT的结束时间后面可能有 align:start position:0% 等设置
+		if fields := strings.Fields(end); len(fields) > 0 {
+			end = fields[0]
+		}
+		cue := Cue{}
+		var err error
+		if cue.Start, err = parseTimestamp(start); err != nil {
+			return nil, err
+		}
+		if cue.End, err = parseTimestamp(end); err != nil {
+			return nil, err
+		}
+		cue.Text = cleanText(strings.Join(lines[timing+1:], "\n"))
+		if cue.Text != "" {
+			cues = append(cues, cue)
+		}
+	}
+	return cues, nil
+}
+
+func formatSRT(cues []Cue) []byte {
+	var buf bytes.Buffer
+	index := 1
+	for _, cue := range cues {
+		if cue.Text == "" {
+			continue
+		}
+		fmt.Fprintf(&buf, "%d\n%s --> %s\n%s\n\n", index, formatTimestamp(cue.Start, ","), formatTimestamp(cue.End, ","), cue.Text)
+		index++
+	}
+	return buf.Bytes()
+}
+
+var vttEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func formatVTT(cues []Cue) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("WEBVTT\n\n")
+	for _, cue := range cues {
+		if cue.Text == "" {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s --> %s\n%s\n\n", formatTimestamp(cue.Start, "."), formatTimestamp(cue.End, "."), vttEscaper.Replace(cue.Text))
+	}
+	return buf.Bytes()
+}
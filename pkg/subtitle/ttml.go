@@ -0,0 +1,164 @@
+package subtitle
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	clockTimeRegexp  = regexp.MustCompile(`^(\d+):(\d{2}):(\d{2}(?:\.\d+)?)(?::(\d+(?:\.\d+)?))?$`)
+	offsetTimeRegexp = regexp.MustCompile(`^(\d+(?:\.\d+)?)(h|ms|m|s|f|t)$`)
+)
+
+type ttmlRates struct {
+	frameRate float64
+	tickRate  float64
+}
+
+// parseTTMLTime 解析TTML的时间表达式，支持时钟格式(带帧数)和偏移格式
+func parseTTMLTime(s string, rates ttmlRates) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if matchs := clockTimeRegexp.FindStringSubmatch(s); matchs != nil {
+		h, _ := strconv.ParseFloat(matchs[1], 64)
+		m, _ := strconv.ParseFloat(matchs[2], 64)
+		sec, _ := strconv.ParseFloat(matchs[3], 64)
+		sec += h*3600 + m*60
+		if matchs[4] != "" {
+			frames, _ := strconv.ParseFloat(matchs[4], 64)
+			sec += frames / rates.frameRate
+		}
+		return time.Duration(sec*float64(time.Second) + 0.5), nil
+	}
+	if matchs := offsetTimeRegexp.FindStringSubmatch(s); matchs != nil {
+		value, _ := strconv.ParseFloat(matchs[1], 64)
+		unit := map[string]float64{
+			"h":  3600,
+			"m":  60,
+			"s":  1,
+			"ms": 0.001,
+			"f":  1 / rates.frameRate,
+			"t":  1 / rates.tickRate,
+		}[matchs[2]]
+		return time.Duration(value*unit*float64(time.Second) + 0.5), nil
+	}
+	return 0, fmt.Errorf("subtitle: invalid ttml time: %s", s)
+}
+
+var spaceRegexp = regexp.MustCompile(`[ \t\r\n]+`)
+
+/*
+parseTTML 解析TTML的p元素，br转换为换行，span只保留文本
+不处理div/body上的时间偏移
+*/
+func parseTTML(data []byte) ([]Cue, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+	rates := ttmlRates{frameRate: 30, tickRate: 1}
+
+	cues := make([]Cue, 0)
+	var (
+		cue     *Cue
+		text    strings.Builder
+		hasEnd  bool
+		dur     time.Duration
+		sawRoot bool
+	)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("subtitle: invalid ttml: %w", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "tt":
+				sawRoot = true
+				for _, attr := range t.Attr {
+					value, err := strconv.ParseFloat(attr.Value, 64)
+					if err != nil || value <= 0 {
+						continue
+					}
+					switch attr.Name.Local {
+					case "frameRate":
+						rates.frameRate = value
+					case "tickRate":
+						rates.tickRate = value
+					}
+				}
+			case "p":
+				cue = &Cue{}
+				text.Reset()
+				hasEnd, dur = false, 0
+				for _, attr := range t.Attr {
+					var err error
+					switch attr.Name.Local {
+					case "begin":
+						cue.Start, err = parseTTMLTime(attr.Value, rates)
+					case "end":
+						cue.End, err = parseTTMLTime(attr.Value, rates)
+						hasEnd = true
+					case "dur":
+						dur, err = parseTTMLTime(attr.Value, rates)
+					}
+					if err != nil {
+						return nil, err
+					}
+				}
+			case "br":
+				if cue != nil {
+					text.WriteString("\n")
+				}
+			}
+		case xml.CharData:
+			if cue != nil {
+				text.WriteString(spaceRegexp.ReplaceAllString(string(t), " "))
+			}
+		case xml.EndElement:
+			if t.Name.Local == "p" && cue != nil {
+				if !hasEnd {
+					cue.End = cue.Start + dur
+				}
+				cue.Text = trimLines(text.String())
+				if cue.Text != "" {
+					cues = append(cues, *cue)
+				}
+				cue = nil
+			}
+		}
+	}
+	if !sawRoot {
+		return nil, fmt.Errorf("subtitle: invalid ttml: no tt element")
+	}
+	return cues, nil
+}
+
+func formatTTML(cues []Cue) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<tt xmlns="http://www.w3.org/ns/ttml">` + "\n")
+	buf.WriteString("  <body>\n    <div>\n")
+	for _, cue := range cues {
+		if cue.Text == "" {
+			continue
+		}
+		fmt.Fprintf(&buf, `      <p begin="%s" end="%s">`, formatTimestamp(cue.Start, "."), formatTimestamp(cue.End, "."))
+		for i, line := range strings.Split(cue.Text, "\n") {
+			if i > 0 {
+				buf.WriteString("<br/>")
+			}
+			xml.EscapeText(&buf, []byte(line))
+		}
+		buf.WriteString("</p>\n")
+	}
+	buf.WriteString("    </div>\n  </body>\n</tt>\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,537 @@
+/*
+Package config 从配置文件和环境变量生成Monitor的选项
+支持JSON、YAML和TOML，按文件扩展名区分，环境变量优先于文件:
+YTMNT_ 加上字段路径的大写，如 YTMNT_DB_PATH、YTMNT_QUEUE_MAX_CONCURRENT
+map类型的字段在路径后加上键名，如 YTMNT_TOKENS_YOUTUBE、YTMNT_PROXIES_INSTAGRAM
+*/
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/yinyajiang/yt-mnt/pkg/db"
+	"github.com/yinyajiang/yt-mnt/pkg/downloader"
+	"github.com/yinyajiang/yt-mnt/pkg/ies"
+	"github.com/yinyajiang/yt-mnt/pkg/ies/instagram"
+	"github.com/yinyajiang/yt-mnt/pkg/ies/instagram/insapi"
+	"github.com/yinyajiang/yt-mnt/pkg/ies/youtube"
+	"github.com/yinyajiang/yt-mnt/pkg/ies/youtube/ytbapi"
+	"github.com/yinyajiang/yt-mnt/service/monitor"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+const EnvPrefix = "YTMNT_"
+
+type Config struct {
+	DB     DBConfig          `json:"db" yaml:"db" toml:"db"`
+	Tables TablesConfig      `json:"tables" yaml:"tables" toml:"tables"`
+	Tokens map[string]string `json:"tokens" yaml:"tokens" toml:"tokens"`
+	//下载和没有单独设置代理的IE使用的代理
+	Proxy string `json:"proxy" yaml:"proxy" toml:"proxy"`
+	//按IE名称设置的代理，如 youtube、instagram
+	Proxies map[string]string `json:"proxies" yaml:"proxies" toml:"proxies"`
+	//单次IE API调用的超时，为0使用默认值30秒
+	IETimeout Duration        `json:"ie_timeout" yaml:"ie_timeout" toml:"ie_timeout"`
+	Download  DownloadConfig  `json:"download" yaml:"download" toml:"download"`
+	Queue     QueueConfig     `json:"queue" yaml:"queue" toml:"queue"`
+	Scheduler SchedulerConfig `json:"scheduler" yaml:"scheduler" toml:"scheduler"`
+	Retention RetentionConfig `json:"retention" yaml:"retention" toml:"retention"`
+	Archive   ArchiveConfig   `json:"archive" yaml:"archive" toml:"archive"`
+	RootCache RootCacheConfig `json:"root_cache" yaml:"root_cache" toml:"root_cache"`
+	//youtube API的每日配额
+	YoutubeQuota YoutubeQuotaConfig `json:"youtube_quota" yaml:"youtube_quota" toml:"youtube_quota"`
+}
+
+type DBConfig struct {
+	Path    string `json:"path" yaml:"path" toml:"path"`
+	Verbose bool   `json:"verbose" yaml:"verbose" toml:"verbose"`
+}
+
+// TablesConfig 为空使用默认的表名
+type TablesConfig struct {
+	Asset        string `json:"asset" yaml:"asset" toml:"asset"`
+	Bundle       string `json:"bundle" yaml:"bundle" toml:"bundle"`
+	Queue        string `json:"queue" yaml:"queue" toml:"queue"`
+	Archive      string `json:"archive" yaml:"archive" toml:"archive"`
+	RootCache    string `json:"root_cache" yaml:"root_cache" toml:"root_cache"`
+	YoutubeQuota string `json:"youtube_quota" yaml:"youtube_quota" toml:"youtube_quota"`
+}
+
+// DownloadConfig 调度器自动下载新资源的默认选项
+type DownloadConfig struct {
+	Dir string `json:"dir" yaml:"dir" toml:"dir"`
+	//按IE名称设置的下载目录，没有设置的IE使用Dir
+	Dirs map[string]string `json:"dirs" yaml:"dirs" toml:"dirs"`
+	//best、worst或者分辨率，如 1080p
+	Quality        Quality  `json:"quality" yaml:"quality" toml:"quality"`
+	HopeMediaType  string   `json:"hope_media_type" yaml:"hope_media_type" toml:"hope_media_type"`
+	Subtitle       string   `json:"subtitle" yaml:"subtitle" toml:"subtitle"`
+	SubtitleFormat string   `json:"subtitle_format" yaml:"subtitle_format" toml:"subtitle_format"`
+	OriginalOnly   bool     `json:"original_subtitle" yaml:"original_subtitle" toml:"original_subtitle"`
+	Thumbnail      bool     `json:"thumbnail" yaml:"thumbnail" toml:"thumbnail"`
+	PostProcessors []string `json:"post_processors" yaml:"post_processors" toml:"post_processors"`
+}
+
+type QueueConfig struct {
+	Enable        bool           `json:"enable" yaml:"enable" toml:"enable"`
+	MaxConcurrent int            `json:"max_concurrent" yaml:"max_concurrent" toml:"max_concurrent"`
+	MaxPerBundle  int            `json:"max_per_bundle" yaml:"max_per_bundle" toml:"max_per_bundle"`
+	MaxPerIE      map[string]int `json:"max_per_ie" yaml:"max_per_ie" toml:"max_per_ie"`
+	MaxRetries    int            `json:"max_retries" yaml:"max_retries" toml:"max_retries"`
+	RetryDelay    Duration       `json:"retry_delay" yaml:"retry_delay" toml:"retry_delay"`
+	StartPaused   bool           `json:"start_paused" yaml:"start_paused" toml:"start_paused"`
+}
+
+type SchedulerConfig struct {
+	Enable          bool     `json:"enable" yaml:"enable" toml:"enable"`
+	DefaultInterval Duration `json:"default_interval" yaml:"default_interval" toml:"default_interval"`
+	MaxBackoff      Duration `json:"max_backoff" yaml:"max_backoff" toml:"max_backoff"`
+	Jitter          float64  `json:"jitter" yaml:"jitter" toml:"jitter"`
+	Concurrency     int      `json:"concurrency" yaml:"concurrency" toml:"concurrency"`
+	CheckInterval   Duration `json:"check_interval" yaml:"check_interval" toml:"check_interval"`
+}
+
+type RetentionConfig struct {
+	Enable   bool     `json:"enable" yaml:"enable" toml:"enable"`
+	Interval Duration `json:"interval" yaml:"interval" toml:"interval"`
+}
+
+type ArchiveConfig struct {
+	Enable       bool `json:"enable" yaml:"enable" toml:"enable"`
+	RecordOnSave bool `json:"record_on_save" yaml:"record_on_save" toml:"record_on_save"`
+}
+
+// RootCacheConfig IE解析链接的缓存，Capacity和TTL为0使用默认值
+type RootCacheConfig struct {
+	Capacity int      `json:"capacity" yaml:"capacity" toml:"capacity"`
+	TTL      Duration `json:"ttl" yaml:"ttl" toml:"ttl"`
+	Persist  bool     `json:"persist" yaml:"persist" toml:"persist"`
+}
+
+// YoutubeQuotaConfig DailyLimit为0使用默认值10000，LowReserve为0使用每日配额的10%，<0不保留
+type YoutubeQuotaConfig struct {
+	DailyLimit int64 `json:"daily_limit" yaml:"daily_limit" toml:"daily_limit"`
+	LowReserve int64 `json:"low_reserve" yaml:"low_reserve" toml:"low_reserve"`
+	Persist    bool  `json:"persist" yaml:"persist" toml:"persist"`
+}
+
+// Duration 配置中的时长，字符串按time.ParseDuration解析，如 1h30m，数字表示秒数
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		return d.parse(s)
+	}
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err != nil {
+		return errors.New("duration must be a string like 1h30m or a number of seconds")
+	}
+	*d = Duration(seconds * float64(time.Second))
+	return nil
+}
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: duration must be a string like 1h30m or a number of seconds", node.Line)
+	}
+	return d.parse(node.Value)
+}
+
+// UnmarshalText toml中的字符串和数字、环境变量都会调用
+func (d *Duration) UnmarshalText(text []byte) error {
+	return d.parse(string(text))
+}
+
+func (d *Duration) parse(s string) error {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		*d = 0
+		return nil
+	}
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Quality 下载质量，只有数字时当作分辨率的高度，如 720 等同于 720p
+type Quality string
+
+func (q *Quality) set(s string) {
+	s = strings.TrimSpace(s)
+	if _, err := strconv.ParseUint(s, 10, 32); err == nil {
+		s += "p"
+	}
+	*q = Quality(s)
+}
+
+func (q *Quality) UnmarshalJSON(data []byte) error {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case string:
+		q.set(v)
+	case float64:
+		q.set(strconv.FormatFloat(v, 'f', -1, 64))
+	default:
+		return errors.New("quality must be a string or a number")
+	}
+	return nil
+}
+
+func (q *Quality) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: quality must be a string or a number", node.Line)
+	}
+	q.set(node.Value)
+	return nil
+}
+
+// UnmarshalText toml中的字符串和数字、环境变量都会调用
+func (q *Quality) UnmarshalText(text []byte) error {
+	q.set(string(text))
+	return nil
+}
+
+// Default 没有配置的字段使用的值
+func Default() *Config {
+	return &Config{
+		Tokens:  make(map[string]string),
+		Proxies: make(map[string]string),
+		Download: DownloadConfig{
+			Quality: "best",
+		},
+	}
+}
+
+// FormatOf 按扩展名返回配置文件的格式
+func FormatOf(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return FormatJSON, nil
+	case ".yaml", ".yml":
+		return FormatYAML, nil
+	case ".toml":
+		return FormatTOML, nil
+	}
+	return "", fmt.Errorf("unsupported config format: %s", path)
+}
+
+/*
+Load 读取配置文件，应用环境变量后校验
+文件中的相对路径相对于配置文件所在的目录，path为空时只使用环境变量
+defaults为文件中没有的字段使用的值，为空时使用Default()
+*/
+func Load(path string, defaults ...*Config) (*Config, error) {
+	c := Default()
+	if len(defaults) != 0 && defaults[0] != nil {
+		c = defaults[0].clone()
+	}
+	if path != "" {
+		format, err := FormatOf(path)
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err = c.decode(data, format); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		c.resolvePaths(filepath.Dir(path))
+	}
+	if err := c.ApplyEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Parse 解析配置内容，不应用环境变量也不校验，未知的字段返回错误
+func Parse(data []byte, format string) (*Config, error) {
+	c := Default()
+	if err := c.decode(data, format); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// decode 把配置内容解析到c中，内容中没有的字段保持不变
+func (c *Config) decode(data []byte, format string) error {
+	switch format {
+	case FormatJSON:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil {
+			return decodeError(err)
+		}
+	case FormatYAML:
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		//空文件返回io.EOF
+		if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	case FormatTOML:
+		meta, err := toml.NewDecoder(bytes.NewReader(data)).Decode(c)
+		if err != nil {
+			return err
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) != 0 {
+			return &FieldError{
+				Field: undecoded[0].String(),
+				Msg:   "unknown field",
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported config format: %s", format)
+	}
+	if c.Tokens == nil {
+		c.Tokens = make(map[string]string)
+	}
+	if c.Proxies == nil {
+		c.Proxies = make(map[string]string)
+	}
+	return nil
+}
+
+// clone 复制配置，map和slice不和原配置共享
+func (c *Config) clone() *Config {
+	ret := *c
+	ret.Tokens = copyMap(c.Tokens)
+	ret.Proxies = copyMap(c.Proxies)
+	ret.Download.Dirs = copyMap(c.Download.Dirs)
+	ret.Download.PostProcessors = append([]string(nil), c.Download.PostProcessors...)
+	ret.Queue.MaxPerIE = copyMap(c.Queue.MaxPerIE)
+	if ret.Tokens == nil {
+		ret.Tokens = make(map[string]string)
+	}
+	if ret.Proxies == nil {
+		ret.Proxies = make(map[string]string)
+	}
+	return &ret
+}
+
+// decodeError 把json的错误转换为带有字段路径的错误
+func decodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return &FieldError{
+			Field: typeErr.Field,
+			Msg:   fmt.Sprintf("cannot use %s as %s", typeErr.Value, typeErr.Type),
+		}
+	}
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return &FieldError{
+			Field: strings.Trim(name, `"`),
+			Msg:   "unknown field",
+		}
+	}
+	return err
+}
+
+func (c *Config) resolvePaths(base string) {
+	abs := func(p string) string {
+		if p == "" || filepath.IsAbs(p) || strings.HasPrefix(p, "~") {
+			return p
+		}
+		return filepath.Join(base, p)
+	}
+	c.DB.Path = abs(c.DB.Path)
+	c.Download.Dir = abs(c.Download.Dir)
+	for ie, dir := range c.Download.Dirs {
+		c.Download.Dirs[ie] = abs(dir)
+	}
+}
+
+// IEProxy IE的API客户端使用的代理，没有单独设置时使用Proxy
+func (c *Config) IEProxy(ie string) string {
+	if p, ok := c.Proxies[ie]; ok {
+		return p
+	}
+	return c.Proxy
+}
+
+// DownloadOption 下载资源的默认选项，ie不为空时使用该IE的下载目录
+func (c *Config) DownloadOption(ie ...string) monitor.AssetDownloadOption {
+	d := c.Download
+	opt := monitor.AssetDownloadOption{
+		Subtitle:            d.Subtitle,
+		IsDownloadThumbnail: d.Thumbnail,
+		IsOriginalSubtitle:  d.OriginalOnly,
+		SubtitleFormat:      d.SubtitleFormat,
+		Dir:                 d.Dir,
+		Quality:             string(d.Quality),
+		HopeMediaType:       d.HopeMediaType,
+		PostProcessors:      append([]string(nil), d.PostProcessors...),
+	}
+	if len(ie) != 0 {
+		if dir, ok := d.Dirs[ie[0]]; ok && dir != "" {
+			opt.Dir = dir
+		}
+	}
+	return opt
+}
+
+func (c *Config) QueueOption(base ...monitor.QueueOption) monitor.QueueOption {
+	var opt monitor.QueueOption
+	if len(base) != 0 {
+		opt = base[0]
+	}
+	opt.Enable = c.Queue.Enable
+	opt.MaxConcurrent = c.Queue.MaxConcurrent
+	opt.MaxPerBundle = c.Queue.MaxPerBundle
+	opt.MaxPerIE = copyMap(c.Queue.MaxPerIE)
+	opt.MaxRetries = c.Queue.MaxRetries
+	opt.RetryDelay = time.Duration(c.Queue.RetryDelay)
+	opt.StartPaused = c.Queue.StartPaused
+	return opt
+}
+
+// SchedulerOption base中的回调保持不变，base没有设置FeedDownloadOption时按feed的IE选择下载目录
+func (c *Config) SchedulerOption(base ...monitor.SchedulerOption) monitor.SchedulerOption {
+	var opt monitor.SchedulerOption
+	if len(base) != 0 {
+		opt = base[0]
+	}
+	s := c.Scheduler
+	opt.Enable = s.Enable
+	opt.DefaultInterval = time.Duration(s.DefaultInterval)
+	opt.MaxBackoff = time.Duration(s.MaxBackoff)
+	opt.Jitter = s.Jitter
+	opt.Concurrency = s.Concurrency
+	opt.CheckInterval = time.Duration(s.CheckInterval)
+	opt.DownloadOption = c.DownloadOption()
+	if opt.FeedDownloadOption == nil && len(c.Download.Dirs) != 0 {
+		cfg := *c
+		opt.FeedDownloadOption = func(feed *monitor.Bundle) monitor.AssetDownloadOption {
+			return cfg.DownloadOption(feed.IE)
+		}
+	}
+	return opt
+}
+
+func (c *Config) RetentionOption(base ...monitor.RetentionOption) monitor.RetentionOption {
+	var opt monitor.RetentionOption
+	if len(base) != 0 {
+		opt = base[0]
+	}
+	opt.Enable = c.Retention.Enable
+	opt.Interval = time.Duration(c.Retention.Interval)
+	return opt
+}
+
+/*
+MonitorOption 生成Monitor的选项
+base提供配置文件中没有的字段，如回调、RegistDownloader、外部的数据库，配置中的字段覆盖base
+*/
+func (c *Config) MonitorOption(base ...monitor.MonitorOption) monitor.MonitorOption {
+	var opt monitor.MonitorOption
+	if len(base) != 0 {
+		opt = base[0]
+	}
+	opt.Verbose = c.DB.Verbose
+	opt.IECallTimeout = time.Duration(c.IETimeout)
+	opt.IEToken = make(ies.IETokens, len(c.Tokens))
+	for ie, token := range c.Tokens {
+		opt.IEToken[ie] = token
+	}
+	opt.AssetTableName = c.Tables.Asset
+	opt.BundleTableName = c.Tables.Bundle
+	opt.QueueTableName = c.Tables.Queue
+	opt.ArchiveTableName = c.Tables.Archive
+	opt.RootCacheTableName = c.Tables.RootCache
+	opt.YoutubeQuotaTableName = c.Tables.YoutubeQuota
+	if opt.DBOption.OutDB == nil {
+		opt.DBOption = db.DBOption{
+			DBPath: c.DB.Path,
+		}
+	}
+	opt.Scheduler = c.SchedulerOption(opt.Scheduler)
+	opt.Queue = c.QueueOption(opt.Queue)
+	opt.Retention = c.RetentionOption(opt.Retention)
+	opt.Archive = monitor.ArchiveOption{
+		Enable:       c.Archive.Enable,
+		RecordOnSave: c.Archive.RecordOnSave,
+	}
+	opt.RootCache = monitor.RootCacheOption{
+		Capacity: c.RootCache.Capacity,
+		TTL:      time.Duration(c.RootCache.TTL),
+		Persist:  c.RootCache.Persist,
+	}
+	opt.YoutubeQuota = monitor.YoutubeQuotaOption{
+		DailyLimit: c.YoutubeQuota.DailyLimit,
+		LowReserve: c.YoutubeQuota.LowReserve,
+		Persist:    c.YoutubeQuota.Persist,
+	}
+	return opt
+}
+
+// ApplyProxy 设置下载和IE客户端的代理，IE的代理只对之后创建的客户端生效
+func (c *Config) ApplyProxy() {
+	downloader.SetProxy(c.Proxy)
+	ytbapi.SetProxy(c.IEProxy(youtube.Name()))
+	insapi.SetProxy(c.IEProxy(instagram.Name()))
+}
+
+// NewMonitor 设置代理后按配置创建Monitor，base同MonitorOption
+func NewMonitor(c *Config, base ...monitor.MonitorOption) (*monitor.Monitor, error) {
+	c.ApplyProxy()
+	return monitor.NewMonitor(c.MonitorOption(base...))
+}
+
+func copyMap[K comparable, V any](m map[K]V) map[K]V {
+	if m == nil {
+		return nil
+	}
+	ret := make(map[K]V, len(m))
+	for k, v := range m {
+		ret[k] = v
+	}
+	return ret
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,134 @@
+package config
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ApplyEnv 用环境变量覆盖配置，environ的格式同os.Environ
+变量名是 EnvPrefix 加上字段路径的大写，数组用逗号分隔，map的键名转换为小写
+*/
+func (c *Config) ApplyEnv(environ []string) error {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		key, value, ok := strings.Cut(kv, "=")
+		if ok && strings.HasPrefix(key, EnvPrefix) {
+			env[key] = value
+		}
+	}
+	errs := make([]error, 0)
+	applyEnvStruct(reflect.ValueOf(c).Elem(), strings.TrimSuffix(EnvPrefix, "_"), "", env, &errs)
+	return errors.Join(errs...)
+}
+
+func applyEnvStruct(v reflect.Value, envPath, fieldPath string, env map[string]string, errs *[]error) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		envName := envPath + "_" + strings.ToUpper(name)
+		field := joinField(fieldPath, name)
+		fv := v.Field(i)
+		switch fv.Kind() {
+		case reflect.Struct:
+			applyEnvStruct(fv, envName, field, env, errs)
+		case reflect.Map:
+			applyEnvMap(fv, envName, field, env, errs)
+		default:
+			value, ok := env[envName]
+			if !ok {
+				continue
+			}
+			if err := setValue(fv, value); err != nil {
+				*errs = append(*errs, &FieldError{
+					Field: field,
+					Msg:   fmt.Sprintf("%s: %s", envName, err),
+				})
+			}
+		}
+	}
+}
+
+func applyEnvMap(v reflect.Value, envName, field string, env map[string]string, errs *[]error) {
+	prefix := envName + "_"
+	keys := make([]string, 0)
+	for key := range env {
+		if strings.HasPrefix(key, prefix) && len(key) > len(prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if err := setValue(elem, env[key]); err != nil {
+			*errs = append(*errs, &FieldError{
+				Field: field,
+				Msg:   fmt.Sprintf("%s: %s", key, err),
+			})
+			continue
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		v.SetMapIndex(reflect.ValueOf(strings.ToLower(key[len(prefix):])), elem)
+	}
+}
+
+func setValue(v reflect.Value, s string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("invalid bool %q", s)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", s)
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		list := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := setValue(elem, item); err != nil {
+				return err
+			}
+			list = reflect.Append(list, elem)
+		}
+		v.Set(list)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func joinField(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
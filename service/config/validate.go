@@ -0,0 +1,171 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/yinyajiang/yt-mnt/pkg/common"
+	"github.com/yinyajiang/yt-mnt/pkg/downloader"
+	"github.com/yinyajiang/yt-mnt/pkg/ies"
+)
+
+// FieldError 配置字段的错误，Field是配置文件中的路径，如 queue.max_concurrent
+type FieldError struct {
+	Field string
+	Msg   string
+}
+
+func (e *FieldError) Error() string {
+	if e.Field == "" {
+		return e.Msg
+	}
+	return e.Field + ": " + e.Msg
+}
+
+var tableNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Validate 检查所有字段，返回的错误包含每个无效字段的*FieldError
+func (c *Config) Validate() error {
+	errs := make([]error, 0)
+	fail := func(field, format string, args ...any) {
+		errs = append(errs, &FieldError{
+			Field: field,
+			Msg:   fmt.Sprintf(format, args...),
+		})
+	}
+
+	if strings.TrimSpace(c.DB.Path) == "" {
+		fail("db.path", "is required")
+	}
+
+	tables := map[string]string{
+		"tables.asset":         c.Tables.Asset,
+		"tables.bundle":        c.Tables.Bundle,
+		"tables.queue":         c.Tables.Queue,
+		"tables.archive":       c.Tables.Archive,
+		"tables.root_cache":    c.Tables.RootCache,
+		"tables.youtube_quota": c.Tables.YoutubeQuota,
+	}
+	seen := make(map[string]string)
+	for _, field := range sortedKeys(tables) {
+		name := tables[field]
+		if name == "" {
+			continue
+		}
+		if !tableNameRegexp.MatchString(name) {
+			fail(field, "invalid table name %q", name)
+			continue
+		}
+		if other, ok := seen[strings.ToLower(name)]; ok {
+			fail(field, "table name %q is already used by %s", name, other)
+			continue
+		}
+		seen[strings.ToLower(name)] = field
+	}
+
+	known := make(map[string]bool)
+	for _, name := range ies.Names() {
+		known[name] = true
+		if strings.TrimSpace(c.Tokens[name]) == "" {
+			fail("tokens."+name, "is required")
+		}
+	}
+	checkIEKeys := func(field string, keys []string) {
+		for _, key := range keys {
+			if !known[key] {
+				fail(field+"."+key, "unknown IE, expected one of %s", strings.Join(ies.Names(), ", "))
+			}
+		}
+	}
+	checkIEKeys("tokens", sortedKeys(c.Tokens))
+	checkIEKeys("proxies", sortedKeys(c.Proxies))
+	checkIEKeys("download.dirs", sortedKeys(c.Download.Dirs))
+	checkIEKeys("queue.max_per_ie", sortedKeys(c.Queue.MaxPerIE))
+
+	if err := validateProxy(c.Proxy); err != nil {
+		fail("proxy", "%s", err)
+	}
+	for _, ie := range sortedKeys(c.Proxies) {
+		if err := validateProxy(c.Proxies[ie]); err != nil {
+			fail("proxies."+ie, "%s", err)
+		}
+	}
+
+	d := c.Download
+	switch q := strings.ToLower(string(d.Quality)); q {
+	case "", "best", "worst":
+	default:
+		if _, ok := common.ParseResolutionInfo(q); !ok {
+			fail("download.quality", "invalid quality %q, expected best, worst or a resolution like 1080p", d.Quality)
+		}
+	}
+	switch strings.ToLower(d.SubtitleFormat) {
+	case "", "srt", "vtt", "ttml":
+	default:
+		fail("download.subtitle_format", "invalid format %q, expected srt, vtt or ttml", d.SubtitleFormat)
+	}
+	if _, err := downloader.ParsePostProcessors(d.PostProcessors); err != nil {
+		fail("download.post_processors", "%s", err)
+	}
+
+	q := c.Queue
+	nonNegative := map[string]int{
+		"queue.max_concurrent":  q.MaxConcurrent,
+		"queue.max_per_bundle":  q.MaxPerBundle,
+		"queue.max_retries":     q.MaxRetries,
+		"scheduler.concurrency": c.Scheduler.Concurrency,
+		"root_cache.capacity":   c.RootCache.Capacity,
+	}
+	for _, ie := range sortedKeys(q.MaxPerIE) {
+		nonNegative["queue.max_per_ie."+ie] = q.MaxPerIE[ie]
+	}
+	durations := map[string]Duration{
+		"queue.retry_delay":          q.RetryDelay,
+		"scheduler.default_interval": c.Scheduler.DefaultInterval,
+		"scheduler.max_backoff":      c.Scheduler.MaxBackoff,
+		"scheduler.check_interval":   c.Scheduler.CheckInterval,
+		"retention.interval":         c.Retention.Interval,
+		"ie_timeout":                 c.IETimeout,
+		"root_cache.ttl":             c.RootCache.TTL,
+	}
+	for field, d := range durations {
+		nonNegative[field] = int(d)
+	}
+	for _, field := range sortedKeys(nonNegative) {
+		if nonNegative[field] < 0 {
+			fail(field, "must not be negative")
+		}
+	}
+	if yq := c.YoutubeQuota; yq.DailyLimit < 0 {
+		fail("youtube_quota.daily_limit", "must not be negative")
+	} else if yq.DailyLimit > 0 && yq.LowReserve >= yq.DailyLimit {
+		fail("youtube_quota.low_reserve", "must be less than daily_limit %d", yq.DailyLimit)
+	}
+	if j := c.Scheduler.Jitter; j < 0 || j > 0.5 {
+		fail("scheduler.jitter", "must be between 0 and 0.5, got %g", j)
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateProxy(proxy string) error {
+	if proxy == "" {
+		return nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return fmt.Errorf("invalid proxy url %q", proxy)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("invalid proxy url %q, expected http, https or socks5 scheme", proxy)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid proxy url %q, missing host", proxy)
+	}
+	return nil
+}
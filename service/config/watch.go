@@ -0,0 +1,231 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/yinyajiang/yt-mnt/pkg/downloader"
+	"github.com/yinyajiang/yt-mnt/pkg/ies"
+	"github.com/yinyajiang/yt-mnt/service/monitor"
+)
+
+type WatchOption struct {
+	//检查文件修改的周期，<=0 使用默认值5秒
+	Interval time.Duration
+	//创建Monitor时传入的base，重启调度器、队列和清理时保留其中的回调
+	Base monitor.MonitorOption
+	//每次重新加载后调用，restart是修改了但需要重启Monitor才生效的字段，加载失败时cfg为空
+	OnReload func(cfg *Config, restart []string, err error)
+}
+
+/*
+Watcher 配置文件修改后重新加载，不重启Monitor应用以下设置:
+下载代理、下载选项、调度器、队列的并发限制和开关、清理的周期和开关
+数据库、表名、token、IE的代理、超时、缓存和配额、存档和队列的重试设置需要重启，在重启之前保持原来的值
+*/
+type Watcher struct {
+	path string
+	m    *monitor.Monitor
+	opt  WatchOption
+
+	//reload保证同时只有一个重新加载，lock保护下面的字段
+	reload  sync.Mutex
+	lock    sync.Mutex
+	cfg     *Config
+	modTime time.Time
+	size    int64
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Watch 开始检查path的修改，cfg是创建m时使用的配置
+func Watch(path string, m *monitor.Monitor, cfg *Config, opt ...WatchOption) *Watcher {
+	w := &Watcher{
+		path: path,
+		m:    m,
+		cfg:  cfg,
+	}
+	if len(opt) != 0 {
+		w.opt = opt[0]
+	}
+	if w.opt.Interval <= 0 {
+		w.opt.Interval = 5 * time.Second
+	}
+	if info, err := os.Stat(path); err == nil {
+		w.modTime, w.size = info.ModTime(), info.Size()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		ticker := time.NewTicker(w.opt.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if w.changed() {
+					w.Reload()
+				}
+			}
+		}
+	}()
+	return w
+}
+
+// Stop 停止检查，等待正在进行的重新加载完成
+func (w *Watcher) Stop() {
+	w.cancel()
+	w.wg.Wait()
+}
+
+// Config 当前生效的配置
+func (w *Watcher) Config() *Config {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.cfg
+}
+
+func (w *Watcher) changed() bool {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return false
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return false
+	}
+	w.modTime, w.size = info.ModTime(), info.Size()
+	return true
+}
+
+// Reload 立即重新加载并应用，加载失败时保持当前的配置
+func (w *Watcher) Reload() (restart []string, err error) {
+	w.reload.Lock()
+	defer w.reload.Unlock()
+
+	cur := w.Config()
+	next, err := Load(w.path)
+	if err == nil {
+		restart = structuralChanges(cur, next)
+		keepStructural(next, cur)
+		err = w.apply(cur, next)
+		w.lock.Lock()
+		w.cfg = next
+		w.lock.Unlock()
+	}
+	if w.opt.OnReload != nil {
+		w.opt.OnReload(next, restart, err)
+	} else if err != nil {
+		log.Printf("reload config %s: %s", w.path, err)
+	} else if len(restart) != 0 {
+		log.Printf("reload config %s: changes of %v take effect after restart", w.path, restart)
+	}
+	return restart, err
+}
+
+func (w *Watcher) apply(old, next *Config) error {
+	errs := make([]error, 0)
+	base := w.opt.Base
+
+	if old.Proxy != next.Proxy {
+		downloader.SetProxy(next.Proxy)
+	}
+
+	if old.Queue.Enable != next.Queue.Enable {
+		if next.Queue.Enable {
+			errs = append(errs, w.m.StartQueue(next.QueueOption(base.Queue)))
+		} else {
+			w.m.StopQueue()
+		}
+	} else if next.Queue.Enable && !reflect.DeepEqual(old.Queue, next.Queue) {
+		errs = append(errs, w.m.SetQueueLimits(next.Queue.MaxConcurrent, next.Queue.MaxPerBundle, copyMap(next.Queue.MaxPerIE)))
+	}
+
+	//调度器停止时会等待正在进行的更新
+	if !reflect.DeepEqual(old.Scheduler, next.Scheduler) || !reflect.DeepEqual(old.Download, next.Download) {
+		w.m.StopScheduler()
+		if next.Scheduler.Enable {
+			errs = append(errs, w.m.StartScheduler(next.SchedulerOption(base.Scheduler)))
+		}
+	}
+
+	if old.Retention != next.Retention {
+		w.m.StopRetentionSweeper()
+		if next.Retention.Enable {
+			errs = append(errs, w.m.StartRetentionSweeper(next.RetentionOption(base.Retention)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// structuralChanges 修改后需要重启Monitor才生效的字段
+func structuralChanges(old, next *Config) []string {
+	changes := make([]string, 0)
+	if old.DB != next.DB {
+		changes = append(changes, "db")
+	}
+	if old.Tables != next.Tables {
+		changes = append(changes, "tables")
+	}
+	if !reflect.DeepEqual(old.Tokens, next.Tokens) {
+		changes = append(changes, "tokens")
+	}
+	if old.IETimeout != next.IETimeout {
+		changes = append(changes, "ie_timeout")
+	}
+	for _, ie := range ies.Names() {
+		if old.IEProxy(ie) != next.IEProxy(ie) {
+			changes = append(changes, "proxies."+ie)
+		}
+	}
+	if old.Archive != next.Archive {
+		changes = append(changes, "archive")
+	}
+	if old.RootCache != next.RootCache {
+		changes = append(changes, "root_cache")
+	}
+	if old.YoutubeQuota != next.YoutubeQuota {
+		changes = append(changes, "youtube_quota")
+	}
+	if old.Queue.MaxRetries != next.Queue.MaxRetries {
+		changes = append(changes, "queue.max_retries")
+	}
+	if old.Queue.RetryDelay != next.Queue.RetryDelay {
+		changes = append(changes, "queue.retry_delay")
+	}
+	if old.Queue.StartPaused != next.Queue.StartPaused {
+		changes = append(changes, "queue.start_paused")
+	}
+	return changes
+}
+
+// keepStructural 需要重启的字段保持当前的值，重启前继续报告这些修改
+func keepStructural(next, cur *Config) {
+	next.DB = cur.DB
+	next.Tables = cur.Tables
+	next.Tokens = cur.Tokens
+	next.IETimeout = cur.IETimeout
+	next.Archive = cur.Archive
+	next.RootCache = cur.RootCache
+	next.YoutubeQuota = cur.YoutubeQuota
+	next.Queue.MaxRetries = cur.Queue.MaxRetries
+	next.Queue.RetryDelay = cur.Queue.RetryDelay
+	next.Queue.StartPaused = cur.Queue.StartPaused
+	//IE的代理保存为每个IE实际使用的值，Proxy只用于下载
+	proxies := make(map[string]string)
+	for _, ie := range ies.Names() {
+		proxies[ie] = cur.IEProxy(ie)
+	}
+	next.Proxies = proxies
+}
@@ -0,0 +1,83 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/yinyajiang/yt-mnt/service/monitor"
+)
+
+// 事件流的心跳间隔，避免代理断开空闲的连接
+const sseHeartbeat = 30 * time.Second
+
+var eventNames = map[int]string{
+	monitor.EventAssetCreated:       "asset_created",
+	monitor.EventAssetStatusChanged: "asset_status",
+	monitor.EventAssetProgress:      "asset_progress",
+	monitor.EventAssetDeleted:       "asset_deleted",
+	monitor.EventFeedUpdated:        "feed_updated",
+	monitor.EventFeedError:          "feed_error",
+	monitor.EventBundleAdded:        "bundle_added",
+	monitor.EventBundleDeleted:      "bundle_deleted",
+	monitor.EventTitleChanged:       "title_changed",
+}
+
+// eventJSON 事件的JSON格式，错误转换为字符串
+type eventJSON struct {
+	monitor.Event
+	Name string
+	Err  string `json:",omitempty"`
+}
+
+// events Server-Sent Events推送事件，?type=1,3 只推送指定类型
+func (s *Server) events(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	types, err := queryInts(r, "type")
+	if err != nil {
+		return nil, err
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("streaming unsupported")
+	}
+	sub := s.m.SubscribeContext(r.Context(), s.opt.EventBuffer, types...)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				return nil, nil
+			}
+			data := eventJSON{
+				Event: e,
+				Name:  eventNames[e.Type],
+			}
+			if e.Err != nil {
+				data.Err = e.Err.Error()
+			}
+			by, err := json.Marshal(data)
+			if err != nil {
+				continue
+			}
+			if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", data.Name, by); err != nil {
+				return nil, nil
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return nil, nil
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,543 @@
+package httpapi
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yinyajiang/yt-mnt/pkg/ies"
+	"github.com/yinyajiang/yt-mnt/service/monitor"
+	"gorm.io/gorm"
+)
+
+type listResult[T any] struct {
+	Total int64
+	Items []T
+}
+
+var okResult = map[string]bool{"ok": true}
+
+type explorerInfo struct {
+	Handle   string
+	URL      string
+	Root     *ies.MediaEntry
+	Explored int
+	Loaded   int
+	IsEnd    bool
+	IsPlain  bool
+}
+
+func newExplorerInfo(handle string, e *monitor.Explorer) *explorerInfo {
+	return &explorerInfo{
+		Handle:   handle,
+		URL:      e.URL(),
+		Root:     e.Root(),
+		Explored: e.ExploredCount(),
+		Loaded:   e.AllLoadSize(),
+		IsEnd:    e.IsEnd(),
+		IsPlain:  e.IsPlain(),
+	}
+}
+
+// withExplorer 在handle的锁内操作explorer
+func (s *Server) withExplorer(handle string, fn func(e *monitor.Explorer) (any, error)) (any, error) {
+	v, _ := s.explorerLocks.LoadOrStore(handle, &sync.Mutex{})
+	lock := v.(*sync.Mutex)
+	lock.Lock()
+	defer lock.Unlock()
+	e := s.explorers.Get(handle)
+	if e == nil {
+		s.explorerLocks.Delete(handle)
+		return nil, errNotFound
+	}
+	return fn(e)
+}
+
+type openExplorerRequest struct {
+	URL   string
+	Plain bool
+}
+
+func (s *Server) openExplorer(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	var req openExplorerRequest
+	if err := readJSON(r, &req); err != nil {
+		return nil, err
+	}
+	if req.URL == "" {
+		return nil, errBadRequest("url is empty")
+	}
+	e, err := s.m.OpenExplorerContext(r.Context(), req.URL, req.Plain)
+	if err != nil {
+		return nil, err
+	}
+	return newExplorerInfo(s.explorers.Put(e), e), nil
+}
+
+func (s *Server) getExplorer(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	return s.withExplorer(args[0], func(e *monitor.Explorer) (any, error) {
+		return newExplorerInfo(args[0], e), nil
+	})
+}
+
+func (s *Server) closeExplorer(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	_, err := s.withExplorer(args[0], func(e *monitor.Explorer) (any, error) {
+		e.Close()
+		s.explorers.Delete(args[0])
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return okResult, nil
+}
+
+type exploreResult struct {
+	*explorerInfo
+	//Entries第一个在所有已获取项中的索引，用于选择
+	Start   int
+	Entries []*ies.MediaEntry
+}
+
+// exploreNext ?max=N 获取下一批，?all=true 获取剩下所有的
+func (s *Server) exploreNext(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	max, err := queryInt(r, "max", -1)
+	if err != nil {
+		return nil, err
+	}
+	all := queryBool(r, "all")
+	return s.withExplorer(args[0], func(e *monitor.Explorer) (any, error) {
+		start := e.ExploredCount()
+		var entries []*ies.MediaEntry
+		var err error
+		if all {
+			entries, err = e.ExploreNextAllContext(r.Context())
+		} else {
+			entries, err = e.ExploreNextContext(r.Context(), max)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &exploreResult{
+			explorerInfo: newExplorerInfo(args[0], e),
+			Start:        start,
+			Entries:      entries,
+		}, nil
+	})
+}
+
+func (s *Server) explorerItems(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	offset, limit, err := pageParams(r)
+	if err != nil {
+		return nil, err
+	}
+	return s.withExplorer(args[0], func(e *monitor.Explorer) (any, error) {
+		items := e.AllPage()
+		return &listResult[*ies.MediaEntry]{
+			Total: int64(len(items)),
+			Items: page(items, offset, limit),
+		}, nil
+	})
+}
+
+func (s *Server) openItemExplorer(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	index, err := parseIndex(args[1])
+	if err != nil {
+		return nil, err
+	}
+	var item *monitor.Explorer
+	_, err = s.withExplorer(args[0], func(e *monitor.Explorer) (any, error) {
+		item, err = s.m.OpenItemExplorer(e, index)
+		return nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newExplorerInfo(s.explorers.Put(item), item), nil
+}
+
+/*
+selectRequest 选择explorer中的项
+Selected为索引，也可以是monitor.IndexCurrentPage等负数，MediaTypes按类型选择
+*/
+type selectRequest struct {
+	Selected   []int
+	MediaTypes []int
+	//按类型选择时先获取所有页
+	AllPage bool
+	//subscribe时复用的bundle id
+	ReuseID uint
+	//为空时使用服务的默认下载选项
+	Option *monitor.AssetDownloadOption
+}
+
+func (req *selectRequest) apply(e *monitor.Explorer) error {
+	if len(req.Selected) == 0 && len(req.MediaTypes) == 0 {
+		return errBadRequest("nothing selected")
+	}
+	e.ResetSelected()
+	e.Select(req.Selected...)
+	for _, t := range req.MediaTypes {
+		e.SelectMediaType(t, req.AllPage)
+	}
+	return nil
+}
+
+func (s *Server) subscribeSelected(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	var req selectRequest
+	if err := readJSON(r, &req); err != nil {
+		return nil, err
+	}
+	return s.withExplorer(args[0], func(e *monitor.Explorer) (any, error) {
+		if err := req.apply(e); err != nil {
+			return nil, err
+		}
+		if req.ReuseID != 0 {
+			return s.m.SubscribeSelected(e, req.ReuseID)
+		}
+		return s.m.SubscribeSelected(e)
+	})
+}
+
+func (s *Server) addSelected(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	var req selectRequest
+	if err := readJSON(r, &req); err != nil {
+		return nil, err
+	}
+	return s.withExplorer(args[0], func(e *monitor.Explorer) (any, error) {
+		if err := req.apply(e); err != nil {
+			return nil, err
+		}
+		return s.m.AssetbasedSelected(e, nil, s.downloadOption(req.Option))
+	})
+}
+
+func (s *Server) downloadOption(opt *monitor.AssetDownloadOption) monitor.AssetDownloadOption {
+	if opt == nil {
+		return s.opt.DownloadOption
+	}
+	return *opt
+}
+
+// listBundles ?type=1,2 按类型过滤，?count=true 同时统计资源数量
+func (s *Server) listBundles(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	types, err := queryInts(r, "type")
+	if err != nil {
+		return nil, err
+	}
+	offset, limit, err := pageParams(r)
+	if err != nil {
+		return nil, err
+	}
+	var bundles []*monitor.Bundle
+	if len(types) > 0 {
+		bundles, err = s.m.ListTypeBundles(false, queryBool(r, "count"), types...)
+	} else {
+		bundles, err = s.m.ListBundlesByWheres(false, queryBool(r, "count"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &listResult[*monitor.Bundle]{
+		Total: int64(len(bundles)),
+		Items: page(bundles, offset, limit),
+	}, nil
+}
+
+func (s *Server) getBundle(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	id, err := parseID(args[0])
+	if err != nil {
+		return nil, err
+	}
+	bundles, err := s.m.ListBundlesByWheres(false, true, &monitor.Bundle{
+		Model: gorm.Model{
+			ID: id,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(bundles) == 0 {
+		return nil, errNotFound
+	}
+	return bundles[0], nil
+}
+
+type renameRequest struct {
+	Title string
+}
+
+func (s *Server) renameBundle(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	id, err := parseID(args[0])
+	if err != nil {
+		return nil, err
+	}
+	var req renameRequest
+	if err = readJSON(r, &req); err != nil {
+		return nil, err
+	}
+	if req.Title == "" {
+		return nil, errBadRequest("title is empty")
+	}
+	if err = s.m.ChangeBundleTitle(id, req.Title); err != nil {
+		return nil, err
+	}
+	return okResult, nil
+}
+
+// deleteBundle ?remain_finished=true 保留已经下载完成的文件
+func (s *Server) deleteBundle(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	id, err := parseID(args[0])
+	if err != nil {
+		return nil, err
+	}
+	s.m.DeleteBundle(id, queryBool(r, "remain_finished"))
+	return okResult, nil
+}
+
+type updateFeedResult struct {
+	FeedID            uint
+	NewAssets         []*monitor.Asset
+	AutoDownloaded    []uint
+	AutoDownloadError string `json:",omitempty"`
+}
+
+// updateFeed 请求体为monitor.AssetDownloadOption，为空时使用服务的默认下载选项
+func (s *Server) updateFeed(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	id, err := parseID(args[0])
+	if err != nil {
+		return nil, err
+	}
+	opt := s.opt.DownloadOption
+	if err = readJSON(r, &opt); err != nil {
+		return nil, err
+	}
+	result := s.m.UpdateFeedWithResultContext(r.Context(), id, opt)
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	ret := &updateFeedResult{
+		FeedID:         id,
+		NewAssets:      result.NewAssets,
+		AutoDownloaded: result.AutoDownloaded,
+	}
+	if result.AutoDownloadErr != nil {
+		ret.AutoDownloadError = result.AutoDownloadErr.Error()
+	}
+	return ret, nil
+}
+
+// unsubscribe ?delete_empty=true 没有资源时直接删除
+func (s *Server) unsubscribe(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	id, err := parseID(args[0])
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := s.m.Unsubscribe(id, queryBool(r, "delete_empty"))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]bool{"deleted": deleted}, nil
+}
+
+func (s *Server) listBundleAssets(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	id, err := parseID(args[0])
+	if err != nil {
+		return nil, err
+	}
+	q, err := assetQuery(r)
+	if err != nil {
+		return nil, err
+	}
+	q.BundleID = id
+	return s.listAssets(q)
+}
+
+func (s *Server) stopBundle(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	id, err := parseID(args[0])
+	if err != nil {
+		return nil, err
+	}
+	s.m.StopBundleDownloading(id, false)
+	return okResult, nil
+}
+
+/*
+queryAssets 参数:
+bundle、ie、media_id、status(逗号分隔)、type、keyword、
+uploaded_after、uploaded_before(RFC3339或2006-01-02)、order、offset、limit
+*/
+func (s *Server) queryAssets(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	q, err := assetQuery(r)
+	if err != nil {
+		return nil, err
+	}
+	if v := r.URL.Query().Get("bundle"); v != "" {
+		if q.BundleID, err = parseID(v); err != nil {
+			return nil, err
+		}
+	}
+	return s.listAssets(q)
+}
+
+func (s *Server) listAssets(q monitor.AssetQuery) (any, error) {
+	total, err := s.m.CountAssets(q)
+	if err != nil {
+		return nil, err
+	}
+	assets, err := s.m.QueryAssets(q)
+	if err != nil {
+		return nil, err
+	}
+	return &listResult[*monitor.Asset]{
+		Total: total,
+		Items: assets,
+	}, nil
+}
+
+func assetQuery(r *http.Request) (q monitor.AssetQuery, err error) {
+	values := r.URL.Query()
+	q.IE = values.Get("ie")
+	q.MediaID = values.Get("media_id")
+	q.Keyword = values.Get("keyword")
+	if q.Status, err = queryInts(r, "status"); err != nil {
+		return
+	}
+	if q.Type, err = queryInt(r, "type", 0); err != nil {
+		return
+	}
+	if q.Order, err = queryInt(r, "order", monitor.AssetOrderNewest); err != nil {
+		return
+	}
+	if q.Offset, q.Limit, err = pageParams(r); err != nil {
+		return
+	}
+	if q.UploadedAfter, err = queryTime(r, "uploaded_after"); err != nil {
+		return
+	}
+	q.UploadedBefore, err = queryTime(r, "uploaded_before")
+	return
+}
+
+func (s *Server) getAsset(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	id, err := parseID(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return s.m.GetAsset(id)
+}
+
+func (s *Server) renameAsset(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	id, err := parseID(args[0])
+	if err != nil {
+		return nil, err
+	}
+	var req renameRequest
+	if err = readJSON(r, &req); err != nil {
+		return nil, err
+	}
+	if req.Title == "" {
+		return nil, errBadRequest("title is empty")
+	}
+	if err = s.m.ChangeAssetTitle(id, req.Title); err != nil {
+		return nil, err
+	}
+	return okResult, nil
+}
+
+// deleteAsset ?remain_finished=true 保留已经下载完成的文件
+func (s *Server) deleteAsset(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	id, err := parseID(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.m.GetAsset(id); err != nil {
+		return nil, err
+	}
+	s.m.DeleteAsset(id, queryBool(r, "remain_finished"))
+	return okResult, nil
+}
+
+type downloadRequest struct {
+	//资源没有下载目录时使用，为空时使用服务默认下载选项的Dir
+	Dir            string
+	NotCheckStatus bool
+}
+
+// downloadAsset 开始下载，进度通过事件流获取
+func (s *Server) downloadAsset(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	id, err := parseID(args[0])
+	if err != nil {
+		return nil, err
+	}
+	var req downloadRequest
+	if err = readJSON(r, &req); err != nil {
+		return nil, err
+	}
+	if req.Dir == "" {
+		req.Dir = s.opt.DownloadOption.Dir
+	}
+	if err = s.m.AsyncDownloadAsset(id, req.Dir, nil, nil, nil, req.NotCheckStatus); err != nil {
+		return nil, err
+	}
+	return okResult, nil
+}
+
+func (s *Server) stopAsset(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	id, err := parseID(args[0])
+	if err != nil {
+		return nil, err
+	}
+	s.m.StopDownloading(id, false)
+	return okResult, nil
+}
+
+func (s *Server) youtubeQuota(w http.ResponseWriter, r *http.Request, args []string) (any, error) {
+	return s.m.YoutubeQuotaUsage(), nil
+}
+
+func pageParams(r *http.Request) (offset, limit int, err error) {
+	if offset, err = queryInt(r, "offset", 0); err != nil {
+		return
+	}
+	limit, err = queryInt(r, "limit", 0)
+	if offset < 0 || limit < 0 {
+		err = errBadRequest("offset and limit must not be negative")
+	}
+	return
+}
+
+// page 按offset和limit截取，limit为0不限制
+func page[T any](items []T, offset, limit int) []T {
+	if offset >= len(items) {
+		return []T{}
+	}
+	items = items[offset:]
+	if limit > 0 && limit < len(items) {
+		items = items[:limit]
+	}
+	return items
+}
+
+func parseIndex(s string) (int, error) {
+	index, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errBadRequest("invalid index: " + s)
+	}
+	return index, nil
+}
+
+func queryTime(r *http.Request, key string) (time.Time, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, v, time.Local)
+	if err != nil {
+		return time.Time{}, errBadRequest("invalid " + key + ": " + v)
+	}
+	return t, nil
+}
@@ -0,0 +1,267 @@
+package httpapi
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/yinyajiang/yt-mnt/pkg/ies"
+	"github.com/yinyajiang/yt-mnt/service/monitor"
+	"gorm.io/gorm"
+)
+
+type Option struct {
+	//为空时不校验，否则请求需要带 Authorization: Bearer <Token> 或者 ?token=<Token>
+	Token string
+	//路径前缀，默认/api
+	Prefix string
+	//同时保存的explorer数量，<=0 使用默认值100
+	ExplorerCacheCount int
+	//请求没有带下载选项时使用
+	DownloadOption monitor.AssetDownloadOption
+	//每个事件流的缓冲大小，<=0 使用默认值256
+	EventBuffer int
+}
+
+// Server 通过HTTP/JSON操作同一个Monitor，实现了http.Handler
+type Server struct {
+	m         *monitor.Monitor
+	opt       Option
+	explorers *monitor.ExplorerCaches
+	//explorer不是并发安全的，同一个handle的操作串行执行
+	explorerLocks sync.Map
+}
+
+func New(m *monitor.Monitor, opt Option) *Server {
+	if opt.Prefix == "" {
+		opt.Prefix = "/api"
+	}
+	opt.Prefix = "/" + strings.Trim(opt.Prefix, "/")
+	if opt.ExplorerCacheCount <= 0 {
+		opt.ExplorerCacheCount = 100
+	}
+	if opt.EventBuffer <= 0 {
+		opt.EventBuffer = 256
+	}
+	s := &Server{
+		m:         m,
+		opt:       opt,
+		explorers: m.CreateExplorerCacher(opt.ExplorerCacheCount),
+	}
+	//explorer被淘汰时同时删除它的锁
+	s.explorers.SetOnRemove(func(handle string) {
+		s.explorerLocks.Delete(handle)
+	})
+	return s
+}
+
+// ListenAndServe 在addr上启动服务，直到出错才返回
+func (s *Server) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, s)
+}
+
+type httpError struct {
+	code int
+	msg  string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+func errBadRequest(msg string) error {
+	return &httpError{code: http.StatusBadRequest, msg: msg}
+}
+
+var errNotFound = &httpError{code: http.StatusNotFound, msg: "not found"}
+
+type handlerFunc func(w http.ResponseWriter, r *http.Request, args []string) (any, error)
+
+type route struct {
+	method  string
+	pattern []string
+	handler handlerFunc
+}
+
+func (s *Server) routes() []route {
+	return []route{
+		{http.MethodPost, []string{"explorers"}, s.openExplorer},
+		{http.MethodGet, []string{"explorers", "*"}, s.getExplorer},
+		{http.MethodDelete, []string{"explorers", "*"}, s.closeExplorer},
+		{http.MethodPost, []string{"explorers", "*", "next"}, s.exploreNext},
+		{http.MethodGet, []string{"explorers", "*", "items"}, s.explorerItems},
+		{http.MethodPost, []string{"explorers", "*", "items", "*"}, s.openItemExplorer},
+		{http.MethodPost, []string{"explorers", "*", "subscribe"}, s.subscribeSelected},
+		{http.MethodPost, []string{"explorers", "*", "add"}, s.addSelected},
+
+		{http.MethodGet, []string{"bundles"}, s.listBundles},
+		{http.MethodGet, []string{"bundles", "*"}, s.getBundle},
+		{http.MethodPatch, []string{"bundles", "*"}, s.renameBundle},
+		{http.MethodDelete, []string{"bundles", "*"}, s.deleteBundle},
+		{http.MethodPost, []string{"bundles", "*", "update"}, s.updateFeed},
+		{http.MethodPost, []string{"bundles", "*", "unsubscribe"}, s.unsubscribe},
+		{http.MethodGet, []string{"bundles", "*", "assets"}, s.listBundleAssets},
+		{http.MethodPost, []string{"bundles", "*", "stop"}, s.stopBundle},
+
+		{http.MethodGet, []string{"assets"}, s.queryAssets},
+		{http.MethodGet, []string{"assets", "*"}, s.getAsset},
+		{http.MethodPatch, []string{"assets", "*"}, s.renameAsset},
+		{http.MethodDelete, []string{"assets", "*"}, s.deleteAsset},
+		{http.MethodPost, []string{"assets", "*", "download"}, s.downloadAsset},
+		{http.MethodPost, []string{"assets", "*", "stop"}, s.stopAsset},
+
+		{http.MethodGet, []string{"quota", "youtube"}, s.youtubeQuota},
+
+		{http.MethodGet, []string{"events"}, s.events},
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		writeError(w, &httpError{code: http.StatusUnauthorized, msg: "unauthorized"})
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, s.opt.Prefix)
+	if path == r.URL.Path && s.opt.Prefix != "/" {
+		writeError(w, errNotFound)
+		return
+	}
+	segs := strings.Split(strings.Trim(path, "/"), "/")
+
+	methodNotAllowed := false
+	for _, rt := range s.routes() {
+		args, ok := match(rt.pattern, segs)
+		if !ok {
+			continue
+		}
+		if rt.method != r.Method {
+			methodNotAllowed = true
+			continue
+		}
+		ret, err := rt.handler(w, r, args)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if ret != nil {
+			writeJSON(w, http.StatusOK, ret)
+		}
+		return
+	}
+	if methodNotAllowed {
+		writeError(w, &httpError{code: http.StatusMethodNotAllowed, msg: "method not allowed"})
+		return
+	}
+	writeError(w, errNotFound)
+}
+
+// match 按段匹配路径，*匹配任意一段并作为参数返回
+func match(pattern, segs []string) ([]string, bool) {
+	if len(pattern) != len(segs) {
+		return nil, false
+	}
+	args := make([]string, 0)
+	for i, p := range pattern {
+		if p == "*" {
+			if segs[i] == "" {
+				return nil, false
+			}
+			args = append(args, segs[i])
+		} else if p != segs[i] {
+			return nil, false
+		}
+	}
+	return args, true
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.opt.Token == "" {
+		return true
+	}
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.opt.Token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("httpapi write response fail: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	var he *httpError
+	if errors.As(err, &he) {
+		code = he.code
+	} else if errors.Is(err, gorm.ErrRecordNotFound) {
+		code = http.StatusNotFound
+	} else if errors.Is(err, ies.ErrQuotaExceeded) {
+		code = http.StatusTooManyRequests
+	}
+	writeJSON(w, code, map[string]string{
+		"error": err.Error(),
+	})
+}
+
+// readJSON 解析请求体，请求体为空时保持v不变
+func readJSON(r *http.Request, v any) error {
+	if r.Body == nil || r.ContentLength == 0 {
+		return nil
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return errBadRequest("invalid json: " + err.Error())
+	}
+	return nil
+}
+
+func parseID(s string) (uint, error) {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || id == 0 {
+		return 0, errBadRequest("invalid id: " + s)
+	}
+	return uint(id), nil
+}
+
+func queryInt(r *http.Request, key string, def int) (int, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, errBadRequest("invalid " + key + ": " + v)
+	}
+	return n, nil
+}
+
+func queryBool(r *http.Request, key string) bool {
+	v, _ := strconv.ParseBool(r.URL.Query().Get(key))
+	return v
+}
+
+// queryInts 解析逗号分隔的整数列表
+func queryInts(r *http.Request, key string) ([]int, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return nil, nil
+	}
+	ret := make([]int, 0)
+	for _, s := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return nil, errBadRequest("invalid " + key + ": " + v)
+		}
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
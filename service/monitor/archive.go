@@ -0,0 +1,181 @@
+package monitor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/yinyajiang/yt-mnt/pkg/ies"
+	"github.com/yinyajiang/yt-mnt/pkg/ies/instagram"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type ArchiveOption struct {
+	//保存资源时跳过存档中的媒体
+	Enable bool
+	//保存资源时就记录到存档，默认下载完成时才记录
+	RecordOnSave bool
+}
+
+// ArchiveItem 下载存档，同一个IE的同一个媒体只下载一次
+type ArchiveItem struct {
+	gorm.Model
+	IE      string `gorm:"uniqueIndex:,composite:media"`
+	MediaID string `gorm:"uniqueIndex:,composite:media"`
+	AssetID uint
+	Title   string
+
+	_tabname string
+}
+
+func (a *ArchiveItem) TableName() string {
+	if a._tabname != "" {
+		return a._tabname
+	}
+	return "download_archive"
+}
+
+/*
+archiveMediaID 存档使用的媒体ID，与yt-dlp的--download-archive一致
+instagram的帖子使用shortcode：优先从链接中取，mediaID是链接或pk时也转换为shortcode，其他使用MediaID
+*/
+func archiveMediaID(ie, mediaID, link string) string {
+	if ie != instagram.Name() {
+		return mediaID
+	}
+	for _, l := range []string{link, mediaID} {
+		if code, err := instagram.ParseInstagramPostCode(l); err == nil {
+			return code
+		}
+	}
+	if code, err := instagram.InstagramPostCode(mediaID); err == nil {
+		return code
+	}
+	return mediaID
+}
+
+// IsArchived 媒体是否在下载存档中，mediaID可以是IE返回的MediaID或者链接
+func (m *Monitor) IsArchived(ie, mediaID string) bool {
+	ie = strings.ToLower(ie)
+	mediaID = archiveMediaID(ie, mediaID, "")
+	if ie == "" || mediaID == "" {
+		return false
+	}
+	var item ArchiveItem
+	m._db.Where("ie = ? AND media_id = ?", ie, mediaID).Limit(1).Find(&item)
+	return item.ID != 0
+}
+
+// AddToArchive 把媒体加入下载存档，已经存在时忽略
+func (m *Monitor) AddToArchive(ie, mediaID string) error {
+	ie = strings.ToLower(ie)
+	return m.addArchive(&ArchiveItem{
+		IE:      ie,
+		MediaID: archiveMediaID(ie, mediaID, ""),
+	})
+}
+
+func (m *Monitor) RemoveFromArchive(ie, mediaID string) error {
+	ie = strings.ToLower(ie)
+	return m.storage.Delete(&ArchiveItem{}, "ie = ? AND media_id = ?", ie, archiveMediaID(ie, mediaID, ""))
+}
+
+func (m *Monitor) addArchive(items ...*ArchiveItem) error {
+	valid := make([]*ArchiveItem, 0, len(items))
+	for _, item := range items {
+		if item.IE != "" && item.MediaID != "" {
+			valid = append(valid, item)
+		}
+	}
+	if len(valid) == 0 {
+		return nil
+	}
+	return m._db.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(valid, 100).Error
+}
+
+// archiveAsset 资源下载完成后记录到存档
+func (m *Monitor) archiveAsset(asset *Asset) {
+	if asset.MediaID == "" {
+		return
+	}
+	ie := asset.IE
+	if ie == "" {
+		ie = m.assetIE(asset)
+	}
+	err := m.addArchive(&ArchiveItem{
+		IE:      ie,
+		MediaID: archiveMediaID(ie, asset.MediaID, asset.URL),
+		AssetID: asset.ID,
+		Title:   asset.Title,
+	})
+	if err != nil {
+		log.Printf("archive asset %d fail: %s", asset.ID, err)
+	}
+}
+
+// filterArchived 去掉存档中已经有的媒体，图集按整体判断
+func (m *Monitor) filterArchived(ie string, entries []*ies.MediaEntry) []*ies.MediaEntry {
+	ret := make([]*ies.MediaEntry, 0, len(entries))
+	for _, entry := range entries {
+		if m.IsArchived(ie, archiveMediaID(ie, entry.MediaID, entry.URL)) {
+			continue
+		}
+		ret = append(ret, entry)
+	}
+	return ret
+}
+
+/*
+ImportArchive 导入yt-dlp --download-archive格式的存档，每行为 "提取器 媒体ID"
+空行和#开头的行忽略，返回新加入的数量
+*/
+func (m *Monitor) ImportArchive(r io.Reader) (int, error) {
+	var before, after int64
+	m._db.Model(&ArchiveItem{}).Count(&before)
+
+	items := make([]*ArchiveItem, 0)
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return 0, fmt.Errorf("invalid archive line %d: %s", lineNo, line)
+		}
+		items = append(items, &ArchiveItem{
+			IE:      strings.ToLower(fields[0]),
+			MediaID: fields[1],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if err := m.addArchive(items...); err != nil {
+		return 0, err
+	}
+	m._db.Model(&ArchiveItem{}).Count(&after)
+	return int(after - before), nil
+}
+
+// ExportArchive 按yt-dlp --download-archive格式导出存档
+func (m *Monitor) ExportArchive(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	var items []*ArchiveItem
+	err := m._db.Order("id").FindInBatches(&items, 500, func(tx *gorm.DB, batch int) error {
+		for _, item := range items {
+			if _, err := fmt.Fprintf(bw, "%s %s\n", item.IE, item.MediaID); err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,58 @@
+package monitor
+
+import (
+	"errors"
+	"sort"
+
+	"gorm.io/gorm"
+)
+
+// SetFeedAutoDownload 设置feed的自动下载策略，policy为空时关闭自动下载
+func (m *Monitor) SetFeedAutoDownload(feedid uint, policy *AutoDownloadPolicy) error {
+	return m.storage.ModelUpdates(&Bundle{
+		Model: gorm.Model{
+			ID: feedid,
+		},
+	}, map[string]any{
+		"auto_download": policy,
+	})
+}
+
+/*
+autoDownloadAssets 按feed的策略把新资源交给下载
+下载队列运行时加入队列，否则直接开始下载
+*/
+func (m *Monitor) autoDownloadAssets(feed *Bundle, newAssets []*Asset) ([]uint, error) {
+	policy := feed.AutoDownload
+	if !policy.IsEnabled() {
+		return nil, nil
+	}
+	assets := append([]*Asset{}, newAssets...)
+	sort.SliceStable(assets, func(i, j int) bool {
+		return assets[i].UploadDate.After(assets[j].UploadDate)
+	})
+	if policy.MaxItems > 0 && len(assets) > policy.MaxItems {
+		assets = assets[:policy.MaxItems]
+	}
+	ids := make([]uint, 0, len(assets))
+	for _, asset := range assets {
+		ids = append(ids, asset.ID)
+	}
+
+	if m.getQueue() != nil {
+		if err := m.EnqueueAssets(ids, policy.Dir, policy.Priority); err != nil {
+			return nil, err
+		}
+		return ids, nil
+	}
+	started := make([]uint, 0, len(ids))
+	var errs []error
+	for _, id := range ids {
+		if err := m.AsyncDownloadAsset(id, policy.Dir, nil, nil, nil); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		started = append(started, id)
+	}
+	return started, errors.Join(errs...)
+}
@@ -0,0 +1,195 @@
+package monitor
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	EventAssetCreated = iota + 1
+	EventAssetStatusChanged
+	EventAssetProgress
+	EventAssetDeleted
+	EventFeedUpdated
+	EventFeedError
+	EventBundleAdded
+	EventBundleDeleted
+	EventTitleChanged
+)
+
+// 同一个资源的进度事件最短间隔，完成时总会发送
+const eventProgressInterval = 500 * time.Millisecond
+
+/*
+Event 监控中发生的事件，只包含值，可以在其他goroutine中安全使用
+AssetID为0表示bundle的事件
+*/
+type Event struct {
+	Type     int
+	Time     time.Time
+	BundleID uint
+	AssetID  uint
+
+	//EventAssetStatusChanged
+	Status    int
+	OldStatus int
+	//EventAssetCreated、EventBundleAdded、EventTitleChanged
+	Title string
+
+	//EventAssetProgress
+	Progress EventProgress
+
+	//EventFeedUpdated
+	NewAssets []uint
+	//EventFeedError和失败的EventAssetStatusChanged
+	Err error
+}
+
+type EventProgress struct {
+	Total      int64
+	Downloaded int64
+	Speed      int64
+	ETA        int64
+	Percent    float64
+}
+
+// Subscription 事件订阅，缓冲满时丢弃新的事件，不会阻塞发送方
+type Subscription struct {
+	C <-chan Event
+
+	ch      chan Event
+	types   map[int]bool
+	dropped atomic.Uint64
+	bus     *eventBus
+	once    sync.Once
+	//取消订阅时关闭，用于结束SubscribeContext的goroutine
+	done chan struct{}
+}
+
+// Dropped 因为缓冲满而丢弃的事件数
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close 取消订阅并关闭C，可以重复调用
+func (s *Subscription) Close() {
+	s.bus.remove(s)
+}
+
+func (s *Subscription) shutdown() {
+	s.once.Do(func() {
+		close(s.ch)
+		close(s.done)
+	})
+}
+
+type eventBus struct {
+	lock   sync.RWMutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+/*
+Subscribe 订阅事件，buffer为每个订阅的缓冲大小，<=0 使用默认值64
+types为空时订阅所有类型，Monitor关闭时C也会关闭
+*/
+func (m *Monitor) Subscribe(buffer int, types ...int) *Subscription {
+	return m.events.add(buffer, types...)
+}
+
+// SubscribeContext 同Subscribe，ctx结束时自动取消订阅
+func (m *Monitor) SubscribeContext(ctx context.Context, buffer int, types ...int) *Subscription {
+	sub := m.events.add(buffer, types...)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sub.Close()
+		case <-sub.done:
+		}
+	}()
+	return sub
+}
+
+func (b *eventBus) add(buffer int, types ...int) *Subscription {
+	if buffer <= 0 {
+		buffer = 64
+	}
+	ch := make(chan Event, buffer)
+	sub := &Subscription{
+		C:    ch,
+		ch:   ch,
+		bus:  b,
+		done: make(chan struct{}),
+	}
+	if len(types) > 0 {
+		sub.types = make(map[int]bool, len(types))
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		sub.shutdown()
+		return sub
+	}
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+func (b *eventBus) remove(sub *Subscription) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.subs, sub)
+	sub.shutdown()
+}
+
+func (b *eventBus) publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for sub := range b.subs {
+		if sub.types != nil && !sub.types[e.Type] {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+func (b *eventBus) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	for sub := range b.subs {
+		delete(b.subs, sub)
+		sub.shutdown()
+	}
+}
+
+// progressThrottle 限制同一个资源进度事件的频率
+type progressThrottle struct {
+	last time.Time
+}
+
+func (t *progressThrottle) allow(percent float64) bool {
+	now := time.Now()
+	if percent >= 100 || now.Sub(t.last) >= eventProgressInterval {
+		t.last = now
+		return true
+	}
+	return false
+}
@@ -1,6 +1,7 @@
 package monitor
 
 import (
+	"context"
 	"errors"
 	"math"
 	"sync"
@@ -9,6 +10,7 @@ import (
 	"github.com/duke-git/lancet/v2/mathutil"
 	"github.com/duke-git/lancet/v2/slice"
 	"github.com/google/uuid"
+	"github.com/yinyajiang/yt-mnt/pkg/common"
 	"github.com/yinyajiang/yt-mnt/pkg/ies"
 	"golang.org/x/exp/maps"
 )
@@ -23,6 +25,8 @@ type Explorer struct {
 	rootToken ies.RootToken
 	rootInfo  ies.MediaEntry
 	url       string
+	//打开Explorer的Monitor的生命周期，Monitor关闭时取消正在加载的页
+	ctx context.Context
 
 	nextToken ies.NextPageToken
 
@@ -53,6 +57,7 @@ func newExplorer() *Explorer {
 	var explorer Explorer
 	explorer._time = time.Now()
 	explorer._uuid = uuid.New().String()
+	explorer.ctx = context.Background()
 	explorer.userData = make(map[string]any)
 	explorer._cacher = pageItemCaches{
 		explorer: &explorer,
@@ -129,7 +134,7 @@ func (e *Explorer) Page() []*ies.MediaEntry {
 
 func (e *Explorer) AllPage(loadLeft ...bool) []*ies.MediaEntry {
 	if len(loadLeft) > 0 && loadLeft[0] {
-		e.loadAll()
+		e.loadAll(e.ctx)
 	}
 	return e.allPage
 }
@@ -146,23 +151,42 @@ func (e *Explorer) PageCount() int {
 }
 
 func (e *Explorer) ExploreAll() ([]*ies.MediaEntry, error) {
-	ret, err := e._cacher.exploreAll()
+	return e.ExploreAllContext(e.ctx)
+}
+
+func (e *Explorer) ExploreNextAll() ([]*ies.MediaEntry, error) {
+	return e.ExploreNextAllContext(e.ctx)
+}
+
+func (e *Explorer) ExploreNext(max_ ...int) ([]*ies.MediaEntry, error) {
+	return e.ExploreNextContext(e.ctx, max_...)
+}
+
+// ExploreAllContext 同ExploreAll，ctx结束或者Monitor关闭时停止加载
+func (e *Explorer) ExploreAllContext(ctx context.Context) ([]*ies.MediaEntry, error) {
+	ctx, cancel := common.MergeContext(ctx, e.ctx)
+	defer cancel()
+	ret, err := e._cacher.exploreAll(ctx)
 	e.exploredCount = len(ret)
 	return ret, err
 }
 
-func (e *Explorer) ExploreNextAll() ([]*ies.MediaEntry, error) {
-	ret, err := e._cacher.exploreNextAll()
+func (e *Explorer) ExploreNextAllContext(ctx context.Context) ([]*ies.MediaEntry, error) {
+	ctx, cancel := common.MergeContext(ctx, e.ctx)
+	defer cancel()
+	ret, err := e._cacher.exploreNextAll(ctx)
 	e.exploredCount += len(ret)
 	return ret, err
 }
 
-func (e *Explorer) ExploreNext(max_ ...int) ([]*ies.MediaEntry, error) {
+func (e *Explorer) ExploreNextContext(ctx context.Context, max_ ...int) ([]*ies.MediaEntry, error) {
 	max := -1
 	if len(max_) > 0 {
 		max = max_[0]
 	}
-	ret, err := e._cacher.exploreNext(max)
+	ctx, cancel := common.MergeContext(ctx, e.ctx)
+	defer cancel()
+	ret, err := e._cacher.exploreNext(ctx, max)
 	e.exploredCount += len(ret)
 	return ret, err
 }
@@ -245,6 +269,7 @@ func (e *Explorer) GetUserExplorer() (*Explorer, error) {
 	userExplorer.rootToken = e.rootToken
 	userExplorer.rootInfo = e.rootInfo
 	userExplorer.url = e.url
+	userExplorer.ctx = e.ctx
 	err := userExplorer.ie.ConvertToUserRoot(&userExplorer.rootToken, &userExplorer.rootInfo)
 	if err != nil {
 		return nil, err
@@ -265,7 +290,7 @@ func (e *Explorer) Selected(enableConvertUser bool) ([]*ies.MediaEntry, error) {
 	// 筛选类型
 	for _, selectedType := range e.selectedTypes {
 		if selectedType.allPage {
-			e.loadAll()
+			e.loadAll(e.ctx)
 		}
 		for i, entry := range e.allPage {
 			if entry.MediaType == selectedType.mediaType {
@@ -286,7 +311,7 @@ func (e *Explorer) Selected(enableConvertUser bool) ([]*ies.MediaEntry, error) {
 		case IndexExplored:
 			return e.allPage, nil
 		case IndexAllPage:
-			e.loadAll()
+			e.loadAll(e.ctx)
 			return e.allPage, nil
 		case IndexRoot, IndexUser:
 			item, err := e.Item(index, enableConvertUser)
@@ -337,10 +362,10 @@ func (e *Explorer) loadIsEnd() bool {
 	return e.nextToken.IsEnd
 }
 
-func (e *Explorer) loadAll() ([]*ies.MediaEntry, error) {
+func (e *Explorer) loadAll(ctx context.Context) ([]*ies.MediaEntry, error) {
 	before := len(e.allPage)
 	for !e.loadIsEnd() {
-		if _, err := e.loadNextPage(); err != nil {
+		if _, err := e.loadNextPage(ctx); err != nil {
 			return nil, err
 		}
 	}
@@ -348,19 +373,19 @@ func (e *Explorer) loadAll() ([]*ies.MediaEntry, error) {
 	return e.allPage, nil
 }
 
-func (e *Explorer) loadNextAll() ([]*ies.MediaEntry, error) {
-	_, err := e.loadAll()
+func (e *Explorer) loadNextAll(ctx context.Context) ([]*ies.MediaEntry, error) {
+	_, err := e.loadAll(ctx)
 	return e.Page(), err
 }
 
-func (e *Explorer) loadNextPage() ([]*ies.MediaEntry, error) {
+func (e *Explorer) loadNextPage(ctx context.Context) ([]*ies.MediaEntry, error) {
 	if !e.IsValid() {
 		return nil, errors.New("invalid explore handle")
 	}
 	if e.loadIsEnd() {
 		return nil, errors.New("no more page")
 	}
-	page, err := e.ie.ExtractPage(&e.rootToken, &e.nextToken)
+	page, err := e.ie.ExtractPage(ctx, &e.rootToken, &e.nextToken)
 	if err != nil {
 		return nil, err
 	}
@@ -384,18 +409,18 @@ func (p *pageItemCaches) isCacheEmpty() bool {
 	return len(p._cacheItems) == 0
 }
 
-func (p *pageItemCaches) exploreAll() ([]*ies.MediaEntry, error) {
+func (p *pageItemCaches) exploreAll(ctx context.Context) ([]*ies.MediaEntry, error) {
 	p.clear()
-	all, err := p.explorer.loadAll()
+	all, err := p.explorer.loadAll(ctx)
 	if len(all) != 0 {
 		err = nil
 	}
 	return all, err
 }
 
-func (p *pageItemCaches) exploreNextAll() ([]*ies.MediaEntry, error) {
+func (p *pageItemCaches) exploreNextAll(ctx context.Context) ([]*ies.MediaEntry, error) {
 	all := p.pop(-1)
-	nextall, err := p.explorer.loadNextAll()
+	nextall, err := p.explorer.loadNextAll(ctx)
 	all = append(all, nextall...)
 	if len(all) != 0 {
 		err = nil
@@ -403,10 +428,10 @@ func (p *pageItemCaches) exploreNextAll() ([]*ies.MediaEntry, error) {
 	return all, err
 }
 
-func (p *pageItemCaches) exploreNext(max int) ([]*ies.MediaEntry, error) {
+func (p *pageItemCaches) exploreNext(ctx context.Context, max int) ([]*ies.MediaEntry, error) {
 	if max <= 0 {
 		lastPages := p.pop(-1)
-		pages, err := p.explorer.loadNextPage()
+		pages, err := p.explorer.loadNextPage(ctx)
 		lastPages = append(lastPages, pages...)
 		if len(lastPages) != 0 {
 			err = nil
@@ -420,7 +445,7 @@ func (p *pageItemCaches) exploreNext(max int) ([]*ies.MediaEntry, error) {
 	var err error
 	for len(p._cacheItems) < max && !p.explorer.loadIsEnd() {
 		var pages []*ies.MediaEntry
-		pages, err = p.explorer.loadNextPage()
+		pages, err = p.explorer.loadNextPage(ctx)
 		if err != nil {
 			break
 		}
@@ -459,6 +484,7 @@ type ExplorerCaches struct {
 	lock         sync.RWMutex
 	explorersMap map[string]*Explorer
 	cacheCount   int
+	onRemove     func(handle string)
 }
 
 func NewExplorerCaches(cacheCount_ ...int) *ExplorerCaches {
@@ -481,11 +507,28 @@ func (c *ExplorerCaches) Put(explorer *Explorer) (handle string) {
 	defer c.lock.Unlock()
 	c.explorersMap[explorer.uuid()] = explorer
 	if len(c.explorersMap) > c.cacheCount {
-		delete(c.explorersMap, c.first().uuid())
+		c.remove(c.first().uuid())
 	}
 	return explorer.uuid()
 }
 
+// SetOnRemove 设置explorer从缓存中移除(超出数量淘汰、Pop、Delete、Clear)时的回调，回调在缓存的锁内执行，不能再操作缓存
+func (c *ExplorerCaches) SetOnRemove(fn func(handle string)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.onRemove = fn
+}
+
+func (c *ExplorerCaches) remove(handle string) {
+	if _, ok := c.explorersMap[handle]; !ok {
+		return
+	}
+	delete(c.explorersMap, handle)
+	if c.onRemove != nil {
+		c.onRemove(handle)
+	}
+}
+
 func (c *ExplorerCaches) Get(handle string) *Explorer {
 	if handle == "" {
 		return nil
@@ -547,7 +590,7 @@ func (c *ExplorerCaches) Delete(handle string, notlock ...bool) {
 		c.lock.Lock()
 		defer c.lock.Unlock()
 	}
-	delete(c.explorersMap, handle)
+	c.remove(handle)
 }
 
 func (c *ExplorerCaches) Clear(notlock ...bool) {
@@ -555,12 +598,13 @@ func (c *ExplorerCaches) Clear(notlock ...bool) {
 		c.lock.Lock()
 		defer c.lock.Unlock()
 	}
-	c.explorersMap = map[string]*Explorer{}
+	for handle := range c.explorersMap {
+		c.remove(handle)
+	}
 }
 
+// first 最早创建的explorer，调用方需要持有锁
 func (c *ExplorerCaches) first() *Explorer {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
 	if len(c.explorersMap) == 0 {
 		return nil
 	}
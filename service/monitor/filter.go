@@ -0,0 +1,296 @@
+package monitor
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/yinyajiang/yt-mnt/pkg/ies"
+	"gorm.io/gorm"
+)
+
+const (
+	FilterShortsAll = iota
+	FilterShortsExclude
+	FilterShortsOnly
+)
+
+const (
+	FilterRuleIncludeTitle       = "include_title"
+	FilterRuleExcludeTitle       = "exclude_title"
+	FilterRuleIncludeDescription = "include_description"
+	FilterRuleExcludeDescription = "exclude_description"
+	FilterRuleMinDuration        = "min_duration"
+	FilterRuleMaxDuration        = "max_duration"
+	FilterRuleMediaType          = "media_type"
+	FilterRuleShorts             = "shorts"
+	FilterRuleUploadedAfter      = "uploaded_after"
+	FilterRuleUploadedBefore     = "uploaded_before"
+	FilterRuleMaxAge             = "max_age"
+)
+
+/*
+FeedFilter feed的过滤规则，空的规则不生效
+时长或上传时间未知的媒体不受对应规则限制
+*/
+type FeedFilter struct {
+	//正则表达式，Include不为空时必须匹配，Exclude匹配时排除
+	IncludeTitle       string `json:",omitempty"`
+	ExcludeTitle       string `json:",omitempty"`
+	IncludeDescription string `json:",omitempty"`
+	ExcludeDescription string `json:",omitempty"`
+
+	//时长范围，秒，<=0 不限制
+	MinDuration int64 `json:",omitempty"`
+	MaxDuration int64 `json:",omitempty"`
+
+	//允许的媒体类型，如ies.MediaTypeVideo、ies.MediaTypeCarousel，为空不限制
+	MediaTypes []int `json:",omitempty"`
+	//FilterShortsAll/FilterShortsExclude/FilterShortsOnly
+	//youtube按时长推测是否是shorts，排除shorts时时长未知的视频也会被排除
+	Shorts int `json:",omitempty"`
+
+	//上传时间窗口
+	UploadedAfter  time.Time `json:",omitempty"`
+	UploadedBefore time.Time `json:",omitempty"`
+	//只要最近多少天上传的，<=0 不限制
+	MaxAgeDays int `json:",omitempty"`
+}
+
+// FilterRejection 被规则排除的媒体
+type FilterRejection struct {
+	Entry  *ies.MediaEntry
+	Rule   string
+	Reason string
+}
+
+type FilterResult struct {
+	Accepted []*ies.MediaEntry
+	Rejected []FilterRejection
+}
+
+func (f *FeedFilter) Value() (driver.Value, error) {
+	if f == nil {
+		return nil, nil
+	}
+	return json.Marshal(f)
+}
+
+func (f *FeedFilter) Scan(value interface{}) error {
+	if f == nil {
+		return nil
+	}
+	data, ok := value.([]byte)
+	if !ok || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, f)
+}
+
+type compiledFilter struct {
+	*FeedFilter
+	includeTitle       *regexp.Regexp
+	excludeTitle       *regexp.Regexp
+	includeDescription *regexp.Regexp
+	excludeDescription *regexp.Regexp
+}
+
+func (f *FeedFilter) compile() (*compiledFilter, error) {
+	c := &compiledFilter{FeedFilter: f}
+	for _, r := range []struct {
+		expr string
+		out  **regexp.Regexp
+		rule string
+	}{
+		{f.IncludeTitle, &c.includeTitle, FilterRuleIncludeTitle},
+		{f.ExcludeTitle, &c.excludeTitle, FilterRuleExcludeTitle},
+		{f.IncludeDescription, &c.includeDescription, FilterRuleIncludeDescription},
+		{f.ExcludeDescription, &c.excludeDescription, FilterRuleExcludeDescription},
+	} {
+		if r.expr == "" {
+			continue
+		}
+		re, err := regexp.Compile(r.expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", r.rule, err)
+		}
+		*r.out = re
+	}
+	return c, nil
+}
+
+// needDetails 规则是否用到列表接口可能不返回的时长
+func (f *FeedFilter) needDetails() bool {
+	return f != nil && (f.MinDuration > 0 || f.MaxDuration > 0 || f.Shorts != FilterShortsAll)
+}
+
+/*
+fillFilterDetails 规则需要时长时向IE补充详情
+补充失败时返回错误，不能把时长未知的媒体当作被排除，否则更新时间前进后这些媒体就永久丢失了
+*/
+func fillFilterDetails(ctx context.Context, ie ies.InfoExtractor, filter *FeedFilter, entries []*ies.MediaEntry) error {
+	if !filter.needDetails() || len(entries) == 0 {
+		return nil
+	}
+	filler, ok := ie.(ies.DetailFiller)
+	if !ok {
+		return nil
+	}
+	if err := filler.FillDetails(ctx, entries); err != nil {
+		return fmt.Errorf("fill details for filter fail: %w", err)
+	}
+	return nil
+}
+
+// Validate 检查正则表达式是否正确
+func (f *FeedFilter) Validate() error {
+	if f == nil {
+		return nil
+	}
+	_, err := f.compile()
+	return err
+}
+
+// Filter 按规则过滤媒体，每个被排除的媒体只记录第一个不满足的规则
+func (f *FeedFilter) Filter(entries []*ies.MediaEntry) (FilterResult, error) {
+	result := FilterResult{
+		Accepted: make([]*ies.MediaEntry, 0, len(entries)),
+	}
+	if f == nil {
+		result.Accepted = append(result.Accepted, entries...)
+		return result, nil
+	}
+	c, err := f.compile()
+	if err != nil {
+		return result, err
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		if rule, reason := c.check(entry, now); rule != "" {
+			result.Rejected = append(result.Rejected, FilterRejection{
+				Entry:  entry,
+				Rule:   rule,
+				Reason: reason,
+			})
+			continue
+		}
+		result.Accepted = append(result.Accepted, entry)
+	}
+	return result, nil
+}
+
+func (c *compiledFilter) check(entry *ies.MediaEntry, now time.Time) (rule, reason string) {
+	if c.includeTitle != nil && !c.includeTitle.MatchString(entry.Title) {
+		return FilterRuleIncludeTitle, "title does not match " + c.IncludeTitle
+	}
+	if c.excludeTitle != nil && c.excludeTitle.MatchString(entry.Title) {
+		return FilterRuleExcludeTitle, "title matches " + c.ExcludeTitle
+	}
+	if c.includeDescription != nil && !c.includeDescription.MatchString(entry.Description) {
+		return FilterRuleIncludeDescription, "description does not match " + c.IncludeDescription
+	}
+	if c.excludeDescription != nil && c.excludeDescription.MatchString(entry.Description) {
+		return FilterRuleExcludeDescription, "description matches " + c.ExcludeDescription
+	}
+	if entry.Duration > 0 {
+		if c.MinDuration > 0 && entry.Duration < c.MinDuration {
+			return FilterRuleMinDuration, fmt.Sprintf("duration %ds is shorter than %ds", entry.Duration, c.MinDuration)
+		}
+		if c.MaxDuration > 0 && entry.Duration > c.MaxDuration {
+			return FilterRuleMaxDuration, fmt.Sprintf("duration %ds is longer than %ds", entry.Duration, c.MaxDuration)
+		}
+	}
+	if len(c.MediaTypes) > 0 {
+		matched := false
+		for _, t := range c.MediaTypes {
+			if t == entry.MediaType {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return FilterRuleMediaType, fmt.Sprintf("media type %d is not allowed", entry.MediaType)
+		}
+	}
+	switch c.Shorts {
+	case FilterShortsExclude:
+		if entry.IsShort {
+			return FilterRuleShorts, "shorts are excluded"
+		}
+		//时长未知时无法判断是否是shorts，按shorts排除
+		if entry.MediaType == ies.MediaTypeVideo && entry.Duration <= 0 {
+			return FilterRuleShorts, "duration is unknown, may be a short"
+		}
+	case FilterShortsOnly:
+		if !entry.IsShort {
+			return FilterRuleShorts, "only shorts are allowed"
+		}
+	}
+	if !entry.UploadDate.IsZero() {
+		if !c.UploadedAfter.IsZero() && entry.UploadDate.Before(c.UploadedAfter) {
+			return FilterRuleUploadedAfter, "uploaded before " + c.UploadedAfter.Format(time.DateOnly)
+		}
+		if !c.UploadedBefore.IsZero() && entry.UploadDate.After(c.UploadedBefore) {
+			return FilterRuleUploadedBefore, "uploaded after " + c.UploadedBefore.Format(time.DateOnly)
+		}
+		if c.MaxAgeDays > 0 && entry.UploadDate.Before(now.AddDate(0, 0, -c.MaxAgeDays)) {
+			return FilterRuleMaxAge, fmt.Sprintf("uploaded more than %d days ago", c.MaxAgeDays)
+		}
+	}
+	return "", ""
+}
+
+// SetFeedFilter 设置feed的过滤规则，filter为空时清除
+func (m *Monitor) SetFeedFilter(feedid uint, filter *FeedFilter) error {
+	if err := filter.Validate(); err != nil {
+		return err
+	}
+	return m.storage.ModelUpdates(&Bundle{
+		Model: gorm.Model{
+			ID: feedid,
+		},
+	}, map[string]any{
+		"filter": filter,
+	})
+}
+
+/*
+DryRunFeedFilter 获取since之后的媒体，返回过滤规则的结果，不保存资源
+filter为空时使用feed保存的规则，since为零时取最近30天
+*/
+func (m *Monitor) DryRunFeedFilter(feedid uint, filter *FeedFilter, since time.Time) (FilterResult, error) {
+	var feed Bundle
+	err := m._db.First(&feed, &Bundle{
+		Model: gorm.Model{
+			ID: feedid,
+		},
+		BundleType: BundleTypeFeed,
+	}).Error
+	if err != nil {
+		return FilterResult{}, err
+	}
+	if filter == nil {
+		filter = feed.Filter
+	}
+	if err = filter.Validate(); err != nil {
+		return FilterResult{}, err
+	}
+	if since.IsZero() {
+		since = time.Now().AddDate(0, 0, -30)
+	}
+	ie, err := ies.GetIE(feed.IE)
+	if err != nil {
+		return FilterResult{}, err
+	}
+	entries, err := ie.ExtractAllAfterTime(m.ctx, feed.MediaID, since)
+	if err != nil {
+		return FilterResult{}, err
+	}
+	if err = fillFilterDetails(m.ctx, ie, filter, entries); err != nil {
+		return FilterResult{}, err
+	}
+	return filter.Filter(entries)
+}
@@ -2,6 +2,9 @@ package monitor
 
 import (
 	"fmt"
+	"math"
+	"net/url"
+	"strings"
 
 	"github.com/yinyajiang/yt-mnt/pkg/common"
 	"github.com/yinyajiang/yt-mnt/pkg/ies"
@@ -50,6 +53,68 @@ func selectAudioFormatByResolution(formats []*ies.Format, resolution string) (in
 	return
 }
 
+func selectFormats(entry *ies.MediaEntry, quality string) (qualityFormat, audioFormat *ies.Format) {
+	index := selectQualityFormatByResolution(entry.Formats, quality)
+	if index < 0 {
+		return
+	}
+	qualityFormat = entry.Formats[index]
+	if ies.MediaTypeVideo == entry.MediaType && qualityFormat.FormatType == ies.FormatTypeVideo {
+		if audioIndex := selectAudioFormatByResolution(entry.Formats, quality); audioIndex >= 0 {
+			audioFormat = entry.Formats[audioIndex]
+		}
+	}
+	return
+}
+
+func urlPath(u string) string {
+	info, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	return info.Path
+}
+
+/*
+matchRefreshEntry 从重新解析并展开(plain)的媒体中找到asset对应的项
+先按签名地址的路径匹配(重新签名不会变化)，再按MediaID匹配，都不匹配时返回nil
+图集中的其他项类型相同，不能按类型猜测
+*/
+func matchRefreshEntry(entries []*ies.MediaEntry, asset *Asset) *ies.MediaEntry {
+	if asset.QualityFormat != nil {
+		if path := urlPath(asset.QualityFormat.URL); path != "" {
+			for _, entry := range entries {
+				for _, f := range entry.Formats {
+					if urlPath(f.URL) == path {
+						return entry
+					}
+				}
+			}
+		}
+	}
+	if asset.MediaID == "" {
+		return nil
+	}
+	for _, entry := range entries {
+		if entry.MediaID == asset.MediaID {
+			return entry
+		}
+	}
+	return nil
+}
+
+func mediaType2AssetType(mediaType int) int {
+	switch mediaType {
+	case ies.MediaTypeVideo:
+		return AssetTypeVideo
+	case ies.MediaTypeAudio:
+		return AssetTypeAudio
+	case ies.MediaTypeImage:
+		return AssetTypeImage
+	}
+	return 0
+}
+
 func plain(items []*ies.MediaEntry) []*ies.MediaEntry {
 	outAll := make([]*ies.MediaEntry, 0, len(items))
 	plainAppend(&outAll, items)
@@ -71,3 +136,18 @@ func plainAppend(outAll *[]*ies.MediaEntry, items []*ies.MediaEntry) {
 		}
 	}
 }
+
+func splitPostProcessors(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// postProcessProgressStart 有处理步骤时，下载阶段的进度到此为止
+func postProcessProgressStart(processors int) float64 {
+	if processors == 0 {
+		return 100
+	}
+	return math.Max(100-float64(processors)*5, 50)
+}
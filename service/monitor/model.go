@@ -1,6 +1,7 @@
 package monitor
 
 import (
+	"database/sql/driver"
 	"encoding/json"
 	"path/filepath"
 	"strings"
@@ -27,13 +28,21 @@ const (
 // 每个是一个可下载项
 type Asset struct {
 	gorm.Model
-	BundleID    uint `gorm:"index"`
+	BundleID    uint `gorm:"index;index:,composite:bundle_media,priority:1"`
 	BundleTitle string
 	Type        int
 	Status      int
 
-	Title     string
-	Thumbnail string
+	//所属的IE和媒体在IE中的ID，用于下载存档和去重
+	IE      string
+	MediaID string `gorm:"index:,composite:bundle_media,priority:2"`
+
+	Title       string
+	Thumbnail   string
+	Uploader    string
+	Channel     string
+	UploadDate  time.Time `gorm:"index"`
+	Description string
 
 	URL                 string
 	Quality             string
@@ -41,6 +50,10 @@ type Asset struct {
 	IsDownloadThumbnail bool
 	IsOriginalSubtitle  bool
 	HopeMediaType       string
+	SubtitleFormat      string
+	Subtitles           ies.SubtitleList `gorm:"type:json"`
+	//已经向IE查询过字幕轨道，没有字幕时不再重复查询
+	IsSubtitleChecked bool
 
 	Duration      int64
 	QualityFormat *ies.Format `gorm:"type:json"`
@@ -55,6 +68,20 @@ type Asset struct {
 	DownloadTotalSize int64
 	DownloadedSize    int64
 	DownloadPercent   float64
+	//下载完成的时间，保留策略按它计算文件的存在时间
+	FinishedAt time.Time `gorm:"index"`
+	//文件已经被保留策略删除，只保留记录
+	IsFileDeleted bool
+
+	//最后一次下载失败的分类(downloader.ErrorKind)和信息
+	FailKind    string
+	FailMessage string
+
+	//下载完成后的处理步骤，逗号分隔，如 extract_audio:mp3,embed_thumbnail
+	PostProcessors string
+	//正在执行、失败或者被取消的处理步骤，为空表示没有未完成的步骤
+	PostProcessStage string
+	Checksum         string
 
 	UserData string
 
@@ -108,7 +135,20 @@ type Bundle struct {
 
 	Flags int64
 
-	LastUpdate         time.Time
+	LastUpdate time.Time
+	//自动更新的间隔秒数，0使用调度器的默认间隔，<0不自动更新
+	UpdateInterval int64
+	NextUpdate     time.Time `gorm:"index"`
+	//连续更新失败的次数和最后一次的错误
+	UpdateFailCount int
+	LastUpdateError string
+	//更新到新资源时自动下载，为空不自动下载
+	AutoDownload *AutoDownloadPolicy `gorm:"type:json"`
+	//保存资源前的过滤规则，为空不过滤
+	Filter *FeedFilter `gorm:"type:json"`
+	//已下载文件的保留策略，为空不清理
+	Retention *RetentionPolicy `gorm:"type:json"`
+
 	AssetCount         int64    `gorm:"-"`
 	AssetFinishedCount int64    `gorm:"-"`
 	Assets             []*Asset `gorm:"foreignKey:BundleID"`
@@ -127,6 +167,57 @@ func (f *Bundle) TableName() string {
 	return "bundles"
 }
 
+// AutoDownloadPolicy feed的自动下载策略，空的字段使用更新时传入的AssetDownloadOption
+type AutoDownloadPolicy struct {
+	Enable        bool
+	Quality       string
+	HopeMediaType string
+	Dir           string
+	//每次更新最多自动下载的数量，按上传时间从新到旧，<=0 不限制
+	MaxItems int
+	//在下载队列中的优先级
+	Priority int
+}
+
+func (p *AutoDownloadPolicy) Value() (driver.Value, error) {
+	if p == nil {
+		return nil, nil
+	}
+	return json.Marshal(p)
+}
+
+func (p *AutoDownloadPolicy) Scan(value interface{}) error {
+	if p == nil {
+		return nil
+	}
+	data, ok := value.([]byte)
+	if !ok || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, p)
+}
+
+func (p *AutoDownloadPolicy) IsEnabled() bool {
+	return p != nil && p.Enable
+}
+
+// apply 用策略覆盖新资源的下载选项
+func (p *AutoDownloadPolicy) apply(opt AssetDownloadOption) AssetDownloadOption {
+	if !p.IsEnabled() {
+		return opt
+	}
+	if p.Quality != "" {
+		opt.Quality = p.Quality
+	}
+	if p.HopeMediaType != "" {
+		opt.HopeMediaType = p.HopeMediaType
+	}
+	if p.Dir != "" {
+		opt.Dir = p.Dir
+	}
+	return opt
+}
+
 func (f *Bundle) SetFlag(flag int64) {
 	f.setFlags(flag, true)
 }
@@ -220,15 +311,33 @@ type ExternalDownloadingStatManagerFunc struct {
 	OverMaxConcurrentErr        error
 }
 
-type LastDownloading struct {
+// QueueItem 等待下载的资源，下载完成或者取消后删除
+type QueueItem struct {
 	gorm.Model
-	AssetID  uint
+	AssetID  uint `gorm:"uniqueIndex"`
+	BundleID uint `gorm:"index"`
+	IE       string
+
+	//越大越先下载，相同时按Seq从小到大
+	Priority int `gorm:"index"`
+	Seq      int64
+	//资源没有下载目录时使用
+	Dir            string
+	NotCheckStatus bool
+	Paused         bool
+
+	//可恢复的失败已经重试的次数和下次重试的时间
+	Attempts int
+	RetryAt  time.Time
+
+	Running bool `gorm:"-"`
+
 	_tabname string
 }
 
-func (l *LastDownloading) TableName() string {
-	if l._tabname != "" {
-		return l._tabname
+func (q *QueueItem) TableName() string {
+	if q._tabname != "" {
+		return q._tabname
 	}
-	return "last_downloading"
+	return "download_queue"
 }
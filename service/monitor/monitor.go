@@ -2,6 +2,7 @@ package monitor
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -28,6 +29,7 @@ import (
 type downloadingStat struct {
 	id       uint
 	bundleID uint
+	ie       string
 	cancel   context.CancelFunc
 }
 
@@ -39,22 +41,55 @@ type Monitor struct {
 	downloading                        map[uint]*downloadingStat
 	externalDownloadingStatManagerFunc ExternalDownloadingStatManagerFunc
 
+	scheduler  *scheduler
+	queue      *downloadQueue
+	queueHooks map[uint]queueHooks
+	retention  *retentionSweeper
+	archive    ArchiveOption
+	rootCache  RootCacheOption
+	quota      YoutubeQuotaOption
+	events     *eventBus
+	//Monitor的生命周期，Close时取消，没有传入ctx的IE调用使用它
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	_lastBundle      Bundle
 	_lastBundleDirty bool
 }
 
 type MonitorOption struct {
-	Verbose                            bool
-	IEToken                            ies.IETokens
+	Verbose bool
+	IEToken ies.IETokens
+	//单次IE API调用的超时，<=0 使用默认值30秒
+	IECallTimeout                      time.Duration
 	AssetTableName                     string
 	BundleTableName                    string
-	LastDownloadingTableName           string
+	QueueTableName                     string
+	ArchiveTableName                   string
+	RootCacheTableName                 string
+	YoutubeQuotaTableName              string
 	RegistDownloader                   []downloader.Downloader
 	DBOption                           db.DBOption
 	ExternalDownloadingStatManagerFunc ExternalDownloadingStatManagerFunc
+	//自动更新feed，Enable为true时创建后即开始
+	Scheduler SchedulerOption
+	//下载队列，Enable为true时创建后即开始
+	Queue QueueOption
+	//下载存档，避免重复下载同一个媒体
+	Archive ArchiveOption
+	//按bundle的保留策略定期清理，Enable为true时创建后即开始
+	Retention RetentionOption
+	//IE解析链接的缓存
+	RootCache RootCacheOption
+	//youtube API的每日配额
+	YoutubeQuota YoutubeQuotaOption
+
+	// Deprecated: 下载队列替代了last_downloading表，启动时把这个表中的资源迁移到队列后删除表
+	LastDownloadingTableName string
 }
 
 func NewMonitor(opt MonitorOption) (*Monitor, error) {
+	ies.Cfg.CallTimeout = opt.IECallTimeout
 	err := ies.InitIE(opt.IEToken)
 	if err != nil {
 		return nil, err
@@ -71,20 +106,49 @@ func NewMonitor(opt MonitorOption) (*Monitor, error) {
 		&Bundle{
 			_tabname: opt.BundleTableName,
 		},
-		&LastDownloading{
-			_tabname: opt.LastDownloadingTableName,
+		&QueueItem{
+			_tabname: opt.QueueTableName,
+		},
+		&ArchiveItem{
+			_tabname: opt.ArchiveTableName,
+		},
+		&RootCacheItem{
+			_tabname: opt.RootCacheTableName,
+		},
+		&QuotaUsageItem{
+			_tabname: opt.YoutubeQuotaTableName,
 		},
 	)
 	if err != nil {
 		return nil, err
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	m := &Monitor{
+		ctx:                                ctx,
+		cancel:                             cancel,
 		storage:                            storage,
 		_db:                                storage.GormDB(),
 		downloading:                        make(map[uint]*downloadingStat),
+		queueHooks:                         make(map[uint]queueHooks),
+		archive:                            opt.Archive,
+		rootCache:                          opt.RootCache,
+		quota:                              opt.YoutubeQuota,
+		events:                             newEventBus(),
 		externalDownloadingStatManagerFunc: opt.ExternalDownloadingStatManagerFunc,
 	}
+	m.setRootCache(opt.RootCache)
+	m.setYoutubeQuota(opt.YoutubeQuota)
+	m.migrateLastDownloading(opt.LastDownloadingTableName, opt.QueueTableName)
+	if opt.Queue.Enable {
+		m.StartQueue(opt.Queue)
+	}
+	if opt.Scheduler.Enable {
+		m.StartScheduler(opt.Scheduler)
+	}
+	if opt.Retention.Enable {
+		m.StartRetentionSweeper(opt.Retention)
+	}
 	return m, nil
 }
 
@@ -92,12 +156,30 @@ func (m *Monitor) SetExternalDownloadingStatManagerFunc(f ExternalDownloadingSta
 	m.externalDownloadingStatManagerFunc = f
 }
 
+// Close 先取消正在进行的IE调用，再停止调度器、队列和下载
 func (m *Monitor) Close(recordDownloadings ...bool) {
 	if len(recordDownloadings) > 0 && recordDownloadings[0] {
 		m.RecordDownloadings()
 	}
+	m.cancel()
+	m.StopScheduler()
+	m.StopRetentionSweeper()
+	m.StopQueue()
 	m.StopAllDownloading(true)
+	if m.rootCache.Persist {
+		m.setRootCache(RootCacheOption{
+			Capacity: m.rootCache.Capacity,
+			TTL:      m.rootCache.TTL,
+		})
+	}
+	if m.quota.Persist {
+		m.setYoutubeQuota(YoutubeQuotaOption{
+			DailyLimit: m.quota.DailyLimit,
+			LowReserve: m.quota.LowReserve,
+		})
+	}
 	m.storage.Close()
+	m.events.close()
 }
 
 func (m *Monitor) LocalDownloaderStageSaver(dir string) downloader.DownloaderStageSaver {
@@ -109,15 +191,23 @@ func (m *Monitor) CreateExplorerCacher(cacheCount ...int) *ExplorerCaches {
 }
 
 func (m *Monitor) OpenExplorer(url string, isPlain bool, opt ...ies.ParseOptions) (*Explorer, error) {
+	return m.OpenExplorerContext(m.ctx, url, isPlain, opt...)
+}
+
+// OpenExplorerContext 同OpenExplorer，ctx只用于解析，之后的浏览见Explorer的Context方法
+func (m *Monitor) OpenExplorerContext(ctx context.Context, url string, isPlain bool, opt ...ies.ParseOptions) (*Explorer, error) {
 	ie, err := ies.GetIE(url)
 	if err != nil {
 		return nil, err
 	}
-	info, rootToken, err := ie.ParseRoot(url, opt...)
+	ctx, cancel := common.MergeContext(ctx, m.ctx)
+	defer cancel()
+	info, rootToken, err := ie.ParseRoot(ctx, url, opt...)
 	if err != nil {
 		return nil, err
 	}
 	explorer := newExplorer()
+	explorer.ctx = m.ctx
 	explorer.ie = ie
 	explorer.url = url
 	explorer.rootInfo = *info
@@ -136,26 +226,35 @@ func (m *Monitor) OpenItemExplorer(parentExplorer *Explorer, index int) (*Explor
 	return m.OpenExplorer(item.URL, false)
 }
 
+// RecordDownloadings 把不在队列中的正在下载的资源加入队列，下次启动队列时继续下载
 func (m *Monitor) RecordDownloadings() error {
-	m.storage.DeleteAll(&LastDownloading{})
 	ids := m.getDownloadingsID()
 	if len(ids) == 0 {
 		return nil
 	}
+	var queued []uint
+	m._db.Model(&QueueItem{}).Where("asset_id IN ?", ids).Pluck("asset_id", &queued)
+	isQueued := make(map[uint]bool, len(queued))
+	for _, id := range queued {
+		isQueued[id] = true
+	}
 	for _, id := range ids {
-		m.storage.Create(&LastDownloading{
-			AssetID: id,
-		})
+		if isQueued[id] {
+			continue
+		}
+		if err := m.EnqueueAsset(id, ""); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// GetLastDownloadings 返回队列中等待下载的资源
 func (m *Monitor) GetLastDownloadings() []uint {
-	var lasts []LastDownloading
-	m._db.Find(&lasts)
 	ids := []uint{}
-	for _, last := range lasts {
-		ids = append(ids, last.AssetID)
+	items, _ := m.ListQueue()
+	for _, item := range items {
+		ids = append(ids, item.AssetID)
 	}
 	return ids
 }
@@ -173,16 +272,64 @@ func (m *Monitor) SubscriptionID(url string) (id uint, ok bool) {
 }
 
 type AssetDownloadOption struct {
+	//逗号分隔的字幕语言，如 en,zh-Hans，all表示所有语言
 	Subtitle            string
 	IsDownloadThumbnail bool
 	IsOriginalSubtitle  bool
-	Dir                 string
-	Quality             string
-	HopeMediaType       string
+	//字幕保存的格式，srt/vtt/ttml，为空保留原格式
+	SubtitleFormat string
+	Dir            string
+	Quality        string
+	HopeMediaType  string
+	//下载完成后的处理步骤，如 extract_audio:mp3、convert:mkv、embed_thumbnail、metadata、checksum:sha256
+	PostProcessors []string
 }
 
 // mustHasItem 调试接口，无论是否时间满足都会返回数据
 func (m *Monitor) UpdateFeed(feedid uint, opt AssetDownloadOption, mustHasItem ...bool) (newAssets []*Asset, err error) {
+	result := m.UpdateFeedWithResult(feedid, opt, mustHasItem...)
+	return result.NewAssets, result.Err
+}
+
+// UpdateFeedWithResult 同UpdateFeed，feed设置了自动下载时同时返回自动下载的结果
+func (m *Monitor) UpdateFeedWithResult(feedid uint, opt AssetDownloadOption, mustHasItem ...bool) (result FeedUpdateResult) {
+	return m.UpdateFeedWithResultContext(m.ctx, feedid, opt, mustHasItem...)
+}
+
+// UpdateFeedWithResultContext 同UpdateFeedWithResult，ctx结束或者Monitor关闭时取消，取消时不发布EventFeedError
+func (m *Monitor) UpdateFeedWithResultContext(ctx context.Context, feedid uint, opt AssetDownloadOption, mustHasItem ...bool) (result FeedUpdateResult) {
+	ctx, cancel := common.MergeContext(ctx, m.ctx)
+	defer cancel()
+	result.FeedID = feedid
+	var feed *Bundle
+	result.NewAssets, feed, result.Err = m.updateFeed(ctx, feedid, opt, mustHasItem...)
+	if result.Err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		m.events.publish(Event{
+			Type:     EventFeedError,
+			BundleID: feedid,
+			Err:      result.Err,
+		})
+		return
+	}
+	ids := make([]uint, 0, len(result.NewAssets))
+	for _, asset := range result.NewAssets {
+		ids = append(ids, asset.ID)
+	}
+	m.events.publish(Event{
+		Type:      EventFeedUpdated,
+		BundleID:  feedid,
+		NewAssets: ids,
+	})
+	if feed != nil && len(result.NewAssets) > 0 {
+		result.AutoDownloaded, result.AutoDownloadErr = m.autoDownloadAssets(feed, result.NewAssets)
+	}
+	return
+}
+
+func (m *Monitor) updateFeed(ctx context.Context, feedid uint, opt AssetDownloadOption, mustHasItem ...bool) (newAssets []*Asset, _ *Bundle, err error) {
 	var feed Bundle
 	err = m._db.First(&feed, &Bundle{
 		Model: gorm.Model{
@@ -202,22 +349,28 @@ func (m *Monitor) UpdateFeed(feedid uint, opt AssetDownloadOption, mustHasItem .
 		return
 	}
 
-	newEntries, err := ie.ExtractAllAfterTime(feed.MediaID, feed.LastUpdate, mustHasItem...)
+	newEntries, err := ie.ExtractAllAfterTime(ctx, feed.MediaID, feed.LastUpdate, mustHasItem...)
 	if err != nil {
 		return
 	}
 	if len(newEntries) == 0 {
 		return
 	}
+	//补充失败时本次更新失败，LastUpdate不前进，下次重新获取
+	if err = fillFilterDetails(ctx, ie, feed.Filter, newEntries); err != nil {
+		return
+	}
 
-	newAssets, err = m.saveAssets(feed.IE, newEntries, &feed, opt)
+	newAssets, err = m.saveAssets(feed.IE, newEntries, &feed, feed.AutoDownload.apply(opt))
 	if err != nil {
 		return
 	}
 
+	m.lock.Lock()
 	if m._lastBundle.ID == feedid {
 		m._lastBundleDirty = true
 	}
+	m.lock.Unlock()
 
 	err = m.storage.Updates(&Bundle{
 		Model: gorm.Model{
@@ -225,7 +378,7 @@ func (m *Monitor) UpdateFeed(feedid uint, opt AssetDownloadOption, mustHasItem .
 		},
 		LastUpdate: time.Now(),
 	})
-	return
+	return newAssets, &feed, err
 }
 
 func (m *Monitor) Unsubscribe(id uint, deleteEmpty bool) (isDeleted bool, err error) {
@@ -257,6 +410,7 @@ func (m *Monitor) DeleteAsset(id uint, remainFinished bool) {
 	if id <= 0 {
 		return
 	}
+	m.removeQueueItems(id)
 	m.StopDownloading(id, true)
 	m._lastBundleDirty = true
 
@@ -273,12 +427,18 @@ func (m *Monitor) DeleteAsset(id uint, remainFinished bool) {
 			ID: id,
 		},
 	})
+	m.events.publish(Event{
+		Type:     EventAssetDeleted,
+		BundleID: aset.BundleID,
+		AssetID:  id,
+	})
 }
 
 func (m *Monitor) DeleteBundle(id uint, remainFinished bool) {
 	if id <= 0 {
 		return
 	}
+	m.storage.Delete(&QueueItem{}, "bundle_id = ?", id)
 	ids := m.allDownloadingBundleAssetID(id)
 	for _, id := range ids {
 		m.StopDownloading(id, true)
@@ -299,6 +459,10 @@ func (m *Monitor) DeleteBundle(id uint, remainFinished bool) {
 	for _, aset := range assets {
 		m.deleteDownloaderItem(aset, remainFinished)
 	}
+	m.events.publish(Event{
+		Type:     EventBundleDeleted,
+		BundleID: id,
+	})
 }
 
 func (m *Monitor) ClearTypeBundles(remainFinished bool, bundleTypes ...int) []uint {
@@ -333,6 +497,7 @@ func (m *Monitor) deleteDownloaderItem(asset *Asset, remainFinished bool) {
 }
 
 func (m *Monitor) ClearAll() {
+	m.storage.DeleteAll(&QueueItem{})
 	m.StopAllDownloading(true)
 	bundles, _ := m.ListBundlesByWheres(false, false)
 	for _, bundle := range bundles {
@@ -346,7 +511,6 @@ func (m *Monitor) ClearAll() {
 		m.deleteDownloaderItem(aset, true)
 	}
 	m.storage.DeleteAll(&Asset{})
-	m.storage.DeleteAll(&LastDownloading{})
 }
 
 func (m *Monitor) GetBundle(id uint, preload bool, assetCount bool) (*Bundle, error) {
@@ -418,12 +582,20 @@ func (m *Monitor) ChangeBundleTitle(id uint, title string) error {
 	if title == "" {
 		return fmt.Errorf("title is empty")
 	}
-	return m.storage.Updates(&Bundle{
+	err := m.storage.Updates(&Bundle{
 		Model: gorm.Model{
 			ID: id,
 		},
 		Title: title,
 	})
+	if err == nil {
+		m.events.publish(Event{
+			Type:     EventTitleChanged,
+			BundleID: id,
+			Title:    title,
+		})
+	}
+	return err
 }
 
 func (m *Monitor) ChangeAssetTitle(id uint, title string) error {
@@ -436,9 +608,19 @@ func (m *Monitor) ChangeAssetTitle(id uint, title string) error {
 		return err
 	}
 	if asset.Status == AssetStatusFinished {
+		oldStem := asset.DownloadFileStem
 		stem := common.ReplaceWrongFileChars(title)
 		if e := os.Rename(asset.FilePath(), filepath.Join(asset.DownloadFileDir, stem+asset.DownloadFileExt)); e == nil {
 			asset.DownloadFileStem = stem
+			//缩略图等附属文件由下载器改名
+			if d := downloader.GetByName(asset.Downloader); d != nil {
+				d.ChangeFileTitle(downloader.DownloadOptions{
+					DownloadFileDir:  asset.DownloadFileDir,
+					DownloadFileStem: &oldStem,
+					DownloadFileExt:  &asset.DownloadFileExt,
+					DownloaderData:   &asset.DownloaderData,
+				}, stem)
+			}
 		}
 	} else {
 		d := downloader.GetByName(asset.Downloader)
@@ -448,13 +630,14 @@ func (m *Monitor) ChangeAssetTitle(id uint, title string) error {
 		err = d.ChangeFileTitle(downloader.DownloadOptions{
 			DownloadFileDir:  asset.DownloadFileDir,
 			DownloadFileStem: &asset.DownloadFileStem,
+			DownloadFileExt:  &asset.DownloadFileExt,
 			DownloaderData:   &asset.DownloaderData,
 		}, title)
 	}
 	if err != nil {
 		return err
 	}
-	return m.storage.Updates(&Asset{
+	err = m.storage.Updates(&Asset{
 		Model: gorm.Model{
 			ID: id,
 		},
@@ -462,35 +645,45 @@ func (m *Monitor) ChangeAssetTitle(id uint, title string) error {
 		DownloaderData:   asset.DownloaderData,
 		Title:            title,
 	})
+	if err == nil {
+		m.events.publish(Event{
+			Type:     EventTitleChanged,
+			BundleID: asset.BundleID,
+			AssetID:  id,
+			Title:    title,
+		})
+	}
+	return err
 }
 
-func (m *Monitor) ListAssets(bundleID uint) (assets []*Asset, err error) {
-	err = m._db.Where(&Asset{
+// order 排序方式，默认AssetOrderNewest
+func (m *Monitor) ListAssets(bundleID uint, order ...int) (assets []*Asset, err error) {
+	err = orderAssets(m._db.Where(&Asset{
 		BundleID: bundleID,
-	}).Order("id DESC").Find(&assets).Error
+	}), order...).Find(&assets).Error
 	return
 }
 
-func (m *Monitor) FirstAsset(bundleID uint) (*Asset, error) {
+func (m *Monitor) FirstAsset(bundleID uint, order ...int) (*Asset, error) {
 	var asset Asset
-	err := m._db.Where(&Asset{
+	err := orderAssets(m._db.Where(&Asset{
 		BundleID: bundleID,
-	}).Order("id DESC").First(&asset).Error
+	}), order...).First(&asset).Error
 	return &asset, err
 }
 
-func (m *Monitor) ListAssetsWithOffset(bundleID uint, offset, limit int) (assets []*Asset, err error) {
+func (m *Monitor) ListAssetsWithOffset(bundleID uint, offset, limit int, order ...int) (assets []*Asset, err error) {
 	if limit <= 0 && offset <= 0 {
-		assets, err = m.ListAssets(bundleID)
+		assets, err = m.ListAssets(bundleID, order...)
 		return
 	}
 	if limit == 0 {
 		limit = -1
 	}
 
-	err = m._db.Where(&Asset{
+	err = orderAssets(m._db.Where(&Asset{
 		BundleID: bundleID,
-	}).Offset(offset).Limit(limit).Order("id DESC").Find(&assets).Error
+	}).Offset(offset).Limit(limit), order...).Find(&assets).Error
 	return
 }
 
@@ -579,8 +772,9 @@ func (m *Monitor) SubscribeURLAndAddAsset(url string, entries []*ies.MediaEntry,
 }
 
 func (m *Monitor) GenSubscribeURL(entry *ies.MediaEntry, feedType int) (subscribeURL string, err error) {
-	if feedType == FeedTypeUser && instagram.IsInstragramURL(entry.URL) && entry.Channel != "" {
-		return instagram.GenInstagramURL(entry.Channel)
+	//instagram的用户链接使用用户名
+	if feedType == FeedTypeUser && instagram.IsInstragramURL(entry.URL) && entry.Uploader != "" {
+		return instagram.GenInstagramURL(entry.Uploader)
 	}
 	if feedType == FeedTypeUser && youtube.IsYoutubeURL(entry.URL) && entry.Channel != "" {
 		return youtube.GenYoutubeURL(entry.Channel, "", "")
@@ -605,7 +799,12 @@ func (m *Monitor) Convert2SubscribeURL(hintURL string, feedType int) (subscribeU
 				subscribeURL = hintURL
 			}
 		} else if instagram.IsInstragramURL(hintURL) {
-			if _, _, err = instagram.ParseInstagramURL(hintURL); err != nil {
+			kind, _, e := instagram.ParseInstagramURL(hintURL)
+			if e == nil && kind != instagram.KindUser {
+				e = fmt.Errorf("url not is a user")
+			}
+			if e != nil {
+				err = e
 				return
 			}
 			subscribeURL = hintURL
@@ -649,6 +848,48 @@ func (m *Monitor) AddExternalGenericBundle(bundle *ies.MediaEntry, opt AssetDown
 	return bundles[0], nil
 }
 
+// AddMediaURL 解析单个帖子/视频链接，作为一个generic bundle保存
+func (m *Monitor) AddMediaURL(url string, opt AssetDownloadOption, reUseID ...uint) (*Bundle, error) {
+	ie, err := ies.GetIE(url)
+	if err != nil {
+		return nil, err
+	}
+	downer := downloader.GetByIE(ie.Name())
+	if downer == nil {
+		return nil, fmt.Errorf("%w: %s", downloader.ErrNoDownloader, ie.Name())
+	}
+	entry, err := ie.ParseMedia(m.ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	//IE不提供格式时(如youtube data api)，需要注册不需要格式的下载器
+	if downer.IsNeedFormat() {
+		for _, item := range plain([]*ies.MediaEntry{entry}) {
+			if len(item.Formats) == 0 {
+				return nil, fmt.Errorf("%w: %s, but downloader(%s) need format", ies.ErrFormatsUnsupported, url, downer.Name())
+			}
+		}
+	}
+	bundles, err := m.saveBundles(ie.Name(), func(b *Bundle) bool {
+		if len(reUseID) > 0 && reUseID[0] > 0 {
+			b.ID = reUseID[0]
+			return false
+		}
+		return true
+	}, []*ies.MediaEntry{{
+		URL:       entry.URL,
+		MediaID:   entry.MediaID,
+		Title:     entry.Title,
+		Thumbnail: entry.Thumbnail,
+		Uploader:  entry.Uploader,
+		Entries:   []*ies.MediaEntry{entry},
+	}}, BundleTypeGeneric, opt, false)
+	if err != nil {
+		return nil, err
+	}
+	return bundles[0], nil
+}
+
 func (m *Monitor) AddUnparseBundle(url string, feedType int, opt AssetDownloadOption, userKVData map[string]any) (*Bundle, error) {
 	saveBundleType := BundleTypeGeneric
 	if feedType == FeedTypeUser || feedType == FeedTypePlaylist {
@@ -684,7 +925,7 @@ func (m *Monitor) AssetbasedSelected(explorer *Explorer, preProcBundle func(*Bun
 	switch explorer.RootMediaType() {
 	case ies.MediaTypeUser:
 		if explorer.firstSelectedIndex() == IndexUser {
-			explorer.loadNextAll()
+			explorer.loadNextAll(explorer.ctx)
 		}
 	}
 
@@ -758,6 +999,15 @@ func (m *Monitor) AsyncDownloadAsset(id uint, newAssetDir string,
 	if err != nil {
 		return err
 	}
+	//队列运行时受队列的并发限制
+	if m.getQueue() != nil {
+		m.setQueueHooks(id, queueHooks{
+			begin:  begin,
+			sink:   sink_,
+			result: result,
+		})
+		return m.enqueueAssets([]uint{id}, newAssetDir, len(notCheckStatus) > 0 && notCheckStatus[0])
+	}
 	go func() {
 		asset, err := m.DownloadAsset(context.Background(), id, newAssetDir, begin, sink_, notCheckStatus...)
 		if result != nil {
@@ -781,7 +1031,7 @@ func (m *Monitor) DownloadAsset(ctx context.Context, id uint, newAssetDir string
 	if asset.DownloadFileDir == "" {
 		asset.DownloadFileDir = newAssetDir
 	}
-	if !(len(notCheckStatus) > 0 && notCheckStatus[0]) && asset.Status == AssetStatusFinished {
+	if !(len(notCheckStatus) > 0 && notCheckStatus[0]) && asset.Status == AssetStatusFinished && asset.PostProcessStage == "" && !asset.IsFileDeleted {
 		if fileutil.IsExist(asset.FilePath()) {
 			return asset, nil
 		}
@@ -798,6 +1048,7 @@ func (m *Monitor) DownloadAsset(ctx context.Context, id uint, newAssetDir string
 		}
 	}
 
+	var throttle progressThrottle
 	sink := func(total, downloaded, speed, eta int64, percent float64, videoDuration int64) {
 		asset.DownloadTotalSize = total
 		asset.DownloadedSize = downloaded
@@ -805,6 +1056,20 @@ func (m *Monitor) DownloadAsset(ctx context.Context, id uint, newAssetDir string
 		if videoDuration > 0 && asset.Duration == 0 {
 			asset.Duration = videoDuration
 		}
+		if throttle.allow(percent) {
+			m.events.publish(Event{
+				Type:     EventAssetProgress,
+				BundleID: asset.BundleID,
+				AssetID:  asset.ID,
+				Progress: EventProgress{
+					Total:      total,
+					Downloaded: downloaded,
+					Speed:      speed,
+					ETA:        eta,
+					Percent:    percent,
+				},
+			})
+		}
 		if sink_ != nil {
 			sink_(total, downloaded, speed, eta, percent, asset.Duration)
 		}
@@ -815,26 +1080,123 @@ func (m *Monitor) DownloadAsset(ctx context.Context, id uint, newAssetDir string
 		return asset, fmt.Errorf("downloader not found: %s", asset.Downloader)
 	}
 
-	qualityFormat := ies.Format{}
-	if asset.QualityFormat != nil {
-		qualityFormat = *asset.QualityFormat
-	}
-	audioFormat := ies.Format{}
-	if asset.AudioFormat != nil {
-		audioFormat = *asset.AudioFormat
-	}
-
 	ctx, cancel := context.WithCancel(ctx)
 	m.addDownloading(&downloadingStat{
 		id:       asset.ID,
 		bundleID: asset.BundleID,
+		ie:       m.assetIE(asset),
 		cancel:   cancel,
 	})
 	defer cancel()
 	defer m.removeDownloading(asset.ID)
 
+	//签名地址已经过期，先刷新格式
+	if d.IsNeedFormat() && asset.QualityFormat != nil && downloader.IsURLExpired(asset.QualityFormat.URL) {
+		if e := m.refreshAssetFormats(ctx, asset); e != nil {
+			log.Printf("refresh asset %d formats fail: %s", asset.ID, e)
+		}
+	}
+
+	//从列表中添加的媒体没有字幕信息，只查询一次
+	if asset.Subtitle != "" && len(asset.Subtitles) == 0 && !asset.IsSubtitleChecked {
+		if e := m.refreshAssetSubtitles(ctx, asset); e != nil {
+			log.Printf("refresh asset %d subtitles fail: %s", asset.ID, e)
+		}
+	}
+
+	processors, err := downloader.ParsePostProcessors(splitPostProcessors(asset.PostProcessors))
+	if err != nil {
+		return asset, err
+	}
+	downloadEnd := postProcessProgressStart(len(processors))
+
+	oldStatus := asset.Status
 	asset.Status = AssetStatusDownloading
-	ok, err := d.Download(ctx, downloader.DownloadOptions{
+	m.publishStatus(asset, oldStatus, nil)
+	oldStatus = asset.Status
+	var ok bool
+	//上次在处理阶段中断，文件已经下载完成
+	if asset.PostProcessStage == "" || !fileutil.IsExist(asset.FilePath()) {
+		asset.PostProcessStage = ""
+		downloadSink := downloader.ScaleSink(sink, 0, downloadEnd)
+		ok, err = m.downloadWithDownloader(ctx, d, asset, downloadSink)
+		if err != nil && !common.IsCtxDone(ctx) && d.IsNeedFormat() {
+			switch downloader.ClassifyError(err) {
+			case downloader.ErrKindExpiredURL, downloader.ErrKindForbidden:
+				if e := m.refreshAssetFormats(ctx, asset); e != nil {
+					log.Printf("refresh asset %d formats fail: %s", asset.ID, e)
+				} else {
+					ok, err = m.downloadWithDownloader(ctx, d, asset, downloadSink)
+				}
+			}
+		}
+	}
+	if err == nil {
+		ok = true
+		err = m.postProcessAsset(ctx, asset, processors, sink, downloadEnd)
+	}
+	if err != nil && downloader.ClassifyError(err) == downloader.ErrKindPostProcess {
+		//处理失败时主文件仍然可用
+		asset.Status = AssetStatusFinished
+		asset.FailKind = string(downloader.ErrKindPostProcess)
+		asset.FailMessage = err.Error()
+		asset.DownloadTotalSize, _ = fileutil.FileSize(asset.FilePath())
+		asset.FinishedAt = time.Now()
+		asset.IsFileDeleted = false
+	} else if err != nil {
+		if common.IsCtxDone(ctx) {
+			asset.Status = AssetStatusCanceled
+		} else {
+			if ok {
+				asset.Status = AssetStatusDownloading
+			} else {
+				asset.Status = AssetStatusFail
+			}
+		}
+		asset.FailKind = string(downloader.ClassifyError(err))
+		asset.FailMessage = err.Error()
+	} else {
+		asset.FailKind = ""
+		asset.FailMessage = ""
+		asset.PostProcessStage = ""
+		asset.Status = AssetStatusFinished
+		asset.DownloadTotalSize, _ = fileutil.FileSize(asset.FilePath())
+		asset.DownloadPercent = 100
+		asset.FinishedAt = time.Now()
+		asset.IsFileDeleted = false
+	}
+
+	if e := m.storage.Save(asset); e != nil {
+		log.Printf("db save fail: %s", e)
+	}
+	if asset.Status == AssetStatusFinished {
+		m.archiveAsset(asset)
+	}
+	m.publishStatus(asset, oldStatus, err)
+	return asset, err
+}
+
+func (m *Monitor) publishStatus(asset *Asset, oldStatus int, err error) {
+	m.events.publish(Event{
+		Type:      EventAssetStatusChanged,
+		BundleID:  asset.BundleID,
+		AssetID:   asset.ID,
+		Status:    asset.Status,
+		OldStatus: oldStatus,
+		Err:       err,
+	})
+}
+
+func (m *Monitor) downloadWithDownloader(ctx context.Context, d downloader.Downloader, asset *Asset, sink downloader.ProgressSink) (bool, error) {
+	qualityFormat := ies.Format{}
+	if asset.QualityFormat != nil {
+		qualityFormat = *asset.QualityFormat
+	}
+	audioFormat := ies.Format{}
+	if asset.AudioFormat != nil {
+		audioFormat = *asset.AudioFormat
+	}
+	return d.Download(ctx, downloader.DownloadOptions{
 		URL:                 asset.URL,
 		Quality:             &asset.Quality,
 		DownloadedSize:      asset.DownloadedSize,
@@ -847,6 +1209,8 @@ func (m *Monitor) DownloadAsset(ctx context.Context, id uint, newAssetDir string
 		IsDownloadThumbnail: asset.IsDownloadThumbnail,
 		IsOriginalSubtitle:  asset.IsOriginalSubtitle,
 		HopeMediaType:       asset.HopeMediaType,
+		Subtitles:           asset.Subtitles,
+		SubtitleFormat:      asset.SubtitleFormat,
 
 		DownloadFileStem: &asset.DownloadFileStem,
 		DownloadFileExt:  &asset.DownloadFileExt,
@@ -858,26 +1222,92 @@ func (m *Monitor) DownloadAsset(ctx context.Context, id uint, newAssetDir string
 			Duration:  &asset.Duration,
 		},
 	}, sink)
-	if err != nil {
-		if common.IsCtxDone(ctx) {
-			asset.Status = AssetStatusCanceled
-		} else {
-			if ok {
-				asset.Status = AssetStatusDownloading
-			} else {
-				asset.Status = AssetStatusFail
+}
+
+/*
+postProcessAsset 执行下载完成后的处理步骤
+上次在某个步骤失败或被取消时，从该步骤开始继续
+*/
+func (m *Monitor) postProcessAsset(ctx context.Context, asset *Asset, processors []downloader.PostProcessor, sink downloader.ProgressSink, from float64) error {
+	if asset.PostProcessStage != "" {
+		for i, p := range processors {
+			if p.Name() == asset.PostProcessStage {
+				processors = processors[i:]
+				break
 			}
 		}
-	} else {
-		asset.Status = AssetStatusFinished
-		asset.DownloadTotalSize, _ = fileutil.FileSize(asset.FilePath())
-		asset.DownloadPercent = 100
 	}
+	info := &downloader.PostProcessInfo{
+		FilePath:    asset.FilePath(),
+		Title:       asset.Title,
+		Uploader:    asset.Uploader,
+		UploadDate:  asset.UploadDate,
+		Description: asset.Description,
+		SourceURL:   asset.URL,
+		Thumbnail:   asset.Thumbnail,
+	}
+	err := downloader.RunPostProcessors(ctx, processors, info, sink, from, 100, func(name string) {
+		//上一步可能改变了扩展名
+		asset.DownloadFileExt = filepath.Ext(info.FilePath)
+		asset.PostProcessStage = name
+		if e := m.storage.Save(asset); e != nil {
+			log.Printf("db save fail: %s", e)
+		}
+	})
+	if info.Checksum != "" {
+		asset.Checksum = info.Checksum
+	}
+	return err
+}
 
-	if e := m.storage.Save(asset); e != nil {
-		log.Printf("db save fail: %s", e)
+// refreshAssetFormats 重新解析asset对应的媒体，按原来的画质重新选择格式，用于签名地址过期的情况
+func (m *Monitor) refreshAssetFormats(ctx context.Context, asset *Asset) error {
+	ie, err := ies.GetIE(asset.URL)
+	if err != nil {
+		return err
 	}
-	return asset, err
+	entry, err := ie.ParseMedia(ctx, asset.URL)
+	if err != nil {
+		return err
+	}
+	matched := matchRefreshEntry(plain([]*ies.MediaEntry{entry}), asset)
+	if matched == nil || len(matched.Formats) == 0 {
+		return fmt.Errorf("no matched media found for asset: %d", asset.ID)
+	}
+	qualityFormat, audioFormat := selectFormats(matched, asset.Quality)
+	if qualityFormat == nil {
+		return fmt.Errorf("no format found for asset: %d", asset.ID)
+	}
+	asset.QualityFormat = qualityFormat
+	asset.AudioFormat = audioFormat
+	return m.storage.Save(asset)
+}
+
+/*
+refreshAssetSubtitles 向IE查询asset的字幕轨道，查询成功后记录下来，IE不支持查询字幕时也不再查询
+查询失败(包括配额不足)时不记录，下次下载时再查询
+*/
+func (m *Monitor) refreshAssetSubtitles(ctx context.Context, asset *Asset) error {
+	ie, err := ies.GetIE(asset.IE, asset.URL)
+	if err != nil {
+		return err
+	}
+	//查询字幕消耗配额，配额不足时不查询，不能占用更新feed和手动操作的配额
+	if limiter, ok := ie.(ies.QuotaLimiter); ok {
+		if afford, resetAt := limiter.AffordUpdate(); !afford {
+			return fmt.Errorf("%w: %s, resets at %s", ies.ErrQuotaExceeded, ie.Name(), resetAt.Format(time.RFC3339))
+		}
+	}
+	var subtitles []*ies.Subtitle
+	if lister, ok := ie.(ies.SubtitleLister); ok {
+		subtitles, err = lister.ListSubtitles(ctx, asset.URL)
+		if err != nil && !errors.Is(err, ies.ErrSubtitleUnsupported) {
+			return err
+		}
+	}
+	asset.Subtitles = subtitles
+	asset.IsSubtitleChecked = true
+	return m.storage.Save(asset)
 }
 
 func (m *Monitor) GetDownloadingStatFunc() (
@@ -937,7 +1367,7 @@ func (m *Monitor) bundleMediaEntryDeepAnalysis(url string) []*ies.MediaEntry {
 	if err != nil {
 		return nil
 	}
-	explorer.loadNextAll()
+	explorer.loadNextAll(explorer.ctx)
 
 	root := explorer.Root()
 	ret := make([]*ies.MediaEntry, 0)
@@ -1017,6 +1447,11 @@ func (m *Monitor) saveBundles(ie string, preSaveBundle func(b *Bundle) (isCreate
 		if err != nil {
 			continue
 		}
+		m.events.publish(Event{
+			Type:     EventBundleAdded,
+			BundleID: bundle.ID,
+			Title:    bundle.Title,
+		})
 		if saveFeedBundleAssets || saveBundleType != BundleTypeFeed {
 			assets, err := m.saveAssets(ie, entry.Entries, bundle, opt)
 			if err == nil {
@@ -1033,14 +1468,34 @@ func (m *Monitor) saveBundles(ie string, preSaveBundle func(b *Bundle) (isCreate
 }
 
 func (m *Monitor) saveAssets(ie string, entryies []*ies.MediaEntry, owner *Bundle, opt AssetDownloadOption) (retAssets []*Asset, err error) {
+	//在展开图集之前过滤，图集作为整体判断
+	if owner != nil && owner.Filter != nil {
+		result, e := owner.Filter.Filter(entryies)
+		if e != nil {
+			return nil, e
+		}
+		if len(result.Rejected) > 0 {
+			log.Printf("bundle %d filter rejected %d of %d entries", owner.ID, len(result.Rejected), len(entryies))
+		}
+		entryies = result.Accepted
+	}
+	if m.archive.Enable {
+		entryies = m.filterArchived(ie, entryies)
+	}
 	entryies = plain(entryies)
 	retAssets = make([]*Asset, 0, len(entryies))
 
 	downer := downloader.GetByIE(ie)
+	if downer == nil {
+		return nil, fmt.Errorf("%w: %s", downloader.ErrNoDownloader, ie)
+	}
 	if opt.Quality == "" {
 		opt.Quality = "best"
 	}
 	opt.Quality = strings.ToLower(opt.Quality)
+	if _, err = downloader.ParsePostProcessors(opt.PostProcessors); err != nil {
+		return nil, err
+	}
 
 	lastBeginStem := ""
 	stemSuffIndex := 1
@@ -1057,16 +1512,13 @@ func (m *Monitor) saveAssets(ie string, entryies []*ies.MediaEntry, owner *Bundl
 				err = fmt.Errorf("no format found for entry: %s, but downloader(%s) need format", entry.URL, downer.Name())
 				continue
 			}
-			qualityFormat = entry.Formats[selectQualityFormatByResolution(entry.Formats, opt.Quality)]
-			if ies.MediaTypeVideo == entry.MediaType && qualityFormat.FormatType == ies.FormatTypeVideo {
-				if audioIndex := selectAudioFormatByResolution(entry.Formats, opt.Quality); audioIndex >= 0 {
-					audioFormat = entry.Formats[audioIndex]
-				}
-			}
+			qualityFormat, audioFormat = selectFormats(entry, opt.Quality)
 		}
 		asset := &Asset{
 			Status: AssetStatusNew,
 
+			IE:                  ie,
+			MediaID:             entry.MediaID,
 			Title:               entry.Title,
 			URL:                 entry.URL,
 			Quality:             opt.Quality,
@@ -1074,25 +1526,27 @@ func (m *Monitor) saveAssets(ie string, entryies []*ies.MediaEntry, owner *Bundl
 			Subtitle:            opt.Subtitle,
 			IsDownloadThumbnail: opt.IsDownloadThumbnail,
 			IsOriginalSubtitle:  opt.IsOriginalSubtitle,
+			SubtitleFormat:      opt.SubtitleFormat,
+			Subtitles:           entry.Subtitles,
 			Thumbnail:           entry.Thumbnail,
+			Uploader:            entry.Uploader,
+			Channel:             entry.Channel,
+			UploadDate:          entry.UploadDate,
+			Description:         entry.Description,
+			Duration:            entry.Duration,
 			QualityFormat:       qualityFormat,
 			AudioFormat:         audioFormat,
 
 			DownloadFileDir: opt.Dir,
 			Downloader:      downer.Name(),
 		}
-		switch entry.MediaType {
-		case ies.MediaTypeVideo:
-			asset.Type = AssetTypeVideo
-		case ies.MediaTypeAudio:
-			asset.Type = AssetTypeAudio
-		case ies.MediaTypeImage:
-			asset.Type = AssetTypeImage
-		default:
-			err = fmt.Errorf("unsupported media type: %d", asset.Type)
+		asset.Type = mediaType2AssetType(entry.MediaType)
+		if asset.Type == 0 {
+			err = fmt.Errorf("unsupported media type: %d", entry.MediaType)
 			log.Println(err)
 			continue
 		}
+		asset.PostProcessors = strings.Join(opt.PostProcessors, ",")
 		if asset.Title == "" {
 			if owner != nil {
 				asset.Title = owner.IE + "(" + time.Now().Format("2006-01-02 15-04-05") + ")"
@@ -1122,6 +1576,15 @@ func (m *Monitor) saveAssets(ie string, entryies []*ies.MediaEntry, owner *Bundl
 
 		if err = m.storage.Create(asset); err == nil {
 			retAssets = append(retAssets, asset)
+			m.events.publish(Event{
+				Type:     EventAssetCreated,
+				BundleID: asset.BundleID,
+				AssetID:  asset.ID,
+				Title:    asset.Title,
+			})
+			if m.archive.RecordOnSave {
+				m.archiveAsset(asset)
+			}
 		}
 	}
 	if len(retAssets) > 0 {
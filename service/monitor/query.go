@@ -0,0 +1,99 @@
+package monitor
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	//按加入的顺序从新到旧
+	AssetOrderNewest = iota
+	AssetOrderOldest
+	//按上传时间，相同时按加入的顺序
+	AssetOrderUploadDateDesc
+	AssetOrderUploadDateAsc
+)
+
+// AssetQuery 资源的查询条件，零值的条件不生效
+type AssetQuery struct {
+	BundleID uint
+	IE       string
+	MediaID  string
+	Status   []int
+	Type     int
+	//标题、上传者或频道包含的文字
+	Keyword string
+
+	UploadedAfter  time.Time
+	UploadedBefore time.Time
+
+	Order  int
+	Offset int
+	//<=0 不限制
+	Limit int
+}
+
+// QueryAssets 按条件查询资源
+func (m *Monitor) QueryAssets(q AssetQuery) (assets []*Asset, err error) {
+	tx := q.where(m._db.Model(&Asset{}))
+	if q.Offset > 0 {
+		tx = tx.Offset(q.Offset)
+	}
+	if q.Limit > 0 {
+		tx = tx.Limit(q.Limit)
+	}
+	err = orderAssets(tx, q.Order).Find(&assets).Error
+	return
+}
+
+// CountAssets 满足条件的资源数量，忽略Offset和Limit
+func (m *Monitor) CountAssets(q AssetQuery) (count int64, err error) {
+	err = q.where(m._db.Model(&Asset{})).Count(&count).Error
+	return
+}
+
+func (q *AssetQuery) where(tx *gorm.DB) *gorm.DB {
+	if q.BundleID != 0 {
+		tx = tx.Where("bundle_id = ?", q.BundleID)
+	}
+	if q.IE != "" {
+		tx = tx.Where("ie = ?", q.IE)
+	}
+	if q.MediaID != "" {
+		tx = tx.Where("media_id = ?", q.MediaID)
+	}
+	if len(q.Status) > 0 {
+		tx = tx.Where("status IN ?", q.Status)
+	}
+	if q.Type != 0 {
+		tx = tx.Where("type = ?", q.Type)
+	}
+	if q.Keyword != "" {
+		like := "%" + q.Keyword + "%"
+		tx = tx.Where("title LIKE ? OR uploader LIKE ? OR channel LIKE ?", like, like, like)
+	}
+	if !q.UploadedAfter.IsZero() {
+		tx = tx.Where("upload_date >= ?", q.UploadedAfter)
+	}
+	if !q.UploadedBefore.IsZero() {
+		tx = tx.Where("upload_date < ?", q.UploadedBefore)
+	}
+	return tx
+}
+
+func orderAssets(tx *gorm.DB, order ...int) *gorm.DB {
+	o := AssetOrderNewest
+	if len(order) > 0 {
+		o = order[0]
+	}
+	switch o {
+	case AssetOrderOldest:
+		return tx.Order("id")
+	case AssetOrderUploadDateDesc:
+		return tx.Order("upload_date DESC").Order("id DESC")
+	case AssetOrderUploadDateAsc:
+		return tx.Order("upload_date").Order("id")
+	}
+	return tx.Order("id DESC")
+}
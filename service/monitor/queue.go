@@ -0,0 +1,565 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yinyajiang/yt-mnt/pkg/downloader"
+	"github.com/yinyajiang/yt-mnt/pkg/ies"
+	"gorm.io/gorm"
+)
+
+type QueueOption struct {
+	Enable bool
+	//同时下载的总数，<=0 使用默认值3
+	MaxConcurrent int
+	//每个bundle同时下载的数量，<=0 不限制
+	MaxPerBundle int
+	//每个IE同时下载的数量，没有设置的IE不限制
+	MaxPerIE map[string]int
+	//可恢复的失败最多重试的次数，<=0 使用默认值3
+	MaxRetries int
+	//第n次重试前等待 n*RetryDelay，<=0 使用默认值30秒
+	RetryDelay time.Duration
+	//启动时处于暂停状态
+	StartPaused bool
+
+	//资源开始下载、进度和结束时调用，在下载的goroutine中执行
+	OnBegin    func(asset *Asset)
+	OnProgress func(asset *Asset, total, downloaded, speed, eta int64, percent float64, videoDuration int64)
+	OnResult   func(asset *Asset, err error)
+}
+
+// queueHooks AsyncDownloadAsset传入的回调，只在内存中保存
+type queueHooks struct {
+	begin  func(asset *Asset)
+	sink   downloader.ProgressSink
+	result func(asset *Asset, err error)
+}
+
+type downloadQueue struct {
+	opt    QueueOption
+	ctx    context.Context
+	cancel context.CancelFunc
+	wake   chan struct{}
+	wg     sync.WaitGroup
+
+	lock    sync.Mutex
+	paused  bool
+	running map[uint]*QueueItem
+}
+
+func newDownloadQueue(opt QueueOption) *downloadQueue {
+	if opt.MaxConcurrent <= 0 {
+		opt.MaxConcurrent = 3
+	}
+	if opt.MaxRetries <= 0 {
+		opt.MaxRetries = 3
+	}
+	if opt.RetryDelay <= 0 {
+		opt.RetryDelay = 30 * time.Second
+	}
+	return &downloadQueue{
+		opt:     opt,
+		wake:    make(chan struct{}, 1),
+		paused:  opt.StartPaused,
+		running: make(map[uint]*QueueItem),
+	}
+}
+
+// StartQueue 开始按优先级下载队列中的资源，上次退出时没有完成的资源会继续下载
+func (m *Monitor) StartQueue(opt QueueOption) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.queue != nil {
+		return errors.New("queue is already running")
+	}
+	q := newDownloadQueue(opt)
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	q.wg.Add(1)
+	go q.loop(m)
+	m.queue = q
+	return nil
+}
+
+// StopQueue 停止队列和队列中正在进行的下载，资源保留在队列中
+func (m *Monitor) StopQueue() {
+	m.lock.Lock()
+	q := m.queue
+	m.queue = nil
+	m.lock.Unlock()
+	if q == nil {
+		return
+	}
+	q.cancel()
+	q.wg.Wait()
+}
+
+/*
+SetQueueLimits 修改运行中队列的并发限制，参数同QueueOption，超出新限制的下载不会被停止
+队列没有运行时返回错误
+*/
+func (m *Monitor) SetQueueLimits(maxConcurrent, maxPerBundle int, maxPerIE map[string]int) error {
+	q := m.getQueue()
+	if q == nil {
+		return errors.New("queue is not running")
+	}
+	if maxConcurrent <= 0 {
+		maxConcurrent = 3
+	}
+	q.lock.Lock()
+	q.opt.MaxConcurrent = maxConcurrent
+	q.opt.MaxPerBundle = maxPerBundle
+	q.opt.MaxPerIE = maxPerIE
+	q.lock.Unlock()
+	q.signal()
+	return nil
+}
+
+func (m *Monitor) getQueue() *downloadQueue {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.queue
+}
+
+/*
+EnqueueAsset 把资源加入下载队列，已经在队列中时更新目录和优先级
+priority越大越先下载，默认为0
+*/
+func (m *Monitor) EnqueueAsset(id uint, newAssetDir string, priority ...int) error {
+	return m.EnqueueAssets([]uint{id}, newAssetDir, priority...)
+}
+
+func (m *Monitor) EnqueueAssets(ids []uint, newAssetDir string, priority ...int) error {
+	return m.enqueueAssets(ids, newAssetDir, false, priority...)
+}
+
+func (m *Monitor) enqueueAssets(ids []uint, newAssetDir string, notCheckStatus bool, priority ...int) error {
+	p := 0
+	if len(priority) > 0 {
+		p = priority[0]
+	}
+	for _, id := range ids {
+		asset, err := m.GetAsset(id)
+		if err != nil {
+			return err
+		}
+		item := QueueItem{
+			AssetID:        id,
+			BundleID:       asset.BundleID,
+			IE:             m.assetIE(asset),
+			Priority:       p,
+			Seq:            time.Now().UnixNano(),
+			Dir:            newAssetDir,
+			NotCheckStatus: notCheckStatus,
+		}
+		var exist QueueItem
+		if m._db.Where("asset_id = ?", id).Limit(1).Find(&exist); exist.ID != 0 {
+			err = m.storage.ModelUpdates(&exist, map[string]any{
+				"dir":              newAssetDir,
+				"priority":         p,
+				"not_check_status": notCheckStatus,
+				"paused":           false,
+			})
+		} else {
+			err = m.storage.Create(&item)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	m.getQueue().signal()
+	return nil
+}
+
+// migrateLastDownloading 旧版本在last_downloading表中记录未完成的下载，迁移到下载队列后删除旧表
+func (m *Monitor) migrateLastDownloading(tableName, queueTableName string) {
+	if tableName == "" {
+		tableName = "last_downloading"
+	}
+	if queueTableName == "" {
+		queueTableName = (&QueueItem{}).TableName()
+	}
+	migrator := m._db.Migrator()
+	if tableName == queueTableName || !migrator.HasTable(tableName) {
+		return
+	}
+	var ids []uint
+	if err := m._db.Table(tableName).Where("deleted_at IS NULL").Order("id").Pluck("asset_id", &ids).Error; err != nil {
+		log.Printf("read %s fail: %s", tableName, err)
+		return
+	}
+	for _, id := range ids {
+		//资源可能已经被删除
+		if err := m.enqueueAssets([]uint{id}, "", false); err != nil {
+			log.Printf("migrate asset %d to queue fail: %s", id, err)
+		}
+	}
+	if err := migrator.DropTable(tableName); err != nil {
+		log.Printf("drop %s fail: %s", tableName, err)
+	}
+}
+
+// assetIE 资源所属的IE，用于按IE限制并发
+func (m *Monitor) assetIE(asset *Asset) string {
+	if asset.IE != "" {
+		return asset.IE
+	}
+	if asset.BundleID != 0 {
+		var bundle Bundle
+		if m._db.Select("ie").Where("id = ?", asset.BundleID).Limit(1).Find(&bundle); bundle.IE != "" {
+			return bundle.IE
+		}
+	}
+	if ie, err := ies.GetIE(asset.URL); err == nil {
+		return ie.Name()
+	}
+	return ""
+}
+
+// ListQueue 按下载顺序返回队列中的资源
+func (m *Monitor) ListQueue() ([]*QueueItem, error) {
+	var items []*QueueItem
+	err := m._db.Order("priority desc, seq").Find(&items).Error
+	if err != nil {
+		return nil, err
+	}
+	if q := m.getQueue(); q != nil {
+		q.lock.Lock()
+		for _, item := range items {
+			_, item.Running = q.running[item.AssetID]
+		}
+		q.lock.Unlock()
+	}
+	return items, nil
+}
+
+// PauseQueue 暂停分派新的下载，正在进行的下载不受影响
+func (m *Monitor) PauseQueue() {
+	if q := m.getQueue(); q != nil {
+		q.lock.Lock()
+		q.paused = true
+		q.lock.Unlock()
+	}
+}
+
+func (m *Monitor) ResumeQueue() {
+	if q := m.getQueue(); q != nil {
+		q.lock.Lock()
+		q.paused = false
+		q.lock.Unlock()
+		q.signal()
+	}
+}
+
+func (m *Monitor) IsQueuePaused() bool {
+	q := m.getQueue()
+	if q == nil {
+		return true
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.paused
+}
+
+// PauseQueueItem 暂停队列中的资源，正在下载时停止下载
+func (m *Monitor) PauseQueueItem(id uint) error {
+	if err := m.setQueueItem(id, map[string]any{"paused": true}); err != nil {
+		return err
+	}
+	m.StopDownloading(id, false)
+	return nil
+}
+
+func (m *Monitor) ResumeQueueItem(id uint) error {
+	if err := m.setQueueItem(id, map[string]any{"paused": false}); err != nil {
+		return err
+	}
+	m.getQueue().signal()
+	return nil
+}
+
+// CancelQueueItem 从队列中移除资源，正在下载时停止下载
+func (m *Monitor) CancelQueueItem(id uint) error {
+	if err := m.removeQueueItems(id); err != nil {
+		return err
+	}
+	m.StopDownloading(id, false)
+	m.getQueue().signal()
+	return nil
+}
+
+func (m *Monitor) SetQueuePriority(id uint, priority int) error {
+	if err := m.setQueueItem(id, map[string]any{"priority": priority}); err != nil {
+		return err
+	}
+	m.getQueue().signal()
+	return nil
+}
+
+/*
+MoveQueueItem 把资源移动到队列的第index个位置
+资源会使用新位置上原来资源的优先级
+*/
+func (m *Monitor) MoveQueueItem(id uint, index int) error {
+	items, err := m.ListQueue()
+	if err != nil {
+		return err
+	}
+	from := -1
+	for i, item := range items {
+		if item.AssetID == id {
+			from = i
+			break
+		}
+	}
+	if from == -1 {
+		return fmt.Errorf("asset %d is not in queue", id)
+	}
+	moved := items[from]
+	items = append(items[:from], items[from+1:]...)
+	if index < 0 {
+		index = 0
+	}
+	if index > len(items) {
+		index = len(items)
+	}
+	if index < len(items) {
+		moved.Priority = items[index].Priority
+	} else if index > 0 {
+		moved.Priority = items[index-1].Priority
+	}
+	items = append(items[:index], append([]*QueueItem{moved}, items[index:]...)...)
+	//优先级保持非递增，重新编号
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Priority > items[j].Priority
+	})
+	return m._db.Transaction(func(tx *gorm.DB) error {
+		for i, item := range items {
+			if err := tx.Model(item).Updates(map[string]any{
+				"priority": item.Priority,
+				"seq":      int64(i),
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *Monitor) setQueueItem(id uint, values map[string]any) error {
+	result := m._db.Model(&QueueItem{}).Where("asset_id = ?", id).Updates(values)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("asset %d is not in queue", id)
+	}
+	return nil
+}
+
+func (m *Monitor) removeQueueItems(ids ...uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return m.storage.Delete(&QueueItem{}, "asset_id IN ?", ids)
+}
+
+func (q *downloadQueue) signal() {
+	if q == nil {
+		return
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *downloadQueue) loop(m *Monitor) {
+	defer q.wg.Done()
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		q.dispatch(m)
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+// dispatch 按优先级启动满足并发限制的资源
+func (q *downloadQueue) dispatch(m *Monitor) {
+	q.lock.Lock()
+	paused := q.paused
+	q.lock.Unlock()
+	if paused || q.ctx.Err() != nil || m.storage.IsClosed() {
+		return
+	}
+
+	q.lock.Lock()
+	maxConcurrent, maxPerBundle, maxPerIE := q.opt.MaxConcurrent, q.opt.MaxPerBundle, q.opt.MaxPerIE
+	q.lock.Unlock()
+
+	//正在下载的(包括不是队列启动的)和队列已经启动但还没开始下载的，所有限制都按这一份计数
+	active := 0
+	bundleCount := make(map[uint]int)
+	ieCount := make(map[string]int)
+	counted := make(map[uint]bool)
+	m.lock.RLock()
+	for _, stat := range m.downloading {
+		counted[stat.id] = true
+		active++
+		bundleCount[stat.bundleID]++
+		ieCount[stat.ie]++
+	}
+	m.lock.RUnlock()
+	q.lock.Lock()
+	for _, item := range q.running {
+		if counted[item.AssetID] {
+			continue
+		}
+		active++
+		bundleCount[item.BundleID]++
+		ieCount[item.IE]++
+	}
+	q.lock.Unlock()
+
+	left := maxConcurrent - active
+	if m.externalDownloadingStatManagerFunc.GetExternalDownloadingCount != nil &&
+		m.externalDownloadingStatManagerFunc.GetMaxConcurrentCount != nil {
+		if max := m.externalDownloadingStatManagerFunc.GetMaxConcurrentCount(); max > 0 {
+			if external := max - m.externalDownloadingStatManagerFunc.GetExternalDownloadingCount() - active; external < left {
+				left = external
+			}
+		}
+	}
+	if left <= 0 {
+		return
+	}
+
+	var items []*QueueItem
+	err := m._db.Where("paused = ? AND retry_at <= ?", false, time.Now()).Order("priority desc, seq").Find(&items).Error
+	if err != nil {
+		log.Printf("queue list fail: %s", err)
+		return
+	}
+
+	for _, item := range items {
+		if left <= 0 {
+			return
+		}
+		q.lock.Lock()
+		_, running := q.running[item.AssetID]
+		q.lock.Unlock()
+		if _, downloading := m.getDownloading(item.AssetID); running || downloading {
+			continue
+		}
+		if maxPerBundle > 0 && item.BundleID != 0 && bundleCount[item.BundleID] >= maxPerBundle {
+			continue
+		}
+		if limit := maxPerIE[item.IE]; limit > 0 && ieCount[item.IE] >= limit {
+			continue
+		}
+		left--
+		bundleCount[item.BundleID]++
+		ieCount[item.IE]++
+		q.lock.Lock()
+		q.running[item.AssetID] = item
+		q.lock.Unlock()
+		q.wg.Add(1)
+		go q.run(m, item)
+	}
+}
+
+func (q *downloadQueue) run(m *Monitor, item *QueueItem) {
+	defer q.wg.Done()
+	hooks := m.takeQueueHooks(item.AssetID)
+	begin := func(asset *Asset) {
+		if hooks.begin != nil {
+			hooks.begin(asset)
+		}
+		if q.opt.OnBegin != nil {
+			q.opt.OnBegin(asset)
+		}
+	}
+	var asset *Asset
+	sink := func(total, downloaded, speed, eta int64, percent float64, videoDuration int64) {
+		if hooks.sink != nil {
+			hooks.sink(total, downloaded, speed, eta, percent, videoDuration)
+		}
+		if q.opt.OnProgress != nil && asset != nil {
+			q.opt.OnProgress(asset, total, downloaded, speed, eta, percent, videoDuration)
+		}
+	}
+	asset, err := m.DownloadAsset(q.ctx, item.AssetID, item.Dir, func(a *Asset) {
+		asset = a
+		begin(a)
+	}, sink, item.NotCheckStatus)
+
+	q.finish(m, item, asset, err)
+	q.lock.Lock()
+	delete(q.running, item.AssetID)
+	q.lock.Unlock()
+
+	if hooks.result != nil {
+		hooks.result(asset, err)
+	}
+	if q.opt.OnResult != nil {
+		q.opt.OnResult(asset, err)
+	}
+	q.signal()
+}
+
+/*
+finish 下载结束后决定资源是否留在队列中
+暂停、队列停止、并发已满和可恢复的失败保留，其他情况移除
+*/
+func (q *downloadQueue) finish(m *Monitor, item *QueueItem, asset *Asset, err error) {
+	var cur QueueItem
+	if m._db.Where("asset_id = ?", item.AssetID).Limit(1).Find(&cur); cur.ID == 0 {
+		//已经取消或者删除
+		return
+	}
+	if cur.Paused || q.ctx.Err() != nil {
+		return
+	}
+	overMax := m.externalDownloadingStatManagerFunc.OverMaxConcurrentErr
+	if err != nil && overMax != nil && errors.Is(err, overMax) {
+		return
+	}
+	if err != nil && asset != nil && asset.Status == AssetStatusDownloading && cur.Attempts+1 < q.opt.MaxRetries {
+		cur.Attempts++
+		if e := m.storage.ModelUpdates(&cur, map[string]any{
+			"attempts": cur.Attempts,
+			"retry_at": time.Now().Add(time.Duration(cur.Attempts) * q.opt.RetryDelay),
+		}); e != nil {
+			log.Printf("queue save fail: %s", e)
+		}
+		return
+	}
+	if e := m.removeQueueItems(item.AssetID); e != nil {
+		log.Printf("queue remove fail: %s", e)
+	}
+}
+
+func (m *Monitor) setQueueHooks(id uint, hooks queueHooks) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.queueHooks[id] = hooks
+}
+
+func (m *Monitor) takeQueueHooks(id uint) queueHooks {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	hooks := m.queueHooks[id]
+	delete(m.queueHooks, id)
+	return hooks
+}
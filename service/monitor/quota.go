@@ -0,0 +1,81 @@
+package monitor
+
+import (
+	"github.com/yinyajiang/yt-mnt/pkg/ies/youtube/ytbapi"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type YoutubeQuotaOption struct {
+	//每日配额，<=0 使用默认值10000
+	DailyLimit int64
+	//剩余配额低于该值时推迟自动更新和低优先级的调用，0 使用每日配额的10%，<0 不保留
+	LowReserve int64
+	//已使用的配额保存到数据库，重启后继续计算
+	Persist bool
+}
+
+// QuotaUsageItem 每天每种调用已使用的配额单位
+type QuotaUsageItem struct {
+	gorm.Model
+	Day    string `gorm:"uniqueIndex:,composite:day_method"`
+	Method string `gorm:"uniqueIndex:,composite:day_method"`
+	Units  int64
+
+	_tabname string
+}
+
+func (q *QuotaUsageItem) TableName() string {
+	if q._tabname != "" {
+		return q._tabname
+	}
+	return "youtube_quota"
+}
+
+// quotaStore 实现ytbapi.QuotaStore
+type quotaStore struct {
+	db *gorm.DB
+}
+
+func (s *quotaStore) LoadQuotaUsage(day string) (map[string]int64, error) {
+	var items []*QuotaUsageItem
+	if err := s.db.Where("day = ?", day).Find(&items).Error; err != nil {
+		return nil, err
+	}
+	used := make(map[string]int64, len(items))
+	for _, item := range items {
+		used[item.Method] += item.Units
+	}
+	return used, nil
+}
+
+func (s *quotaStore) AddQuotaUsage(day, call string, units int64) error {
+	return s.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "day"}, {Name: "method"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"units":      gorm.Expr("units + ?", units),
+			"updated_at": gorm.Expr("excluded.updated_at"),
+		}),
+	}).Create(&QuotaUsageItem{
+		Day:    day,
+		Method: call,
+		Units:  units,
+	}).Error
+}
+
+// setYoutubeQuota 设置ytbapi的配额，Persist时使用m的数据库
+func (m *Monitor) setYoutubeQuota(opt YoutubeQuotaOption) {
+	quotaOpt := ytbapi.QuotaOption{
+		DailyLimit: opt.DailyLimit,
+		LowReserve: opt.LowReserve,
+	}
+	if opt.Persist {
+		quotaOpt.Store = &quotaStore{db: m._db}
+	}
+	ytbapi.SetQuotaOption(quotaOpt)
+}
+
+// YoutubeQuotaUsage 当天youtube API已使用和剩余的配额
+func (m *Monitor) YoutubeQuotaUsage() ytbapi.QuotaUsage {
+	return ytbapi.GetQuotaUsage()
+}
@@ -0,0 +1,263 @@
+package monitor
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/duke-git/lancet/v2/fileutil"
+	"gorm.io/gorm"
+)
+
+const (
+	RetentionReasonKeepLast = "keep_last"
+	RetentionReasonMaxAge   = "max_age"
+	RetentionReasonMaxBytes = "max_bytes"
+)
+
+/*
+RetentionPolicy bundle已下载文件的保留策略，只处理下载完成的资源，<=0 的规则不生效
+KeepLast和MaxBytes按上传时间从新到旧保留，MaxAgeDays按下载完成的时间计算
+*/
+type RetentionPolicy struct {
+	KeepLast   int   `json:",omitempty"`
+	MaxAgeDays int   `json:",omitempty"`
+	MaxBytes   int64 `json:",omitempty"`
+	//只删除文件，保留资源记录并标记IsFileDeleted
+	KeepRecord bool `json:",omitempty"`
+}
+
+func (p *RetentionPolicy) Value() (driver.Value, error) {
+	if p == nil {
+		return nil, nil
+	}
+	return json.Marshal(p)
+}
+
+func (p *RetentionPolicy) Scan(value interface{}) error {
+	if p == nil {
+		return nil
+	}
+	data, ok := value.([]byte)
+	if !ok || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, p)
+}
+
+func (p *RetentionPolicy) IsEmpty() bool {
+	return p == nil || (p.KeepLast <= 0 && p.MaxAgeDays <= 0 && p.MaxBytes <= 0)
+}
+
+type RetentionRemoved struct {
+	AssetID  uint
+	BundleID uint
+	Title    string
+	Path     string
+	Size     int64
+	Reason   string
+	//记录被保留，只删除了文件
+	RecordKept bool
+}
+
+type RetentionReport struct {
+	Removed    []RetentionRemoved
+	FreedBytes int64
+}
+
+type RetentionOption struct {
+	Enable bool
+	//清理的周期，<=0 使用默认值1小时
+	Interval time.Duration
+	//每次清理后调用，没有删除任何资源时不调用
+	OnSwept func(report RetentionReport, err error)
+}
+
+type retentionSweeper struct {
+	opt    RetentionOption
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// SetBundleRetention 设置bundle的保留策略，policy为空时不再清理
+func (m *Monitor) SetBundleRetention(bundleID uint, policy *RetentionPolicy) error {
+	if policy != nil && (policy.KeepLast < 0 || policy.MaxAgeDays < 0 || policy.MaxBytes < 0) {
+		return errors.New("retention values must not be negative")
+	}
+	return m.storage.ModelUpdates(&Bundle{
+		Model: gorm.Model{
+			ID: bundleID,
+		},
+	}, map[string]any{
+		"retention": policy,
+	})
+}
+
+// StartRetentionSweeper 定期按保留策略清理，已经在运行时返回错误
+func (m *Monitor) StartRetentionSweeper(opt RetentionOption) error {
+	if opt.Interval <= 0 {
+		opt.Interval = time.Hour
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.retention != nil {
+		return errors.New("retention sweeper is already running")
+	}
+	s := &retentionSweeper{
+		opt: opt,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.wg.Add(1)
+	go s.run(ctx, m)
+	m.retention = s
+	return nil
+}
+
+// StopRetentionSweeper 停止定期清理，等待正在进行的清理完成
+func (m *Monitor) StopRetentionSweeper() {
+	m.lock.Lock()
+	s := m.retention
+	m.retention = nil
+	m.lock.Unlock()
+	if s == nil {
+		return
+	}
+	s.cancel()
+	s.wg.Wait()
+}
+
+func (s *retentionSweeper) run(ctx context.Context, m *Monitor) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.opt.Interval)
+	defer ticker.Stop()
+	for {
+		if !m.storage.IsClosed() {
+			report, err := m.sweepRetention(ctx)
+			if err != nil {
+				log.Printf("retention sweep fail: %s", err)
+			}
+			if s.opt.OnSwept != nil && (len(report.Removed) > 0 || err != nil) {
+				s.opt.OnSwept(report, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SweepRetention 立即按保留策略清理，bundleIDs为空时处理所有设置了策略的bundle
+func (m *Monitor) SweepRetention(bundleIDs ...uint) (RetentionReport, error) {
+	return m.sweepRetention(context.Background(), bundleIDs...)
+}
+
+func (m *Monitor) sweepRetention(ctx context.Context, bundleIDs ...uint) (RetentionReport, error) {
+	report := RetentionReport{
+		Removed: make([]RetentionRemoved, 0),
+	}
+	var bundles []*Bundle
+	tx := m._db.Where("retention IS NOT NULL")
+	if len(bundleIDs) > 0 {
+		tx = tx.Where("id IN ?", bundleIDs)
+	}
+	if err := tx.Find(&bundles).Error; err != nil {
+		return report, err
+	}
+	var errs []error
+	for _, bundle := range bundles {
+		if ctx.Err() != nil {
+			break
+		}
+		if bundle.Retention.IsEmpty() {
+			continue
+		}
+		if err := m.sweepBundleRetention(ctx, bundle, &report); err != nil {
+			errs = append(errs, fmt.Errorf("bundle %d: %w", bundle.ID, err))
+		}
+	}
+	return report, errors.Join(errs...)
+}
+
+func (m *Monitor) sweepBundleRetention(ctx context.Context, bundle *Bundle, report *RetentionReport) error {
+	var assets []*Asset
+	err := m._db.Where("bundle_id = ? AND status = ? AND (is_file_deleted IS NULL OR is_file_deleted = ?)",
+		bundle.ID, AssetStatusFinished, false).
+		Order("upload_date DESC").Order("finished_at DESC").Order("id DESC").
+		Find(&assets).Error
+	if err != nil {
+		return err
+	}
+
+	policy := bundle.Retention
+	now := time.Now()
+	kept := 0
+	var keptBytes int64
+	for _, asset := range assets {
+		if ctx.Err() != nil {
+			return nil
+		}
+		//正在重新下载或处理的不动
+		if _, ok := m.getDownloading(asset.ID); ok {
+			continue
+		}
+		size := asset.DownloadTotalSize
+		if size <= 0 {
+			size, _ = fileutil.FileSize(asset.FilePath())
+		}
+		finishedAt := asset.FinishedAt
+		if finishedAt.IsZero() {
+			finishedAt = asset.UpdatedAt
+		}
+
+		reason := ""
+		switch {
+		case policy.KeepLast > 0 && kept >= policy.KeepLast:
+			reason = RetentionReasonKeepLast
+		case policy.MaxAgeDays > 0 && finishedAt.Before(now.AddDate(0, 0, -policy.MaxAgeDays)):
+			reason = RetentionReasonMaxAge
+		case policy.MaxBytes > 0 && keptBytes+size > policy.MaxBytes:
+			reason = RetentionReasonMaxBytes
+		}
+		if reason == "" {
+			kept++
+			keptBytes += size
+			continue
+		}
+
+		removed := RetentionRemoved{
+			AssetID:    asset.ID,
+			BundleID:   bundle.ID,
+			Title:      asset.Title,
+			Path:       asset.FilePath(),
+			Size:       size,
+			Reason:     reason,
+			RecordKept: policy.KeepRecord,
+		}
+		if policy.KeepRecord {
+			m.deleteDownloaderItem(asset, false)
+			err = m.storage.ModelUpdates(&Asset{
+				Model: gorm.Model{
+					ID: asset.ID,
+				},
+			}, map[string]any{
+				"is_file_deleted": true,
+			})
+			if err != nil {
+				return err
+			}
+		} else {
+			m.DeleteAsset(asset.ID, false)
+		}
+		report.Removed = append(report.Removed, removed)
+		report.FreedBytes += size
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yinyajiang/yt-mnt/pkg/db"
+	"github.com/yinyajiang/yt-mnt/pkg/downloader"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const retentionTestDownloader = "retention_test"
+
+// fileDownloader 只实现删除，用于检查保留策略删除的文件
+type fileDownloader struct{}
+
+func (fileDownloader) Name() string          { return retentionTestDownloader }
+func (fileDownloader) SupportedIE() []string { return nil }
+func (fileDownloader) IsNeedFormat() bool    { return false }
+
+func (fileDownloader) Download(ctx context.Context, opt downloader.DownloadOptions, sink downloader.ProgressSink) (bool, error) {
+	return false, nil
+}
+
+func (fileDownloader) Delete(opt downloader.DeleteOptions, deleteFile bool) {
+	if deleteFile {
+		os.Remove(filepath.Join(opt.DownloadFileDir, opt.DownloadFileStem+opt.DownloadFileExt))
+	}
+}
+
+func (fileDownloader) ChangeFileTitle(opt downloader.DownloadOptions, title string) error {
+	return nil
+}
+
+// newTestMonitor 使用内存数据库，不初始化IE也不启动后台任务
+func newTestMonitor(t *testing.T) *Monitor {
+	t.Helper()
+	gdb, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{
+		Logger: logger.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//每个连接是独立的内存数据库
+	sqlDB, err := gdb.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	storage, err := db.NewStorage(db.DBOption{OutDB: gdb}, false, &Asset{}, &Bundle{}, &QueueItem{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Monitor{
+		ctx:         ctx,
+		cancel:      cancel,
+		storage:     storage,
+		_db:         storage.GormDB(),
+		downloading: make(map[uint]*downloadingStat),
+		queueHooks:  make(map[uint]queueHooks),
+		events:      newEventBus(),
+	}
+	t.Cleanup(func() {
+		cancel()
+		storage.Close()
+	})
+	downloader.Regist(fileDownloader{})
+	return m
+}
+
+type retentionFixture struct {
+	//距今的天数
+	uploadedDaysAgo int
+	finishedDaysAgo int
+	size            int64
+	downloading     bool
+}
+
+// newRetentionBundle 创建bundle和已经下载完成的资源，每个资源有一个size大小的文件，返回的资源顺序同fixtures
+func newRetentionBundle(t *testing.T, m *Monitor, policy *RetentionPolicy, fixtures []retentionFixture) (*Bundle, []*Asset) {
+	t.Helper()
+	dir := t.TempDir()
+	bundle := &Bundle{
+		BundleType: BundleTypeFeed,
+		Title:      "retention",
+		Retention:  policy,
+	}
+	if err := m.storage.Save(bundle); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	assets := make([]*Asset, 0, len(fixtures))
+	for i, f := range fixtures {
+		asset := &Asset{
+			BundleID:          bundle.ID,
+			Type:              AssetTypeVideo,
+			Status:            AssetStatusFinished,
+			Title:             fmt.Sprintf("asset-%d", i),
+			UploadDate:        now.AddDate(0, 0, -f.uploadedDaysAgo),
+			FinishedAt:        now.AddDate(0, 0, -f.finishedDaysAgo),
+			Downloader:        retentionTestDownloader,
+			DownloadFileDir:   dir,
+			DownloadFileStem:  fmt.Sprintf("asset-%d", i),
+			DownloadFileExt:   ".mp4",
+			DownloadTotalSize: f.size,
+		}
+		if err := os.WriteFile(asset.FilePath(), make([]byte, f.size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.storage.Save(asset); err != nil {
+			t.Fatal(err)
+		}
+		if f.downloading {
+			id := asset.ID
+			//取消时结束下载，StopDownloading不会一直等待
+			m.addDownloading(&downloadingStat{
+				id:       id,
+				bundleID: bundle.ID,
+				cancel:   func() { m.removeDownloading(id) },
+			})
+		}
+		assets = append(assets, asset)
+	}
+	//没有下载完成的资源不受保留策略影响
+	pending := &Asset{
+		BundleID: bundle.ID,
+		Type:     AssetTypeVideo,
+		Status:   AssetStatusNew,
+		Title:    "pending",
+	}
+	if err := m.storage.Save(pending); err != nil {
+		t.Fatal(err)
+	}
+	return bundle, assets
+}
+
+func TestSweepBundleRetention(t *testing.T) {
+	//上传时间从旧到新：0最旧，3最新
+	fixtures := []retentionFixture{
+		{uploadedDaysAgo: 40, finishedDaysAgo: 30, size: 100},
+		{uploadedDaysAgo: 30, finishedDaysAgo: 1, size: 100},
+		{uploadedDaysAgo: 20, finishedDaysAgo: 20, size: 100},
+		{uploadedDaysAgo: 10, finishedDaysAgo: 1, size: 100},
+	}
+	cases := []struct {
+		name     string
+		policy   RetentionPolicy
+		fixtures []retentionFixture
+		//被删除的资源在fixtures中的索引和原因
+		removed map[int]string
+	}{
+		{
+			name:     "keep last",
+			policy:   RetentionPolicy{KeepLast: 2},
+			fixtures: fixtures,
+			removed:  map[int]string{0: RetentionReasonKeepLast, 1: RetentionReasonKeepLast},
+		},
+		{
+			name:     "max age",
+			policy:   RetentionPolicy{MaxAgeDays: 10},
+			fixtures: fixtures,
+			removed:  map[int]string{0: RetentionReasonMaxAge, 2: RetentionReasonMaxAge},
+		},
+		{
+			name:     "max bytes",
+			policy:   RetentionPolicy{MaxBytes: 250},
+			fixtures: fixtures,
+			removed:  map[int]string{0: RetentionReasonMaxBytes, 1: RetentionReasonMaxBytes},
+		},
+		{
+			name:     "keep record",
+			policy:   RetentionPolicy{KeepLast: 3, KeepRecord: true},
+			fixtures: fixtures,
+			removed:  map[int]string{0: RetentionReasonKeepLast},
+		},
+		{
+			//正在下载的不删除，也不占用保留的数量
+			name:   "skip downloading",
+			policy: RetentionPolicy{KeepLast: 1},
+			fixtures: []retentionFixture{
+				fixtures[0],
+				fixtures[1],
+				{uploadedDaysAgo: 20, finishedDaysAgo: 20, size: 100, downloading: true},
+				fixtures[3],
+			},
+			removed: map[int]string{0: RetentionReasonKeepLast, 1: RetentionReasonKeepLast},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := newTestMonitor(t)
+			policy := c.policy
+			bundle, assets := newRetentionBundle(t, m, &policy, c.fixtures)
+
+			report, err := m.SweepRetention(bundle.ID)
+			if err != nil {
+				t.Fatalf("sweep: %s", err)
+			}
+			got := make(map[uint]RetentionRemoved, len(report.Removed))
+			for _, r := range report.Removed {
+				got[r.AssetID] = r
+			}
+			if len(got) != len(c.removed) {
+				t.Errorf("removed %d assets, want %d: %+v", len(got), len(c.removed), report.Removed)
+			}
+			var freed int64
+			for i, asset := range assets {
+				reason, wantRemoved := c.removed[i]
+				r, removed := got[asset.ID]
+				if removed != wantRemoved {
+					t.Errorf("asset %d removed = %v, want %v", i, removed, wantRemoved)
+					continue
+				}
+				_, statErr := os.Stat(asset.FilePath())
+				if fileExists := statErr == nil; fileExists == wantRemoved {
+					t.Errorf("asset %d file exists = %v, want %v", i, fileExists, !wantRemoved)
+				}
+
+				var stored Asset
+				m._db.Limit(1).Find(&stored, asset.ID)
+				recordExists := stored.ID != 0
+				if !wantRemoved {
+					if !recordExists || stored.IsFileDeleted {
+						t.Errorf("asset %d record = %v, file deleted = %v, want kept", i, recordExists, stored.IsFileDeleted)
+					}
+					continue
+				}
+				freed += r.Size
+				if r.Reason != reason || r.Size != c.fixtures[i].size || r.RecordKept != c.policy.KeepRecord {
+					t.Errorf("asset %d removed = %+v, want reason %s", i, r, reason)
+				}
+				if recordExists != c.policy.KeepRecord {
+					t.Errorf("asset %d record exists = %v, want %v", i, recordExists, c.policy.KeepRecord)
+				}
+				if c.policy.KeepRecord && !stored.IsFileDeleted {
+					t.Errorf("asset %d kept record is not marked IsFileDeleted", i)
+				}
+			}
+			if report.FreedBytes != freed {
+				t.Errorf("freed = %d, want %d", report.FreedBytes, freed)
+			}
+
+			var pending int64
+			m._db.Model(&Asset{}).Where("bundle_id = ? AND status = ?", bundle.ID, AssetStatusNew).Count(&pending)
+			if pending != 1 {
+				t.Errorf("pending assets = %d, want 1", pending)
+			}
+
+			//再次清理时不会重复删除
+			report, err = m.SweepRetention(bundle.ID)
+			if err != nil || len(report.Removed) != 0 {
+				t.Errorf("second sweep removed %+v, err %v", report.Removed, err)
+			}
+		})
+	}
+}
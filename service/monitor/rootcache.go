@@ -0,0 +1,94 @@
+package monitor
+
+import (
+	"time"
+
+	"github.com/yinyajiang/yt-mnt/pkg/ies"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type RootCacheOption struct {
+	//内存中保存的链接数，<=0 使用默认值64
+	Capacity int
+	//解析结果的有效期，<=0 使用默认值30分钟
+	TTL time.Duration
+	//同时保存到数据库，重启后有效期内的链接不再请求API
+	Persist bool
+}
+
+// RootCacheItem 持久化的ParseRoot结果，Data由ies编码
+type RootCacheItem struct {
+	gorm.Model
+	Key      string `gorm:"uniqueIndex"`
+	Data     []byte
+	ParsedAt time.Time `gorm:"index"`
+
+	_tabname string
+}
+
+func (r *RootCacheItem) TableName() string {
+	if r._tabname != "" {
+		return r._tabname
+	}
+	return "root_cache"
+}
+
+// rootCacheStore 实现ies.RootCacheStore，删除时不保留软删除的记录，避免与Key的唯一索引冲突
+type rootCacheStore struct {
+	db *gorm.DB
+}
+
+func (s *rootCacheStore) LoadRoot(key string) ([]byte, time.Time, error) {
+	var item RootCacheItem
+	err := s.db.Where("key = ?", key).Limit(1).Find(&item).Error
+	if err != nil || item.ID == 0 {
+		return nil, time.Time{}, err
+	}
+	return item.Data, item.ParsedAt, nil
+}
+
+func (s *rootCacheStore) SaveRoot(key string, data []byte, parsedAt time.Time) error {
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"data", "parsed_at", "updated_at"}),
+	}).Create(&RootCacheItem{
+		Key:      key,
+		Data:     data,
+		ParsedAt: parsedAt,
+	}).Error
+}
+
+func (s *rootCacheStore) DeleteRoot(key string) error {
+	return s.db.Unscoped().Where("key = ?", key).Delete(&RootCacheItem{}).Error
+}
+
+func (s *rootCacheStore) DeleteRootsBefore(parsedAt time.Time) error {
+	return s.db.Unscoped().Where("parsed_at < ?", parsedAt).Delete(&RootCacheItem{}).Error
+}
+
+func (s *rootCacheStore) ClearRoots() error {
+	return s.db.Unscoped().Where("1 = 1").Delete(&RootCacheItem{}).Error
+}
+
+// setRootCache 设置ies的根缓存，Persist时使用m的数据库
+func (m *Monitor) setRootCache(opt RootCacheOption) {
+	cacheOpt := ies.RootCacheOption{
+		Capacity: opt.Capacity,
+		TTL:      opt.TTL,
+	}
+	if opt.Persist {
+		cacheOpt.Store = &rootCacheStore{db: m._db}
+	}
+	ies.SetRootCache(cacheOpt)
+}
+
+// RootCacheStats ParseRoot缓存的命中统计
+func (m *Monitor) RootCacheStats() ies.RootCacheStats {
+	return ies.GetRootCacheStats()
+}
+
+// InvalidateRoot 删除链接的ParseRoot缓存，下次打开或订阅时重新解析
+func (m *Monitor) InvalidateRoot(url string) {
+	ies.InvalidateRoot(url)
+}
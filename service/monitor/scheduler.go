@@ -0,0 +1,288 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/yinyajiang/yt-mnt/pkg/ies"
+	"gorm.io/gorm"
+)
+
+type SchedulerOption struct {
+	Enable bool
+	//没有单独设置间隔的feed使用的间隔，<=0 使用默认值1小时
+	DefaultInterval time.Duration
+	//连续失败后退避的最大间隔，<=0 使用默认值24小时
+	MaxBackoff time.Duration
+	//间隔的随机浮动比例，避免同时更新，<=0 使用默认值0.1，最大0.5
+	Jitter float64
+	//同时更新的feed数，<=0 使用默认值2
+	Concurrency int
+	//检查到期feed的周期，<=0 使用默认值1分钟
+	CheckInterval time.Duration
+
+	//新资源的下载选项，FeedDownloadOption不为空时优先使用
+	DownloadOption     AssetDownloadOption
+	FeedDownloadOption func(feed *Bundle) AssetDownloadOption
+	//每个feed更新完成后调用，在调度的goroutine中执行
+	OnFeedUpdated func(result FeedUpdateResult)
+}
+
+type FeedUpdateResult struct {
+	FeedID    uint
+	NewAssets []*Asset
+	Err       error
+	//按feed的自动下载策略交给下载的资源和失败的原因
+	AutoDownloaded  []uint
+	AutoDownloadErr error
+
+	//以下只在调度器中有效
+	FailCount  int
+	NextUpdate time.Time
+}
+
+type scheduler struct {
+	opt     SchedulerOption
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	lock    sync.Mutex
+	running map[uint]bool
+}
+
+func newScheduler(opt SchedulerOption) *scheduler {
+	if opt.DefaultInterval <= 0 {
+		opt.DefaultInterval = time.Hour
+	}
+	if opt.MaxBackoff <= 0 {
+		opt.MaxBackoff = 24 * time.Hour
+	}
+	if opt.Jitter <= 0 {
+		opt.Jitter = 0.1
+	}
+	if opt.Jitter > 0.5 {
+		opt.Jitter = 0.5
+	}
+	if opt.Concurrency <= 0 {
+		opt.Concurrency = 2
+	}
+	if opt.CheckInterval <= 0 {
+		opt.CheckInterval = time.Minute
+	}
+	return &scheduler{
+		opt:     opt,
+		running: make(map[uint]bool),
+	}
+}
+
+// StartScheduler 开始按每个feed的间隔自动更新，已经在运行时返回错误
+func (m *Monitor) StartScheduler(opt SchedulerOption) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.scheduler != nil {
+		return errors.New("scheduler is already running")
+	}
+	s := newScheduler(opt)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.wg.Add(1)
+	go s.run(ctx, m)
+	m.scheduler = s
+	return nil
+}
+
+// StopScheduler 停止自动更新，等待正在进行的更新完成
+func (m *Monitor) StopScheduler() {
+	m.lock.Lock()
+	s := m.scheduler
+	m.scheduler = nil
+	m.lock.Unlock()
+	if s == nil {
+		return
+	}
+	s.cancel()
+	s.wg.Wait()
+}
+
+// SetFeedUpdateInterval 设置feed的自动更新间隔，0使用默认间隔，<0不自动更新
+func (m *Monitor) SetFeedUpdateInterval(feedid uint, interval time.Duration) error {
+	seconds := int64(interval / time.Second)
+	if interval < 0 {
+		seconds = -1
+	}
+	return m.storage.ModelUpdates(&Bundle{
+		Model: gorm.Model{
+			ID: feedid,
+		},
+	}, map[string]any{
+		"update_interval": seconds,
+		//立即按新的间隔重新计算
+		"next_update": time.Time{},
+	})
+}
+
+func (s *scheduler) run(ctx context.Context, m *Monitor) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.opt.CheckInterval)
+	defer ticker.Stop()
+	sem := make(chan struct{}, s.opt.Concurrency)
+	for {
+		s.dispatch(ctx, m, sem)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatch 启动到期的feed，并发数已满时剩下的留到下个周期
+func (s *scheduler) dispatch(ctx context.Context, m *Monitor, sem chan struct{}) {
+	if ctx.Err() != nil || m.storage.IsClosed() {
+		return
+	}
+	var feeds []*Bundle
+	err := m._db.Where("bundle_type = ? AND flags & ? = 0 AND (update_interval IS NULL OR update_interval >= 0) AND (next_update IS NULL OR next_update <= ?)",
+		BundleTypeFeed, BundleFlagUnparse, time.Now()).Order("next_update").Find(&feeds).Error
+	if err != nil {
+		log.Printf("scheduler list feeds fail: %s", err)
+		return
+	}
+	for _, feed := range feeds {
+		s.lock.Lock()
+		running := s.running[feed.ID]
+		s.lock.Unlock()
+		if running {
+			continue
+		}
+		//第一次遇到的feed随机推迟，避免启动时同时更新
+		if feed.NextUpdate.IsZero() {
+			spread := time.Duration(rand.Float64() * s.opt.Jitter * float64(s.interval(feed)))
+			s.reschedule(m, feed, spread, feed.UpdateFailCount, feed.LastUpdateError)
+			continue
+		}
+		if _, deferred := s.deferForQuota(m, feed); deferred {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		default:
+			return
+		}
+		s.lock.Lock()
+		s.running[feed.ID] = true
+		s.lock.Unlock()
+		s.wg.Add(1)
+		go func(feed *Bundle) {
+			defer s.wg.Done()
+			defer func() {
+				<-sem
+				s.lock.Lock()
+				delete(s.running, feed.ID)
+				s.lock.Unlock()
+			}()
+			s.poll(ctx, m, feed)
+		}(feed)
+	}
+}
+
+func (s *scheduler) poll(ctx context.Context, m *Monitor, feed *Bundle) {
+	if ctx.Err() != nil {
+		return
+	}
+	opt := s.opt.DownloadOption
+	if s.opt.FeedDownloadOption != nil {
+		opt = s.opt.FeedDownloadOption(feed)
+	}
+	result := m.UpdateFeedWithResultContext(ctx, feed.ID, opt)
+	err := result.Err
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		//已经删除或者取消订阅
+		return
+	}
+	if ctx.Err() != nil {
+		//调度器停止时取消的更新不算失败，下次启动时仍然到期
+		return
+	}
+
+	if errors.Is(err, ies.ErrQuotaExceeded) {
+		if next, deferred := s.deferForQuota(m, feed); deferred {
+			result.FailCount = feed.UpdateFailCount
+			result.NextUpdate = next
+			if s.opt.OnFeedUpdated != nil {
+				s.opt.OnFeedUpdated(result)
+			}
+			return
+		}
+	}
+
+	delay := s.interval(feed)
+	errMsg := ""
+	if err != nil {
+		result.FailCount = feed.UpdateFailCount + 1
+		errMsg = err.Error()
+		delay = s.backoff(delay, result.FailCount)
+		log.Printf("scheduler update feed %d fail(%d): %s", feed.ID, result.FailCount, err)
+	}
+	result.NextUpdate = s.reschedule(m, feed, s.jitter(delay), result.FailCount, errMsg)
+	if s.opt.OnFeedUpdated != nil {
+		s.opt.OnFeedUpdated(result)
+	}
+}
+
+// deferForQuota API配额不足时推迟到配额重置之后，不算失败
+func (s *scheduler) deferForQuota(m *Monitor, feed *Bundle) (time.Time, bool) {
+	ok, resetAt := ies.AffordUpdate(feed.IE, feed.URL)
+	if ok {
+		return time.Time{}, false
+	}
+	log.Printf("scheduler defer feed %d until %s: %s", feed.ID, resetAt.Format(time.RFC3339), ies.ErrQuotaExceeded)
+	return s.reschedule(m, feed, time.Until(resetAt), feed.UpdateFailCount, feed.LastUpdateError), true
+}
+
+func (s *scheduler) reschedule(m *Monitor, feed *Bundle, delay time.Duration, failCount int, errMsg string) time.Time {
+	next := time.Now().Add(delay)
+	err := m.storage.ModelUpdates(&Bundle{
+		Model: gorm.Model{
+			ID: feed.ID,
+		},
+	}, map[string]any{
+		"next_update":       next,
+		"update_fail_count": failCount,
+		"last_update_error": errMsg,
+	})
+	if err != nil {
+		log.Printf("scheduler save feed %d fail: %s", feed.ID, err)
+	}
+	return next
+}
+
+func (s *scheduler) interval(feed *Bundle) time.Duration {
+	if feed.UpdateInterval > 0 {
+		return time.Duration(feed.UpdateInterval) * time.Second
+	}
+	return s.opt.DefaultInterval
+}
+
+// backoff 连续失败时间隔按2的指数增长，不超过MaxBackoff
+func (s *scheduler) backoff(interval time.Duration, failCount int) time.Duration {
+	if interval >= s.opt.MaxBackoff {
+		return interval
+	}
+	delay := interval
+	for i := 0; i < failCount && delay < s.opt.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > s.opt.MaxBackoff {
+		delay = s.opt.MaxBackoff
+	}
+	return delay
+}
+
+// jitter 在间隔上加减Jitter比例的随机值
+func (s *scheduler) jitter(delay time.Duration) time.Duration {
+	return time.Duration(float64(delay) * (1 + s.opt.Jitter*(2*rand.Float64()-1)))
+}